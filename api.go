@@ -2,14 +2,14 @@ package patchy
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dchest/uniuri"
@@ -18,28 +18,80 @@ import (
 	"github.com/gopatchy/metadata"
 	"github.com/gopatchy/path"
 	"github.com/gopatchy/potency"
-	"github.com/gopatchy/selfcert"
-	"github.com/gopatchy/storebus"
 	"github.com/julienschmidt/httprouter"
 	"github.com/vfaronov/httpheader"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
 )
 
 type API struct {
-	router   *httprouter.Router
-	sb       *storebus.StoreBus
-	potency  *potency.Potency
-	registry map[string]*config
+	router     *httprouter.Router
+	bulkRouter *httprouter.Router
+	sb         Store
+	potency    *potency.Potency
+	registry   map[string]*config
 
-	listener net.Listener
-	srv      *http.Server
+	listeners   []*listener
+	listenersMu sync.Mutex
+
+	acme       *autocert.Manager
+	acmeHTTP   http.Handler
+	acmeClient *http.Client
 
 	openAPI      openAPI
 	prefix       string
 	requestHooks []RequestHook
 
-	authBasic  bool
-	authBearer bool
+	authBasic   bool
+	authBearer  bool
+	authAPIKey  bool
+	authSession bool
+
+	sessionCfg *config
+	sessionTTL time.Duration
+	cors       *CORSPolicy
+
+	streamDebounce    time.Duration
+	streamMaxRate     float64
+	streamHeartbeat   time.Duration
+	streamMaxDuration time.Duration
+
+	passwordHasher PasswordHasher
+	loginLimiter   *loginLimiter
+	limiter        *requestLimiter
+	rateLimiter    *rateLimiter
+
+	adminHook AdminHook
+
+	// Held exclusively by Backup; shared by store writes
+	snapshotMu sync.RWMutex
+
+	// Keeps Backup from seeing a Restore partway through
+	restoreMu sync.Mutex
+
+	wsConns  map[*websocket.Conn]bool
+	wsClosed bool
+	wsMu     sync.Mutex
+	wsWG     sync.WaitGroup
+
+	subscriptions   map[string]*sseSubscription
+	subscriptionsMu sync.Mutex
 
+	auditSinks    []AuditSink
+	auditReadHook AuditReadHook
+
+	healthChecks []*namedHealthCheck
+
+	// Set and draining closed by Shutdown, under handlersMu
+	shuttingDown atomic.Bool
+	draining     chan struct{}
+	handlersMu   sync.Mutex
+	handlersWG   sync.WaitGroup
+
+	metrics     *metrics
+	tracer      trace.Tracer
 	eventClient *event.Client
 }
 
@@ -60,10 +112,15 @@ const (
 
 	ContextAuthBasicLookup
 	ContextAuthBearerLookup
+	ContextAPIKeyLookup
+	ContextAuthSessionLookup
 	ContextReplicate
 
 	ContextAuthBearer
 	ContextAuthBasic
+	ContextAuthAPIKey
+	ContextAuthScopes
+	ContextAuthSession
 
 	ContextWriteID
 	ContextWriteGeneration
@@ -71,26 +128,68 @@ const (
 	ContextSpanID
 
 	ContextEvent
+
+	ContextAuditWrite
+
+	// Name of the listener that accepted the request
+	ContextListener
 )
 
-func NewAPI(dbname string) (*API, error) {
-	router := httprouter.New()
-	router.RedirectTrailingSlash = false
-	router.RedirectFixedPath = false
+// NewAPI is New(WithSQLite(dbname), WithLimits(limits)). It takes at most
+// one Limits, and fails with more; DefaultLimits are used without one.
+func NewAPI(dbname string, limits ...*Limits) (*API, error) {
+	l, err := getLimits(limits)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(WithSQLite(dbname), WithLimits(l))
+}
+
+// NewAPIMemory is New(WithMemoryStore(), WithLimits(limits))
+func NewAPIMemory(limits ...*Limits) (*API, error) {
+	l, err := getLimits(limits)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(WithMemoryStore(), WithLimits(l))
+}
 
-	sb, err := storebus.NewStoreBus(dbname)
+// NewAPIWithStore is New(WithStore(sb), WithLimits(limits))
+func NewAPIWithStore(sb Store, limits ...*Limits) (*API, error) {
+	l, err := getLimits(limits)
 	if err != nil {
 		return nil, err
 	}
 
+	return New(WithStore(sb), WithLimits(l))
+}
+
+func newAPI(sb Store, limits *Limits) *API {
+	router := httprouter.New()
+	router.RedirectTrailingSlash = false
+	router.RedirectFixedPath = false
+
+	bulkRouter := httprouter.New()
+	bulkRouter.RedirectTrailingSlash = false
+	bulkRouter.RedirectFixedPath = false
+
 	api := &API{
-		router:   router,
-		sb:       sb,
-		potency:  potency.NewPotency(router),
-		registry: map[string]*config{},
-		srv: &http.Server{
-			ReadHeaderTimeout: 30 * time.Second,
-		},
+		router:          router,
+		bulkRouter:      bulkRouter,
+		registry:        map[string]*config{},
+		passwordHasher:  NewBcryptHasher(bcrypt.DefaultCost),
+		loginLimiter:    newLoginLimiter(),
+		sessionTTL:      DefaultSessionTTL,
+		streamHeartbeat: DefaultStreamHeartbeat,
+		wsConns:         map[*websocket.Conn]bool{},
+		subscriptions:   map[string]*sseSubscription{},
+		draining:        make(chan struct{}),
+		metrics:         newMetrics(),
+		tracer:          defaultTracer(),
+		limiter:         newRequestLimiter(limits),
+		rateLimiter:     newRateLimiter(limits),
 		eventClient: event.New().
 			AddHook(event.HookBuildInfo).
 			AddHook(event.HookMetrics).
@@ -98,7 +197,11 @@ func NewAPI(dbname string) (*API, error) {
 			AddHook(EventHookSpanID),
 	}
 
-	api.srv.Handler = api
+	api.sb = newInstrumentedStore(sb, api)
+	api.potency = potency.NewPotency(http.HandlerFunc(api.serveRouter))
+
+	api.router.GlobalOPTIONS = http.HandlerFunc(api.handlePreflight)
+	api.bulkRouter.GlobalOPTIONS = http.HandlerFunc(api.handlePreflight)
 
 	api.router.GET(
 		"/_debug",
@@ -117,7 +220,19 @@ func NewAPI(dbname string) (*API, error) {
 
 	api.registerTemplates()
 
-	return api, nil
+	api.registerBackupHandlers()
+
+	api.registerLockoutHandlers()
+
+	api.registerWSHandlers()
+
+	api.registerSubscribeHandlers()
+
+	api.registerMetricsHandlers()
+
+	api.registerHealthHandlers()
+
+	return api
 }
 
 func Register[T any](api *API) {
@@ -127,6 +242,7 @@ func Register[T any](api *API) {
 func RegisterName[T any](api *API, apiName, camelName string) {
 	// TODO: Support nested types
 	cfg := newConfig[T](apiName, camelName)
+	cfg.lockWait = func(d time.Duration) { api.metrics.lockWait.observe(d.Seconds(), apiName) }
 	api.registry[cfg.apiName] = cfg
 	api.registerHandlers(fmt.Sprintf("/%s", cfg.apiName), cfg)
 
@@ -144,6 +260,46 @@ func RegisterName[T any](api *API, apiName, camelName string) {
 	if ok {
 		AddAuthBearerName[T](api, apiName, authBearerTokenPath)
 	}
+
+	apiKeyPrefixPath, ok := path.FindTagValueType(cfg.typeOf, "patchy", "apiKeyPrefix")
+	if ok {
+		apiKeyHashPath, ok := path.FindTagValueType(cfg.typeOf, "patchy", "apiKeyHash")
+		if !ok {
+			panic("patchy:apiKeyPrefix without patchy:apiKeyHash")
+		}
+
+		paths := &APIKeyPaths{
+			Prefix: apiKeyPrefixPath,
+			Hash:   apiKeyHashPath,
+		}
+
+		paths.Scopes, _ = path.FindTagValueType(cfg.typeOf, "patchy", "apiKeyScopes")
+		paths.Expires, _ = path.FindTagValueType(cfg.typeOf, "patchy", "apiKeyExpires")
+		paths.LastUsed, _ = path.FindTagValueType(cfg.typeOf, "patchy", "apiKeyLastUsed")
+
+		AddAPIKeyName[T](api, apiName, paths)
+	}
+
+	sessionTokenPath, ok := path.FindTagValueType(cfg.typeOf, "patchy", "sessionToken")
+	if ok {
+		paths := &SessionPaths{
+			Token: sessionTokenPath,
+		}
+
+		paths.CSRF, ok = path.FindTagValueType(cfg.typeOf, "patchy", "sessionCSRF")
+		if !ok {
+			panic("patchy:sessionToken without patchy:sessionCSRF")
+		}
+
+		paths.User, ok = path.FindTagValueType(cfg.typeOf, "patchy", "sessionUser")
+		if !ok {
+			panic("patchy:sessionToken without patchy:sessionUser")
+		}
+
+		paths.Expires, _ = path.FindTagValueType(cfg.typeOf, "patchy", "sessionExpires")
+
+		AddSessionName[T](api, apiName, paths)
+	}
 }
 
 func (api *API) SetStripPrefix(prefix string) {
@@ -199,73 +355,40 @@ func (api *API) ServeFiles(path string, fs http.FileSystem) {
 }
 
 func (api *API) ListenSelfCert(bind string) error {
-	tlsConfig, err := selfcert.NewTLSConfigFromHostPort(bind)
-	if err != nil {
-		return err
-	}
-
-	api.listener, err = tls.Listen("tcp", bind, tlsConfig)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return api.Listen(&ListenConfig{Bind: bind, TLS: "self"})
 }
 
+// ListenTLS reloads the key pair when either file changes
 func (api *API) ListenTLS(bind, certFile, keyFile string) error {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
-	}
-
-	cfg := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS13,
-		NextProtos:   []string{"h2"},
-	}
-
-	api.listener, err = tls.Listen("tcp", bind, cfg)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return api.Listen(&ListenConfig{Bind: bind, TLS: "files", CertFile: certFile, KeyFile: keyFile})
 }
 
 func (api *API) ListenInsecure(bind string) error {
-	var err error
-
-	api.listener, err = net.Listen("tcp", bind)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return api.addListener(&ListenConfig{Bind: bind}, nil, nil)
 }
 
-func (api *API) Addr() *net.TCPAddr {
-	return api.listener.Addr().(*net.TCPAddr)
-}
+// Shutdown refuses new requests, ends streams with a reconnect event, and
+// closes the store once all requests have returned
+func (api *API) Shutdown(ctx context.Context) error {
+	api.startDrain()
 
-func (api *API) Serve() error {
-	if api.listener == nil {
-		return jsrest.Errorf(jsrest.ErrInternalServerError, "Serve() called before Listen*()")
-	}
+	// http.Server doesn't track hijacked connections
+	api.closeWS()
 
-	err := api.srv.Serve(api.listener)
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+	err := api.shutdownListeners(ctx)
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (api *API) Shutdown(ctx context.Context) error {
-	err := api.srv.Shutdown(ctx)
+	err = api.waitHandlers(ctx)
 	if err != nil {
 		return err
 	}
 
+	if api.acmeClient != nil {
+		api.acmeClient.CloseIdleConnections()
+	}
+
 	api.eventClient.Close()
 	api.sb.Close()
 
@@ -275,7 +398,14 @@ func (api *API) Shutdown(ctx context.Context) error {
 func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	ctx := r.Context()
+	if !api.enterHandler() {
+		writeDraining(w)
+		return
+	}
+
+	defer api.exitHandler()
+
+	start := time.Now()
 
 	ev := event.NewEvent("httpSuccess",
 		"httpProto", r.Proto,
@@ -286,51 +416,53 @@ func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"responseCode", 200,
 	)
 
-	ctx = context.WithValue(ctx, ContextSpanID, uniuri.New())
+	ctx, span := api.startRequestSpan(r)
+
+	id := spanID(span)
+	if id == "" {
+		id = uniuri.New()
+	}
+
+	ctx = context.WithValue(ctx, ContextSpanID, id)
 	ctx = context.WithValue(ctx, ContextEvent, ev)
 	r = r.WithContext(ctx)
 
+	if name, ok := ctx.Value(ContextListener).(string); ok {
+		ev.Set("listener", name)
+	}
+
 	r, err = api.serveHTTP(w, r)
 	if err != nil {
-		jsrest.WriteError(w, err)
-
-		ev.Set(
-			"type", "httpError",
-			"responseError", err.Error(),
-		)
-
-		hErr := jsrest.GetHTTPError(err)
-		if hErr != nil {
-			ev.Set("responseCode", hErr.Code)
-		}
+		api.writeError(w, r, err)
 	}
 
+	api.metrics.observeRequest(r, ev, start)
+	endRequestSpan(span, ev)
+
 	api.eventClient.WriteEvent(r.Context(), ev) //nolint:contextcheck
 }
 
 func (api *API) serveHTTP(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
-	w.Header().Set("Cache-Control", "no-store")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Expose-Headers", "*")
-	w.Header().Set("Timing-Allow-Origin", "*")
+	if api.serveACMEChallenge(w, r) {
+		return r, nil
+	}
 
-	if r.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Methods", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		w.Header().Set("Access-Control-Max-Age", "86400")
+	w.Header().Set("Cache-Control", "no-store")
 
-		w.WriteHeader(http.StatusNoContent)
+	api.writeCORSHeaders(w, r)
 
-		return r, nil
+	err := api.checkListenerRoute(r)
+	if err != nil {
+		return r, err
 	}
 
-	err := r.ParseForm()
+	err = r.ParseForm()
 	if err != nil {
 		return r, jsrest.Errorf(jsrest.ErrUnauthorized, "parse form failed (%w)", err)
 	}
 
 	for _, hook := range api.requestHooks {
-		newR, err := hook(w, r, api)
+		newR, err := api.runHook(hook, w, r)
 		if err != nil {
 			return r, jsrest.Errorf(jsrest.ErrInternalServerError, "request hook failed (%w)", err)
 		}
@@ -343,6 +475,23 @@ func (api *API) serveHTTP(w http.ResponseWriter, r *http.Request) (*http.Request
 	return r, nil
 }
 
+// serveRouter is behind the idempotency cache, so keyed requests that
+// reach it are cache misses
+func (api *API) serveRouter(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Idempotency-Key") != "" {
+		api.SetEventData(r.Context(), "idempotency", "miss")
+	}
+
+	// httprouter can't register a static _bulk segment alongside the :id
+	// wildcard, so bulk routes have their own router
+	if h, _, _ := api.bulkRouter.Lookup(http.MethodPost, r.URL.Path); h != nil {
+		api.bulkRouter.ServeHTTP(w, r)
+		return
+	}
+
+	api.router.ServeHTTP(w, r)
+}
+
 func (api *API) registerHandlers(base string, cfg *config) {
 	api.router.GET(
 		base,
@@ -354,7 +503,7 @@ func (api *API) registerHandlers(base string, cfg *config) {
 	api.router.POST(
 		base,
 		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-			api.wrapError(api.post, cfg, w, r)
+			api.wrapError(api.limited("create", api.post), cfg, w, r)
 		},
 	)
 
@@ -363,21 +512,21 @@ func (api *API) registerHandlers(base string, cfg *config) {
 	api.router.PUT(
 		single,
 		func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			api.wrapErrorID(api.put, cfg, ps[0].Value, w, r)
+			api.wrapErrorID(api.limitedID("replace", api.put), cfg, ps[0].Value, w, r)
 		},
 	)
 
 	api.router.PATCH(
 		single,
 		func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			api.wrapErrorID(api.patch, cfg, ps[0].Value, w, r)
+			api.wrapErrorID(api.limitedID("update", api.patch), cfg, ps[0].Value, w, r)
 		},
 	)
 
 	api.router.DELETE(
 		single,
 		func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			api.wrapErrorID(api.delete, cfg, ps[0].Value, w, r)
+			api.wrapErrorID(api.limitedID("delete", api.delete), cfg, ps[0].Value, w, r)
 		},
 	)
 
@@ -387,13 +536,20 @@ func (api *API) registerHandlers(base string, cfg *config) {
 			api.wrapErrorID(api.routeSingleGET, cfg, ps[0].Value, w, r)
 		},
 	)
+
+	api.bulkRouter.POST(
+		fmt.Sprintf("%s/_bulk", base),
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			api.wrapError(api.limitedBulk(api.bulk), cfg, w, r)
+		},
+	)
 }
 
 func (api *API) routeListGET(cfg *config, w http.ResponseWriter, r *http.Request) error {
 	ac := httpheader.Accept(r.Header)
 
 	if m := httpheader.MatchAccept(ac, "application/json"); m.Type != "" {
-		return api.getList(cfg, w, r)
+		return api.limited("list", api.getList)(cfg, w, r)
 	}
 
 	if m := httpheader.MatchAccept(ac, "text/event-stream"); m.Type != "" {
@@ -407,7 +563,7 @@ func (api *API) routeSingleGET(cfg *config, id string, w http.ResponseWriter, r
 	ac := httpheader.Accept(r.Header)
 
 	if m := httpheader.MatchAccept(ac, "application/json"); m.Type != "" {
-		return api.getObject(cfg, id, w, r)
+		return api.limitedID("get", api.getObject)(cfg, id, w, r)
 	}
 
 	if m := httpheader.MatchAccept(ac, "text/event-stream"); m.Type != "" {
@@ -420,14 +576,14 @@ func (api *API) routeSingleGET(cfg *config, id string, w http.ResponseWriter, r
 func (api *API) wrapError(cb func(*config, http.ResponseWriter, *http.Request) error, cfg *config, w http.ResponseWriter, r *http.Request) {
 	err := cb(cfg, w, r)
 	if err != nil {
-		jsrest.WriteError(w, err)
+		api.writeError(w, r, err)
 	}
 }
 
 func (api *API) wrapErrorID(cb func(*config, string, http.ResponseWriter, *http.Request) error, cfg *config, id string, w http.ResponseWriter, r *http.Request) {
 	err := cb(cfg, id, w, r)
 	if err != nil {
-		jsrest.WriteError(w, err)
+		api.writeError(w, r, err)
 	}
 }
 
@@ -1,14 +1,38 @@
 package patchy_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dchest/uniuri"
+	"github.com/go-resty/resty/v2"
 	"github.com/gopatchy/patchy"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
 )
 
 func TestRegisterMissingMetadata(t *testing.T) {
@@ -270,3 +294,2829 @@ func TestRequestHookError(t *testing.T) {
 	require.True(t, resp.IsError())
 	require.Contains(t, resp.String(), "test reject")
 }
+
+func TestNewAPIMemory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	api, err := patchy.NewAPIMemory()
+	require.NoError(t, err)
+
+	defer func() {
+		err := api.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	patchy.Register[testType](api)
+
+	create, err := patchy.Create[testType](ctx, api, &testType{Text: "foo"})
+	require.NoError(t, err)
+	require.NotEmpty(t, create.ETag)
+
+	stream, err := patchy.StreamGet[testType](ctx, api, create.ID)
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	require.Equal(t, "foo", stream.Read().Text)
+
+	_, err = patchy.Update[testType](ctx, api, create.ID, &testType{Text: "bar"}, nil)
+	require.NoError(t, err)
+
+	get := stream.Read()
+	require.Equal(t, "bar", get.Text)
+	require.NotEqual(t, create.ETag, get.ETag)
+
+	_, err = patchy.Create[testType](ctx, api, &testType{Text: "baz"})
+	require.NoError(t, err)
+
+	list, err := patchy.List[testType](ctx, api, nil)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "bar", list[0].Text)
+	require.Equal(t, "baz", list[1].Text)
+}
+
+type migrateV0 struct {
+	patchy.Metadata
+	Name string `json:"name"`
+}
+
+type migrateV1 struct {
+	patchy.Metadata
+	FullName string `json:"fullName"`
+}
+
+func renameField(from, to string) patchy.Migration {
+	return func(m map[string]any) (map[string]any, error) {
+		v, found := m[from]
+		if !found {
+			return nil, fmt.Errorf("missing %s", from)
+		}
+
+		m[to] = v
+		delete(m, from)
+
+		return m, nil
+	}
+}
+
+func TestMigrateLazy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store := patchy.NewMemoryStore()
+
+	err := store.Write(ctx, "migrate", &migrateV0{Metadata: patchy.Metadata{ID: "a", Generation: 1}, Name: "foo"})
+	require.NoError(t, err)
+
+	api, err := patchy.NewAPIWithStore(store)
+	require.NoError(t, err)
+
+	defer func() {
+		err := api.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	patchy.RegisterName[migrateV1](api, "migrate", "migrates")
+	patchy.RegisterMigrationName[migrateV1](api, "migrate", 0, renameField("name", "fullName"))
+
+	get, err := patchy.GetName[migrateV1](ctx, api, "migrate", "a", nil)
+	require.NoError(t, err)
+	require.Equal(t, "foo", get.FullName)
+	require.EqualValues(t, 2, get.Generation)
+
+	created, err := patchy.CreateName[migrateV1](ctx, api, "migrate", &migrateV1{FullName: "bar"})
+	require.NoError(t, err)
+
+	list, err := patchy.ListName[migrateV1](ctx, api, "migrate", nil)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "foo", list[0].FullName)
+	require.EqualValues(t, 2, list[0].Generation)
+	require.Equal(t, "bar", list[1].FullName)
+	require.EqualValues(t, 1, list[1].Generation)
+	require.Equal(t, created.ETag, list[1].ETag)
+}
+
+func TestMigrateEager(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store := patchy.NewMemoryStore()
+
+	err := store.Write(ctx, "migrate", &migrateV0{Metadata: patchy.Metadata{ID: "a", Generation: 1}, Name: "foo"})
+	require.NoError(t, err)
+
+	api, err := patchy.NewAPIWithStore(store)
+	require.NoError(t, err)
+
+	defer func() {
+		err := api.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	patchy.RegisterName[migrateV1](api, "migrate", "migrates")
+	patchy.RegisterMigrationName[migrateV1](api, "migrate", 0, renameField("name", "fullName"))
+
+	err = api.Migrate(ctx)
+	require.NoError(t, err)
+
+	raw, err := store.Read(ctx, "migrate", "a", func() any { return &map[string]any{} })
+	require.NoError(t, err)
+	require.Equal(t, "foo", (*raw.(*map[string]any))["fullName"])
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store := patchy.NewMemoryStore()
+
+	err := store.Write(ctx, "migrate", &migrateV0{Metadata: patchy.Metadata{ID: "a", Generation: 1}, Name: "foo"})
+	require.NoError(t, err)
+
+	err = store.Write(ctx, "migrate", &migrateV1{Metadata: patchy.Metadata{ID: "b", Generation: 1}, FullName: "bar"})
+	require.NoError(t, err)
+
+	api, err := patchy.NewAPIWithStore(store)
+	require.NoError(t, err)
+
+	defer func() {
+		err := api.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	patchy.RegisterName[migrateV1](api, "migrate", "migrates")
+	patchy.RegisterMigrationName[migrateV1](api, "migrate", 0, renameField("name", "fullName"))
+
+	failures, err := api.MigrateDryRun(ctx)
+	require.NoError(t, err)
+	require.Len(t, failures, 1)
+	require.Equal(t, "migrate", failures[0].Type)
+	require.Equal(t, "b", failures[0].ID)
+	require.EqualValues(t, 0, failures[0].FromVersion)
+
+	raw, err := store.Read(ctx, "migrate", "a", func() any { return &map[string]any{} })
+	require.NoError(t, err)
+	require.Equal(t, "foo", (*raw.(*map[string]any))["name"])
+
+	_, err = patchy.GetName[migrateV1](ctx, api, "migrate", "a", nil)
+	require.Error(t, err)
+}
+
+func TestMigrateOrder(t *testing.T) {
+	t.Parallel()
+
+	api, err := patchy.NewAPIMemory()
+	require.NoError(t, err)
+
+	defer func() {
+		err := api.Shutdown(context.Background())
+		require.NoError(t, err)
+	}()
+
+	patchy.Register[testType](api)
+
+	require.Panics(t, func() {
+		patchy.RegisterMigration[testType](api, 1, renameField("a", "b"))
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	metrics := func() string {
+		resp, err := ta.r().Get("_metrics")
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Contains(t, resp.Header().Get("Content-Type"), "text/plain")
+
+		return string(resp.Body())
+	}
+
+	created := &testType{}
+
+	for i := 0; i < 2; i++ {
+		resp, err := ta.r().
+			SetHeader("Idempotency-Key", `"metrics-test"`).
+			SetBody(&testType{Text: "foo"}).
+			SetResult(created).
+			Post("testtype")
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+	}
+
+	resp, err := ta.r().
+		SetPathParam("id", "doesnotexist").
+		Get("testtype/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+
+	_, err = patchy.Update[testType](ctx, ta.api, created.ID, &testType{Text: "bar"}, nil)
+	require.NoError(t, err)
+
+	stream, err := ta.r().
+		SetDoNotParseResponse(true).
+		SetHeader("Accept", "text/event-stream").
+		SetPathParam("id", created.ID).
+		Get("testtype/{id}")
+	require.NoError(t, err)
+	require.False(t, stream.IsError())
+
+	defer stream.RawBody().Close()
+
+	// Wait for the stream to start
+	scan := bufio.NewScanner(stream.RawBody())
+	require.True(t, scan.Scan())
+
+	body := metrics()
+	require.Contains(t, body, "# TYPE patchy_http_requests_total counter\n")
+	require.Contains(t, body, `patchy_http_requests_total{operation="create",typeName="testtype",responseCode="200"} 1`+"\n")
+	require.Contains(t, body, `patchy_http_requests_total{operation="get",typeName="testtype",responseCode="404"} 1`+"\n")
+	require.Contains(t, body, `patchy_http_request_duration_seconds_count{operation="create",typeName="testtype",responseCode="200"} 1`+"\n")
+	require.Contains(t, body, `patchy_http_request_duration_seconds_bucket{operation="create",typeName="testtype",responseCode="200",le="+Inf"} 1`+"\n")
+	require.Contains(t, body, `patchy_idempotency_requests_total{result="hit"} 1`+"\n")
+	require.Contains(t, body, `patchy_idempotency_requests_total{result="miss"} 1`+"\n")
+	require.Contains(t, body, `patchy_streams_active{typeName="testtype"} 1`+"\n")
+	require.Contains(t, body, `patchy_store_duration_seconds_count{operation="write",typeName="testtype"}`)
+	require.Contains(t, body, `patchy_lock_wait_seconds_count{typeName="testtype"} 1`+"\n")
+
+	stream.RawBody().Close()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(metrics(), `patchy_streams_active{typeName="testtype"} 0`+"\n")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	exp := tracetest.NewInMemoryExporter()
+	ta.api.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+
+	resp, err := ta.r().
+		SetHeader("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01").
+		SetBody(&mayType{Text1: "foo"}).
+		Post("maytype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	spans := map[string]tracetest.SpanStub{}
+
+	for _, span := range exp.GetSpans() {
+		require.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.SpanContext.TraceID().String())
+		spans[span.Name] = span
+	}
+
+	server := spans["create maytype"]
+	require.Equal(t, trace.SpanKindServer, server.SpanKind)
+	require.Equal(t, "b7ad6b7169203331", server.Parent.SpanID().String())
+	require.True(t, server.Parent.IsRemote())
+
+	require.Equal(t, server.SpanContext.SpanID(), spans["requestHook"].Parent.SpanID())
+	require.Equal(t, server.SpanContext.SpanID(), spans["create"].Parent.SpanID())
+	require.Equal(t, spans["create"].SpanContext.SpanID(), spans["mayWrite"].Parent.SpanID())
+	require.Equal(t, spans["create"].SpanContext.SpanID(), spans["store.write"].Parent.SpanID())
+	require.Equal(t, spans["create"].SpanContext.SpanID(), spans["mayRead"].Parent.SpanID())
+}
+
+func TestTracingError(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	exp := tracetest.NewInMemoryExporter()
+	ta.api.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+
+	resp, err := ta.r().
+		SetPathParam("id", "doesnotexist").
+		Get("testtype/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+
+	spans := map[string]tracetest.SpanStub{}
+
+	for _, span := range exp.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	server := spans["get testtype"]
+	require.False(t, server.Parent.IsValid())
+	require.Contains(t, server.Attributes, attribute.Int("http.status_code", 404))
+
+	// Client errors aren't server errors
+	require.Equal(t, codes.Unset, server.Status.Code)
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	ta.api.EnableAuditLog(func(context.Context, *patchy.API) error { return nil })
+
+	created := &testType{}
+
+	resp, err := ta.r().
+		SetHeader("Authorization", "Bearer abcd").
+		SetBody(&testType{Text: "foo"}).
+		SetResult(created).
+		Post("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	_, err = patchy.Update[testType](ctx, ta.api, created.ID, &testType{Text: "bar", Num: 1}, nil)
+	require.NoError(t, err)
+
+	resp, err = ta.r().
+		SetPathParam("id", "doesnotexist").
+		Delete("testtype/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+
+	recs := []*patchy.AuditRecord{}
+
+	resp, err = ta.r().
+		SetQueryParam("_sort", "time").
+		SetResult(&recs).
+		Get("audit")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Len(t, recs, 3)
+
+	require.Equal(t, "create", recs[0].Operation)
+	require.Equal(t, "testtype", recs[0].Type)
+	require.Equal(t, created.ID, recs[0].ObjectID)
+	require.Equal(t, "http", recs[0].Source)
+	require.Equal(t, "bearer", recs[0].AuthMethod)
+	require.NotEmpty(t, recs[0].PrincipalID)
+	require.Equal(t, "success", recs[0].Result)
+	require.Equal(t, []patchy.AuditChange{
+		{Path: "num", New: "0"},
+		{Path: "text", New: `"foo"`},
+	}, recs[0].Changes)
+
+	require.Equal(t, "update", recs[1].Operation)
+	require.Equal(t, "direct", recs[1].Source)
+	require.Empty(t, recs[1].AuthMethod)
+	require.Equal(t, []patchy.AuditChange{
+		{Path: "num", Old: "0", New: "1"},
+		{Path: "text", Old: `"foo"`, New: `"bar"`},
+	}, recs[1].Changes)
+
+	require.Equal(t, "delete", recs[2].Operation)
+	require.Equal(t, "doesnotexist", recs[2].ObjectID)
+	require.Equal(t, "error", recs[2].Result)
+	require.NotEmpty(t, recs[2].Error)
+
+	// Append-only, and attempts are recorded
+	resp, err = ta.r().
+		SetPathParam("id", recs[0].ID).
+		Delete("audit/{id}")
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	err = patchy.DeleteName[patchy.AuditRecord](ctx, ta.api, "audit", recs[0].ID, nil)
+	require.Error(t, err)
+
+	list, err := patchy.ListName[patchy.AuditRecord](ctx, ta.api, "audit", &patchy.ListOpts{
+		Filters: []patchy.Filter{
+			{
+				Path:  "type",
+				Op:    "eq",
+				Value: "audit",
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	for _, rec := range list {
+		require.Equal(t, "delete", rec.Operation)
+		require.Equal(t, recs[0].ID, rec.ObjectID)
+		require.Equal(t, "error", rec.Result)
+	}
+}
+
+func TestAuditSink(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	recs := []*patchy.AuditRecord{}
+	mu := sync.Mutex{}
+
+	ta.api.AddAuditSink(patchy.AuditSinkFunc(func(_ context.Context, rec *patchy.AuditRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		recs = append(recs, rec)
+
+		return nil
+	}))
+
+	bearers, err := patchy.List[authBearerType](ctx, ta.api, nil)
+	require.NoError(t, err)
+	require.Len(t, bearers, 1)
+
+	_, err = patchy.UpdateMap[authBearerType](ctx, ta.api, bearers[0].ID, map[string]any{"token": "efgh"}, nil)
+	require.NoError(t, err)
+
+	err = patchy.SyncList[testType](ctx, ta.api, []*testType{{Text: "foo"}}, nil)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, recs, 2)
+
+	// Secrets are redacted
+	require.Equal(t, []patchy.AuditChange{
+		{Path: "token", Old: `"[redacted]"`, New: `"[redacted]"`},
+	}, recs[0].Changes)
+
+	require.Equal(t, "create", recs[1].Operation)
+	require.Equal(t, "replication", recs[1].Source)
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	hs := &patchy.HealthStatus{}
+
+	resp, err := ta.r().
+		SetResult(hs).
+		Get("_health/live")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "ok", hs.Status)
+	require.Empty(t, hs.Checks)
+
+	resp, err = ta.r().
+		SetResult(hs).
+		Get("_health/ready")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "ok", hs.Status)
+
+	for _, name := range []string{"store", "types", "migrations", "listener"} {
+		require.Contains(t, hs.Checks, name)
+		require.Equal(t, "ok", hs.Checks[name].Status)
+		require.GreaterOrEqual(t, hs.Checks[name].Latency, 0.0)
+	}
+
+	ta.api.AddHealthCheck("upstream", func(ctx context.Context) error {
+		return fmt.Errorf("upstream unreachable")
+	})
+
+	hs = &patchy.HealthStatus{}
+
+	resp, err = ta.r().
+		SetError(hs).
+		Get("_health/ready")
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode())
+	require.Equal(t, "error", hs.Status)
+	require.Equal(t, "ok", hs.Checks["store"].Status)
+	require.Equal(t, "error", hs.Checks["upstream"].Status)
+	require.Equal(t, "upstream unreachable", hs.Checks["upstream"].Error)
+
+	// Liveness ignores readiness checks
+	resp, err = ta.r().Get("_health/live")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+}
+
+func TestShutdownDrain(t *testing.T) {
+	// Not parallel, so other tests' goroutines don't come and go
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ta := newTestAPI(t)
+	defer ta.proxy.Close()
+
+	ctx := context.Background()
+
+	created, err := patchy.Create[testType](ctx, ta.api, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	stream := func(path string) *sseTestStream {
+		resp, err := ta.r().
+			SetDoNotParseResponse(true).
+			SetHeader("Accept", "text/event-stream").
+			Get(path)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		return &sseTestStream{
+			body: resp.RawBody(),
+			scan: bufio.NewScanner(resp.RawBody()),
+		}
+	}
+
+	next := func(sts *sseTestStream) string {
+		for {
+			ev := sts.next(t)
+			if ev.event != "heartbeat" {
+				return ev.event
+			}
+		}
+	}
+
+	get := stream(fmt.Sprintf("testtype/%s", created.ID))
+	defer get.close()
+
+	require.Equal(t, "initial", next(get))
+
+	list := stream("testtype")
+	defer list.close()
+
+	require.Equal(t, "list", next(list))
+
+	sub := ta.subscribe(t, url.Values{"get": []string{fmt.Sprintf("testtype/%s", created.ID)}})
+	defer sub.close()
+
+	require.Equal(t, "open", next(sub))
+	require.Equal(t, "initial", sub.recv(t, fmt.Sprintf("testtype/%s", created.ID)).event)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	err = ta.api.Shutdown(shutdownCtx)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	require.Equal(t, "reconnect", next(get))
+	require.Equal(t, "reconnect", next(list))
+
+	// Skip the end (and maybe reconnect) of the subscription's stream
+	ev := sub.next(t)
+	for ev.params["ref"] != "" || ev.event == "heartbeat" {
+		ev = sub.next(t)
+	}
+
+	require.Equal(t, "shutdown", ev.event)
+
+	// Requests from other servers are refused too
+	rec := httptest.NewRecorder()
+	ta.api.ServeHTTP(rec, httptest.NewRequest("GET", "/api/testtype", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestLimits(t *testing.T) {
+	t.Parallel()
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithLimits(&patchy.Limits{
+			TypeMaxBodySize:        map[string]int64{"testtype": 100},
+			OperationTimeout:       map[string]time.Duration{"create": 500 * time.Millisecond},
+			TypeMaxInFlight:        map[string]int{"maytype": 1},
+			MaxStreamsPerPrincipal: 1,
+		}),
+		patchy.WithListen(&patchy.ListenConfig{Bind: "[::]:0", TLS: "self"}),
+	)
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetBody(&testType{Text: strings.Repeat("x", 200)}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 413, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	// Other types aren't limited
+	resp, err = ta.r().
+		SetBody(&testType{Text: strings.Repeat("x", 200)}).
+		Post("testtypeb")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	// Bulk bodies are limited per operation
+	ops := []string{}
+
+	for i := 0; i < 5; i++ {
+		ops = append(ops, `{"op":"create","obj":{"text":"foo"}}`)
+	}
+
+	ops = append(ops, `{"op":"create","obj":{"text":"`+strings.Repeat("x", 200)+`"}}`)
+
+	resp, err = ta.r().
+		SetHeader("Content-Type", "application/x-ndjson").
+		SetBody(strings.Join(ops, "\n")).
+		Post("testtype/_bulk")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+
+	dec := json.NewDecoder(strings.NewReader(resp.String()))
+	statuses := []int{}
+
+	for dec.More() {
+		res := &patchy.BulkResult{}
+		require.NoError(t, dec.Decode(res))
+		statuses = append(statuses, res.Status)
+	}
+
+	require.Equal(t, []int{200, 200, 200, 200, 200, 413}, statuses)
+
+	blocked := make(chan *resty.Response)
+
+	go func() {
+		resp, _ := ta.r().
+			SetHeader("X-Block-Write", "1").
+			SetBody(&mayType{}).
+			Post("maytype")
+		blocked <- resp
+	}()
+
+	require.Eventually(t, func() bool {
+		resp, err := ta.r().
+			SetBody(&mayType{}).
+			Post("maytype")
+		require.NoError(t, err)
+
+		return resp.StatusCode() == 429
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp = <-blocked
+	require.NotNil(t, resp)
+	require.Equal(t, 503, resp.StatusCode())
+
+	// Streams are exempt from the timeout but limited per principal
+	stream, err := ta.r().
+		SetDoNotParseResponse(true).
+		SetHeader("Accept", "text/event-stream").
+		Get("testtype")
+	require.NoError(t, err)
+	require.False(t, stream.IsError())
+
+	defer stream.RawBody().Close()
+
+	resp, err = ta.r().
+		SetHeader("Accept", "text/event-stream").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 429, resp.StatusCode())
+
+	// Authenticated principals have their own limit
+	stream2, err := ta.r().
+		SetDoNotParseResponse(true).
+		SetHeader("Accept", "text/event-stream").
+		SetAuthToken("abcd").
+		Get("testtype")
+	require.NoError(t, err)
+	require.False(t, stream2.IsError())
+
+	defer stream2.RawBody().Close()
+}
+
+func TestLimitsTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithLimits(&patchy.Limits{
+			OperationTimeout: map[string]time.Duration{"create": 100 * time.Millisecond},
+		}),
+		patchy.WithListen(&patchy.ListenConfig{Bind: "[::]:0", TLS: "self"}),
+	)
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	// The handler ignores its context, but the response doesn't wait
+	start := time.Now()
+
+	resp, err := ta.r().
+		SetHeader("X-Slow-Write", "1").
+		SetBody(&mayType{Text1: "foo"}).
+		Post("maytype")
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode())
+	require.Less(t, time.Since(start), 900*time.Millisecond)
+
+	// It still finishes its write
+	require.Eventually(t, func() bool {
+		list, err := patchy.List[mayType](ctx, ta.api, nil)
+		require.NoError(t, err)
+
+		return len(list) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLimitsWS(t *testing.T) {
+	t.Parallel()
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithLimits(&patchy.Limits{
+			TypeMaxBodySize:  map[string]int64{"testtype": 100},
+			OperationTimeout: map[string]time.Duration{"create": 100 * time.Millisecond},
+			RouteRateLimit: map[string]*patchy.RateLimit{
+				"testtypeb/create": {Rate: 0.01, Burst: 1},
+			},
+		}),
+		patchy.WithListen(&patchy.ListenConfig{Bind: "[::]:0", TLS: "self"}),
+	)
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	wtc := ta.ws(t, "")
+	defer wtc.close()
+
+	wtc.send(t, &patchy.WSRequest{
+		Ref:  "big",
+		Op:   "create",
+		Type: "testtype",
+		Obj:  json.RawMessage(`{"text":"` + strings.Repeat("x", 200) + `"}`),
+	})
+
+	msg := wtc.recv(t, "big")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 413, msg.Status)
+
+	for _, status := range []int{200, 429} {
+		wtc.send(t, &patchy.WSRequest{
+			Ref:  "rl",
+			Op:   "create",
+			Type: "testtypeb",
+			Obj:  json.RawMessage(`{"text":"foo"}`),
+		})
+
+		msg = wtc.recv(t, "rl")
+		require.Equal(t, status, msg.Status)
+	}
+
+	// The handler ignores its context, but the reply doesn't wait
+	slow := ta.wsHeader(t, "", http.Header{"X-Slow-Write": {"1"}})
+	defer slow.close()
+
+	start := time.Now()
+
+	slow.send(t, &patchy.WSRequest{
+		Ref:  "slow",
+		Op:   "create",
+		Type: "maytype",
+		Obj:  json.RawMessage(`{"text1":"foo"}`),
+	})
+
+	msg = slow.recv(t, "slow")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 503, msg.Status)
+	require.Less(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithLimits(&patchy.Limits{
+			RouteRateLimit: map[string]*patchy.RateLimit{
+				"testtype/create": {Rate: 0.01, Burst: 2},
+			},
+		}),
+		patchy.WithListen(&patchy.ListenConfig{Bind: "[::]:0", TLS: "self"}),
+	)
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	for _, remaining := range []string{"1", "0"} {
+		resp, err := ta.r().
+			SetBody(&testType{Text: "foo"}).
+			Post("testtype")
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, "2", resp.Header().Get("RateLimit-Limit"))
+		require.Equal(t, remaining, resp.Header().Get("RateLimit-Remaining"))
+		require.Empty(t, resp.Header().Get("Retry-After"))
+	}
+
+	resp, err := ta.r().
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 429, resp.StatusCode())
+	require.Equal(t, "0", resp.Header().Get("RateLimit-Remaining"))
+
+	retry, err := strconv.Atoi(resp.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.InDelta(t, 100, retry, 1)
+
+	// Other operations have their own (here, no) limit
+	resp, err = ta.r().Get("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Empty(t, resp.Header().Get("RateLimit-Limit"))
+
+	// Other principals have their own bucket
+	resp, err = ta.r().
+		SetAuthToken("abcd").
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "1", resp.Header().Get("RateLimit-Remaining"))
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "patchy.yaml")
+
+	err := os.WriteFile(path, []byte(`
+store:
+  type: memory
+listen:
+  - bind: "[::]:0"
+    tls: self
+    tlsMinVersion: "1.2"
+limits:
+  typeMaxBodySize:
+    testtype: 100
+streams:
+  heartbeat: 10s
+openAPIInfo:
+  title: Config Test
+  version: 1.2.3
+`), 0o600)
+	require.NoError(t, err)
+
+	api, err := patchy.New(patchy.WithConfigFile(path))
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetBody(&testType{Text: strings.Repeat("x", 200)}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 413, resp.StatusCode())
+
+	resp, err = ta.r().Get("_openapi")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Contains(t, resp.String(), "Config Test")
+}
+
+func TestConfigSQLStore(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "patchy.yaml")
+
+	err := os.WriteFile(path, []byte(`
+store:
+  type: sql
+  driver: sqlite3
+  dsn: file:`+filepath.Join(t.TempDir(), "patchy.db")+`
+listen:
+  - bind: "[::]:0"
+    tls: self
+`), 0o600)
+	require.NoError(t, err)
+
+	api, err := patchy.New(patchy.WithConfigFile(path))
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	created := &testType{}
+
+	resp, err := ta.r().
+		SetBody(&testType{Text: "foo"}).
+		SetResult(created).
+		Post("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	get := &testType{}
+
+	resp, err = ta.r().
+		SetResult(get).
+		SetPathParam("id", created.ID).
+		Get("testtype/{id}")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "foo", get.Text)
+
+	_, err = patchy.New(patchy.WithSQL("bogus", ""))
+	require.Error(t, err)
+}
+
+func TestNewAPILimits(t *testing.T) {
+	t.Parallel()
+
+	_, err := patchy.NewAPIMemory(&patchy.Limits{}, &patchy.Limits{})
+	require.ErrorIs(t, err, patchy.ErrMultipleLimits)
+
+	api, err := patchy.NewAPIMemory(&patchy.Limits{MaxBodySize: 100})
+	require.NoError(t, err)
+
+	err = api.ListenSelfCert("[::]:0")
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetBody(&testType{Text: strings.Repeat("x", 200)}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 413, resp.StatusCode())
+}
+
+func TestConfigLoad(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	envPath := filepath.Join(dir, "patchy.env")
+
+	err := os.WriteFile(envPath, []byte(`
+# Comments and blank lines are skipped
+PATCHY_STORE_TYPE=memory
+PATCHY_STRIPPREFIX="/api"
+PATCHY_CORS_ORIGINS=[https://a.example, https://b.example]
+PATCHY_LIMITS_TYPEMAXBODYSIZE={testtype: 100}
+PATCHY_LIMITS_TIMEOUT=5s
+export PATCHY_AUTH_LOGINLIMITS_USERFAILURES=3
+`), 0o600)
+	require.NoError(t, err)
+
+	cfg, err := patchy.LoadConfig(envPath)
+	require.NoError(t, err)
+	require.Equal(t, "memory", cfg.Store.Type)
+	require.Equal(t, "/api", cfg.StripPrefix)
+	require.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.CORS.Origins)
+	require.Equal(t, map[string]int64{"testtype": 100}, cfg.Limits.TypeMaxBodySize)
+	require.Equal(t, 5*time.Second, cfg.Limits.Timeout)
+	require.Equal(t, 3, cfg.Auth.LoginLimits.UserFailures)
+
+	jsonPath := filepath.Join(dir, "patchy.json")
+
+	err = os.WriteFile(jsonPath, []byte(`{"store": {"type": "sqlite", "dbName": "file::memory:"}, "streams": {"maxDuration": "1m"}}`), 0o600)
+	require.NoError(t, err)
+
+	cfg, err = patchy.LoadConfig(jsonPath)
+	require.NoError(t, err)
+	require.Equal(t, "file::memory:", cfg.Store.DBName)
+	require.Equal(t, time.Minute, cfg.Streams.MaxDuration)
+
+	badPath := filepath.Join(dir, "bad.env")
+
+	err = os.WriteFile(badPath, []byte("PATCHY_BOGUS=1\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = patchy.LoadConfig(badPath)
+	require.ErrorIs(t, err, patchy.ErrUnknownConfigEnv)
+
+	badPath = filepath.Join(dir, "bad.yaml")
+
+	err = os.WriteFile(badPath, []byte("bogus: 1\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = patchy.LoadConfig(badPath)
+	require.Error(t, err)
+}
+
+func TestListeners(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithListen(&patchy.ListenConfig{Name: "public", Bind: "[::]:0", TLS: "self", Auth: []string{"bearer"}}),
+		patchy.WithListen(&patchy.ListenConfig{Name: "local", Bind: "[::1]:0", Routes: []string{"/_health"}}),
+		patchy.WithListen(&patchy.ListenConfig{Name: "admin", Network: "unix", Bind: sock}),
+	)
+	require.NoError(t, err)
+
+	patchy.Register[testType](api)
+	patchy.Register[authBasicType](api)
+
+	_, err = patchy.Create[authBasicType](ctx, api, &authBasicType{
+		User: "foo",
+		Pass: "$2a$10$ARCRvjao7aP7CU1Ck8rlqez3FkWwJZY1oe62sxGCA12fxeRcqj0K6", // abcd
+	})
+	require.NoError(t, err)
+
+	addrs := api.Addr()
+	require.Len(t, addrs, 3)
+	require.Equal(t, sock, addrs["admin"].String())
+
+	err = api.ListenInsecure(addrs["local"].String())
+	require.Error(t, err)
+
+	err = api.Listen(&patchy.ListenConfig{Name: "public", Bind: "[::1]:0"})
+	require.ErrorIs(t, err, patchy.ErrDuplicateListener)
+
+	serveErr := make(chan error)
+
+	go func() {
+		serveErr <- api.Serve()
+	}()
+
+	public := resty.New().
+		SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true}). //nolint:gosec
+		SetBaseURL(fmt.Sprintf("https://[::1]:%d/", addrs["public"].(*net.TCPAddr).Port))
+
+	local := resty.New().
+		SetBaseURL(fmt.Sprintf("http://%s/", addrs["local"]))
+
+	admin := resty.New().
+		SetTransport(&http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		}).
+		SetBaseURL("http://admin/")
+
+	require.Eventually(t, func() bool {
+		resp, err := local.R().Get("_health/ready")
+		return err == nil && !resp.IsError()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := local.R().Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+
+	resp, err = public.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	resp, err = public.R().
+		SetBasicAuth("foo", "abcd").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 401, resp.StatusCode())
+	require.Contains(t, resp.String(), "auth scheme not accepted")
+
+	list := []*testType{}
+
+	resp, err = admin.R().
+		SetBasicAuth("foo", "abcd").
+		SetHeader("Accept", "application/json").
+		SetResult(&list).
+		Get("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Len(t, list, 1)
+
+	err = api.Shutdown(ctx)
+	require.NoError(t, err)
+	require.NoError(t, <-serveErr)
+
+	_, err = os.Stat(sock)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCertReload(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	first := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, certFile, keyFile, first)
+
+	api, err := patchy.NewAPIMemory()
+	require.NoError(t, err)
+
+	err = api.ListenTLS("[::1]:0", certFile, keyFile)
+	require.NoError(t, err)
+
+	patchy.Register[testType](api)
+
+	go func() {
+		_ = api.Serve()
+	}()
+
+	defer func() {
+		err := api.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	addr := tcpAddr(t, api)
+
+	require.True(t, peerCertificate(t, addr, "localhost").NotAfter.Equal(first))
+
+	// Replaced files are picked up by a later handshake
+	expired := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTestCert(t, certFile, keyFile, expired)
+
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	require.Eventually(t, func() bool {
+		return peerCertificate(t, addr, "localhost").NotAfter.Equal(expired)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	c := resty.New().
+		SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true}). //nolint:gosec
+		SetBaseURL(fmt.Sprintf("https://[::1]:%d/", addr.Port))
+
+	hs := &patchy.HealthStatus{}
+
+	resp, err := c.R().
+		SetError(hs).
+		Get("_health/ready")
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode())
+	require.Equal(t, "error", hs.Checks["certificates"].Status)
+	require.Contains(t, hs.Checks["certificates"].Error, "certificate expired")
+
+	resp, err = c.R().Get("_metrics")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Contains(t, resp.String(), fmt.Sprintf(`patchy_tls_certificate_expiry_timestamp_seconds{listener="%s",certificate="%s"} %s`, addr, certFile, strconv.FormatFloat(float64(expired.Unix()), 'g', -1, 64)))
+
+	// A broken pair is refused and the current one kept
+	err = os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	require.NoError(t, err)
+
+	err = api.ReloadCertificates()
+	require.Error(t, err)
+	require.True(t, peerCertificate(t, addr, "localhost").NotAfter.Equal(expired))
+
+	writeTestCert(t, certFile, keyFile, first)
+
+	err = api.ReloadCertificates()
+	require.NoError(t, err)
+	require.True(t, peerCertificate(t, addr, "localhost").NotAfter.Equal(first))
+
+	resp, err = c.R().Get("_health/ready")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+}
+
+// TestACMEPebble needs a Pebble server, e.g. started with
+// PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+// and PATCHY_TEST_PEBBLE_DIRECTORY=https://localhost:14000/dir
+// PATCHY_TEST_PEBBLE_CA=test/certs/pebble.minica.pem
+func TestACMEPebble(t *testing.T) {
+	t.Parallel()
+
+	dirURL := os.Getenv("PATCHY_TEST_PEBBLE_DIRECTORY")
+	if dirURL == "" {
+		t.Skip("PATCHY_TEST_PEBBLE_DIRECTORY not set")
+	}
+
+	ctx := context.Background()
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithACME(&patchy.ACMEConfig{
+			DirectoryURL: dirURL,
+			CAFile:       os.Getenv("PATCHY_TEST_PEBBLE_CA"),
+			Hosts:        []string{"localhost"},
+		}),
+		patchy.WithListen(&patchy.ListenConfig{Bind: "[::1]:0", TLS: "acme"}),
+	)
+	require.NoError(t, err)
+
+	patchy.Register[testType](api)
+
+	go func() {
+		_ = api.Serve()
+	}()
+
+	defer func() {
+		err := api.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	addr := tcpAddr(t, api)
+
+	cert := peerCertificate(t, addr, "localhost")
+	require.Contains(t, cert.DNSNames, "localhost")
+	require.True(t, cert.NotAfter.After(time.Now()))
+
+	resp, err := resty.New().
+		SetTLSClientConfig(&tls.Config{ServerName: "localhost", InsecureSkipVerify: true}). //nolint:gosec
+		R().
+		Get(fmt.Sprintf("https://[::1]:%d/_metrics", addr.Port))
+	require.NoError(t, err)
+	require.Contains(t, resp.String(), `certificate="localhost"`)
+}
+
+func TestLoginLockoutAdmin(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ta.api.SetLoginLimits(&patchy.LoginLimits{
+		UserFailures: 2,
+		Window:       time.Minute,
+		Lockout:      time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := ta.r().
+			SetBasicAuth("foo", "bcde").
+			Get("authbasictype")
+		require.NoError(t, err)
+		require.Equal(t, 401, resp.StatusCode())
+	}
+
+	resp, err := ta.r().
+		SetHeader("X-Admin", "1").
+		Get("_lockouts")
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode())
+
+	ta.api.SetAdminHook(func(r *http.Request, _ *patchy.API) error {
+		if r.Header.Get("X-Admin") == "" {
+			return fmt.Errorf("X-Admin required")
+		}
+
+		return nil
+	})
+
+	resp, err = ta.r().
+		Get("_lockouts")
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode())
+
+	lockouts := []*patchy.LoginLockout{}
+
+	resp, err = ta.r().
+		SetHeader("X-Admin", "1").
+		SetResult(&lockouts).
+		Get("_lockouts")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+	require.Len(t, lockouts, 1)
+	require.Equal(t, "foo", lockouts[0].User)
+
+	resp, err = ta.r().
+		SetHeader("X-Admin", "1").
+		Delete("_lockouts")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetQueryParam("user", "foo").
+		Delete("_lockouts")
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetHeader("X-Admin", "1").
+		SetQueryParam("user", "foo").
+		Delete("_lockouts")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetBasicAuth("foo", "abcd").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+}
+
+func TestLoginLockoutMaxEntries(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ta.api.SetLoginLimits(&patchy.LoginLimits{
+		UserFailures: 2,
+		Window:       time.Minute,
+		Lockout:      time.Minute,
+		MaxEntries:   2,
+	})
+
+	fail := func(user string) *resty.Response {
+		resp, err := ta.r().
+			SetBasicAuth(user, "bcde").
+			Get("authbasictype")
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	// Locked entries aren't evicted
+	fail("foo")
+	require.Equal(t, "60", fail("foo").Header().Get("Retry-After"))
+
+	// bar is evicted by baz, so its count starts over
+	require.Empty(t, fail("bar").Header().Get("Retry-After"))
+	require.Empty(t, fail("baz").Header().Get("Retry-After"))
+	require.Empty(t, fail("bar").Header().Get("Retry-After"))
+	require.Equal(t, "60", fail("bar").Header().Get("Retry-After"))
+
+	lockouts := ta.api.LoginLockouts()
+	require.Len(t, lockouts, 2)
+}
+
+func TestLoginLockoutOff(t *testing.T) {
+	t.Parallel()
+
+	api, err := patchy.NewAPIMemory()
+	require.NoError(t, err)
+
+	err = api.ListenSelfCert("[::]:0")
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	// Off by default
+	for i := 0; i < 20; i++ {
+		resp, err := ta.r().
+			SetBasicAuth("foo", "bcde").
+			Get("authbasictype")
+		require.NoError(t, err)
+		require.Equal(t, 401, resp.StatusCode())
+		require.Empty(t, resp.Header().Get("Retry-After"))
+	}
+
+	// Limits can change while requests are in progress
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 20; i++ {
+			ta.api.SetLoginLimits(patchy.DefaultLoginLimits())
+			ta.api.SetLoginLimits(nil)
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		resp, err := ta.r().
+			SetBasicAuth("foo", "bcde").
+			Get("authbasictype")
+		require.NoError(t, err)
+		require.Equal(t, 401, resp.StatusCode())
+	}
+
+	<-done
+}
+
+func TestImportStoreError(t *testing.T) {
+	t.Parallel()
+
+	src := newTestAPI(t)
+	defer src.shutdown(t)
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared", uniuri.New()))
+	require.NoError(t, err)
+
+	backend := &failBackend{Backend: patchy.NewSQLBackend(db)}
+
+	api, err := patchy.NewAPIWithStore(patchy.NewBusStore(backend))
+	require.NoError(t, err)
+
+	err = api.ListenSelfCert("[::]:0")
+	require.NoError(t, err)
+
+	dst := newTestAPIInt(t, api, "https")
+	defer dst.shutdown(t)
+
+	admin := func(*http.Request, *patchy.API) error { return nil }
+
+	src.api.SetAdminHook(admin)
+	dst.api.SetAdminHook(admin)
+
+	resp, err := src.r().
+		Get("_export")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+
+	backend.fail.Store(true)
+
+	resp, err = dst.r().
+		SetHeader("Content-Type", "application/x-ndjson").
+		SetBody(resp.Body()).
+		Post("_import")
+	require.NoError(t, err)
+	require.Equal(t, 500, resp.StatusCode())
+
+	resp, err = dst.r().
+		SetHeader("Content-Type", "application/x-ndjson").
+		SetBody("bogus\n").
+		Post("_import")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+}
+
+type failBackend struct {
+	patchy.Backend
+	fail atomic.Bool
+}
+
+func (fb *failBackend) Write(ctx context.Context, t string, obj any) error {
+	if fb.fail.Load() {
+		return fmt.Errorf("write disabled")
+	}
+
+	return fb.Backend.Write(ctx, t, obj)
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	wtc := ta.ws(t, "")
+	defer wtc.close()
+
+	wtc.send(t, &patchy.WSRequest{Ref: "l", Op: "streamList", Type: "testtype"})
+
+	msg := wtc.recv(t, "l")
+	require.Equal(t, "list", msg.Event)
+	require.Len(t, msg.Data, 0)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "c", Op: "create", Type: "testtype", Obj: json.RawMessage(`{"text":"foo"}`)})
+
+	msg = wtc.recv(t, "c")
+	require.Equal(t, "result", msg.Event)
+	require.Equal(t, 200, msg.Status)
+
+	created := msg.Data.(map[string]any)
+	require.Equal(t, "foo", created["text"])
+
+	id := created["id"].(string)
+	require.NotEmpty(t, id)
+
+	msg = wtc.recv(t, "l")
+	require.Equal(t, "list", msg.Event)
+	require.Len(t, msg.Data, 1)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "g", Op: "streamGet", Type: "testtype", ID: id})
+
+	msg = wtc.recv(t, "g")
+	require.Equal(t, "initial", msg.Event)
+	require.Equal(t, "foo", msg.Data.(map[string]any)["text"])
+
+	wtc.send(t, &patchy.WSRequest{Ref: "u", Op: "update", Type: "testtype", ID: id, Obj: json.RawMessage(`{"text":"bar"}`)})
+
+	msg = wtc.recv(t, "u")
+	require.Equal(t, "result", msg.Event)
+	require.Equal(t, 200, msg.Status)
+	require.Equal(t, "bar", msg.Data.(map[string]any)["text"])
+
+	msg = wtc.recv(t, "g")
+	require.Equal(t, "update", msg.Event)
+	require.Equal(t, "bar", msg.Data.(map[string]any)["text"])
+
+	wtc.send(t, &patchy.WSRequest{Ref: "g", Op: "unsubscribe"})
+
+	msg = wtc.recv(t, "g")
+	require.Equal(t, "end", msg.Event)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "d", Op: "delete", Type: "testtype", ID: id})
+
+	msg = wtc.recv(t, "d")
+	require.Equal(t, "result", msg.Event)
+	require.Equal(t, 204, msg.Status)
+
+	for {
+		msg = wtc.recv(t, "l")
+		require.Equal(t, "list", msg.Event)
+
+		if len(msg.Data.([]any)) == 0 {
+			break
+		}
+	}
+}
+
+func TestWebSocketNotModified(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	created, err := patchy.Create[testType](ctx, ta.api, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	wtc := ta.ws(t, "")
+	defer wtc.close()
+
+	wtc.send(t, &patchy.WSRequest{Ref: "g", Op: "streamGet", Type: "testtype", ID: created.ID, IfNoneMatch: created.ETag})
+
+	msg := wtc.recv(t, "g")
+	require.Equal(t, "notModified", msg.Event)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "l", Op: "streamList", Type: "testtype", Params: url.Values{"_stream": {"diff"}}})
+
+	msg = wtc.recv(t, "l")
+	require.Equal(t, "add", msg.Event)
+	require.Equal(t, created.ID, msg.Data.(map[string]any)["id"])
+
+	msg = wtc.recv(t, "l")
+	require.Equal(t, "sync", msg.Event)
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	wtc := ta.ws(t, "")
+	defer wtc.close()
+
+	wtc.send(t, &patchy.WSRequest{Ref: "a", Op: "bogus"})
+
+	msg := wtc.recv(t, "a")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 400, msg.Status)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "b", Op: "streamList", Type: "doesnotexist"})
+
+	msg = wtc.recv(t, "b")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 404, msg.Status)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "c", Op: "streamList", Type: "testtype"})
+
+	msg = wtc.recv(t, "c")
+	require.Equal(t, "list", msg.Event)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "c", Op: "streamList", Type: "testtype"})
+
+	msg = wtc.recv(t, "c")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 400, msg.Status)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "d", Op: "streamList", Type: "testtype", Params: url.Values{"_heartbeat": {"1ms"}}})
+
+	msg = wtc.recv(t, "d")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 400, msg.Status)
+
+	// Never started, so no end; the ref is free again
+	wtc.send(t, &patchy.WSRequest{Ref: "d", Op: "streamList", Type: "testtype"})
+
+	msg = wtc.recv(t, "d")
+	require.Equal(t, "list", msg.Event)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "e", Op: "update", Type: "testtype", Obj: json.RawMessage(`{"text":"foo"}`)})
+
+	msg = wtc.recv(t, "e")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 400, msg.Status)
+
+	err := websocket.Message.Send(wtc.conn, `{"ref":`)
+	require.NoError(t, err)
+
+	msg = wtc.recv(t, "")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 400, msg.Status)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		Get("_ws")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+
+	ta.api.SetCORSPolicy(&patchy.CORSPolicy{
+		Origins: []string{"https://app.example.com"},
+	})
+
+	wtc := ta.ws(t, "https://app.example.com")
+	wtc.close()
+
+	url := strings.Replace(ta.baseURL, "https://", "wss://", 1) + "_ws"
+
+	cfg, err := websocket.NewConfig(url, "https://evil.example.com")
+	require.NoError(t, err)
+
+	cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+
+	_, err = websocket.DialConfig(cfg)
+	require.Error(t, err)
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	created, err := patchy.Create[testType](ctx, ta.api, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	getRef := fmt.Sprintf("testtype/%s", created.ID)
+	listRef := "testtype?_stream=diff"
+
+	sts := ta.subscribe(t, url.Values{
+		"get":  {getRef},
+		"list": {listRef},
+	})
+	defer sts.close()
+
+	ev := sts.next(t)
+	require.Equal(t, "open", ev.event)
+
+	sid := ev.params["subscription"]
+	require.NotEmpty(t, sid)
+
+	ev = sts.recv(t, getRef)
+	require.Equal(t, "initial", ev.event)
+	require.Contains(t, ev.data, `"text":"foo"`)
+
+	ev = sts.recv(t, listRef)
+	require.Equal(t, "add", ev.event)
+
+	ev = sts.recv(t, listRef)
+	require.Equal(t, "sync", ev.event)
+
+	resp, err := ta.r().
+		SetBody(&patchy.WSRequest{Ref: "l", Op: "streamList", Type: "testtype"}).
+		SetPathParam("id", sid).
+		Post("_subscribe/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+
+	ev = sts.recv(t, "l")
+	require.Equal(t, "list", ev.event)
+	require.Contains(t, ev.data, `"text":"foo"`)
+
+	_, err = patchy.Update[testType](ctx, ta.api, created.ID, &testType{Text: "bar"}, nil)
+	require.NoError(t, err)
+
+	ev = sts.recv(t, getRef)
+	require.Equal(t, "update", ev.event)
+	require.Contains(t, ev.data, `"text":"bar"`)
+
+	ev = sts.recv(t, "l")
+	require.Equal(t, "list", ev.event)
+	require.Contains(t, ev.data, `"text":"bar"`)
+
+	resp, err = ta.r().
+		SetBody(&patchy.WSRequest{Ref: getRef, Op: "unsubscribe"}).
+		SetPathParam("id", sid).
+		Post("_subscribe/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+
+	ev = sts.recv(t, getRef)
+	require.Equal(t, "end", ev.event)
+
+	resp, err = ta.r().
+		SetBody(&patchy.WSRequest{Ref: "l", Op: "streamList", Type: "testtype"}).
+		SetPathParam("id", sid).
+		Post("_subscribe/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetBody(&patchy.WSRequest{Ref: "x", Op: "streamList", Type: "doesnotexist"}).
+		SetPathParam("id", sid).
+		Post("_subscribe/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+}
+
+func TestSubscribeStreamLimit(t *testing.T) {
+	t.Parallel()
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithLimits(&patchy.Limits{MaxStreamsPerPrincipal: 1}),
+		patchy.WithListen(&patchy.ListenConfig{Bind: "[::]:0", TLS: "self"}),
+	)
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	sts := ta.subscribe(t, url.Values{"list": {"testtype"}})
+	defer sts.close()
+
+	ev := sts.next(t)
+	require.Equal(t, "open", ev.event)
+
+	sid := ev.params["subscription"]
+
+	ev = sts.recv(t, "testtype")
+	require.Equal(t, "list", ev.event)
+
+	// Each subscription is a stream, even on one connection
+	resp, err := ta.r().
+		SetBody(&patchy.WSRequest{Ref: "l", Op: "streamList", Type: "testtype"}).
+		SetPathParam("id", sid).
+		Post("_subscribe/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 429, resp.StatusCode())
+
+	wtc := ta.ws(t, "")
+	defer wtc.close()
+
+	wtc.send(t, &patchy.WSRequest{Ref: "w", Op: "streamList", Type: "testtype"})
+
+	msg := wtc.recv(t, "w")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 429, msg.Status)
+
+	resp, err = ta.r().
+		SetBody(&patchy.WSRequest{Ref: "testtype", Op: "unsubscribe"}).
+		SetPathParam("id", sid).
+		Post("_subscribe/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+
+	ev = sts.recv(t, "testtype")
+	require.Equal(t, "end", ev.event)
+
+	// Unsubscribing frees the slot
+	require.Eventually(t, func() bool {
+		wtc.send(t, &patchy.WSRequest{Ref: "w", Op: "streamList", Type: "testtype"})
+		return wtc.recv(t, "w").Event == "list"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRateLimitRoutes(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	api, err := patchy.New(
+		patchy.WithMemoryStore(),
+		patchy.WithLimits(&patchy.Limits{
+			RouteRateLimit: map[string]*patchy.RateLimit{
+				"*/login":        {Rate: 0.01, Burst: 1},
+				"*/rotate":       {Rate: 0.01, Burst: 1},
+				"testtype/list":  {Rate: 0.01, Burst: 1},
+				"testtypeb/list": {Rate: 0.01, Burst: 1},
+				"maytype/list":   {Rate: 0.01, Burst: 1},
+			},
+		}),
+		patchy.WithListen(&patchy.ListenConfig{Bind: "[::]:0", TLS: "self"}),
+	)
+	require.NoError(t, err)
+
+	ta := newTestAPIInt(t, api, "https")
+	defer ta.shutdown(t)
+
+	key, _, err := patchy.CreateAPIKey[apiKeyType](ctx, ta.api, &apiKeyType{Name: "foo"})
+	require.NoError(t, err)
+
+	for _, status := range []int{200, 429} {
+		resp, err := ta.r().
+			SetPathParam("id", key.ID).
+			Post("apikeytype/{id}/_rotate")
+		require.NoError(t, err)
+		require.Equal(t, status, resp.StatusCode(), resp.String())
+	}
+
+	// Each subscription takes a token, whichever way it's added
+	sts := ta.subscribe(t, url.Values{"list": {"testtype"}})
+	defer sts.close()
+
+	ev := sts.next(t)
+	require.Equal(t, "open", ev.event)
+
+	sid := ev.params["subscription"]
+
+	for _, status := range []int{204, 429} {
+		resp, err := ta.r().
+			SetBody(&patchy.WSRequest{Ref: "b", Op: "streamList", Type: "testtypeb"}).
+			SetPathParam("id", sid).
+			Post("_subscribe/{id}")
+		require.NoError(t, err)
+		require.Equal(t, status, resp.StatusCode(), resp.String())
+
+		// Refs are freed by unsubscribing
+		resp, err = ta.r().
+			SetBody(&patchy.WSRequest{Ref: "b", Op: "unsubscribe"}).
+			SetPathParam("id", sid).
+			Post("_subscribe/{id}")
+		require.NoError(t, err)
+		require.Equal(t, 204, resp.StatusCode())
+	}
+
+	wtc := ta.ws(t, "")
+	defer wtc.close()
+
+	wtc.send(t, &patchy.WSRequest{Ref: "m1", Op: "streamList", Type: "maytype"})
+	require.Equal(t, "list", wtc.recv(t, "m1").Event)
+
+	wtc.send(t, &patchy.WSRequest{Ref: "m2", Op: "streamList", Type: "maytype"})
+
+	msg := wtc.recv(t, "m2")
+	require.Equal(t, "error", msg.Event)
+	require.Equal(t, 429, msg.Status)
+
+	// Last, since the session cookie applies to later requests
+	for _, status := range []int{200, 429} {
+		resp, err := ta.r().
+			SetBasicAuth("foo", "abcd").
+			Post("_login")
+		require.NoError(t, err)
+		require.Equal(t, status, resp.StatusCode(), resp.String())
+	}
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetQueryParam("get", "doesnotexist/foo").
+		Get("_subscribe")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetQueryParam("get", "testtype").
+		Get("_subscribe")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetQueryParam("list", "testtype?_heartbeat=1ms").
+		Get("_subscribe")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetBody(&patchy.WSRequest{Ref: "l", Op: "streamList", Type: "testtype"}).
+		Post("_subscribe/doesnotexist")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+}
+
+func TestStreamPatch(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	created, err := patchy.Create[testType](ctx, ta.api, &testType{Text: "foo", Num: 1})
+	require.NoError(t, err)
+
+	listRef := "testtype?_stream=patch"
+
+	sts := ta.subscribe(t, url.Values{
+		"list": {listRef},
+	})
+	defer sts.close()
+
+	ev := sts.next(t)
+	require.Equal(t, "open", ev.event)
+
+	resp, err := ta.r().
+		SetBody(&patchy.WSRequest{
+			Ref:    "g",
+			Op:     "streamGet",
+			Type:   "testtype",
+			ID:     created.ID,
+			Params: url.Values{"_stream": {"patch"}},
+		}).
+		SetPathParam("id", ev.params["subscription"]).
+		Post("_subscribe/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+
+	ev = sts.recv(t, listRef)
+	require.Equal(t, "add", ev.event)
+
+	ev = sts.recv(t, listRef)
+	require.Equal(t, "sync", ev.event)
+
+	ev = sts.recv(t, "g")
+	require.Equal(t, "initial", ev.event)
+
+	updated, err := patchy.Update[testType](ctx, ta.api, created.ID, &testType{Text: "bar", Num: 1}, nil)
+	require.NoError(t, err)
+
+	ev = sts.recv(t, listRef)
+	require.Equal(t, "patch", ev.event)
+	require.Equal(t, created.ETag, ev.params["base"])
+	require.Equal(t, updated.ETag, ev.params["target"])
+	require.Equal(t, "0", ev.params["old-position"])
+	require.Equal(t, "0", ev.params["new-position"])
+	require.Contains(t, ev.data, `"text":"bar"`)
+	require.NotContains(t, ev.data, `"num"`)
+
+	ev = sts.recv(t, listRef)
+	require.Equal(t, "sync", ev.event)
+
+	ev = sts.recv(t, "g")
+	require.Equal(t, "patch", ev.event)
+	require.Equal(t, created.ETag, ev.params["base"])
+	require.Equal(t, updated.ETag, ev.params["target"])
+	require.Equal(t, updated.ETag, ev.params["id"])
+	require.Contains(t, ev.data, `"text":"bar"`)
+	require.NotContains(t, ev.data, `"num"`)
+
+	resp, err = ta.r().
+		SetHeader("Accept", "text/event-stream").
+		SetQueryParam("_stream", "diff").
+		SetPathParam("id", created.ID).
+		Get("testtype/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+}
+
+func TestPasswordHashFromClient(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	// Valid format, but far too slow to verify
+	costly := "$2a$31$" + strings.Repeat("a", 53)
+
+	resp, err := ta.r().
+		SetBody(&authBasicType{User: "bar", Pass: costly}).
+		Post("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	// Hashed like any other password
+	stored := getAuthBasicUser(ctx, t, ta, "bar")
+	require.NotEqual(t, costly, stored.Pass)
+
+	resp, err = ta.r().
+		SetBasicAuth("bar", costly).
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	// Direct writes may store hashes, but costly ones aren't verified
+	_, err = patchy.Create[authBasicType](ctx, ta.api, &authBasicType{
+		User: "baz",
+		Pass: costly,
+	})
+	require.NoError(t, err)
+	require.Equal(t, costly, getAuthBasicUser(ctx, t, ta, "baz").Pass)
+
+	resp, err = ta.r().
+		SetBasicAuth("baz", "abcd").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.Equal(t, 401, resp.StatusCode())
+}
+
+func TestLoginLockoutUser(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ta.api.SetLoginLimits(&patchy.LoginLimits{
+		UserFailures: 3,
+		Window:       time.Minute,
+		Lockout:      time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := ta.r().
+			SetBasicAuth("foo", "bcde").
+			Get("authbasictype")
+		require.NoError(t, err)
+		require.Equal(t, 401, resp.StatusCode())
+		require.Empty(t, resp.Header().Get("Retry-After"))
+	}
+
+	resp, err := ta.r().
+		SetBasicAuth("foo", "bcde").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.Equal(t, 401, resp.StatusCode())
+	require.Equal(t, "60", resp.Header().Get("Retry-After"))
+
+	resp, err = ta.r().
+		SetBasicAuth("foo", "abcd").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.Equal(t, 429, resp.StatusCode())
+	require.NotEmpty(t, resp.Header().Get("Retry-After"))
+	require.Contains(t, resp.String(), "too many failed login attempts")
+
+	lockouts := ta.api.LoginLockouts()
+	require.Len(t, lockouts, 1)
+	require.Equal(t, "foo", lockouts[0].User)
+
+	ta.api.ClearLoginLockoutUser("foo")
+	require.Empty(t, ta.api.LoginLockouts())
+
+	resp, err = ta.r().
+		SetBasicAuth("foo", "abcd").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+}
+
+func TestLoginLockoutAddr(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ta.api.SetLoginLimits(&patchy.LoginLimits{
+		AddrFailures: 2,
+		Window:       time.Minute,
+		Lockout:      time.Minute,
+	})
+
+	for _, user := range []string{"bar", "baz"} {
+		resp, err := ta.r().
+			SetBasicAuth(user, "abcd").
+			Get("authbasictype")
+		require.NoError(t, err)
+		require.Equal(t, 401, resp.StatusCode())
+	}
+
+	resp, err := ta.r().
+		SetBasicAuth("foo", "abcd").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.Equal(t, 429, resp.StatusCode())
+
+	lockouts := ta.api.LoginLockouts()
+	require.Len(t, lockouts, 1)
+	require.NotEmpty(t, lockouts[0].Addr)
+
+	ta.api.ClearLoginLockoutAddr(lockouts[0].Addr)
+
+	resp, err = ta.r().
+		SetBasicAuth("foo", "abcd").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+}
+
+func TestSession(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ta.api.HandlerFunc("GET", "/_session", func(w http.ResponseWriter, r *http.Request) {
+		session, _ := r.Context().Value(patchy.ContextAuthSession).(*sessionType)
+		if session != nil {
+			_, _ = w.Write([]byte(session.User))
+		}
+	})
+
+	resp, err := ta.r().
+		SetBasicAuth("foo", "abcd").
+		Post("_login")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	info := &patchy.SessionInfo{}
+	require.NoError(t, json.Unmarshal(resp.Body(), info))
+	require.NotEmpty(t, info.CSRFToken)
+
+	resp, err = ta.r().Get("_session")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+	require.NotEmpty(t, resp.String())
+
+	session, err := patchy.Get[sessionType](context.Background(), ta.api, info.ID, nil)
+	require.NoError(t, err)
+	require.Empty(t, session.Token)
+	require.Empty(t, session.CSRF)
+	require.Equal(t, resp.String(), session.User)
+
+	resp, err = ta.r().
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode())
+	require.Contains(t, resp.String(), "CSRF token missing or mismatch")
+
+	resp, err = ta.r().
+		SetHeader(patchy.CSRFHeader, "bogus").
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetHeader(patchy.CSRFHeader, info.CSRFToken).
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	resp, err = ta.r().
+		SetHeader(patchy.CSRFHeader, info.CSRFToken).
+		Post("_logout")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+
+	resp, err = ta.r().Get("_session")
+	require.NoError(t, err)
+	require.Empty(t, resp.String())
+
+	session, err = patchy.Get[sessionType](context.Background(), ta.api, info.ID, nil)
+	require.NoError(t, err)
+	require.Nil(t, session)
+}
+
+func TestSessionRevoke(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	resp, err := ta.r().
+		SetBasicAuth("foo", "abcd").
+		Post("_login")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	sessions, err := patchy.List[sessionType](ctx, ta.api, nil)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	err = ta.api.RevokeSessions(ctx, sessions[0].User)
+	require.NoError(t, err)
+
+	sessions, err = patchy.List[sessionType](ctx, ta.api, nil)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// Revoked cookie is ignored (and cleared), not rejected
+	resp, err = ta.r().Get("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+}
+
+func TestCORSPolicy(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetHeader("Origin", "https://app.example.com").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, "*", resp.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, resp.Header().Get("Access-Control-Allow-Credentials"))
+
+	ta.api.SetCORSPolicy(&patchy.CORSPolicy{
+		Origins:     []string{"https://app.example.com"},
+		Credentials: true,
+	})
+
+	resp, err = ta.r().
+		SetHeader("Origin", "https://app.example.com").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, "https://app.example.com", resp.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", resp.Header().Get("Access-Control-Allow-Credentials"))
+
+	resp, err = ta.r().
+		SetHeader("Origin", "https://evil.example.com").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, resp.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSPreflight(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ta.api.SetCORSPolicy(&patchy.CORSPolicy{
+		Origins: []string{"https://*.example.com"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Content-Type", "X-CSRF-Token"},
+		MaxAge:  10 * time.Minute,
+	})
+
+	resp, err := ta.r().
+		SetHeader("Origin", "https://app.example.com").
+		SetHeader("Access-Control-Request-Method", "POST").
+		Options("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+	require.Equal(t, "https://app.example.com", resp.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, POST", resp.Header().Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "Content-Type, X-CSRF-Token", resp.Header().Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "600", resp.Header().Get("Access-Control-Max-Age"))
+
+	resp, err = ta.r().
+		SetHeader("Origin", "https://app.example.com").
+		SetHeader("Access-Control-Request-Method", "PUT").
+		Options("_debug")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+	require.Equal(t, "GET", resp.Header().Get("Access-Control-Allow-Methods"))
+
+	resp, err = ta.r().
+		SetHeader("Origin", "https://app.example.org").
+		SetHeader("Access-Control-Request-Method", "POST").
+		Options("testtype")
+	require.NoError(t, err)
+	require.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, resp.Header().Get("Access-Control-Allow-Methods"))
+
+	resp, err = ta.r().
+		SetHeader("Origin", "https://app.example.com").
+		SetHeader("Access-Control-Request-Method", "GET").
+		Options("doesnotexist")
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode())
+	require.Empty(t, resp.Header().Get("Access-Control-Allow-Methods"))
+}
+
+func TestExportImport(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	src := newTestAPI(t)
+	defer src.shutdown(t)
+
+	dst := newTestAPI(t)
+	defer dst.shutdown(t)
+
+	admin := func(r *http.Request, _ *patchy.API) error {
+		if r.Context().Value(patchy.ContextAuthBasic) == nil {
+			return fmt.Errorf("basic auth required")
+		}
+
+		return nil
+	}
+
+	resp, err := src.r().
+		SetBasicAuth("foo", "abcd").
+		Get("_export")
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode())
+
+	src.api.SetAdminHook(admin)
+	dst.api.SetAdminHook(admin)
+
+	restores := map[string]*patchy.AuditRecord{}
+	mu := sync.Mutex{}
+
+	dst.api.AddAuditSink(patchy.AuditSinkFunc(func(_ context.Context, rec *patchy.AuditRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if rec.Operation == "restore" {
+			restores[rec.Type] = rec
+		}
+
+		return nil
+	}))
+
+	created, err := patchy.Create[testType](ctx, src.api, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	resp, err = src.r().
+		Get("_export")
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode())
+
+	resp, err = src.r().
+		SetBasicAuth("foo", "abcd").
+		Get("_export")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+	require.Equal(t, "application/x-ndjson", resp.Header().Get("Content-Type"))
+
+	resp, err = dst.r().
+		SetBasicAuth("foo", "abcd").
+		SetHeader("Content-Type", "application/x-ndjson").
+		SetBody(resp.Body()).
+		Post("_import")
+	require.NoError(t, err)
+	require.Equal(t, 204, resp.StatusCode())
+
+	get, err := patchy.Get[testType](ctx, dst.api, created.ID, nil)
+	require.NoError(t, err)
+	require.NotNil(t, get)
+	require.Equal(t, "foo", get.Text)
+
+	// One audit record per restored type, with the principal
+	mu.Lock()
+	defer mu.Unlock()
+
+	rec := restores["testtype"]
+	require.NotNil(t, rec)
+	require.Equal(t, "http", rec.Source)
+	require.Equal(t, "basic", rec.AuthMethod)
+	require.NotEmpty(t, rec.PrincipalID)
+	require.Equal(t, "success", rec.Result)
+}
+
+func TestBulk(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	foo, err := patchy.Create[testType](ctx, ta.api, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	bar, err := patchy.Create[testType](ctx, ta.api, &testType{Text: "bar"})
+	require.NoError(t, err)
+
+	body := strings.Join([]string{
+		`{"op":"create","obj":{"text":"baz"}}`,
+		`{"op":"update","id":"` + foo.ID + `","obj":{"text":"foo2"}}`,
+		`{"op":"replace","id":"` + bar.ID + `","ifMatch":"wrong","obj":{"text":"bar2"}}`,
+		`{"op":"delete","id":"` + bar.ID + `"}`,
+		`{"op":"delete","id":"doesnotexist"}`,
+		`{"op":"frob"}`,
+		`{"op":"update","id":"` + foo.ID + `","obj":{"text":"foo3"}}`,
+	}, "\n")
+
+	resp, err := ta.r().
+		SetHeader("Content-Type", "application/x-ndjson").
+		SetBody(body).
+		Post("testtype/_bulk")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+	require.Equal(t, "application/x-ndjson", resp.Header().Get("Content-Type"))
+
+	results := []*patchy.BulkResult{}
+
+	dec := json.NewDecoder(bytes.NewReader(resp.Body()))
+
+	for dec.More() {
+		res := &patchy.BulkResult{}
+		require.NoError(t, dec.Decode(res))
+		results = append(results, res)
+	}
+
+	require.Len(t, results, 7)
+
+	for i, res := range results {
+		require.Equal(t, i, res.Index)
+	}
+
+	require.Equal(t, 200, results[0].Status)
+	require.NotEmpty(t, results[0].ID)
+	require.NotEmpty(t, results[0].ETag)
+	require.Equal(t, 200, results[1].Status)
+	require.Equal(t, 412, results[2].Status)
+	require.NotEmpty(t, results[2].Error)
+	require.Equal(t, 204, results[3].Status)
+	require.Equal(t, 404, results[4].Status)
+	require.Equal(t, 400, results[5].Status)
+	require.Equal(t, 200, results[6].Status)
+
+	get, err := patchy.Get[testType](ctx, ta.api, foo.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "foo3", get.Text)
+	require.EqualValues(t, 3, get.Generation)
+	require.Equal(t, results[6].ETag, get.ETag)
+
+	get, err = patchy.Get[testType](ctx, ta.api, bar.ID, nil)
+	require.NoError(t, err)
+	require.Nil(t, get)
+
+	get, err = patchy.Get[testType](ctx, ta.api, results[0].ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "baz", get.Text)
+}
+
+func TestBulkCoalesce(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	stream, err := patchy.StreamList[testType](ctx, ta.api, nil)
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	require.Len(t, stream.Read(), 0)
+
+	ops := []map[string]any{}
+	for i := 0; i < 1200; i++ {
+		ops = append(ops, map[string]any{
+			"op":  "create",
+			"obj": map[string]any{"num": i},
+		})
+	}
+
+	resp, err := ta.r().
+		SetBody(ops).
+		Post("testtype/_bulk")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+	require.Equal(t, 1200, strings.Count(string(resp.Body()), "\n"))
+
+	updates := 0
+
+	for {
+		list := stream.Read()
+		require.NotNil(t, list)
+
+		updates++
+
+		if len(list) == 1200 {
+			break
+		}
+	}
+
+	require.LessOrEqual(t, updates, 3)
+}
+
+func TestBulkInvalid(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetHeader("Content-Type", "text/plain").
+		SetBody(`[]`).
+		Post("testtype/_bulk")
+	require.NoError(t, err)
+	require.Equal(t, 415, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetBody(`[{"op":"create","obj":{"text":"foo"}}, {"op":`).
+		Post("testtype/_bulk")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+
+	lines := strings.Split(strings.TrimSpace(string(resp.Body())), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[1], `"status":400`)
+
+	resp, err = ta.r().
+		SetBody(`{}`).
+		Post("testtype/foo")
+	require.NoError(t, err)
+	require.Equal(t, 405, resp.StatusCode())
+	require.NotContains(t, resp.Header().Get("Allow"), "POST")
+
+	resp, err = ta.r().
+		Get("testtype/_bulk")
+	require.NoError(t, err)
+	require.Equal(t, 405, resp.StatusCode())
+	require.Equal(t, "OPTIONS, POST", resp.Header().Get("Allow"))
+
+	resp, err = ta.r().
+		Options("testtype/_bulk")
+	require.NoError(t, err)
+	require.Equal(t, "OPTIONS, POST", resp.Header().Get("Allow"))
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	create, token, err := patchy.CreateAPIKey[apiKeyType](ctx, ta.api, &apiKeyType{
+		Name:   "foo",
+		Scopes: []string{"read:testtype"},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	require.Empty(t, create.Hash)
+
+	get, err := patchy.Get[apiKeyType](ctx, ta.api, create.ID, nil)
+	require.NoError(t, err)
+	require.Empty(t, get.Hash)
+	require.Equal(t, create.Prefix, get.Prefix)
+
+	resp, err := ta.r().
+		SetHeader("Authorization", "ApiKey "+token).
+		Get("testtype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	// Recording use doesn't change the key's version
+	used, err := patchy.Get[apiKeyType](ctx, ta.api, create.ID, nil)
+	require.NoError(t, err)
+	require.NotNil(t, used.LastUsed)
+	require.Equal(t, get.ETag, used.ETag)
+	require.Equal(t, get.Generation, used.Generation)
+
+	// Only single gets fill it in
+	keys, err := patchy.List[apiKeyType](ctx, ta.api, nil)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Nil(t, keys[0].LastUsed)
+
+	resp, err = ta.r().
+		SetHeader("Authorization", "ApiKey "+token).
+		SetBody(&testType{Text: "foo"}).
+		Post("testtype")
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+	require.Contains(t, resp.String(), "insufficient scope")
+
+	rotated, err := patchy.RotateAPIKey[apiKeyType](ctx, ta.api, create.ID, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, token, rotated)
+
+	resp, err = ta.r().
+		SetHeader("Authorization", "ApiKey "+token).
+		Get("testtype")
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	get, err = patchy.Get[apiKeyType](ctx, ta.api, create.ID, nil)
+	require.NoError(t, err)
+	require.NotNil(t, get.LastUsed)
+}
+
+func TestPasswordHash(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	create, err := patchy.Create[authBasicType](ctx, ta.api, &authBasicType{
+		User: "bar",
+		Pass: "bcde",
+	})
+	require.NoError(t, err)
+	require.Empty(t, create.Pass)
+
+	stored := getAuthBasicUser(ctx, t, ta, "bar")
+	require.NoError(t, bcrypt.CompareHashAndPassword([]byte(stored.Pass), []byte("bcde")))
+
+	resp, err := ta.r().
+		SetBasicAuth("bar", "bcde").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	// Replace of a read object keeps the existing hash
+	create.User = "baz"
+
+	_, err = patchy.Replace[authBasicType](ctx, ta.api, create.ID, create, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, stored.Pass, getAuthBasicUser(ctx, t, ta, "baz").Pass)
+
+	_, err = patchy.UpdateMap[authBasicType](ctx, ta.api, create.ID, map[string]any{"pass": "cdef"}, nil)
+	require.NoError(t, err)
+
+	resp, err = ta.r().
+		SetBasicAuth("baz", "cdef").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+}
+
+func TestPasswordRehash(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	ta.api.SetPasswordHasher(patchy.NewBcryptHasher(bcrypt.MinCost))
+
+	_, err := patchy.Create[authBasicType](ctx, ta.api, &authBasicType{
+		User: "bar",
+		Pass: "bcde",
+	})
+	require.NoError(t, err)
+
+	before := getAuthBasicUser(ctx, t, ta, "bar")
+
+	cost, err := bcrypt.Cost([]byte(before.Pass))
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.MinCost, cost)
+
+	ta.api.SetPasswordHasher(patchy.NewBcryptHasher(bcrypt.MinCost + 1))
+
+	resp, err := ta.r().
+		SetBasicAuth("bar", "bcde").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	after := getAuthBasicUser(ctx, t, ta, "bar")
+
+	cost, err = bcrypt.Cost([]byte(after.Pass))
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.MinCost+1, cost)
+
+	// Not a user write
+	require.Equal(t, before.Generation, after.Generation)
+
+	ta.api.SetPasswordHasher(&patchy.Argon2idHasher{
+		Time:    1,
+		Memory:  1024,
+		Threads: 1,
+		KeyLen:  32,
+		SaltLen: 16,
+	})
+
+	resp, err = ta.r().
+		SetBasicAuth("bar", "bcde").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	require.True(t, strings.HasPrefix(getAuthBasicUser(ctx, t, ta, "bar").Pass, "$argon2id$"))
+
+	resp, err = ta.r().
+		SetBasicAuth("bar", "bcde").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.String())
+
+	resp, err = ta.r().
+		SetBasicAuth("bar", "cdef").
+		Get("authbasictype")
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+}
+
+func getAuthBasicUser(ctx context.Context, t *testing.T, ta *testAPI, user string) *authBasicType {
+	list, err := patchy.List[authBasicType](
+		context.WithValue(ctx, patchy.ContextAuthBasicLookup, true),
+		ta.api,
+		&patchy.ListOpts{
+			Filters: []patchy.Filter{
+				{
+					Path:  "user",
+					Op:    "eq",
+					Value: user,
+				},
+			},
+		},
+	)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	return list[0]
+}
+
+func TestStreamListDebounceInvalid(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetHeader("Accept", "text/event-stream").
+		SetQueryParam("_debounce", "-1s").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetHeader("Accept", "text/event-stream").
+		SetQueryParam("_maxRate", "fast").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+}
+
+func TestStreamListMaxDuration(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	start := time.Now()
+
+	// The server closes the stream, so the body can be read to the end
+	resp, err := ta.r().
+		SetHeader("Accept", "text/event-stream").
+		SetQueryParam("_heartbeat", "100ms").
+		SetQueryParam("_maxDuration", "500ms").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+
+	body := string(resp.Body())
+	require.GreaterOrEqual(t, strings.Count(body, "event: heartbeat\n"), 3)
+	require.True(t, strings.HasSuffix(body, "event: reconnect\n\n"), body)
+}
+
+func TestStreamGetMaxDuration(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	// Clients can only shorten the server limit
+	ta.api.SetStreamMaxDuration(200 * time.Millisecond)
+
+	created, err := patchy.Create[testType](ctx, ta.api, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	resp, err := ta.r().
+		SetHeader("Accept", "text/event-stream").
+		SetQueryParam("_maxDuration", "1h").
+		SetPathParam("id", created.ID).
+		Get("testtype/{id}")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode())
+
+	body := string(resp.Body())
+	require.Contains(t, body, "event: initial\n")
+	require.True(t, strings.HasSuffix(body, "event: reconnect\n\n"), body)
+}
+
+func TestStreamTimingInvalid(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	resp, err := ta.r().
+		SetHeader("Accept", "text/event-stream").
+		SetQueryParam("_heartbeat", "1ms").
+		Get("testtype")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+
+	resp, err = ta.r().
+		SetHeader("Accept", "text/event-stream").
+		SetQueryParam("_maxDuration", "-1s").
+		Get("testtype/foo")
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode())
+}
@@ -0,0 +1,585 @@
+package patchy
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/store"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes an API for New. It can be built with Option functions or
+// loaded with LoadConfig. Zero values keep the defaults.
+type Config struct {
+	Store StoreConfig `yaml:"store"`
+
+	// Without Listen, call a Listen method before Serve
+	Listen []*ListenConfig `yaml:"listen"`
+
+	// For listeners with TLS "acme"
+	ACME *ACMEConfig `yaml:"acme"`
+
+	StripPrefix string `yaml:"stripPrefix"`
+
+	CORS *CORSPolicy `yaml:"cors"`
+
+	Auth AuthConfig `yaml:"auth"`
+
+	Limits *Limits `yaml:"limits"`
+
+	Streams StreamConfig `yaml:"streams"`
+
+	Events EventConfig `yaml:"events"`
+
+	OpenAPIInfo *OpenAPIInfo `yaml:"openAPIInfo"`
+}
+
+type StoreConfig struct {
+	// sqlite (the default), sql, postgres (sql with Driver "postgres") or
+	// memory
+	Type string `yaml:"type"`
+
+	// sqlite connection string
+	DBName string `yaml:"dbName"`
+
+	// database/sql driver name for sql; the driver must be registered by
+	// the program, e.g. by importing github.com/lib/pq
+	Driver string `yaml:"driver"`
+
+	// Data source name for sql and postgres
+	DSN string `yaml:"dsn"`
+
+	// Overrides Type; can't be loaded
+	Store Store `yaml:"-"`
+}
+
+type ListenConfig struct {
+	// Key in Addr(); defaults to the listening address
+	Name string `yaml:"name"`
+
+	// tcp (the default) or unix, with Bind a socket path
+	Network string `yaml:"network"`
+
+	Bind string `yaml:"bind"`
+
+	// none, self (a self-signed certificate), files or acme (see
+	// ACMEConfig)
+	TLS string `yaml:"tls"`
+
+	// For TLS files, which are reloaded when they change
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// 1.2 or 1.3 (the default)
+	TLSMinVersion string `yaml:"tlsMinVersion"`
+
+	// Path prefixes served, after StripPrefix (e.g. /_health); empty serves
+	// all routes
+	Routes []string `yaml:"routes"`
+
+	// Auth schemes accepted: basic, bearer, apiKey and session; empty
+	// accepts all, and [none] accepts none
+	Auth []string `yaml:"auth"`
+}
+
+type AuthConfig struct {
+	SessionTTL  time.Duration `yaml:"sessionTTL"`
+	LoginLimits *LoginLimits  `yaml:"loginLimits"`
+
+	// For new authBasic password hashes
+	BcryptCost int `yaml:"bcryptCost"`
+}
+
+type StreamConfig struct {
+	Heartbeat   time.Duration `yaml:"heartbeat"`
+	MaxDuration time.Duration `yaml:"maxDuration"`
+}
+
+type EventConfig struct {
+	Targets []*EventTarget `yaml:"targets"`
+
+	// Run after the default hooks; can't be loaded
+	Hooks []event.Hook `yaml:"-"`
+}
+
+// EventTarget receives batches of events over HTTP
+type EventTarget struct {
+	URL         string            `yaml:"url"`
+	Headers     map[string]string `yaml:"headers"`
+	WritePeriod time.Duration     `yaml:"writePeriod"`
+}
+
+// Option changes the Config used by New. They apply in order, so later ones
+// override earlier ones.
+type Option func(*Config) error
+
+var (
+	ErrUnknownStoreType    = errors.New("unknown store type")
+	ErrUnknownConfigFormat = errors.New("unknown config file format")
+	ErrUnknownConfigEnv    = errors.New("unknown config environment variable")
+	ErrInvalidEnvLine      = errors.New("env line missing '='")
+)
+
+// Prefix for config environment variables, e.g. PATCHY_STORE_DBNAME
+const configEnvPrefix = "PATCHY_"
+
+const defaultEventWritePeriod = 5 * time.Second
+
+// New creates an API from opts. Without a store option, it uses sqlite
+// with an empty connection string.
+func New(opts ...Option) (*API, error) {
+	cfg := &Config{}
+
+	for _, opt := range opts {
+		err := opt(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewFromConfig(cfg)
+}
+
+func NewFromConfig(cfg *Config) (*API, error) {
+	sb, err := cfg.Store.open()
+	if err != nil {
+		return nil, err
+	}
+
+	api := newAPI(sb, cfg.Limits.withDefaults())
+
+	err = api.applyConfig(cfg)
+	if err != nil {
+		api.closeListeners()
+		sb.Close()
+		return nil, err
+	}
+
+	return api, nil
+}
+
+// WithConfig replaces the Config built so far
+func WithConfig(cfg *Config) Option {
+	return func(c *Config) error {
+		*c = *cfg
+		return nil
+	}
+}
+
+// WithConfigFile overlays the settings in a YAML, JSON or env file; see
+// LoadConfig
+func WithConfigFile(path string) Option {
+	return func(c *Config) error {
+		return c.load(path)
+	}
+}
+
+// WithEnv overlays settings from PATCHY_* environment variables, named as
+// in env files (see LoadConfig). Variables that don't name a setting are
+// ignored.
+func WithEnv() Option {
+	return func(c *Config) error {
+		return c.loadEnv(os.Environ(), false)
+	}
+}
+
+func WithSQLite(dbname string) Option {
+	return func(c *Config) error {
+		c.Store = StoreConfig{Type: "sqlite", DBName: dbname}
+		return nil
+	}
+}
+
+// WithSQL uses NewSQLStore with a database/sql driver registered by the
+// program
+func WithSQL(driver, dsn string) Option {
+	return func(c *Config) error {
+		c.Store = StoreConfig{Type: "sql", Driver: driver, DSN: dsn}
+		return nil
+	}
+}
+
+// WithMemoryStore stores objects only in memory; useful for tests
+func WithMemoryStore() Option {
+	return func(c *Config) error {
+		c.Store = StoreConfig{Type: "memory"}
+		return nil
+	}
+}
+
+func WithStore(sb Store) Option {
+	return func(c *Config) error {
+		c.Store = StoreConfig{Store: sb}
+		return nil
+	}
+}
+
+// WithListen adds a listener; it can be repeated
+func WithListen(lc *ListenConfig) Option {
+	return func(c *Config) error {
+		c.Listen = append(c.Listen, lc)
+		return nil
+	}
+}
+
+func WithACME(ac *ACMEConfig) Option {
+	return func(c *Config) error {
+		c.ACME = ac
+		return nil
+	}
+}
+
+func WithStripPrefix(prefix string) Option {
+	return func(c *Config) error {
+		c.StripPrefix = prefix
+		return nil
+	}
+}
+
+func WithCORSPolicy(policy *CORSPolicy) Option {
+	return func(c *Config) error {
+		c.CORS = policy
+		return nil
+	}
+}
+
+func WithAuth(auth *AuthConfig) Option {
+	return func(c *Config) error {
+		c.Auth = *auth
+		return nil
+	}
+}
+
+func WithLimits(limits *Limits) Option {
+	return func(c *Config) error {
+		c.Limits = limits
+		return nil
+	}
+}
+
+func WithStreams(streams *StreamConfig) Option {
+	return func(c *Config) error {
+		c.Streams = *streams
+		return nil
+	}
+}
+
+func WithEventTarget(target *EventTarget) Option {
+	return func(c *Config) error {
+		c.Events.Targets = append(c.Events.Targets, target)
+		return nil
+	}
+}
+
+func WithEventHook(hook event.Hook) Option {
+	return func(c *Config) error {
+		c.Events.Hooks = append(c.Events.Hooks, hook)
+		return nil
+	}
+}
+
+func WithOpenAPIInfo(info *OpenAPIInfo) Option {
+	return func(c *Config) error {
+		c.OpenAPIInfo = info
+		return nil
+	}
+}
+
+// LoadConfig reads a Config from a .yaml, .yml, .json or .env file. Env
+// files hold PATCHY_* variables named after the YAML keys, e.g.
+// PATCHY_LIMITS_MAXBODYSIZE=1048576. Their values are YAML, so lists and
+// maps can be written in flow style: PATCHY_CORS_ORIGINS=[a, b].
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+
+	err := cfg.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) load(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "read config failed: %s (%w)", path, err)
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".json":
+		// JSON is YAML
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+
+		err = dec.Decode(cfg)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "decode config failed: %s (%w)", path, err)
+		}
+
+		return nil
+
+	case ".env":
+		environ, err := parseEnvFile(raw)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "parse config failed: %s (%w)", path, err)
+		}
+
+		return cfg.loadEnv(environ, true)
+
+	default:
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", path, ErrUnknownConfigFormat)
+	}
+}
+
+// loadEnv overlays PATCHY_* entries of environ (KEY=VALUE strings). If
+// strict, entries that don't name a setting are errors.
+func (cfg *Config) loadEnv(environ []string, strict bool) error {
+	paths := map[string][]string{}
+	envPaths(reflect.TypeOf(cfg).Elem(), nil, paths)
+
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, kv := range environ {
+		key, val, _ := strings.Cut(kv, "=")
+
+		if !strings.HasPrefix(key, configEnvPrefix) {
+			continue
+		}
+
+		p, found := paths[strings.TrimPrefix(key, configEnvPrefix)]
+		if !found {
+			if !strict {
+				continue
+			}
+
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", key, ErrUnknownConfigEnv)
+		}
+
+		doc := yaml.Node{}
+
+		err := yaml.Unmarshal([]byte(val), &doc)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "parse %s failed (%w)", key, err)
+		}
+
+		valNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+		if len(doc.Content) > 0 {
+			valNode = doc.Content[0]
+		}
+
+		setYAMLPath(root, p, valNode)
+	}
+
+	err := root.Decode(cfg)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "decode config environment failed (%w)", err)
+	}
+
+	return nil
+}
+
+// envPaths maps env names (without prefix) to YAML key paths for fields of
+// t, recursing into structs
+func envPaths(t reflect.Type, prefix []string, paths map[string][]string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "" || key == "-" || !field.IsExported() {
+			continue
+		}
+
+		p := append(append([]string{}, prefix...), key)
+
+		ft := field.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+
+		if ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}) {
+			envPaths(ft, p, paths)
+			continue
+		}
+
+		paths[strings.ToUpper(strings.Join(p, "_"))] = p
+	}
+}
+
+func setYAMLPath(node *yaml.Node, p []string, val *yaml.Node) {
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value != p[0] {
+			continue
+		}
+
+		if len(p) == 1 {
+			node.Content[i+1] = val
+		} else {
+			setYAMLPath(node.Content[i+1], p[1:], val)
+		}
+
+		return
+	}
+
+	child := val
+
+	if len(p) > 1 {
+		child = &yaml.Node{Kind: yaml.MappingNode}
+		setYAMLPath(child, p[1:], val)
+	}
+
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: p[0]},
+		child,
+	)
+}
+
+// parseEnvFile reads KEY=VALUE lines, skipping blanks and # comments.
+// Values may be wrapped in matching quotes.
+func parseEnvFile(raw []byte) ([]string, error) {
+	environ := []string{}
+
+	scan := bufio.NewScanner(bytes.NewReader(raw))
+
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, val, found := strings.Cut(line, "=")
+		if !found {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", line, ErrInvalidEnvLine)
+		}
+
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		val = strings.TrimSpace(val)
+
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+
+		environ = append(environ, fmt.Sprintf("%s=%s", key, val))
+	}
+
+	return environ, scan.Err()
+}
+
+func (sc *StoreConfig) open() (Store, error) {
+	if sc.Store != nil {
+		return sc.Store, nil
+	}
+
+	switch sc.Type {
+	case "", "sqlite":
+		st, err := store.NewStore(sc.DBName)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewBusStore(st), nil
+
+	case "sql", "postgres":
+		driver := sc.Driver
+		if driver == "" && sc.Type == "postgres" {
+			driver = "postgres"
+		}
+
+		db, err := sql.Open(driver, sc.DSN)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "open %s failed (%w)", sc.Type, err)
+		}
+
+		err = db.Ping()
+		if err != nil {
+			db.Close()
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "connect %s failed (%w)", sc.Type, err)
+		}
+
+		return NewSQLStore(db), nil
+
+	case "memory":
+		return NewMemoryStore(), nil
+
+	default:
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", sc.Type, ErrUnknownStoreType)
+	}
+}
+
+func (api *API) applyConfig(cfg *Config) error {
+	if cfg.StripPrefix != "" {
+		api.SetStripPrefix(cfg.StripPrefix)
+	}
+
+	if cfg.CORS != nil {
+		api.SetCORSPolicy(cfg.CORS)
+	}
+
+	if cfg.Auth.SessionTTL != 0 {
+		api.SetSessionTTL(cfg.Auth.SessionTTL)
+	}
+
+	if cfg.Auth.LoginLimits != nil {
+		api.SetLoginLimits(cfg.Auth.LoginLimits)
+	}
+
+	if cfg.Auth.BcryptCost != 0 {
+		api.SetPasswordHasher(NewBcryptHasher(cfg.Auth.BcryptCost))
+	}
+
+	if cfg.Streams.Heartbeat != 0 {
+		api.SetStreamHeartbeat(cfg.Streams.Heartbeat)
+	}
+
+	if cfg.Streams.MaxDuration != 0 {
+		api.SetStreamMaxDuration(cfg.Streams.MaxDuration)
+	}
+
+	for _, target := range cfg.Events.Targets {
+		period := target.WritePeriod
+		if period == 0 {
+			period = defaultEventWritePeriod
+		}
+
+		api.eventClient.AddTarget(target.URL, target.Headers, period.Seconds())
+	}
+
+	for _, hook := range cfg.Events.Hooks {
+		api.eventClient.AddHook(hook)
+	}
+
+	if cfg.OpenAPIInfo != nil {
+		api.SetOpenAPIInfo(cfg.OpenAPIInfo)
+	}
+
+	if cfg.ACME != nil {
+		err := api.SetACME(cfg.ACME)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, lc := range cfg.Listen {
+		err := api.Listen(lc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,463 @@
+package patchy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/header"
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/metadata"
+	"github.com/gopatchy/path"
+	"github.com/julienschmidt/httprouter"
+)
+
+type APIKeyPaths struct {
+	Prefix  string
+	Hash    string
+	Scopes  string
+	Expires string
+
+	// Filled in when a single key is fetched, not in lists or streams
+	LastUsed string
+}
+
+type APIKeyToken struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+var (
+	ErrInvalidAPIKey     = errors.New("invalid API key")
+	ErrAPIKeyExpired     = errors.New("API key expired")
+	ErrInsufficientScope = errors.New("insufficient scope")
+)
+
+const (
+	apiKeyPrefixLen = 12
+	apiKeySecretLen = 40
+
+	// Avoid a write on every request; last-used is approximate
+	apiKeyLastUsedResolution = time.Minute
+
+	// Last-used times are stored apart from keys, so recording one doesn't
+	// change the key's generation or ETag, run write hooks, or audit
+	apiKeyUsageType = "_apiKeyUsage"
+)
+
+type apiKeyUsage struct {
+	Metadata
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+func authAPIKey(_ http.ResponseWriter, r *http.Request, api *API, cfg *config) (*http.Request, error) {
+	ctx := r.Context()
+
+	scheme, val := header.ParseAuthorization(r)
+
+	if strings.ToLower(scheme) != "apikey" {
+		return r, nil
+	}
+
+	err := api.checkListenerAuth(r, "apiKey")
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, secret, found := strings.Cut(val, ".")
+	if !found {
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "Authorization ApiKey data parsing failed (%w)", ErrInvalidAPIKey)
+	}
+
+	lookupCtx := context.WithValue(ctx, ContextAPIKeyLookup, true)
+
+	keys, err := api.listInt(lookupCtx, cfg, &ListOpts{
+		Filters: []Filter{
+			{
+				Path:  cfg.apiKeyPaths.Prefix,
+				Op:    "eq",
+				Value: prefix,
+			},
+		},
+	})
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "list API keys for auth failed (%w)", err)
+	}
+
+	// Always hash, even if the prefix didn't match, to keep timing uniform
+	reqHash := hashSecret(secret)
+
+	for _, key := range keys {
+		keyHash, err := getString(key, cfg.apiKeyPaths.Hash)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "get API key hash failed (%w)", err)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(keyHash), []byte(reqHash)) != 1 {
+			continue
+		}
+
+		if cfg.apiKeyPaths.Expires != "" {
+			expires, err := getTime(key, cfg.apiKeyPaths.Expires)
+			if err != nil {
+				return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "get API key expiry failed (%w)", err)
+			}
+
+			if !expires.IsZero() && time.Now().After(expires) {
+				return nil, jsrest.Errorf(jsrest.ErrUnauthorized, "%s (%w)", prefix, ErrAPIKeyExpired)
+			}
+		}
+
+		if cfg.apiKeyPaths.LastUsed != "" {
+			// Not worth failing authentication over
+			err = api.touchAPIKey(lookupCtx, cfg, key)
+			if err != nil {
+				api.eventClient.WriteEvent(ctx, event.NewEvent(
+					"apiKeyTouchFailed",
+					"apiKeyPrefix", prefix,
+					"error", err.Error(),
+				))
+			}
+		}
+
+		// Keys of a type without scopes are unrestricted; empty scopes grant nothing
+		if cfg.apiKeyPaths.Scopes != "" {
+			scopes, err := getStrings(key, cfg.apiKeyPaths.Scopes)
+			if err != nil {
+				return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "get API key scopes failed (%w)", err)
+			}
+
+			ctx = context.WithValue(ctx, ContextAuthScopes, scopes)
+		}
+
+		err = path.Set(key, cfg.apiKeyPaths.Hash, "")
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clear API key hash failed (%w)", err)
+		}
+
+		ctx = context.WithValue(ctx, ContextAuthAPIKey, key)
+
+		return r.WithContext(ctx), nil
+	}
+
+	return nil, jsrest.Errorf(jsrest.ErrUnauthorized, "API key not found or secret mismatch")
+}
+
+func (api *API) touchAPIKey(ctx context.Context, cfg *config, key any) error {
+	id := apiKeyUsageID(cfg, metadata.GetMetadata(key).ID)
+
+	obj, err := api.sb.Read(ctx, apiKeyUsageType, id, func() any { return &apiKeyUsage{} })
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "read API key usage failed (%w)", err)
+	}
+
+	now := time.Now()
+
+	if obj != nil && now.Sub(obj.(*apiKeyUsage).LastUsed) < apiKeyLastUsedResolution {
+		return nil
+	}
+
+	err = api.sb.Write(ctx, apiKeyUsageType, &apiKeyUsage{
+		Metadata: Metadata{
+			ID: id,
+		},
+		LastUsed: now,
+	})
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write API key usage failed (%w)", err)
+	}
+
+	return nil
+}
+
+// setAPIKeyLastUsed copies the stored last-used time into a key being
+// fetched
+func (api *API) setAPIKeyLastUsed(ctx context.Context, cfg *config, key any) error {
+	if cfg.apiKeyPaths == nil || cfg.apiKeyPaths.LastUsed == "" {
+		return nil
+	}
+
+	obj, err := api.sb.Read(ctx, apiKeyUsageType, apiKeyUsageID(cfg, metadata.GetMetadata(key).ID), func() any { return &apiKeyUsage{} })
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "read API key usage failed (%w)", err)
+	}
+
+	if obj == nil {
+		return nil
+	}
+
+	err = path.MergeMap(key, pathMap(cfg.apiKeyPaths.LastUsed, obj.(*apiKeyUsage).LastUsed))
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "set API key last used failed (%w)", err)
+	}
+
+	return nil
+}
+
+func apiKeyUsageID(cfg *config, id string) string {
+	return fmt.Sprintf("%s:%s", cfg.apiName, id)
+}
+
+func (api *API) rotateAPIKeyInt(ctx context.Context, cfg *config, id string, opts *UpdateOpts) (*APIKeyToken, error) {
+	prefix, secret := newAPIKeySecret()
+
+	patch := pathMap(cfg.apiKeyPaths.Prefix, prefix)
+	path.MergeMaps(patch, pathMap(cfg.apiKeyPaths.Hash, hashSecret(secret)))
+
+	_, err := api.updateInt(ctx, cfg, id, patch, opts)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "update failed (%w)", err)
+	}
+
+	return &APIKeyToken{
+		ID:    id,
+		Token: fmt.Sprintf("%s.%s", prefix, secret),
+	}, nil
+}
+
+func (api *API) rotateAPIKey(cfg *config, id string, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	api.SetEventData(ctx,
+		"operation", "rotate",
+		"typeName", cfg.apiName,
+		"id", id,
+	)
+
+	opts := parseUpdateOpts(r)
+
+	tok, err := api.rotateAPIKeyInt(ctx, cfg, id, opts)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "rotate failed (%w)", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(tok)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write response failed (%w)", err)
+	}
+
+	return nil
+}
+
+func AddAPIKeyName[T any](api *API, name string, paths *APIKeyPaths) {
+	cfg := api.registry[name]
+	if cfg == nil {
+		panic(name)
+	}
+
+	cfg.apiKeyPaths = paths
+	cfg.hidePaths = append(cfg.hidePaths, paths.Hash)
+
+	api.AddRequestHook(func(w http.ResponseWriter, r *http.Request, a *API) (*http.Request, error) {
+		return authAPIKey(w, r, a, cfg)
+	})
+
+	api.router.POST(
+		fmt.Sprintf("/%s/:id/_rotate", cfg.apiName),
+		func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			err := api.limitedID("rotate", api.rotateAPIKey)(cfg, ps[0].Value, w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+
+	api.eventClient.AddHook(EventHookAPIKey)
+	api.AddOpenAPIHook(OpenAPIHookAPIKey)
+	api.AddOpenAPIHook(func(_ context.Context, t *OpenAPI) {
+		openAPIRotate(t, cfg)
+	})
+
+	api.authAPIKey = true
+}
+
+func AddAPIKey[T any](api *API, paths *APIKeyPaths) {
+	AddAPIKeyName[T](api, apiName[T](), paths)
+}
+
+func CreateAPIKeyName[T any](ctx context.Context, api *API, name string, obj *T) (*T, string, error) {
+	cfg := api.registry[name]
+	if cfg == nil || cfg.apiKeyPaths == nil {
+		return nil, "", jsrest.Errorf(jsrest.ErrInternalServerError, "unknown API key type: %s", name)
+	}
+
+	paths := cfg.apiKeyPaths
+	prefix, secret := newAPIKeySecret()
+
+	err := path.Set(obj, paths.Prefix, prefix)
+	if err != nil {
+		return nil, "", jsrest.Errorf(jsrest.ErrInternalServerError, "set API key prefix failed (%w)", err)
+	}
+
+	err = path.Set(obj, paths.Hash, hashSecret(secret))
+	if err != nil {
+		return nil, "", jsrest.Errorf(jsrest.ErrInternalServerError, "set API key hash failed (%w)", err)
+	}
+
+	created, err := CreateName[T](ctx, api, name, obj)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return created, fmt.Sprintf("%s.%s", prefix, secret), nil
+}
+
+func CreateAPIKey[T any](ctx context.Context, api *API, obj *T) (*T, string, error) {
+	return CreateAPIKeyName[T](ctx, api, apiName[T](), obj)
+}
+
+func RotateAPIKeyName[T any](ctx context.Context, api *API, name, id string, opts *UpdateOpts) (string, error) {
+	cfg := api.registry[name]
+	if cfg == nil || cfg.apiKeyPaths == nil {
+		return "", jsrest.Errorf(jsrest.ErrInternalServerError, "unknown API key type: %s", name)
+	}
+
+	tok, err := api.rotateAPIKeyInt(ctx, cfg, id, opts)
+	if err != nil {
+		return "", jsrest.Errorf(jsrest.ErrInternalServerError, "rotate failed (%w)", err)
+	}
+
+	return tok.Token, nil
+}
+
+func RotateAPIKey[T any](ctx context.Context, api *API, id string, opts *UpdateOpts) (string, error) {
+	return RotateAPIKeyName[T](ctx, api, apiName[T](), id, opts)
+}
+
+func EventHookAPIKey(ctx context.Context, ev *event.Event) {
+	ctxKey := ctx.Value(ContextAuthAPIKey)
+
+	if ctxKey == nil {
+		return
+	}
+
+	ev.Set(
+		"authMethod", "apiKey",
+		"apiKeyID", metadata.GetMetadata(ctxKey).ID,
+	)
+}
+
+func OpenAPIHookAPIKey(_ context.Context, t *OpenAPI) {
+	t.Components.SecuritySchemes["apiKeyAuth"] = &openapi3.SecuritySchemeRef{
+		Value: &openapi3.SecurityScheme{
+			Type:        "apiKey",
+			In:          "header",
+			Name:        "Authorization",
+			Description: "`ApiKey <prefix>.<secret>`",
+		},
+	}
+
+	t.Security = append(t.Security, openapi3.SecurityRequirement{"apiKeyAuth": []string{}})
+}
+
+// checkScope enforces API key scopes of the form "read:<type>" and
+// "write:<type>" ("*" matches any type). Write scope implies read.
+// Requests not authenticated by API key are unrestricted.
+func checkScope(ctx context.Context, op, apiName string) error {
+	if isLookup(ctx) {
+		return nil
+	}
+
+	scopes, ok := ctx.Value(ContextAuthScopes).([]string)
+	if !ok {
+		return nil
+	}
+
+	allowed := []string{
+		fmt.Sprintf("%s:%s", op, apiName),
+		fmt.Sprintf("%s:*", op),
+	}
+
+	if op == "read" {
+		allowed = append(allowed, fmt.Sprintf("write:%s", apiName), "write:*")
+	}
+
+	for _, scope := range scopes {
+		for _, a := range allowed {
+			if scope == a {
+				return nil
+			}
+		}
+	}
+
+	return jsrest.Errorf(jsrest.ErrForbidden, "%s:%s (%w)", op, apiName, ErrInsufficientScope)
+}
+
+func newAPIKeySecret() (string, string) {
+	return uniuri.NewLen(apiKeyPrefixLen), uniuri.NewLen(apiKeySecretLen)
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return fmt.Sprintf("sha256:%s", hex.EncodeToString(hash[:]))
+}
+
+func openAPIRotate(t *OpenAPI, cfg *config) {
+	t.Paths[fmt.Sprintf("/%s/{id}/_rotate", cfg.apiName)] = &openapi3.PathItem{
+		Parameters: openapi3.Parameters{
+			&openapi3.ParameterRef{
+				Ref: "#/components/parameters/id",
+			},
+		},
+
+		Post: &openapi3.Operation{
+			Tags:    []string{cfg.apiName},
+			Summary: fmt.Sprintf("Rotate %s secret; the new token is returned only once", cfg.apiName),
+			Parameters: openapi3.Parameters{
+				&openapi3.ParameterRef{
+					Ref: "#/components/headers/if-match",
+				},
+			},
+			Responses: openapi3.Responses{
+				"200": &openapi3.ResponseRef{
+					Value: &openapi3.Response{
+						Description: P("OK: New API key token"),
+						Content: openapi3.Content{
+							"application/json": &openapi3.MediaType{
+								Schema: &openapi3.SchemaRef{
+									Value: &openapi3.Schema{
+										Type: "object",
+										Properties: openapi3.Schemas{
+											"id": &openapi3.SchemaRef{
+												Ref: "#/components/schemas/id",
+											},
+											"token": &openapi3.SchemaRef{
+												Value: &openapi3.Schema{
+													Type: "string",
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				"401": &openapi3.ResponseRef{
+					Ref: "#/components/responses/unauthorized",
+				},
+				"403": &openapi3.ResponseRef{
+					Ref: "#/components/responses/forbidden",
+				},
+				"404": &openapi3.ResponseRef{
+					Ref: "#/components/responses/not-found",
+				},
+				"412": &openapi3.ResponseRef{
+					Ref: "#/components/responses/precondition-failed",
+				},
+			},
+		},
+	}
+}
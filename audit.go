@@ -0,0 +1,318 @@
+package patchy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/metadata"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AuditRecord describes one create, replace, update or delete, whether over
+// HTTP, the direct API or replication, or the restore of one type from a
+// backup. Failed attempts are recorded too.
+type AuditRecord struct {
+	Metadata
+
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Type      string    `json:"type"`
+	ObjectID  string    `json:"objectID"`
+
+	// http, direct or replication
+	Source string `json:"source"`
+
+	// Set when authenticated; PrincipalID is the ID of the user (basic or
+	// session), token or API key
+	AuthMethod  string `json:"authMethod,omitempty"`
+	PrincipalID string `json:"principalID,omitempty"`
+
+	Changes []AuditChange `json:"changes,omitempty"`
+
+	// success or error
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+
+	TraceID string `json:"traceID,omitempty"`
+}
+
+// AuditChange is one changed field. Old and New are JSON-encoded and empty
+// when the field is unset. Secrets are redacted.
+type AuditChange struct {
+	Path string `json:"path"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+type AuditSink interface {
+	WriteAudit(context.Context, *AuditRecord) error
+}
+
+type AuditSinkFunc func(context.Context, *AuditRecord) error
+
+// AuditReadHook decides who may read the audit log type
+type AuditReadHook func(context.Context, *API) error
+
+var (
+	ErrAuditReadDenied = errors.New("audit log read denied")
+	ErrAuditReadOnly   = errors.New("audit log is read-only")
+)
+
+// JSON-encoded, like other AuditChange values
+const auditRedacted = `"[redacted]"`
+
+func (f AuditSinkFunc) WriteAudit(ctx context.Context, rec *AuditRecord) error {
+	return f(ctx, rec)
+}
+
+// AddAuditSink sends every AuditRecord to sink. Sink errors are logged but
+// don't fail the mutation, which has already happened.
+func (api *API) AddAuditSink(sink AuditSink) {
+	api.auditSinks = append(api.auditSinks, sink)
+}
+
+// EnableAuditLog stores audit records as the "audit" type, which can be
+// read with the normal get, list and stream APIs when hook allows. Records
+// can't be changed or deleted, even with the direct API.
+func (api *API) EnableAuditLog(hook AuditReadHook) {
+	api.auditReadHook = hook
+
+	RegisterName[AuditRecord](api, "audit", "Audit")
+	cfg := api.registry["audit"]
+
+	api.AddAuditSink(AuditSinkFunc(func(ctx context.Context, rec *AuditRecord) error {
+		// Keep the trace but not the principal, whose scopes may not cover
+		// the audit type
+		ctx = context.WithValue(
+			trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)),
+			ContextAuditWrite, true,
+		)
+
+		obj := *rec
+
+		_, err := api.createInt(ctx, cfg, &obj)
+
+		return err
+	}))
+}
+
+func (rec *AuditRecord) MayRead(ctx context.Context, api *API) error {
+	if ctx.Value(ContextAuditWrite) != nil {
+		return nil
+	}
+
+	if api.auditReadHook == nil {
+		return ErrAuditReadDenied
+	}
+
+	return api.auditReadHook(ctx, api)
+}
+
+func (rec *AuditRecord) MayWrite(ctx context.Context, prev *AuditRecord, _ *API) error {
+	if ctx.Value(ContextAuditWrite) == nil || prev != nil {
+		return ErrAuditReadOnly
+	}
+
+	return nil
+}
+
+// audit sends a record of m to the audit sinks; err is the result. It's a
+// no-op for nil m (nothing was attempted) and for audit records themselves.
+func (api *API) audit(ctx context.Context, cfg *config, m *mutation, err error) {
+	if m == nil || len(api.auditSinks) == 0 || ctx.Value(ContextAuditWrite) != nil {
+		return
+	}
+
+	rec := &AuditRecord{
+		Time:      time.Now(),
+		Operation: m.op,
+		Type:      cfg.apiName,
+		ObjectID:  m.id,
+		Source:    auditSource(ctx),
+		Result:    "success",
+	}
+
+	rec.AuthMethod, rec.PrincipalID = api.auditPrincipal(ctx)
+
+	if err != nil {
+		rec.Result = "error"
+		rec.Error = err.Error()
+	}
+
+	sc := trace.SpanContextFromContext(ctx)
+	if sc.HasTraceID() {
+		rec.TraceID = sc.TraceID().String()
+	}
+
+	changes, diffErr := cfg.auditChanges(m.prev, m.obj)
+	if diffErr != nil {
+		api.Log(ctx, "type", "auditError", "error", diffErr.Error())
+	}
+
+	rec.Changes = changes
+
+	for _, sink := range api.auditSinks {
+		sinkErr := sink.WriteAudit(ctx, rec)
+		if sinkErr != nil {
+			api.Log(ctx, "type", "auditError", "error", sinkErr.Error())
+		}
+	}
+}
+
+func auditSource(ctx context.Context) string {
+	switch {
+	case ctx.Value(ContextReplicate) != nil:
+		return "replication"
+
+	case ctx.Value(ContextEvent) != nil:
+		return "http"
+
+	default:
+		return "direct"
+	}
+}
+
+func (api *API) auditPrincipal(ctx context.Context) (string, string) {
+	if user := ctx.Value(ContextAuthBasic); user != nil {
+		return "basic", metadata.GetMetadata(user).ID
+	}
+
+	if token := ctx.Value(ContextAuthBearer); token != nil {
+		return "bearer", metadata.GetMetadata(token).ID
+	}
+
+	if key := ctx.Value(ContextAuthAPIKey); key != nil {
+		return "apiKey", metadata.GetMetadata(key).ID
+	}
+
+	if session := ctx.Value(ContextAuthSession); session != nil {
+		user, err := getString(session, api.sessionCfg.sessionPaths.User)
+		if err != nil {
+			return "session", ""
+		}
+
+		return "session", user
+	}
+
+	return "", ""
+}
+
+// auditChanges lists changed fields between prev and obj, either of which
+// may be nil
+func (cfg *config) auditChanges(prev, obj any) ([]AuditChange, error) {
+	from, err := toJSONMap(prev)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "marshal previous failed (%w)", err)
+	}
+
+	to, err := toJSONMap(obj)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "marshal object failed (%w)", err)
+	}
+
+	// Server-owned
+	for _, key := range []string{"id", "etag", "generation"} {
+		delete(from, key)
+		delete(to, key)
+	}
+
+	redact := map[string]bool{}
+
+	for _, p := range cfg.hidePaths {
+		redact[p] = true
+	}
+
+	for _, p := range cfg.secretPaths {
+		redact[p] = true
+	}
+
+	changes := []AuditChange{}
+
+	err = diffAudit("", from, to, redact, &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func diffAudit(prefix string, from, to map[string]any, redact map[string]bool, changes *[]AuditChange) error {
+	keys := []string{}
+
+	for key := range from {
+		keys = append(keys, key)
+	}
+
+	for key := range to {
+		if _, found := from[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		p := prefix + key
+
+		fromVal := from[key]
+		toVal := to[key]
+
+		fromMap, fromIsMap := fromVal.(map[string]any)
+		toMap, toIsMap := toVal.(map[string]any)
+
+		if (fromIsMap || fromVal == nil) && (toIsMap || toVal == nil) && (fromIsMap || toIsMap) && !redact[p] {
+			err := diffAudit(p+".", fromMap, toMap, redact, changes)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if reflect.DeepEqual(fromVal, toVal) {
+			continue
+		}
+
+		change := AuditChange{
+			Path: p,
+		}
+
+		var err error
+
+		change.Old, err = auditValue(fromVal, redact[p])
+		if err != nil {
+			return err
+		}
+
+		change.New, err = auditValue(toVal, redact[p])
+		if err != nil {
+			return err
+		}
+
+		*changes = append(*changes, change)
+	}
+
+	return nil
+}
+
+func auditValue(val any, redact bool) (string, error) {
+	if val == nil {
+		return "", nil
+	}
+
+	if redact {
+		return auditRedacted, nil
+	}
+
+	js, err := json.Marshal(val)
+	if err != nil {
+		return "", jsrest.Errorf(jsrest.ErrInternalServerError, "marshal value failed (%w)", err)
+	}
+
+	return string(js), nil
+}
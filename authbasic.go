@@ -11,10 +11,9 @@ import (
 	"github.com/gopatchy/jsrest"
 	"github.com/gopatchy/metadata"
 	"github.com/gopatchy/path"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func authBasic[T any](_ http.ResponseWriter, r *http.Request, api *API, name, pathUser, pathPass string) (*http.Request, error) {
+func authBasic[T any](w http.ResponseWriter, r *http.Request, api *API, name, pathUser, pathPass string) (*http.Request, error) {
 	ctx := r.Context()
 
 	scheme, val := header.ParseAuthorization(r)
@@ -23,13 +22,26 @@ func authBasic[T any](_ http.ResponseWriter, r *http.Request, api *API, name, pa
 		return r, nil
 	}
 
+	err := api.checkListenerAuth(r, "basic")
+	if err != nil {
+		return nil, err
+	}
+
 	reqUser, reqPass, err := header.ParseBasic(val)
 	if err != nil {
 		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "Authorization Basic data parsing failed (%w)", err)
 	}
 
+	// Check before any password comparison so lockouts also shed CPU load
+	err = api.checkLogin(ctx, w, r, reqUser)
+	if err != nil {
+		return nil, err
+	}
+
+	lookupCtx := context.WithValue(ctx, ContextAuthBasicLookup, true)
+
 	users, err := ListName[T](
-		context.WithValue(ctx, ContextAuthBasicLookup, true),
+		lookupCtx,
 		api,
 		name,
 		&ListOpts{
@@ -47,41 +59,56 @@ func authBasic[T any](_ http.ResponseWriter, r *http.Request, api *API, name, pa
 	}
 
 	for _, user := range users {
-		userPass, err := path.Get(user, pathPass)
+		strPass, err := getString(user, pathPass)
 		if err != nil {
 			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "get user password hash failed (%w)", err)
 		}
 
-		if userPass == nil {
+		if strPass == "" {
 			continue
 		}
 
-		var strPass string
-
-		switch v := userPass.(type) {
-		case string:
-			strPass = v
-		case *string:
-			strPass = *v
-		default:
-			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "user password hash has invalid type %T", v)
+		err = comparePassword(strPass, reqPass, api.passwordHasher)
+		if err != nil {
+			continue
 		}
 
-		err = bcrypt.CompareHashAndPassword([]byte(strPass), []byte(reqPass))
-		if err == nil {
-			err = path.Set(user, pathPass, "")
+		if api.passwordHasher.NeedsRehash(strPass) {
+			// The old hash still works, so this isn't worth failing login over
+			err = api.rehashPassword(ctx, api.registry[name], metadata.GetMetadata(user).ID, pathPass, reqPass)
 			if err != nil {
-				return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clear user password hash failed (%w)", err)
+				api.eventClient.WriteEvent(ctx, event.NewEvent(
+					"authBasicRehashFailed",
+					"authUser", reqUser,
+					"error", err.Error(),
+				))
 			}
+		}
+
+		api.loginLimiter.succeed(reqUser)
 
-			return r.WithContext(context.WithValue(ctx, ContextAuthBasic, user)), nil
+		err = path.Set(user, pathPass, "")
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clear user password hash failed (%w)", err)
 		}
+
+		return r.WithContext(context.WithValue(ctx, ContextAuthBasic, user)), nil
 	}
 
+	api.failLogin(ctx, w, r, reqUser)
+
 	return nil, jsrest.Errorf(jsrest.ErrUnauthorized, "user not found or password mismatch")
 }
 
 func AddAuthBasicName[T any](api *API, name, pathUser, pathPass string) {
+	cfg := api.registry[name]
+	if cfg == nil {
+		panic(name)
+	}
+
+	cfg.hidePaths = append(cfg.hidePaths, pathPass)
+	cfg.passwordPaths = append(cfg.passwordPaths, pathPass)
+
 	api.AddRequestHook(func(w http.ResponseWriter, r *http.Request, a *API) (*http.Request, error) {
 		return authBasic[T](w, r, a, name, pathUser, pathPass)
 	})
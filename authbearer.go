@@ -22,6 +22,11 @@ func authBearer[T any](_ http.ResponseWriter, r *http.Request, api *API, name, p
 		return r, nil
 	}
 
+	err := api.checkListenerAuth(r, "bearer")
+	if err != nil {
+		return nil, err
+	}
+
 	bearers, err := ListName[T](
 		context.WithValue(ctx, ContextAuthBearerLookup, true),
 		api,
@@ -55,6 +60,13 @@ func authBearer[T any](_ http.ResponseWriter, r *http.Request, api *API, name, p
 }
 
 func AddAuthBearerName[T any](api *API, name, pathToken string) {
+	cfg := api.registry[name]
+	if cfg == nil {
+		panic(name)
+	}
+
+	cfg.secretPaths = append(cfg.secretPaths, pathToken)
+
 	api.AddRequestHook(func(w http.ResponseWriter, r *http.Request, a *API) (*http.Request, error) {
 		return authBearer[T](w, r, a, name, pathToken)
 	})
@@ -0,0 +1,494 @@
+package patchy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/metadata"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Backups are NDJSON: one BackupHeader line, then one BackupRecord line per
+// object, grouped by type in header order. A record with Error set ends an
+// archive whose export failed partway.
+type BackupHeader struct {
+	Format  string        `json:"format"`
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Types   []*BackupType `json:"types"`
+}
+
+type BackupType struct {
+	Name          string `json:"name"`
+	SchemaVersion int64  `json:"schemaVersion"`
+	Count         int    `json:"count"`
+}
+
+type BackupRecord struct {
+	Type   string          `json:"type,omitempty"`
+	Object json.RawMessage `json:"object,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// AdminHook authorizes administrative endpoints (/_export, /_import,
+// /_lockouts)
+type AdminHook func(*http.Request, *API) error
+
+var (
+	ErrBackupFormat      = errors.New("invalid backup format")
+	ErrBackupUnknownType = errors.New("backup contains unregistered type")
+	ErrBackupIncomplete  = errors.New("backup ended with an error")
+	ErrAdminRequired     = errors.New("admin access required")
+)
+
+const (
+	backupFormat  = "patchy-backup"
+	backupVersion = 1
+
+	// Objects can be large; bufio.Scanner's default 64KiB line limit isn't enough
+	backupMaxLine = 64 * 1024 * 1024
+)
+
+// Backup writes a consistent snapshot of all registered types, including
+// hidden fields such as password hashes
+func (api *API) Backup(ctx context.Context, w io.Writer) error {
+	// Bring stored objects up to the current schema first; migration writes
+	// can't run while the snapshot lock is held
+	err := api.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+
+	header := &BackupHeader{
+		Format:  backupFormat,
+		Version: backupVersion,
+		Created: time.Now().UTC(),
+		Types:   []*BackupType{},
+	}
+
+	lists := [][]any{}
+
+	api.restoreMu.Lock()
+	api.snapshotMu.Lock()
+
+	for _, name := range api.names() {
+		cfg := api.registry[name]
+
+		list, err := api.sb.List(ctx, cfg.apiName, cfg.factory)
+		if err != nil {
+			api.snapshotMu.Unlock()
+			api.restoreMu.Unlock()
+
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s: list failed (%w)", name, err)
+		}
+
+		header.Types = append(header.Types, &BackupType{
+			Name:          cfg.apiName,
+			SchemaVersion: int64(len(cfg.migrations)),
+			Count:         len(list),
+		})
+
+		lists = append(lists, list)
+	}
+
+	api.snapshotMu.Unlock()
+	api.restoreMu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	err = enc.Encode(header)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write header failed (%w)", err)
+	}
+
+	for i, bt := range header.Types {
+		for _, obj := range lists[i] {
+			js, err := json.Marshal(obj)
+			if err != nil {
+				err = jsrest.Errorf(jsrest.ErrInternalServerError, "%s: marshal failed (%w)", bt.Name, err)
+
+				// Mark the archive as incomplete; Restore refuses it
+				_ = enc.Encode(&BackupRecord{Error: err.Error()})
+
+				return err
+			}
+
+			err = enc.Encode(&BackupRecord{
+				Type:   bt.Name,
+				Object: js,
+			})
+			if err != nil {
+				return jsrest.Errorf(jsrest.ErrInternalServerError, "write record failed (%w)", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Restore replaces the contents of every type in the backup, preserving IDs
+// and generations. Objects from older schema versions are migrated. The
+// header is checked before anything is written, then each type is read and
+// validated in full before it's written, so only one type is held in
+// memory; an invalid archive can fail after earlier types are restored.
+// Objects are written under their locks, like any other write. Each type
+// gets one audit record, with operation restore and no object ID.
+func (api *API) Restore(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, backupMaxLine)
+
+	if !scanner.Scan() {
+		err := scanner.Err()
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrBadRequest, "read header failed (%w)", err)
+		}
+
+		return jsrest.Errorf(jsrest.ErrBadRequest, "missing header (%w)", ErrBackupFormat)
+	}
+
+	header := &BackupHeader{}
+
+	err := json.Unmarshal(scanner.Bytes(), header)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "decode header failed (%w)", err)
+	}
+
+	if header.Format != backupFormat || header.Version != backupVersion {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "%s version %d (%w)", header.Format, header.Version, ErrBackupFormat)
+	}
+
+	seen := map[string]bool{}
+
+	for _, bt := range header.Types {
+		cfg := api.registry[bt.Name]
+		if cfg == nil {
+			return jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", bt.Name, ErrBackupUnknownType)
+		}
+
+		if bt.SchemaVersion > int64(len(cfg.migrations)) {
+			return jsrest.Errorf(jsrest.ErrBadRequest, "%s: schema version %d is newer than %d (%w)", bt.Name, bt.SchemaVersion, len(cfg.migrations), ErrBackupFormat)
+		}
+
+		if seen[bt.Name] {
+			return jsrest.Errorf(jsrest.ErrBadRequest, "%s listed twice (%w)", bt.Name, ErrBackupFormat)
+		}
+
+		seen[bt.Name] = true
+	}
+
+	for _, bt := range header.Types {
+		// Existing objects must be current so the schema version stays valid
+		err = api.migrate(ctx, api.registry[bt.Name])
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s: migrate failed (%w)", bt.Name, err)
+		}
+	}
+
+	api.restoreMu.Lock()
+	defer api.restoreMu.Unlock()
+
+	for _, bt := range header.Types {
+		cfg := api.registry[bt.Name]
+
+		objs, err := readBackupType(scanner, cfg, bt)
+		if err == nil {
+			err = api.restoreType(ctx, cfg, objs)
+			if err != nil {
+				err = jsrest.Errorf(jsrest.ErrInternalServerError, "%s: restore failed (%w)", bt.Name, err)
+			}
+		}
+
+		api.audit(ctx, cfg, &mutation{op: "restore"}, err)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	rec, err := readBackupRecord(scanner)
+	if err != nil {
+		return err
+	}
+
+	if rec != nil {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "%s not in header or over its count (%w)", rec.Type, ErrBackupFormat)
+	}
+
+	return nil
+}
+
+// readBackupType reads the bt.Count records of one type
+func readBackupType(scanner *bufio.Scanner, cfg *config, bt *BackupType) ([]any, error) {
+	objs := []any{}
+
+	for len(objs) < bt.Count {
+		rec, err := readBackupRecord(scanner)
+		if err != nil {
+			return nil, err
+		}
+
+		if rec == nil || rec.Type != bt.Name {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s: expected %d objects, found %d (%w)", bt.Name, bt.Count, len(objs), ErrBackupFormat)
+		}
+
+		obj, err := cfg.decodeBackup(rec.Object, bt.SchemaVersion)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s: decode object failed (%w)", bt.Name, err)
+		}
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
+
+// readBackupRecord returns nil at the end of the archive
+func readBackupRecord(scanner *bufio.Scanner) (*BackupRecord, error) {
+	if !scanner.Scan() {
+		err := scanner.Err()
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "read failed (%w)", err)
+		}
+
+		return nil, nil
+	}
+
+	rec := &BackupRecord{}
+
+	err := json.Unmarshal(scanner.Bytes(), rec)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "decode record failed (%w)", err)
+	}
+
+	if rec.Error != "" {
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", rec.Error, ErrBackupIncomplete)
+	}
+
+	return rec, nil
+}
+
+// SetAdminHook enables administrative endpoints for requests that the hook
+// accepts; without a hook they always return 403
+func (api *API) SetAdminHook(hook AdminHook) {
+	api.adminHook = hook
+}
+
+func (api *API) restoreType(ctx context.Context, cfg *config, objs []any) error {
+	cur, err := api.sb.List(ctx, cfg.apiName, cfg.factory)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "list failed (%w)", err)
+	}
+
+	keep := map[string]bool{}
+
+	for _, obj := range objs {
+		id := metadata.GetMetadata(obj).ID
+		keep[id] = true
+
+		cfg.lock(id)
+		err = api.storeWrite(ctx, cfg, obj)
+		cfg.unlock(id)
+
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "write failed: %s (%w)", id, err)
+		}
+	}
+
+	for _, obj := range cur {
+		id := metadata.GetMetadata(obj).ID
+
+		if keep[id] {
+			continue
+		}
+
+		cfg.lock(id)
+		err = api.storeDelete(ctx, cfg, id)
+		cfg.unlock(id)
+
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "delete failed: %s (%w)", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *config) decodeBackup(js []byte, schemaVersion int64) (any, error) {
+	var obj any
+
+	if schemaVersion < int64(len(cfg.migrations)) {
+		m := map[string]any{}
+
+		err := json.Unmarshal(js, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		obj, err = cfg.migrateObj(m, schemaVersion)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		obj = cfg.factory()
+
+		err := decodeStrict(js, obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if metadata.GetMetadata(obj).ID == "" {
+		return nil, fmt.Errorf("missing id (%w)", ErrBackupFormat)
+	}
+
+	return obj, nil
+}
+
+// storeWrite, storeDelete and storeWriteBatch are blocked while Backup takes
+// its snapshot
+func (api *API) storeWrite(ctx context.Context, cfg *config, obj any) error {
+	api.snapshotMu.RLock()
+	defer api.snapshotMu.RUnlock()
+
+	return api.sb.Write(ctx, cfg.apiName, obj)
+}
+
+func (api *API) storeDelete(ctx context.Context, cfg *config, id string) error {
+	api.snapshotMu.RLock()
+	defer api.snapshotMu.RUnlock()
+
+	return api.sb.Delete(ctx, cfg.apiName, id)
+}
+
+// storeWriteBatch falls back to individual writes for stores without batching
+func (api *API) storeWriteBatch(ctx context.Context, cfg *config, writes []any, deletes []string) error {
+	api.snapshotMu.RLock()
+	defer api.snapshotMu.RUnlock()
+
+	bs, ok := api.sb.(BatchStore)
+	if ok {
+		return bs.WriteBatch(ctx, cfg.apiName, writes, deletes)
+	}
+
+	for _, obj := range writes {
+		err := api.sb.Write(ctx, cfg.apiName, obj)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range deletes {
+		err := api.sb.Delete(ctx, cfg.apiName, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (api *API) checkAdmin(r *http.Request) error {
+	if api.adminHook == nil {
+		return jsrest.Errorf(jsrest.ErrForbidden, "no admin hook set (%w)", ErrAdminRequired)
+	}
+
+	err := api.adminHook(r, api)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrForbidden, "%s (%w)", err, ErrAdminRequired)
+	}
+
+	return nil
+}
+
+func (api *API) handleExport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	api.SetEventData(ctx, "operation", "export")
+
+	err := api.checkAdmin(r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="patchy-%s.ndjson"`, time.Now().UTC().Format("20060102-150405")))
+
+	bw := &backupWriter{w: w}
+
+	err = api.Backup(ctx, bw)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "backup failed (%w)", err)
+
+		if !bw.wrote {
+			return err
+		}
+
+		// Too late for an error status; Backup ended the archive with an
+		// error record instead
+		api.SetEventData(ctx, "error", err.Error())
+	}
+
+	return nil
+}
+
+// backupWriter records whether the response has started
+type backupWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	bw.wrote = true
+	return bw.w.Write(p)
+}
+
+func (api *API) handleImport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	api.SetEventData(ctx, "operation", "import")
+
+	err := api.checkAdmin(r)
+	if err != nil {
+		return err
+	}
+
+	err = api.Restore(ctx, r.Body)
+	if err != nil {
+		// Restore marks invalid archives as 400
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "restore failed (%w)", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (api *API) registerBackupHandlers() {
+	api.router.GET(
+		"/_export",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.handleExport(w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+
+	api.router.POST(
+		"/_import",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.handleImport(w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+}
@@ -0,0 +1,442 @@
+package patchy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/metadata"
+	"github.com/vfaronov/httpheader"
+)
+
+// BulkOp is one operation in a POST /<type>/_bulk request body, which is
+// either a JSON array or NDJSON. Op is create, replace, update or delete.
+type BulkOp struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	IfMatch string          `json:"ifMatch,omitempty"`
+	Obj     json.RawMessage `json:"obj,omitempty"`
+}
+
+// BulkResult is streamed as NDJSON, one per BulkOp, in request order
+type BulkResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+	ETag   string `json:"etag,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkDecoder struct {
+	dec   *json.Decoder
+	lr    *bulkLimitReader
+	limit int64
+	array bool
+}
+
+// bulkLimitReader fails reads past max, so a single oversized operation
+// isn't buffered in full
+type bulkLimitReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+var ErrBulkOp = errors.New("invalid bulk operation")
+
+// Operations are validated and written in batches of this size; each batch
+// is a single update to list streams
+const bulkBatchSize = 500
+
+func (api *API) bulk(cfg *config, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	api.SetEventData(ctx,
+		"operation", "bulk",
+		"typeName", cfg.apiName,
+	)
+
+	contentType, _ := httpheader.ContentType(r.Header)
+
+	switch contentType {
+	case "", "application/json", "application/x-ndjson":
+	default:
+		return jsrest.Errorf(jsrest.ErrUnsupportedMediaType, "Content-Type: %s", contentType)
+	}
+
+	err := api.migrate(ctx, cfg)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
+	}
+
+	dec, err := newBulkDecoder(r.Body, api.limiter.maxBodySize(cfg))
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "read request failed (%w)", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	batch := []*BulkOp{}
+	batchIDs := map[string]bool{}
+	count := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, res := range api.bulkBatch(ctx, cfg, count-len(batch), batch) {
+			err := enc.Encode(res)
+			if err != nil {
+				return jsrest.Errorf(jsrest.ErrInternalServerError, "write response failed (%w)", err)
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		batch = []*BulkOp{}
+		batchIDs = map[string]bool{}
+
+		return nil
+	}
+
+	for {
+		op := &BulkOp{}
+
+		decErr := dec.next(op)
+		if errors.Is(decErr, io.EOF) {
+			break
+		}
+
+		if decErr != nil {
+			err = flush()
+			if err != nil {
+				return err
+			}
+
+			status := http.StatusBadRequest
+			if errors.Is(decErr, ErrBodyTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+
+			// The stream can't be resynchronized after a syntax error
+			_ = enc.Encode(&BulkResult{ //nolint:errchkjson
+				Index:  count,
+				Status: status,
+				Error:  decErr.Error(),
+			})
+
+			return nil
+		}
+
+		// Each ID is locked once per batch
+		if len(batch) >= bulkBatchSize || (op.ID != "" && batchIDs[op.ID]) {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+
+		batch = append(batch, op)
+		count++
+
+		if op.ID != "" {
+			batchIDs[op.ID] = true
+		}
+	}
+
+	api.SetEventData(ctx, "bulkCount", count)
+
+	return flush()
+}
+
+// bulkBatch runs per-object checks (including MayWrite), then writes all
+// successful operations at once
+func (api *API) bulkBatch(ctx context.Context, cfg *config, base int, ops []*BulkOp) []*BulkResult {
+	ids := []string{}
+
+	for _, op := range ops {
+		if op.Op != "create" && op.ID != "" {
+			ids = append(ids, op.ID)
+		}
+	}
+
+	// Consistent ordering prevents deadlock between concurrent batches
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		cfg.lock(id)
+		defer cfg.unlock(id)
+	}
+
+	results := []*BulkResult{}
+	writes := []any{}
+	writeResults := []*BulkResult{}
+	deletes := []string{}
+	deleteResults := []*BulkResult{}
+	muts := []*mutation{}
+
+	for i, op := range ops {
+		res := &BulkResult{
+			Index: base + i,
+			ID:    op.ID,
+		}
+
+		results = append(results, res)
+
+		m, err := api.prepareBulk(ctx, cfg, op)
+		if err != nil {
+			api.audit(ctx, cfg, m, err)
+			res.setError(err)
+
+			continue
+		}
+
+		muts = append(muts, m)
+
+		if m.obj == nil {
+			res.Status = http.StatusNoContent
+			deletes = append(deletes, op.ID)
+			deleteResults = append(deleteResults, res)
+
+			continue
+		}
+
+		res.Status = http.StatusOK
+		res.ID = metadata.GetMetadata(m.obj).ID
+		writes = append(writes, m.obj)
+		writeResults = append(writeResults, res)
+	}
+
+	err := api.storeWriteBatch(ctx, cfg, writes, deletes)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "write failed (%w)", err)
+	}
+
+	for _, m := range muts {
+		api.audit(ctx, cfg, m, err)
+	}
+
+	if err != nil {
+		for _, res := range append(writeResults, deleteResults...) {
+			res.setError(err)
+		}
+
+		return results
+	}
+
+	// Writes set the ETag in place
+	for i, obj := range writes {
+		writeResults[i].ETag = metadata.GetMetadata(obj).ETag
+	}
+
+	return results
+}
+
+// prepareBulk returns nil for operations that can't be decoded
+func (api *API) prepareBulk(ctx context.Context, cfg *config, op *BulkOp) (*mutation, error) {
+	opts := &UpdateOpts{}
+
+	if op.IfMatch != "" {
+		opts.IfMatch = []httpheader.EntityTag{{Opaque: op.IfMatch}}
+	}
+
+	if op.Op != "create" && op.ID == "" {
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s: missing id (%w)", op.Op, ErrBulkOp)
+	}
+
+	switch op.Op {
+	case "create":
+		obj := cfg.factory()
+
+		err := decodeStrict(op.Obj, obj)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "decode failed (%w)", err)
+		}
+
+		return api.prepareCreate(ctx, cfg, obj)
+
+	case "replace":
+		obj := cfg.factory()
+
+		err := decodeStrict(op.Obj, obj)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "decode failed (%w)", err)
+		}
+
+		return api.prepareReplace(ctx, cfg, op.ID, obj, opts)
+
+	case "update":
+		patch := map[string]any{}
+
+		err := decodeStrict(op.Obj, &patch)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "decode failed (%w)", err)
+		}
+
+		return api.prepareUpdate(ctx, cfg, op.ID, patch, opts)
+
+	case "delete":
+		return api.prepareDelete(ctx, cfg, op.ID, opts)
+
+	default:
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", op.Op, ErrBulkOp)
+	}
+}
+
+func (res *BulkResult) setError(err error) {
+	res.Status = http.StatusInternalServerError
+	res.ETag = ""
+	res.Error = err.Error()
+
+	hErr := jsrest.GetHTTPError(err)
+	if hErr != nil {
+		res.Status = hErr.Code
+	}
+}
+
+// newBulkDecoder limits each operation to limit bytes, if non-zero
+func newBulkDecoder(r io.Reader, limit int64) (*bulkDecoder, error) {
+	br := bufio.NewReader(r)
+
+	bd := &bulkDecoder{
+		lr: &bulkLimitReader{
+			r:   br,
+			max: limit,
+		},
+		limit: limit,
+	}
+
+	bd.dec = json.NewDecoder(bd.lr)
+
+	for {
+		b, err := br.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return bd, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = br.ReadByte()
+			continue
+
+		case '[':
+			// Consume the opening bracket
+			_, err = bd.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			bd.array = true
+		}
+
+		return bd, nil
+	}
+}
+
+// next returns io.EOF after the last operation
+func (bd *bulkDecoder) next(op *BulkOp) error {
+	if bd.array && !bd.dec.More() {
+		_, err := bd.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		bd.array = false
+
+		return io.EOF
+	}
+
+	err := bd.dec.Decode(op)
+	if err != nil {
+		return err
+	}
+
+	if bd.limit > 0 {
+		// The decoder may have read ahead into the next operation, which
+		// counts against that operation's limit
+		bd.lr.max = bd.dec.InputOffset() + bd.limit
+	}
+
+	return nil
+}
+
+func (lr *bulkLimitReader) Read(p []byte) (int, error) {
+	if lr.max > 0 {
+		remaining := lr.max - lr.read
+		if remaining <= 0 {
+			return 0, jsrest.Errorf(jsrest.ErrRequestEntityTooLarge, "operation over limit (%w)", ErrBodyTooLarge)
+		}
+
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+
+	return n, err
+}
+
+func decodeStrict(js []byte, obj any) error {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(obj)
+}
+
+func openAPIBulk(t *OpenAPI, cfg *config) {
+	t.Paths[fmt.Sprintf("/%s/_bulk", cfg.apiName)] = &openapi3.PathItem{
+		Post: &openapi3.Operation{
+			Tags:        []string{cfg.apiName},
+			Summary:     fmt.Sprintf("Create, replace, update or delete many %s", cfg.apiName),
+			Description: "Request is a JSON array or NDJSON of operations; results are streamed as NDJSON in request order",
+			RequestBody: &openapi3.RequestBodyRef{
+				Value: &openapi3.RequestBody{
+					Required: true,
+					Content: openapi3.Content{
+						"application/json":     &openapi3.MediaType{},
+						"application/x-ndjson": &openapi3.MediaType{},
+					},
+				},
+			},
+			Responses: openapi3.Responses{
+				"200": &openapi3.ResponseRef{
+					Value: &openapi3.Response{
+						Description: P("OK: Per-operation results"),
+						Content: openapi3.Content{
+							"application/x-ndjson": &openapi3.MediaType{},
+						},
+					},
+				},
+				"400": &openapi3.ResponseRef{
+					Ref: "#/components/responses/bad-request",
+				},
+				"401": &openapi3.ResponseRef{
+					Ref: "#/components/responses/unauthorized",
+				},
+				"403": &openapi3.ResponseRef{
+					Ref: "#/components/responses/forbidden",
+				},
+			},
+		},
+	}
+}
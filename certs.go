@@ -0,0 +1,449 @@
+package patchy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/selfcert"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig obtains and renews certificates from an ACME CA (Let's Encrypt
+// by default) for listeners with TLS "acme". Setting it accepts the CA's
+// terms of service. Challenges are answered with TLS-ALPN-01 on those
+// listeners and HTTP-01 on any plain HTTP listener.
+type ACMEConfig struct {
+	// Empty uses Let's Encrypt production
+	DirectoryURL string `yaml:"directoryURL"`
+
+	// Names to request certificates for; others are refused
+	Hosts []string `yaml:"hosts"`
+
+	Email string `yaml:"email"`
+
+	// Keeps the account key and certificates across restarts; empty keeps
+	// them only in memory
+	CacheDir string `yaml:"cacheDir"`
+
+	// PEM roots trusted for DirectoryURL instead of the system's, e.g.
+	// Pebble's test CA
+	CAFile string `yaml:"caFile"`
+
+	// Zero renews 30 days before expiry
+	RenewBefore time.Duration `yaml:"renewBefore"`
+}
+
+// certSource supplies a TLS listener's certificates, which may change
+// while serving
+type certSource interface {
+	getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// leaves returns the certificates served so far, by name
+	leaves() map[string]*x509.Certificate
+
+	reload() error
+}
+
+type staticCerts struct {
+	name string
+	cert *tls.Certificate
+}
+
+// fileCerts reloads a key pair when either file changes. An incomplete or
+// invalid pair is retried on the next check while the old one is served.
+type fileCerts struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+type acmeCerts struct {
+	manager *autocert.Manager
+
+	mu     sync.Mutex
+	served map[string]*x509.Certificate
+}
+
+var (
+	ErrACMENotConfigured  = errors.New("ACME not configured")
+	ErrACMENoHosts        = errors.New("ACME hosts missing")
+	ErrInvalidCAFile      = errors.New("no certificates in CA file")
+	ErrCertificateExpired = errors.New("certificate expired")
+)
+
+// Handshakes stat certificate files at most this often
+const certCheckInterval = time.Second
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// SetACME configures certificate issuance for listeners with TLS "acme";
+// call it before adding them
+func (api *API) SetACME(ac *ACMEConfig) error {
+	if len(ac.Hosts) == 0 {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "%w", ErrACMENoHosts)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if ac.CAFile != "" {
+		caPEM, err := os.ReadFile(ac.CAFile)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "read CA file failed (%w)", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", ac.CAFile, ErrInvalidCAFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	// Separate from http.DefaultClient so Shutdown can close its connections
+	api.acmeClient = &http.Client{Transport: transport}
+
+	api.acme = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(ac.Hosts...),
+		Email:       ac.Email,
+		RenewBefore: ac.RenewBefore,
+		Client: &acme.Client{
+			DirectoryURL: ac.DirectoryURL,
+			HTTPClient:   api.acmeClient,
+		},
+	}
+
+	if ac.CacheDir != "" {
+		api.acme.Cache = autocert.DirCache(ac.CacheDir)
+	}
+
+	// Also enables HTTP-01, which autocert tries after TLS-ALPN-01
+	api.acmeHTTP = api.acme.HTTPHandler(nil)
+
+	return nil
+}
+
+// ReloadCertificates rereads the key pairs of listeners with TLS "files".
+// Serve also does this on SIGHUP.
+func (api *API) ReloadCertificates() error {
+	for _, li := range api.getListeners() {
+		if li.certs == nil {
+			continue
+		}
+
+		err := li.certs.reload()
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "listener %s (%w)", li.name, err)
+		}
+	}
+
+	return nil
+}
+
+// reloadOnSIGHUP runs ReloadCertificates on SIGHUP until the returned
+// function is called. Without file certificates, SIGHUP keeps its default
+// behavior.
+func (api *API) reloadOnSIGHUP() func() {
+	found := false
+
+	for _, li := range api.getListeners() {
+		if _, ok := li.certs.(*fileCerts); ok {
+			found = true
+		}
+	}
+
+	if !found {
+		return func() {}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				err := api.ReloadCertificates()
+				if err != nil {
+					api.eventClient.WriteEvent(context.Background(), event.NewEvent(
+						"certReloadFailed",
+						"error", err.Error(),
+					))
+				}
+
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// serveACMEChallenge answers HTTP-01 challenges on plain HTTP listeners
+func (api *API) serveACMEChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if api.acmeHTTP == nil || r.TLS != nil || !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		return false
+	}
+
+	api.SetEventData(r.Context(), "operation", "acmeChallenge")
+	api.acmeHTTP.ServeHTTP(w, r)
+
+	return true
+}
+
+// checkCertificateHealth fails if a listener is serving an expired
+// certificate, e.g. because renewal or reload failed
+func (api *API) checkCertificateHealth(_ context.Context) error {
+	now := time.Now()
+
+	for _, li := range api.getListeners() {
+		if li.certs == nil {
+			continue
+		}
+
+		for name, leaf := range li.certs.leaves() {
+			if now.After(leaf.NotAfter) {
+				return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s: %s at %s (%w)", li.name, name, leaf.NotAfter.Format(time.RFC3339), ErrCertificateExpired)
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateCertMetrics runs on each scrape, since certificates change outside
+// of requests
+func (api *API) updateCertMetrics() {
+	for _, li := range api.getListeners() {
+		if li.certs == nil {
+			continue
+		}
+
+		for name, leaf := range li.certs.leaves() {
+			api.metrics.certExpiry.set(float64(leaf.NotAfter.Unix()), li.name, name)
+		}
+	}
+}
+
+func (api *API) listenerTLS(lc *ListenConfig) (*tls.Config, certSource, error) {
+	switch lc.TLS {
+	case "", "none":
+		return nil, nil, nil
+
+	case "self":
+		tlsConfig, err := selfcert.NewTLSConfigFromHostPort(lc.Bind)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cert := &tlsConfig.Certificates[0]
+
+		cert.Leaf, err = certLeaf(cert)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return tlsConfig, &staticCerts{name: "self", cert: cert}, nil
+
+	case "files":
+		certs, err := newFileCerts(lc.CertFile, lc.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &tls.Config{
+			GetCertificate: certs.getCertificate,
+			MinVersion:     tls.VersionTLS13,
+			NextProtos:     []string{"h2"},
+		}, certs, nil
+
+	case "acme":
+		if api.acme == nil {
+			return nil, nil, jsrest.Errorf(jsrest.ErrInternalServerError, "%w", ErrACMENotConfigured)
+		}
+
+		certs := &acmeCerts{
+			manager: api.acme,
+			served:  map[string]*x509.Certificate{},
+		}
+
+		return &tls.Config{
+			GetCertificate: certs.getCertificate,
+			MinVersion:     tls.VersionTLS13,
+			NextProtos:     []string{"h2", acme.ALPNProto},
+		}, certs, nil
+
+	default:
+		return nil, nil, jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", lc.TLS, ErrUnknownTLSMode)
+	}
+}
+
+func (sc *staticCerts) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return sc.cert, nil
+}
+
+func (sc *staticCerts) leaves() map[string]*x509.Certificate {
+	return map[string]*x509.Certificate{sc.name: sc.cert.Leaf}
+}
+
+func (sc *staticCerts) reload() error {
+	return nil
+}
+
+func newFileCerts(certFile, keyFile string) (*fileCerts, error) {
+	fc := &fileCerts{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	err := fc.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+func (fc *fileCerts) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if time.Since(fc.lastCheck) >= certCheckInterval {
+		fc.lastCheck = time.Now()
+
+		modTime, err := fc.filesModTime()
+		if err == nil && !modTime.Equal(fc.modTime) {
+			_ = fc.reloadLocked()
+		}
+	}
+
+	return fc.cert, nil
+}
+
+func (fc *fileCerts) leaves() map[string]*x509.Certificate {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return map[string]*x509.Certificate{fc.certFile: fc.cert.Leaf}
+}
+
+func (fc *fileCerts) reload() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return fc.reloadLocked()
+}
+
+func (fc *fileCerts) reloadLocked() error {
+	modTime, err := fc.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(fc.certFile, fc.keyFile)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "load key pair failed (%w)", err)
+	}
+
+	cert.Leaf, err = certLeaf(&cert)
+	if err != nil {
+		return err
+	}
+
+	fc.cert = &cert
+	fc.modTime = modTime
+
+	return nil
+}
+
+// filesModTime is the later of the two files' modification times
+func (fc *fileCerts) filesModTime() (time.Time, error) {
+	ret := time.Time{}
+
+	for _, path := range []string{fc.certFile, fc.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, jsrest.Errorf(jsrest.ErrInternalServerError, "stat failed (%w)", err)
+		}
+
+		if fi.ModTime().After(ret) {
+			ret = fi.ModTime()
+		}
+	}
+
+	return ret, nil
+}
+
+func (ac *acmeCerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := ac.manager.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	// Challenge responses aren't served to clients
+	isChallenge := len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+
+	if !isChallenge && cert.Leaf != nil {
+		ac.mu.Lock()
+		ac.served[hello.ServerName] = cert.Leaf
+		ac.mu.Unlock()
+	}
+
+	return cert, nil
+}
+
+func (ac *acmeCerts) leaves() map[string]*x509.Certificate {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ret := map[string]*x509.Certificate{}
+
+	for name, leaf := range ac.served {
+		ret[name] = leaf
+	}
+
+	return ret
+}
+
+// reload does nothing, since autocert renews certificates itself
+func (ac *acmeCerts) reload() error {
+	return nil
+}
+
+func certLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "parse certificate failed (%w)", err)
+	}
+
+	return leaf, nil
+}
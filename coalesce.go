@@ -0,0 +1,106 @@
+package patchy
+
+import (
+	"time"
+)
+
+// A pending debounced update is sent at most this many debounce periods
+// after the first change, so continuous writes can't starve the stream
+const debounceMaxWaitFactor = 10
+
+// SetStreamDebounce sets the default _debounce for list streams
+func (api *API) SetStreamDebounce(debounce time.Duration) {
+	api.streamDebounce = debounce
+}
+
+// SetStreamMaxRate sets the default _maxRate (updates per second) for list
+// streams
+func (api *API) SetStreamMaxRate(maxRate float64) {
+	api.streamMaxRate = maxRate
+}
+
+// coalesceLists passes the initial list through immediately, then replaces
+// bursts of lists with the last one. The returned channel closes when in
+// closes.
+func coalesceLists(in <-chan []any, debounce time.Duration, maxRate float64) <-chan []any {
+	out := make(chan []any, 100)
+
+	minInterval := time.Duration(0)
+	if maxRate > 0 {
+		minInterval = time.Duration(float64(time.Second) / maxRate)
+	}
+
+	go func() {
+		defer close(out)
+
+		timer := time.NewTimer(0)
+		stopTimer(timer)
+
+		var pending []any
+
+		hasPending := false
+		initial := true
+		first := time.Time{}
+		lastSent := time.Time{}
+
+		for {
+			select {
+			case list, ok := <-in:
+				if !ok {
+					if hasPending {
+						out <- pending
+					}
+
+					return
+				}
+
+				now := time.Now()
+
+				if initial {
+					initial = false
+					lastSent = now
+					out <- list
+
+					continue
+				}
+
+				if !hasPending {
+					first = now
+				}
+
+				pending = list
+				hasPending = true
+
+				due := now.Add(debounce)
+
+				if debounce > 0 && due.Sub(first) > debounce*debounceMaxWaitFactor {
+					due = first.Add(debounce * debounceMaxWaitFactor)
+				}
+
+				if due.Sub(lastSent) < minInterval {
+					due = lastSent.Add(minInterval)
+				}
+
+				stopTimer(timer)
+				timer.Reset(time.Until(due))
+
+			case <-timer.C:
+				lastSent = time.Now()
+				out <- pending
+				pending = nil
+				hasPending = false
+			}
+		}
+	}()
+
+	return out
+}
+
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
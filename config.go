@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/gopatchy/jsrest"
 	"github.com/gopatchy/metadata"
+	"github.com/gopatchy/path"
 )
 
 var ErrMissingAuthCheck = errors.New("missing auth check")
@@ -27,10 +29,29 @@ type config struct {
 	mayWrite func(context.Context, any, any, *API) error
 	listHook ListHook
 
+	// Paths that are never returned to clients (secrets, hashes)
+	hidePaths     []string
+	passwordPaths []string
+	apiKeyPaths   *APIKeyPaths
+	sessionPaths  *SessionPaths
+
+	// Secrets that are returned to clients (bearer tokens); redacted in
+	// audit records along with hidePaths
+	secretPaths []string
+
+	// Schema migrations, indexed by from-version
+	migrations []Migration
+	migrateMu  sync.Mutex
+	migrated   bool
+	migrateErr error
+
 	// Per-key read/modify/write (update and replace) operation locking
 	// This ensures monotonic generation numbers
 	mu    sync.Mutex
 	locks map[string]*lock
+
+	// Set by RegisterName
+	lockWait func(time.Duration)
 }
 
 type lock struct {
@@ -91,13 +112,28 @@ func (cfg *config) isSafe() error {
 }
 
 func (cfg *config) checkRead(ctx context.Context, obj any, api *API) (any, error) {
+	err := checkScope(ctx, "read", cfg.apiName)
+	if err != nil {
+		return nil, err
+	}
+
 	ret, err := cfg.clone(obj)
 	if err != nil {
 		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clone failed (%w)", err)
 	}
 
+	if !isLookup(ctx) {
+		err = cfg.hide(ret)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "hide failed (%w)", err)
+		}
+	}
+
 	if cfg.mayRead != nil {
-		err := cfg.mayRead(ctx, ret, api)
+		spanCtx, span := api.startSpan(ctx, "mayRead", cfg)
+		err = cfg.mayRead(spanCtx, ret, api)
+		endSpan(span, err)
+
 		if err != nil {
 			return nil, jsrest.Errorf(jsrest.ErrUnauthorized, "not authorized to read (%w)", err)
 		}
@@ -122,11 +158,14 @@ func (cfg *config) checkReadList(ctx context.Context, list []any, api *API) ([]a
 }
 
 func (cfg *config) checkWrite(ctx context.Context, obj, prev any, api *API) (any, error) {
+	err := checkScope(ctx, "write", cfg.apiName)
+	if err != nil {
+		return nil, err
+	}
+
 	var ret any
 
 	if obj != nil {
-		var err error
-
 		ret, err = cfg.clone(obj)
 		if err != nil {
 			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clone failed (%w)", err)
@@ -134,7 +173,10 @@ func (cfg *config) checkWrite(ctx context.Context, obj, prev any, api *API) (any
 	}
 
 	if cfg.mayWrite != nil {
-		err := cfg.mayWrite(ctx, ret, prev, api)
+		spanCtx, span := api.startSpan(ctx, "mayWrite", cfg)
+		err = cfg.mayWrite(spanCtx, ret, prev, api)
+		endSpan(span, err)
+
 		if err != nil {
 			return nil, jsrest.Errorf(jsrest.ErrUnauthorized, "not authorized to write (%w)", err)
 		}
@@ -159,7 +201,47 @@ func (cfg *config) clone(src any) (any, error) {
 	return dst, nil
 }
 
+func (cfg *config) hide(obj any) error {
+	for _, p := range cfg.hidePaths {
+		err := path.Set(obj, p, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unhide copies hidden values from src to dst where dst has none, so that
+// a replace of a previously read object doesn't clear them
+func (cfg *config) unhide(dst, src any) error {
+	for _, p := range cfg.hidePaths {
+		val, err := getString(dst, p)
+		if err != nil {
+			return err
+		}
+
+		if val != "" {
+			continue
+		}
+
+		val, err = getString(src, p)
+		if err != nil {
+			return err
+		}
+
+		err = path.Set(dst, p, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (cfg *config) lock(id string) {
+	start := time.Now()
+
 	cfg.mu.Lock()
 
 	entry := cfg.locks[id]
@@ -172,6 +254,10 @@ func (cfg *config) lock(id string) {
 	cfg.mu.Unlock()
 
 	entry.mu.Lock()
+
+	if cfg.lockWait != nil {
+		cfg.lockWait(time.Since(start))
+	}
 }
 
 func (cfg *config) unlock(id string) {
@@ -0,0 +1,168 @@
+package patchy
+
+import (
+	"net/http"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy controls cross-origin access. Without a policy, any origin may
+// make uncredentialed requests.
+type CORSPolicy struct {
+	// Allowed Origin header values. Entries containing "*" are glob patterns
+	// (e.g. "https://*.example.com"). Empty allows any origin.
+	Origins []string `yaml:"origins"`
+
+	// Methods allowed by preflight, further limited to those the route
+	// supports; empty allows all
+	Methods []string `yaml:"methods"`
+
+	// Request headers allowed by preflight; empty allows any
+	Headers []string `yaml:"headers"`
+
+	// Allow cookies (sessions); requires Origins
+	Credentials bool `yaml:"credentials"`
+
+	// Preflight cache lifetime; zero uses DefaultCORSMaxAge, negative
+	// disables caching
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+const DefaultCORSMaxAge = 24 * time.Hour
+
+// Wildcards are not honored in credentialed responses, so headers are listed
+const corsExposeHeaders = "ETag, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, Stream-Format"
+
+func (api *API) SetCORSPolicy(policy *CORSPolicy) {
+	api.cors = policy
+}
+
+// writeCORSHeaders writes nothing for disallowed origins
+func (api *API) writeCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	policy := api.corsPolicy()
+
+	allowOrigin := "*"
+
+	if len(policy.Origins) > 0 {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if !policy.allowsOrigin(origin) {
+			return
+		}
+
+		allowOrigin = origin
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+	w.Header().Set("Timing-Allow-Origin", allowOrigin)
+
+	if policy.credentials(allowOrigin) {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	} else {
+		w.Header().Set("Access-Control-Expose-Headers", "*")
+	}
+}
+
+// handlePreflight is only reached for registered routes; the router sets
+// the Allow header to the route's methods before calling it
+func (api *API) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	policy := api.corsPolicy()
+
+	// CORS headers were written in serveHTTP if the origin is allowed
+	allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+	if allowOrigin == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	methods := []string{}
+
+	for _, method := range strings.Split(w.Header().Get("Allow"), ", ") {
+		if method == http.MethodOptions || !policy.allowsMethod(method) {
+			continue
+		}
+
+		methods = append(methods, method)
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	switch {
+	case len(policy.Headers) > 0:
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+
+	case policy.credentials(allowOrigin):
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+
+	default:
+		w.Header().Set("Access-Control-Allow-Headers", "*")
+	}
+
+	maxAge := policy.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultCORSMaxAge
+	}
+
+	if maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *API) corsPolicy() *CORSPolicy {
+	if api.cors == nil {
+		return &CORSPolicy{}
+	}
+
+	return api.cors
+}
+
+func (policy *CORSPolicy) credentials(allowOrigin string) bool {
+	return policy.Credentials && allowOrigin != "*"
+}
+
+func (policy *CORSPolicy) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range policy.Origins {
+		allowed = strings.ToLower(allowed)
+
+		if !strings.Contains(allowed, "*") {
+			if allowed == origin {
+				return true
+			}
+
+			continue
+		}
+
+		match, err := pathpkg.Match(allowed, origin)
+		if err == nil && match {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy *CORSPolicy) allowsMethod(method string) bool {
+	if len(policy.Methods) == 0 {
+		return true
+	}
+
+	for _, allowed := range policy.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+
+	return false
+}
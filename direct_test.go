@@ -1,12 +1,17 @@
 package patchy_test
 
 import (
+	"bytes"
 	"context"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gopatchy/patchy"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestDirectGetNotFound(t *testing.T) {
@@ -493,6 +498,66 @@ func TestDirectStreamListOpts(t *testing.T) {
 	require.Contains(t, []string{"foo", "bar"}, s1[0].Text)
 }
 
+func TestDirectStreamListDebounce(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	stream, err := patchy.StreamList[testType](ctx, ta.api, &patchy.ListOpts{Debounce: 200 * time.Millisecond})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Len(t, s1, 0)
+
+	for i := 0; i < 10; i++ {
+		_, err = patchy.Create[testType](ctx, ta.api, &testType{Text: "foo"})
+		require.NoError(t, err)
+	}
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Len(t, s2, 10)
+
+	select {
+	case <-stream.Chan():
+		require.Fail(t, "unexpected list")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDirectStreamListMaxRate(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	ctx := context.Background()
+
+	stream, err := patchy.StreamList[testType](ctx, ta.api, &patchy.ListOpts{MaxRate: 4})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+
+	start := time.Now()
+
+	_, err = patchy.Create[testType](ctx, ta.api, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Len(t, s2, 1)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
 func TestReplicateCreate(t *testing.T) {
 	t.Parallel()
 
@@ -611,3 +676,124 @@ func TestReplicateDelete(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, list, 0)
 }
+
+func TestDirectBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	src, err := patchy.NewAPIMemory()
+	require.NoError(t, err)
+
+	defer func() {
+		err := src.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	patchy.Register[testType](src)
+
+	foo, err := patchy.Create[testType](ctx, src, &testType{Text: "foo"})
+	require.NoError(t, err)
+
+	foo, err = patchy.Update[testType](ctx, src, foo.ID, &testType{Text: "foo2"}, nil)
+	require.NoError(t, err)
+
+	bar, err := patchy.Create[testType](ctx, src, &testType{Text: "bar"})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+
+	err = src.Backup(ctx, buf)
+	require.NoError(t, err)
+
+	dst, err := patchy.NewAPIMemory()
+	require.NoError(t, err)
+
+	defer func() {
+		err := dst.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+
+	patchy.Register[testType](dst)
+
+	_, err = patchy.Create[testType](ctx, dst, &testType{Text: "stray"})
+	require.NoError(t, err)
+
+	err = dst.Restore(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	list, err := patchy.List[testType](ctx, dst, nil)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	get, err := patchy.Get[testType](ctx, dst, foo.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "foo2", get.Text)
+	require.EqualValues(t, 2, get.Generation)
+	require.Equal(t, foo.ETag, get.ETag)
+
+	get, err = patchy.Get[testType](ctx, dst, bar.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "bar", get.Text)
+	require.EqualValues(t, 1, get.Generation)
+
+	// Truncated archives are rejected before their type is written
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	err = dst.Restore(ctx, strings.NewReader(strings.Join(lines[:2], "")))
+	require.ErrorIs(t, err, patchy.ErrBackupFormat)
+
+	// As are those that record a failed export
+	err = dst.Restore(ctx, strings.NewReader(lines[0]+lines[1]+`{"error":"oops"}`+"\n"))
+	require.ErrorIs(t, err, patchy.ErrBackupIncomplete)
+
+	err = dst.Restore(ctx, strings.NewReader(`{"format":"patchy-backup","version":1,"types":[{"name":"nope"}]}`))
+	require.ErrorIs(t, err, patchy.ErrBackupUnknownType)
+
+	list, err = patchy.List[testType](ctx, dst, nil)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+}
+
+func TestDirectTracing(t *testing.T) {
+	t.Parallel()
+
+	ta := newTestAPI(t)
+	defer ta.shutdown(t)
+
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	ta.api.SetTracerProvider(tp)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "test")
+
+	created, err := patchy.Create[mayType](ctx, ta.api, &mayType{Text1: "foo"})
+	require.NoError(t, err)
+
+	stream, err := patchy.StreamGet[mayType](ctx, ta.api, created.ID)
+	require.NoError(t, err)
+
+	obj := stream.Read()
+	require.NotNil(t, obj, stream.Error())
+	require.Equal(t, "foo", obj.Text1)
+
+	stream.Close()
+	parent.End()
+
+	spans := map[string]tracetest.SpanStub{}
+
+	for _, span := range exp.GetSpans() {
+		require.Equal(t, parent.SpanContext().TraceID(), span.SpanContext.TraceID())
+		spans[span.Name] = span
+	}
+
+	require.Equal(t, parent.SpanContext().SpanID(), spans["create"].Parent.SpanID())
+	require.Equal(t, spans["create"].SpanContext.SpanID(), spans["store.write"].Parent.SpanID())
+	require.Contains(t, spans["create"].Attributes, attribute.String("patchy.typeName", "maytype"))
+
+	// The stream span covers reads of every version
+	streamGet := spans["streamGet"]
+	require.Equal(t, parent.SpanContext().SpanID(), streamGet.Parent.SpanID())
+	require.Contains(t, streamGet.Attributes, attribute.String("patchy.id", created.ID))
+	require.Equal(t, streamGet.SpanContext.SpanID(), spans["mayRead"].Parent.SpanID())
+}
@@ -0,0 +1,64 @@
+package patchy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gopatchy/jsrest"
+)
+
+// enterHandler tracks a request until exitHandler, so Shutdown can wait for
+// it. It returns false once Shutdown has started.
+func (api *API) enterHandler() bool {
+	api.handlersMu.Lock()
+	defer api.handlersMu.Unlock()
+
+	if api.shuttingDown.Load() {
+		return false
+	}
+
+	api.handlersWG.Add(1)
+
+	return true
+}
+
+func (api *API) exitHandler() {
+	api.handlersWG.Done()
+}
+
+// startDrain refuses new requests and tells streams to finish
+func (api *API) startDrain() {
+	api.handlersMu.Lock()
+	defer api.handlersMu.Unlock()
+
+	if api.shuttingDown.Load() {
+		return
+	}
+
+	api.shuttingDown.Store(true)
+	close(api.draining)
+}
+
+// waitHandlers waits for tracked requests to return, including those from
+// other http.Servers, which srv.Shutdown doesn't know about
+func (api *API) waitHandlers(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		api.handlersWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		return jsrest.Errorf(jsrest.ErrServiceUnavailable, "wait for handlers failed (%w)", ctx.Err())
+	}
+}
+
+func writeDraining(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	jsrest.WriteError(w, jsrest.Errorf(jsrest.ErrServiceUnavailable, "%w", ErrShuttingDown))
+}
@@ -2,8 +2,11 @@ package patchy
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (api *API) EventClient() *event.Client {
@@ -24,10 +27,30 @@ func (api *API) SetEventData(ctx context.Context, vals ...any) {
 	ev.(*event.Event).Set(vals...)
 }
 
+// writeError writes err to the client and records it in the request event
+func (api *API) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	jsrest.WriteError(w, err)
+
+	api.SetEventData(r.Context(),
+		"type", "httpError",
+		"responseError", err.Error(),
+	)
+
+	hErr := jsrest.GetHTTPError(err)
+	if hErr != nil {
+		api.SetEventData(r.Context(), "responseCode", hErr.Code)
+	}
+}
+
 func EventHookSpanID(ctx context.Context, ev *event.Event) {
 	spanID := ctx.Value(ContextSpanID)
 
 	if spanID != nil {
 		ev.Set("spanID", spanID.(string))
 	}
+
+	sc := trace.SpanContextFromContext(ctx)
+	if sc.HasTraceID() {
+		ev.Set("traceID", sc.TraceID().String())
+	}
 }
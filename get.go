@@ -4,25 +4,70 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
+	"github.com/gopatchy/jsrest"
 	"github.com/vfaronov/httpheader"
 )
 
 type GetOpts struct {
 	IfNoneMatch []httpheader.EntityTag
 
+	// Streams only: "full" (default) or "patch", which sends updates as
+	// merge patches against the previous object
+	Stream string
+
+	// Streams only
+	Heartbeat   time.Duration
+	MaxDuration time.Duration
+
 	// This is "any" because making GetOpts generic complicates too many things
 	Prev any
 }
 
 var (
+	validGetStream = map[string]bool{
+		"full":  true,
+		"patch": true,
+	}
+
 	ErrInvalidIfNoneMatch           = errors.New("invalid If-None-Match")
 	ErrIfNoneMatchUnknownType       = fmt.Errorf("unknown type (%w)", ErrInvalidIfNoneMatch)
 	ErrIfNoneMatchInvalidGeneration = fmt.Errorf("invalid generation (%w)", ErrInvalidIfNoneMatch)
 )
 
-func parseGetOpts(r *http.Request) *GetOpts {
-	return &GetOpts{
-		IfNoneMatch: httpheader.IfNoneMatch(r.Header),
+func (api *API) parseGetOpts(r *http.Request) (*GetOpts, error) {
+	ret, err := api.parseGetForm(r.Form)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.IfNoneMatch = httpheader.IfNoneMatch(r.Header)
+
+	return ret, nil
+}
+
+// parseGetForm parses query parameters, shared by HTTP and WebSocket
+func (api *API) parseGetForm(form url.Values) (*GetOpts, error) {
+	ret := &GetOpts{
+		Stream: "full",
 	}
+
+	if form.Has("_stream") {
+		ret.Stream = form.Get("_stream")
+	}
+
+	if !validGetStream[ret.Stream] {
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", ret.Stream, ErrInvalidStreamFormat)
+	}
+
+	var err error
+
+	ret.Heartbeat, ret.MaxDuration, err = api.parseStreamTiming(form)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
 }
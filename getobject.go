@@ -19,7 +19,10 @@ func (api *API) getObject(cfg *config, id string, w http.ResponseWriter, r *http
 		"stream", false,
 	)
 
-	opts := parseGetOpts(r)
+	opts, err := api.parseGetOpts(r)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "parse get parameters failed (%w)", err)
+	}
 
 	obj, err := api.getInt(ctx, cfg, id)
 	if err != nil {
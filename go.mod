@@ -7,6 +7,7 @@ require (
 	github.com/dchest/uniuri v1.2.0
 	github.com/getkin/kin-openapi v0.118.0
 	github.com/go-resty/resty/v2 v2.7.0
+	github.com/gopatchy/bus v0.0.0-20230611030146-6751438c7f57
 	github.com/gopatchy/event v0.0.0-20230617221934-85df8edcde92
 	github.com/gopatchy/header v0.0.0-20230617154522-b63854f75939
 	github.com/gopatchy/jsrest v0.0.0-20230617154508-e18710a310af
@@ -15,29 +16,35 @@ require (
 	github.com/gopatchy/potency v0.0.0-20230617154544-43d230e5cf5f
 	github.com/gopatchy/proxy v0.0.0-20230608062432-7adc14d65656
 	github.com/gopatchy/selfcert v0.0.0-20230617154536-65aad096a788
+	github.com/gopatchy/store v0.0.0-20230611030019-6d3effdbe685
 	github.com/gopatchy/storebus v0.0.0-20230617154532-b65649a3b18c
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/stretchr/testify v1.8.4
 	github.com/vfaronov/httpheader v0.1.0
+	go.opentelemetry.io/otel v1.16.0
+	go.opentelemetry.io/otel/sdk v1.16.0
+	go.opentelemetry.io/otel/trace v1.16.0
 	go.uber.org/goleak v1.2.1
 	golang.org/x/crypto v0.10.0
 	golang.org/x/net v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.2.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/go-openapi/jsonpointer v0.19.6 // indirect
 	github.com/go-openapi/swag v0.22.4 // indirect
-	github.com/gopatchy/bus v0.0.0-20230611030146-6751438c7f57 // indirect
-	github.com/gopatchy/store v0.0.0-20230611030019-6d3effdbe685 // indirect
 	github.com/invopop/yaml v0.2.0 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/mailru/easyjson v0.7.7 // indirect
-	github.com/mattn/go-sqlite3 v1.14.17 // indirect
 	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
 	github.com/perimeterx/marshmallow v1.1.4 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/otel/metric v1.16.0 // indirect
 	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1 // indirect
+	golang.org/x/sys v0.9.0 // indirect
 	golang.org/x/text v0.10.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,122 @@
+package gotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"test/goclient"
+)
+
+func TestAPIKeyRotate(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateApiKeyType(ctx, &goclient.ApiKeyType{
+		Name:   "foo",
+		Scopes: []string{"read:testtype", "write:apikeytype"},
+	})
+	require.NoError(t, err)
+
+	token, err := c.RotateApiKeyType(ctx, created.ID, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+
+	c.SetAPIKey(token)
+
+	_, err = c.ListTestType(ctx, nil)
+	require.NoError(t, err)
+
+	get, err := c.GetApiKeyType(ctx, created.ID, nil)
+	require.NoError(t, err)
+	require.Empty(t, get.Hash)
+	require.False(t, get.LastUsed.IsZero())
+
+	token2, err := c.RotateApiKeyType(ctx, created.ID, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, token, token2)
+
+	_, err = c.ListTestType(ctx, nil)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "API key not found or secret mismatch")
+
+	c.SetAPIKey(token2)
+
+	_, err = c.ListTestType(ctx, nil)
+	require.NoError(t, err)
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateApiKeyType(ctx, &goclient.ApiKeyType{
+		Name:   "foo",
+		Scopes: []string{"read:testtype"},
+	})
+	require.NoError(t, err)
+
+	token, err := c.RotateApiKeyType(ctx, created.ID, nil)
+	require.NoError(t, err)
+
+	c.SetAPIKey(token)
+
+	_, err = c.ListTestType(ctx, nil)
+	require.NoError(t, err)
+
+	_, err = c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+	require.Error(t, err)
+	require.ErrorContains(t, err, "insufficient scope")
+
+	_, err = c.ListApiKeyType(ctx, nil)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "insufficient scope")
+}
+
+func TestAPIKeyExpired(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	expires := time.Now().Add(-time.Minute)
+
+	created, err := c.CreateApiKeyType(ctx, &goclient.ApiKeyType{
+		Name:    "foo",
+		Scopes:  []string{"read:testtype"},
+		Expires: expires,
+	})
+	require.NoError(t, err)
+
+	token, err := c.RotateApiKeyType(ctx, created.ID, nil)
+	require.NoError(t, err)
+
+	c.SetAPIKey(token)
+
+	_, err = c.ListTestType(ctx, nil)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "API key expired")
+}
+
+func TestAPIKeyInvalid(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	c.SetAPIKey("foo.bar")
+
+	_, err := c.ListTestType(ctx, nil)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "API key not found or secret mismatch")
+}
@@ -3,8 +3,11 @@ package gotest
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"test/goclient"
 )
 
 func TestBasicAuthSuccess(t *testing.T) {
@@ -60,3 +63,38 @@ func TestBasicAuthOptional(t *testing.T) {
 	_, err := c.ListAuthBasicType(ctx, nil)
 	require.NoError(t, err)
 }
+
+func TestBasicAuthPassHidden(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	c.SetBasicAuth("foo", "abcd")
+
+	list, err := c.ListAuthBasicType(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Empty(t, list[0].Pass)
+}
+
+func TestBasicAuthLockoutRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	c.SetBasicAuth("foo", "bcde")
+
+	for i := 0; i < 10; i++ {
+		_, err := c.ListAuthBasicType(ctx, nil)
+		require.Error(t, err)
+	}
+
+	_, err := c.ListAuthBasicType(ctx, nil)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "too many failed login attempts")
+	require.Equal(t, 15*time.Minute, goclient.RetryAfter(err))
+}
@@ -0,0 +1,40 @@
+package gotest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"test/goclient"
+)
+
+func TestSessionLogin(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	err := c.Login(ctx, "foo", "abcd")
+	require.NoError(t, err)
+
+	create, err := c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+	require.NoError(t, err)
+	require.Equal(t, "foo", create.Text)
+
+	err = c.Logout(ctx)
+	require.NoError(t, err)
+}
+
+func TestSessionLoginInvalid(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	err := c.Login(ctx, "bar", "abcd")
+	require.Error(t, err)
+	require.ErrorContains(t, err, "user not found or password mismatch")
+}
@@ -45,6 +45,45 @@ func TestStreamGetHeartbeat(t *testing.T) {
 	require.Less(t, time.Since(stream.LastEventReceived()), 6*time.Second)
 }
 
+func TestStreamGetMaxDuration(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+	require.NoError(t, err)
+
+	stream, err := c.StreamGetTestType(ctx, created.ID, &goclient.GetOpts[goclient.TestType]{MaxDuration: 300 * time.Millisecond})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Equal(t, "foo", s1.Text)
+
+	// Reconnects must not repeat the object or close the stream
+	select {
+	case _, ok := <-stream.Chan():
+		if ok {
+			require.Fail(t, "unexpected object")
+		} else {
+			require.Fail(t, "unexpected closure", stream.Error())
+		}
+
+	case <-time.After(700 * time.Millisecond):
+	}
+
+	_, err = c.UpdateTestType(ctx, created.ID, &goclient.TestType{Text: "bar"}, nil)
+	require.NoError(t, err)
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Equal(t, "bar", s2.Text)
+}
+
 func TestStreamGet(t *testing.T) {
 	t.Parallel()
 
@@ -125,3 +164,42 @@ func TestStreamGetPrev(t *testing.T) {
 	require.Equal(t, "foo", s2.Text)
 	require.EqualValues(t, 1, s2.Num)
 }
+
+func TestStreamGetPatch(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateTestType(ctx, &goclient.TestType{Text: "foo", Num: 1})
+	require.NoError(t, err)
+
+	stream, err := c.StreamGetTestType(ctx, created.ID, &goclient.GetOpts[goclient.TestType]{Stream: "patch"})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Equal(t, "foo", s1.Text)
+	require.EqualValues(t, 1, s1.Num)
+
+	updated, err := c.UpdateTestType(ctx, created.ID, &goclient.TestType{Text: "bar"}, nil)
+	require.NoError(t, err)
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Equal(t, "bar", s2.Text)
+	require.EqualValues(t, 1, s2.Num)
+	require.Equal(t, updated.ETag, s2.ETag)
+	require.Equal(t, updated.Generation, s2.Generation)
+
+	_, err = c.UpdateTestType(ctx, created.ID, &goclient.TestType{Num: 2}, nil)
+	require.NoError(t, err)
+
+	s3 := stream.Read()
+	require.NotNil(t, s3, stream.Error())
+	require.Equal(t, "bar", s3.Text)
+	require.EqualValues(t, 2, s3.Num)
+}
@@ -120,6 +120,69 @@ func TestStreamListUpdate(t *testing.T) {
 	require.Equal(t, "bar", s2[0].Text)
 }
 
+func TestStreamListDebounce(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	stream, err := c.StreamListTestType(ctx, &goclient.ListOpts[goclient.TestType]{Debounce: 200 * time.Millisecond})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Len(t, s1, 0)
+
+	for i := 0; i < 5; i++ {
+		_, err = c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+		require.NoError(t, err)
+	}
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Len(t, s2, 5)
+}
+
+func TestStreamListMaxDuration(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	stream, err := c.StreamListTestType(ctx, &goclient.ListOpts[goclient.TestType]{MaxDuration: 300 * time.Millisecond})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Len(t, s1, 0)
+
+	// Reconnects must not repeat the list or close the stream
+	select {
+	case _, ok := <-stream.Chan():
+		if ok {
+			require.Fail(t, "unexpected list")
+		} else {
+			require.Fail(t, "unexpected closure", stream.Error())
+		}
+
+	case <-time.After(700 * time.Millisecond):
+	}
+
+	_, err = c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+	require.NoError(t, err)
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Len(t, s2, 1)
+	require.Equal(t, "foo", s2[0].Text)
+}
+
 func TestStreamListDelete(t *testing.T) {
 	t.Parallel()
 
@@ -615,3 +678,78 @@ func TestStreamListForceDiff(t *testing.T) {
 	require.Equal(t, "text/event-stream", resp.Header().Get("Content-Type"))
 	require.Equal(t, "diff", resp.Header().Get("Stream-Format"))
 }
+
+func TestStreamListDiffMaxDuration(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	_, err := c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+	require.NoError(t, err)
+
+	stream, err := c.StreamListTestType(ctx, &goclient.ListOpts[goclient.TestType]{Stream: "diff", MaxDuration: 300 * time.Millisecond})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Len(t, s1, 1)
+
+	select {
+	case _, ok := <-stream.Chan():
+		if ok {
+			require.Fail(t, "unexpected list")
+		} else {
+			require.Fail(t, "unexpected closure", stream.Error())
+		}
+
+	case <-time.After(700 * time.Millisecond):
+	}
+
+	_, err = c.CreateTestType(ctx, &goclient.TestType{Text: "bar"})
+	require.NoError(t, err)
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Len(t, s2, 2)
+}
+
+func TestStreamListPatch(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateTestType(ctx, &goclient.TestType{Text: "foo", Num: 1})
+	require.NoError(t, err)
+
+	_, err = c.CreateTestType(ctx, &goclient.TestType{Text: "bar", Num: 2})
+	require.NoError(t, err)
+
+	stream, err := c.StreamListTestType(ctx, &goclient.ListOpts[goclient.TestType]{Stream: "patch", Sorts: []string{"+text"}})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Len(t, s1, 2)
+	require.Equal(t, "bar", s1[0].Text)
+	require.Equal(t, "foo", s1[1].Text)
+
+	updated, err := c.UpdateTestType(ctx, created.ID, &goclient.TestType{Text: "aaa"}, nil)
+	require.NoError(t, err)
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Len(t, s2, 2)
+	require.Equal(t, "aaa", s2[0].Text)
+	require.EqualValues(t, 1, s2[0].Num)
+	require.Equal(t, updated.ETag, s2[0].ETag)
+	require.Equal(t, "bar", s2[1].Text)
+	require.EqualValues(t, 2, s2[1].Num)
+}
@@ -0,0 +1,112 @@
+package gotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"test/goclient"
+)
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+	require.NoError(t, err)
+
+	sub, err := c.Subscribe(ctx)
+	require.NoError(t, err)
+
+	defer sub.Close()
+
+	gs, err := sub.StreamGetTestType(ctx, created.ID, nil)
+	require.NoError(t, err)
+
+	defer gs.Close()
+
+	ls, err := sub.StreamListTestType(ctx, &goclient.ListOpts[goclient.TestType]{Stream: "diff"})
+	require.NoError(t, err)
+
+	defer ls.Close()
+
+	g1 := gs.Read()
+	require.NotNil(t, g1, gs.Error())
+	require.Equal(t, "foo", g1.Text)
+
+	l1 := ls.Read()
+	require.NotNil(t, l1, ls.Error())
+	require.Len(t, l1, 1)
+	require.Equal(t, "foo", l1[0].Text)
+
+	_, err = c.UpdateTestType(ctx, created.ID, &goclient.TestType{Text: "bar"}, nil)
+	require.NoError(t, err)
+
+	g2 := gs.Read()
+	require.NotNil(t, g2, gs.Error())
+	require.Equal(t, "bar", g2.Text)
+
+	l2 := ls.Read()
+	require.NotNil(t, l2, ls.Error())
+	require.Len(t, l2, 1)
+	require.Equal(t, "bar", l2[0].Text)
+
+	// Closing one stream leaves the others running
+	gs.Close()
+
+	_, err = c.CreateTestType(ctx, &goclient.TestType{Text: "zig"})
+	require.NoError(t, err)
+
+	l3 := ls.Read()
+	require.NotNil(t, l3, ls.Error())
+	require.Len(t, l3, 2)
+}
+
+func TestSubscribeMaxDuration(t *testing.T) {
+	t.Parallel()
+
+	defer registerTest(t)()
+	c := getClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateTestType(ctx, &goclient.TestType{Text: "foo"})
+	require.NoError(t, err)
+
+	sub, err := c.Subscribe(ctx)
+	require.NoError(t, err)
+
+	defer sub.Close()
+
+	stream, err := sub.StreamGetTestType(ctx, created.ID, &goclient.GetOpts[goclient.TestType]{MaxDuration: 300 * time.Millisecond})
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	s1 := stream.Read()
+	require.NotNil(t, s1, stream.Error())
+	require.Equal(t, "foo", s1.Text)
+
+	// Reconnects must not repeat the object or close the stream
+	select {
+	case _, ok := <-stream.Chan():
+		if ok {
+			require.Fail(t, "unexpected object")
+		} else {
+			require.Fail(t, "unexpected closure", stream.Error())
+		}
+
+	case <-time.After(700 * time.Millisecond):
+	}
+
+	_, err = c.UpdateTestType(ctx, created.ID, &goclient.TestType{Text: "bar"}, nil)
+	require.NoError(t, err)
+
+	s2 := stream.Read()
+	require.NotNil(t, s2, stream.Error())
+	require.Equal(t, "bar", s2.Text)
+}
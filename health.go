@@ -0,0 +1,225 @@
+package patchy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gopatchy/jsrest"
+	"github.com/julienschmidt/httprouter"
+)
+
+type HealthCheck func(context.Context) error
+
+// HealthStatus is returned by /_health/live and /_health/ready, with status
+// 200 when all checks pass and 503 otherwise
+type HealthStatus struct {
+	Status string                        `json:"status"`
+	Checks map[string]*HealthCheckStatus `json:"checks"`
+}
+
+type HealthCheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// In seconds
+	Latency float64 `json:"latency"`
+}
+
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+var (
+	ErrNoTypes             = errors.New("no types registered")
+	ErrListenerNotServing  = errors.New("listener not serving")
+	ErrShuttingDown        = errors.New("shutting down")
+	ErrMigrationInProgress = errors.New("migration in progress")
+)
+
+// Probes should fail before the prober gives up
+const healthTimeout = 5 * time.Second
+
+// AddHealthCheck adds a readiness check. Checks run concurrently on every
+// request to /_health/ready.
+func (api *API) AddHealthCheck(name string, check HealthCheck) {
+	api.healthChecks = append(api.healthChecks, &namedHealthCheck{
+		name:  name,
+		check: check,
+	})
+}
+
+// readyChecks are the built-in checks followed by those from AddHealthCheck
+func (api *API) readyChecks() []*namedHealthCheck {
+	return append([]*namedHealthCheck{
+		{name: "store", check: api.checkStoreHealth},
+		{name: "types", check: api.checkTypesHealth},
+		{name: "migrations", check: api.checkMigrationsHealth},
+		{name: "listener", check: api.checkListenerHealth},
+		{name: "certificates", check: api.checkCertificateHealth},
+	}, api.healthChecks...)
+}
+
+func (api *API) runHealthChecks(ctx context.Context, checks []*namedHealthCheck) *HealthStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	hs := &HealthStatus{
+		Status: "ok",
+		Checks: map[string]*HealthCheckStatus{},
+	}
+
+	statuses := make([]*HealthCheckStatus, len(checks))
+	wg := sync.WaitGroup{}
+
+	for i, nc := range checks {
+		wg.Add(1)
+
+		go func(i int, nc *namedHealthCheck) {
+			defer wg.Done()
+			statuses[i] = runHealthCheck(ctx, nc.check)
+		}(i, nc)
+	}
+
+	wg.Wait()
+
+	for i, nc := range checks {
+		hs.Checks[nc.name] = statuses[i]
+
+		if statuses[i].Status != "ok" {
+			hs.Status = "error"
+		}
+	}
+
+	return hs
+}
+
+func runHealthCheck(ctx context.Context, check HealthCheck) *HealthCheckStatus {
+	start := time.Now()
+
+	err := check(ctx)
+
+	hcs := &HealthCheckStatus{
+		Status:  "ok",
+		Latency: time.Since(start).Seconds(),
+	}
+
+	if err != nil {
+		hcs.Status = "error"
+		hcs.Error = err.Error()
+	}
+
+	return hcs
+}
+
+// checkStoreHealth reads an object that doesn't exist, which needs a
+// working store but doesn't depend on any data
+func (api *API) checkStoreHealth(ctx context.Context) error {
+	_, err := api.sb.Read(ctx, schemaType, "_health", func() any { return &schemaVersion{} })
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrServiceUnavailable, "read failed (%w)", err)
+	}
+
+	return nil
+}
+
+func (api *API) checkTypesHealth(_ context.Context) error {
+	if len(api.registry) == 0 {
+		return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%w", ErrNoTypes)
+	}
+
+	return nil
+}
+
+// checkMigrationsHealth fails while migrations run, after they fail, or if
+// the stored schema is newer than ours. Pending migrations pass, since they
+// run on first access.
+func (api *API) checkMigrationsHealth(ctx context.Context) error {
+	for _, name := range api.names() {
+		cfg := api.registry[name]
+
+		if len(cfg.migrations) == 0 {
+			continue
+		}
+
+		if !cfg.migrateMu.TryLock() {
+			return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s (%w)", name, ErrMigrationInProgress)
+		}
+
+		migrated, migrateErr := cfg.migrated, cfg.migrateErr
+
+		cfg.migrateMu.Unlock()
+
+		if migrated {
+			continue
+		}
+
+		if migrateErr != nil {
+			return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s: migrate failed (%w)", name, migrateErr)
+		}
+
+		version, _, err := api.getSchemaVersion(ctx, cfg)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s (%w)", name, err)
+		}
+
+		if version > int64(len(cfg.migrations)) {
+			return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s: stored schema version %d is newer than %d", name, version, len(cfg.migrations))
+		}
+	}
+
+	return nil
+}
+
+// checkListenerHealth passes when API is served by another http.Server
+func (api *API) checkListenerHealth(_ context.Context) error {
+	if api.shuttingDown.Load() {
+		return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%w", ErrShuttingDown)
+	}
+
+	for _, li := range api.getListeners() {
+		if !li.serving.Load() {
+			return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s (%w)", li.name, ErrListenerNotServing)
+		}
+	}
+
+	return nil
+}
+
+func (api *API) handleHealth(w http.ResponseWriter, r *http.Request, checks []*namedHealthCheck) {
+	api.SetEventData(r.Context(), "operation", "health")
+
+	hs := api.runHealthChecks(r.Context(), checks)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if hs.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		api.SetEventData(r.Context(), "responseCode", http.StatusServiceUnavailable)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+
+	_ = enc.Encode(hs) //nolint:errchkjson
+}
+
+func (api *API) registerHealthHandlers() {
+	// Liveness only shows that requests are being handled
+	api.router.GET(
+		"/_health/live",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) { api.handleHealth(w, r, nil) },
+	)
+
+	api.router.GET(
+		"/_health/ready",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			api.handleHealth(w, r, api.readyChecks())
+		},
+	)
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/gopatchy/jsrest"
 	"github.com/gopatchy/metadata"
 	"github.com/gopatchy/path"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type getStreamInt struct {
@@ -16,6 +18,7 @@ type getStreamInt struct {
 	cfg    *config
 	id     string
 	sbChan <-chan any
+	span   trace.Span
 }
 
 type listStreamInt struct {
@@ -24,9 +27,57 @@ type listStreamInt struct {
 	api    *API
 	cfg    *config
 	sbChan <-chan []any
+	span   trace.Span
 }
 
-func (api *API) createInt(ctx context.Context, cfg *config, obj any) (any, error) {
+// mutation is a checked create, replace, update or delete, ready to store
+type mutation struct {
+	op string
+	id string
+
+	// Stored objects before and after; prev is nil for create and obj is nil
+	// for delete
+	prev any
+	obj  any
+}
+
+func (api *API) createInt(ctx context.Context, cfg *config, obj any) (_ any, err error) {
+	ctx, span := api.startSpan(ctx, "create", cfg)
+	defer func() { endSpan(span, err) }()
+
+	err = api.migrate(ctx, cfg)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
+	}
+
+	m, err := api.prepareCreate(ctx, cfg, obj)
+	if err != nil {
+		api.audit(ctx, cfg, m, err)
+		return nil, err
+	}
+
+	err = api.storeWrite(ctx, cfg, m.obj)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "write failed (%w)", err)
+	}
+
+	api.audit(ctx, cfg, m, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err = cfg.checkRead(ctx, m.obj, api)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrForbidden, "read check failed (%w)", err)
+	}
+
+	return obj, nil
+}
+
+// prepareCreate returns the object to write after write checks. The
+// mutation is returned even on error, for auditing.
+func (api *API) prepareCreate(ctx context.Context, cfg *config, obj any) (*mutation, error) {
 	md := metadata.GetMetadata(obj)
 
 	if ctx.Value(ContextWriteID) == nil || md.ID == "" {
@@ -37,57 +88,94 @@ func (api *API) createInt(ctx context.Context, cfg *config, obj any) (any, error
 		md.Generation = 1
 	}
 
+	m := &mutation{
+		op: "create",
+		id: md.ID,
+	}
+
 	obj, err := cfg.checkWrite(ctx, obj, nil, api)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
 	}
 
-	err = api.sb.Write(ctx, cfg.apiName, obj)
+	err = cfg.hashPasswords(ctx, obj, nil, api.passwordHasher)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "write failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrBadRequest, "hash password failed (%w)", err)
 	}
 
-	obj, err = cfg.checkRead(ctx, obj, api)
+	m.obj = obj
+
+	return m, nil
+}
+
+func (api *API) deleteInt(ctx context.Context, cfg *config, id string, opts *UpdateOpts) (err error) {
+	ctx, span := api.startSpan(ctx, "delete", cfg, attribute.String("patchy.id", id))
+	defer func() { endSpan(span, err) }()
+
+	err = api.migrate(ctx, cfg)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrForbidden, "read check failed (%w)", err)
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
 	}
 
-	return obj, nil
+	m, err := api.prepareDelete(ctx, cfg, id, opts)
+	if err != nil {
+		api.audit(ctx, cfg, m, err)
+		return err
+	}
+
+	err = api.storeDelete(ctx, cfg, id)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "delete failed: %s (%w)", id, err)
+	}
+
+	api.audit(ctx, cfg, m, err)
+
+	return err
 }
 
-func (api *API) deleteInt(ctx context.Context, cfg *config, id string, opts *UpdateOpts) error {
+func (api *API) prepareDelete(ctx context.Context, cfg *config, id string, opts *UpdateOpts) (*mutation, error) {
 	if opts == nil {
 		opts = &UpdateOpts{}
 	}
 
+	m := &mutation{
+		op: "delete",
+		id: id,
+	}
+
 	obj, err := api.sb.Read(ctx, cfg.apiName, id, cfg.factory)
 	if err != nil {
-		return jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
 	}
 
 	if obj == nil {
-		return jsrest.Errorf(jsrest.ErrNotFound, "%s", id)
+		return m, jsrest.Errorf(jsrest.ErrNotFound, "%s", id)
 	}
 
+	m.prev = obj
+
 	err = opts.ifMatch(obj)
 	if err != nil {
-		return jsrest.Errorf(jsrest.ErrInternalServerError, "match failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "match failed (%w)", err)
 	}
 
 	_, err = cfg.checkWrite(ctx, nil, obj, api)
 	if err != nil {
-		return jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
 	}
 
-	err = api.sb.Delete(ctx, cfg.apiName, id)
+	return m, nil
+}
+
+func (api *API) getInt(ctx context.Context, cfg *config, id string) (_ any, err error) {
+	ctx, span := api.startSpan(ctx, "get", cfg, attribute.String("patchy.id", id))
+	defer func() { endSpan(span, err) }()
+
+	err = api.migrate(ctx, cfg)
 	if err != nil {
-		return jsrest.Errorf(jsrest.ErrInternalServerError, "delete failed: %s (%w)", id, err)
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
 	}
 
-	return nil
-}
-
-func (api *API) getInt(ctx context.Context, cfg *config, id string) (any, error) {
 	obj, err := api.sb.Read(ctx, cfg.apiName, id, cfg.factory)
 	if err != nil {
 		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
@@ -102,17 +190,36 @@ func (api *API) getInt(ctx context.Context, cfg *config, id string) (any, error)
 		return nil, jsrest.Errorf(jsrest.ErrForbidden, "read check failed (%w)", err)
 	}
 
+	// Only here, so lists and auth lookups don't pay for the extra read
+	err = api.setAPIKeyLastUsed(ctx, cfg, obj)
+	if err != nil {
+		return nil, err
+	}
+
 	return obj, nil
 }
 
-func (api *API) listInt(ctx context.Context, cfg *config, opts *ListOpts) ([]any, error) {
+func (api *API) listInt(ctx context.Context, cfg *config, opts *ListOpts) (_ []any, err error) {
+	ctx, span := api.startSpan(ctx, "list", cfg)
+	defer func() { endSpan(span, err) }()
+
 	// TODO: Add query condition pushdown
 	if opts == nil {
 		opts = &ListOpts{}
 	}
 
+	err = checkScope(ctx, "read", cfg.apiName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = api.migrate(ctx, cfg)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
+	}
+
 	if cfg.listHook != nil {
-		err := cfg.listHook(ctx, opts, api)
+		err = cfg.listHook(ctx, opts, api)
 		if err != nil {
 			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "list hook failed (%w)", err)
 		}
@@ -131,31 +238,78 @@ func (api *API) listInt(ctx context.Context, cfg *config, opts *ListOpts) ([]any
 	return list, nil
 }
 
-func (api *API) replaceInt(ctx context.Context, cfg *config, id string, replace any, opts *UpdateOpts) (any, error) {
-	if opts == nil {
-		opts = &UpdateOpts{}
+func (api *API) replaceInt(ctx context.Context, cfg *config, id string, replace any, opts *UpdateOpts) (_ any, err error) {
+	ctx, span := api.startSpan(ctx, "replace", cfg, attribute.String("patchy.id", id))
+	defer func() { endSpan(span, err) }()
+
+	err = api.migrate(ctx, cfg)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
 	}
 
 	cfg.lock(id)
 	defer cfg.unlock(id)
 
+	m, err := api.prepareReplace(ctx, cfg, id, replace, opts)
+	if err != nil {
+		api.audit(ctx, cfg, m, err)
+		return nil, err
+	}
+
+	err = api.storeWrite(ctx, cfg, m.obj)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "write failed: %s (%w)", id, err)
+	}
+
+	api.audit(ctx, cfg, m, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	replace, err = cfg.checkRead(ctx, m.obj, api)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrForbidden, "read check failed (%w)", err)
+	}
+
+	return replace, nil
+}
+
+// prepareReplace must be called with id locked
+func (api *API) prepareReplace(ctx context.Context, cfg *config, id string, replace any, opts *UpdateOpts) (*mutation, error) {
+	if opts == nil {
+		opts = &UpdateOpts{}
+	}
+
+	m := &mutation{
+		op: "replace",
+		id: id,
+	}
+
 	obj, err := api.sb.Read(ctx, cfg.apiName, id, cfg.factory)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
 	}
 
 	if obj == nil {
-		return nil, jsrest.Errorf(jsrest.ErrNotFound, "%s", id)
+		return m, jsrest.Errorf(jsrest.ErrNotFound, "%s", id)
 	}
 
 	err = opts.ifMatch(obj)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "match failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "match failed (%w)", err)
 	}
 
 	prev, err := cfg.clone(obj)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clone failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "clone failed (%w)", err)
+	}
+
+	m.prev = prev
+
+	err = cfg.unhide(replace, obj)
+	if err != nil {
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "unhide failed (%w)", err)
 	}
 
 	// Metadata is immutable or server-owned
@@ -167,83 +321,138 @@ func (api *API) replaceInt(ctx context.Context, cfg *config, id string, replace
 
 	replace, err = cfg.checkWrite(ctx, replace, prev, api)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
 	}
 
-	err = api.sb.Write(ctx, cfg.apiName, replace)
+	err = cfg.hashPasswords(ctx, replace, prev, api.passwordHasher)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "write failed: %s (%w)", id, err)
+		return m, jsrest.Errorf(jsrest.ErrBadRequest, "hash password failed (%w)", err)
 	}
 
-	replace, err = cfg.checkRead(ctx, replace, api)
+	m.obj = replace
+
+	return m, nil
+}
+
+func (api *API) updateInt(ctx context.Context, cfg *config, id string, patch map[string]any, opts *UpdateOpts) (_ any, err error) {
+	ctx, span := api.startSpan(ctx, "update", cfg, attribute.String("patchy.id", id))
+	defer func() { endSpan(span, err) }()
+
+	err = api.migrate(ctx, cfg)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
+	}
+
+	cfg.lock(id)
+	defer cfg.unlock(id)
+
+	m, err := api.prepareUpdate(ctx, cfg, id, patch, opts)
+	if err != nil {
+		api.audit(ctx, cfg, m, err)
+		return nil, err
+	}
+
+	err = api.storeWrite(ctx, cfg, m.obj)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "write failed: %s (%w)", id, err)
+	}
+
+	api.audit(ctx, cfg, m, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := cfg.checkRead(ctx, m.obj, api)
 	if err != nil {
 		return nil, jsrest.Errorf(jsrest.ErrForbidden, "read check failed (%w)", err)
 	}
 
-	return replace, nil
+	return obj, nil
 }
 
-func (api *API) updateInt(ctx context.Context, cfg *config, id string, patch map[string]any, opts *UpdateOpts) (any, error) {
+// prepareUpdate must be called with id locked
+func (api *API) prepareUpdate(ctx context.Context, cfg *config, id string, patch map[string]any, opts *UpdateOpts) (*mutation, error) {
 	if opts == nil {
 		opts = &UpdateOpts{}
 	}
 
-	cfg.lock(id)
-	defer cfg.unlock(id)
-
 	// Metadata is immutable or server-owned
 	delete(patch, "id")
 	delete(patch, "etag")
 	delete(patch, "generation")
 
+	m := &mutation{
+		op: "update",
+		id: id,
+	}
+
 	obj, err := api.sb.Read(ctx, cfg.apiName, id, cfg.factory)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
 	}
 
 	if obj == nil {
-		return nil, jsrest.Errorf(jsrest.ErrNotFound, "%s", id)
+		return m, jsrest.Errorf(jsrest.ErrNotFound, "%s", id)
 	}
 
 	err = opts.ifMatch(obj)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "match failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "match failed (%w)", err)
 	}
 
 	prev, err := cfg.clone(obj)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clone failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrInternalServerError, "clone failed (%w)", err)
 	}
 
+	m.prev = prev
+
 	err = path.MergeMap(obj, patch)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "merge failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrBadRequest, "merge failed (%w)", err)
 	}
 
 	metadata.GetMetadata(obj).Generation++
 
 	obj, err = cfg.checkWrite(ctx, obj, prev, api)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
+		return m, jsrest.Errorf(jsrest.ErrForbidden, "write check failed (%w)", err)
 	}
 
-	err = api.sb.Write(ctx, cfg.apiName, obj)
+	err = cfg.hashPasswords(ctx, obj, prev, api.passwordHasher)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "write failed: %s (%w)", id, err)
+		return m, jsrest.Errorf(jsrest.ErrBadRequest, "hash password failed (%w)", err)
 	}
 
-	obj, err = cfg.checkRead(ctx, obj, api)
-	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrForbidden, "read check failed (%w)", err)
-	}
+	m.obj = obj
 
-	return obj, nil
+	return m, nil
 }
 
 func (api *API) streamGetInt(ctx context.Context, cfg *config, id string) (*getStreamInt, error) {
+	err := checkScope(ctx, "read", cfg.apiName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Covers the stream's lifetime; ended by Close
+	ctx, span := api.startSpan(ctx, "streamGet", cfg, attribute.String("patchy.id", id))
+
+	err = api.migrate(ctx, cfg)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
+		endSpan(span, err)
+
+		return nil, err
+	}
+
 	in, err := api.sb.ReadStream(ctx, cfg.apiName, id, cfg.factory)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
+		endSpan(span, err)
+
+		return nil, err
 	}
 
 	out := make(chan any, 100)
@@ -267,6 +476,7 @@ func (api *API) streamGetInt(ctx context.Context, cfg *config, id string) (*getS
 		cfg:    cfg,
 		id:     id,
 		sbChan: in,
+		span:   span,
 	}, nil
 }
 
@@ -275,9 +485,28 @@ func (api *API) streamListInt(ctx context.Context, cfg *config, opts *ListOpts)
 		opts = &ListOpts{}
 	}
 
+	err := checkScope(ctx, "read", cfg.apiName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Covers the stream's lifetime; ended by Close
+	ctx, span := api.startSpan(ctx, "streamList", cfg)
+
+	err = api.migrate(ctx, cfg)
+	if err != nil {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "migrate failed (%w)", err)
+		endSpan(span, err)
+
+		return nil, err
+	}
+
 	in, err := api.sb.ListStream(ctx, cfg.apiName, cfg.factory)
 	if err != nil {
-		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "read list failed (%w)", err)
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "read list failed (%w)", err)
+		endSpan(span, err)
+
+		return nil, err
 	}
 
 	out := make(chan []any, 100)
@@ -295,16 +524,24 @@ func (api *API) streamListInt(ctx context.Context, cfg *config, opts *ListOpts)
 		}
 	}()
 
+	var ch <-chan []any = out
+
+	if opts.Debounce > 0 || opts.MaxRate > 0 {
+		ch = coalesceLists(out, opts.Debounce, opts.MaxRate)
+	}
+
 	return &listStreamInt{
-		ch:     out,
+		ch:     ch,
 		api:    api,
 		cfg:    cfg,
 		sbChan: in,
+		span:   span,
 	}, nil
 }
 
 func (gsi *getStreamInt) Close() {
 	gsi.api.sb.CloseReadStream(gsi.cfg.apiName, gsi.id, gsi.sbChan)
+	gsi.span.End()
 }
 
 func (gsi *getStreamInt) Chan() <-chan any {
@@ -313,6 +550,7 @@ func (gsi *getStreamInt) Chan() <-chan any {
 
 func (lsi *listStreamInt) Close() {
 	lsi.api.sb.CloseListStream(lsi.cfg.apiName, lsi.sbChan)
+	lsi.span.End()
 }
 
 func (lsi *listStreamInt) Chan() <-chan []any {
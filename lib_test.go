@@ -2,21 +2,33 @@
 package patchy_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/dchest/uniuri"
 	"github.com/go-resty/resty/v2"
 	"github.com/gopatchy/patchy"
 	"github.com/gopatchy/proxy"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
 )
 
 type testAPI struct {
@@ -32,6 +44,23 @@ type testAPI struct {
 	testDone  chan string
 }
 
+type wsTestConn struct {
+	conn    *websocket.Conn
+	pending []*patchy.WSMessage
+}
+
+type sseTestEvent struct {
+	event  string
+	params map[string]string
+	data   string
+}
+
+type sseTestStream struct {
+	body    io.ReadCloser
+	scan    *bufio.Scanner
+	pending []*sseTestEvent
+}
+
 type testType struct {
 	patchy.Metadata
 	Text string `json:"text"`
@@ -69,6 +98,24 @@ type authBasicType struct {
 	Pass string `json:"pass" patchy:"authBasicPass"`
 }
 
+type apiKeyType struct {
+	patchy.Metadata
+	Name     string     `json:"name"`
+	Prefix   string     `json:"prefix" patchy:"apiKeyPrefix"`
+	Hash     string     `json:"hash" patchy:"apiKeyHash"`
+	Scopes   []string   `json:"scopes" patchy:"apiKeyScopes"`
+	Expires  *time.Time `json:"expires" patchy:"apiKeyExpires"`
+	LastUsed *time.Time `json:"lastUsed" patchy:"apiKeyLastUsed"`
+}
+
+type sessionType struct {
+	patchy.Metadata
+	Token   string    `json:"token" patchy:"sessionToken"`
+	CSRF    string    `json:"csrf" patchy:"sessionCSRF"`
+	User    string    `json:"user" patchy:"sessionUser"`
+	Expires time.Time `json:"expires" patchy:"sessionExpires"`
+}
+
 func (mt *mayType) MayRead(ctx context.Context, api *patchy.API) error {
 	if ctx.Value(refuseRead) != nil {
 		return fmt.Errorf("may not read")
@@ -101,6 +148,16 @@ func (mt *mayType) MayWrite(ctx context.Context, prev *mayType, _ *patchy.API) e
 		mt.Text1 = t1w.(string)
 	}
 
+	if ctx.Value(blockWrite) != nil {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	if ctx.Value(slowWrite) != nil {
+		// Like a store that ignores ctx
+		time.Sleep(time.Second)
+	}
+
 	return nil
 }
 
@@ -112,6 +169,8 @@ const (
 	text1Read
 	text1Write
 	newText1
+	blockWrite
+	slowWrite
 )
 
 func requestHook(w http.ResponseWriter, r *http.Request, api *patchy.API) (*http.Request, error) {
@@ -140,6 +199,14 @@ func requestHook(w http.ResponseWriter, r *http.Request, api *patchy.API) (*http
 		ctx = context.WithValue(ctx, newText1, nt1)
 	}
 
+	if r.Header.Get("X-Block-Write") != "" {
+		ctx = context.WithValue(ctx, blockWrite, true)
+	}
+
+	if r.Header.Get("X-Slow-Write") != "" {
+		ctx = context.WithValue(ctx, slowWrite, true)
+	}
+
 	fs := r.Header.Get("Force-Stream")
 	if fs != "" {
 		r.Form.Set("_stream", fs)
@@ -161,11 +228,12 @@ func requestHook(w http.ResponseWriter, r *http.Request, api *patchy.API) (*http
 }
 
 func newTestAPI(t *testing.T) *testAPI {
-	dbname := fmt.Sprintf("file:%s?mode=memory&cache=shared", uniuri.New())
-
-	api, err := patchy.NewAPI(dbname)
+	api, err := patchy.NewAPIMemory()
 	require.NoError(t, err)
 
+	// The generated client tests check lockouts, which are opt-in
+	api.SetLoginLimits(patchy.DefaultLoginLimits())
+
 	err = api.ListenSelfCert("[::]:0")
 	require.NoError(t, err)
 
@@ -173,9 +241,7 @@ func newTestAPI(t *testing.T) *testAPI {
 }
 
 func newTestAPIInsecure(t *testing.T) *testAPI {
-	dbname := fmt.Sprintf("file:%s?mode=memory&cache=shared", uniuri.New())
-
-	api, err := patchy.NewAPI(dbname)
+	api, err := patchy.NewAPIMemory()
 	require.NoError(t, err)
 
 	err = api.ListenInsecure("[::]:0")
@@ -194,7 +260,7 @@ func newTestAPIInt(t *testing.T, api *patchy.API, scheme string) *testAPI {
 
 	ret := &testAPI{
 		api:      api,
-		proxy:    proxy.NewProxy(t, api.Addr()),
+		proxy:    proxy.NewProxy(t, tcpAddr(t, api)),
 		testDone: make(chan string, 100),
 	}
 
@@ -217,6 +283,9 @@ func newTestAPIInt(t *testing.T, api *patchy.API, scheme string) *testAPI {
 	})
 	require.NoError(t, err)
 
+	patchy.Register[apiKeyType](api)
+	patchy.Register[sessionType](api)
+
 	api.HandlerFunc("GET", "/_logEvent", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
@@ -267,10 +336,164 @@ func newTestAPIInt(t *testing.T, api *patchy.API, scheme string) *testAPI {
 	return ret
 }
 
+// tcpAddr returns the address of the API's only listener
+func tcpAddr(t *testing.T, api *patchy.API) *net.TCPAddr {
+	addrs := api.Addr()
+	require.Len(t, addrs, 1)
+
+	for _, addr := range addrs {
+		return addr.(*net.TCPAddr)
+	}
+
+	return nil
+}
+
 func (ta *testAPI) r() *resty.Request {
 	return ta.rst.R()
 }
 
+func (ta *testAPI) ws(t *testing.T, origin string) *wsTestConn {
+	return ta.wsHeader(t, origin, nil)
+}
+
+func (ta *testAPI) wsHeader(t *testing.T, origin string, header http.Header) *wsTestConn {
+	url := strings.Replace(ta.baseURL, "https://", "wss://", 1) + "_ws"
+
+	if origin == "" {
+		origin = ta.baseBaseURL
+	}
+
+	cfg, err := websocket.NewConfig(url, origin)
+	require.NoError(t, err)
+
+	cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+
+	for k, vs := range header {
+		cfg.Header[k] = vs
+	}
+
+	conn, err := websocket.DialConfig(cfg)
+	require.NoError(t, err)
+
+	return &wsTestConn{
+		conn: conn,
+	}
+}
+
+func (wtc *wsTestConn) send(t *testing.T, req *patchy.WSRequest) {
+	err := websocket.JSON.Send(wtc.conn, req)
+	require.NoError(t, err)
+}
+
+// recv returns the next message for ref, skipping heartbeats and holding
+// messages for other refs
+func (wtc *wsTestConn) recv(t *testing.T, ref string) *patchy.WSMessage {
+	for i, msg := range wtc.pending {
+		if msg.Ref == ref {
+			wtc.pending = append(wtc.pending[:i], wtc.pending[i+1:]...)
+			return msg
+		}
+	}
+
+	for {
+		err := wtc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		require.NoError(t, err)
+
+		msg := &patchy.WSMessage{}
+
+		err = websocket.JSON.Receive(wtc.conn, msg)
+		require.NoError(t, err)
+
+		switch {
+		case msg.Event == "heartbeat":
+			continue
+
+		case msg.Ref == ref:
+			return msg
+
+		default:
+			wtc.pending = append(wtc.pending, msg)
+		}
+	}
+}
+
+func (wtc *wsTestConn) close() {
+	wtc.conn.Close()
+}
+
+func (ta *testAPI) subscribe(t *testing.T, query url.Values) *sseTestStream {
+	resp, err := ta.r().
+		SetDoNotParseResponse(true).
+		SetQueryParamsFromValues(query).
+		Get("_subscribe")
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), resp.Status())
+
+	return &sseTestStream{
+		body: resp.RawBody(),
+		scan: bufio.NewScanner(resp.RawBody()),
+	}
+}
+
+func (sts *sseTestStream) next(t *testing.T) *sseTestEvent {
+	ev := &sseTestEvent{
+		params: map[string]string{},
+	}
+
+	for sts.scan.Scan() {
+		line := sts.scan.Text()
+
+		switch {
+		case line == "":
+			return ev
+
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+
+		case strings.Contains(line, ": "):
+			parts := strings.SplitN(line, ": ", 2)
+			ev.params[parts[0]] = parts[1]
+		}
+	}
+
+	require.Fail(t, "stream closed", sts.scan.Err())
+
+	return nil
+}
+
+// recv returns the next event tagged with ref, skipping heartbeats and
+// holding events for other refs
+func (sts *sseTestStream) recv(t *testing.T, ref string) *sseTestEvent {
+	for i, ev := range sts.pending {
+		if ev.params["ref"] == ref {
+			sts.pending = append(sts.pending[:i], sts.pending[i+1:]...)
+			return ev
+		}
+	}
+
+	for {
+		ev := sts.next(t)
+
+		switch {
+		case ev.event == "heartbeat":
+			continue
+
+		case ev.params["ref"] == ref:
+			return ev
+
+		default:
+			sts.pending = append(sts.pending, ev)
+		}
+	}
+}
+
+func (sts *sseTestStream) close() {
+	sts.body.Close()
+}
+
 func (ta *testAPI) checkTests(t *testing.T) {
 	require.Equal(t, ta.testBegin, ta.testEnd)
 	require.NotZero(t, ta.testEnd)
@@ -344,3 +567,43 @@ func getStderr(err error) string {
 
 	return ""
 }
+
+// writeTestCert writes a self-signed key pair for localhost as PEM
+func writeTestCert(t *testing.T, certFile, keyFile string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv6loopback},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	require.NoError(t, err)
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	require.NoError(t, err)
+}
+
+// peerCertificate returns the certificate the server presents
+func peerCertificate(t *testing.T, addr net.Addr, serverName string) *x509.Certificate {
+	conn, err := tls.Dial("tcp", addr.String(), &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, //nolint:gosec
+	})
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0]
+}
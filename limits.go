@@ -0,0 +1,390 @@
+package patchy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+)
+
+// Limits limit large or slow requests and busy clients; pass them to
+// NewAPI, or to New with WithLimits. Zero values leave a limit off.
+type Limits struct {
+	// Passed to http.Server; ReadHeaderTimeout defaults to 30s
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+
+	// Largest object request body in bytes; larger bodies get 413. Applies
+	// to each operation in a bulk request rather than the whole body.
+	MaxBodySize int64 `yaml:"maxBodySize"`
+
+	// By API type name, overriding MaxBodySize
+	TypeMaxBodySize map[string]int64 `yaml:"typeMaxBodySize"`
+
+	// Handler timeout for object operations other than streams and bulk;
+	// requests that run over get 503. The handler's context is cancelled,
+	// but it may run on (e.g. in a store that ignores ctx) and still apply
+	// its change.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// By operation (get, list, create, replace, update, delete, login,
+	// rotate), overriding Timeout
+	OperationTimeout map[string]time.Duration `yaml:"operationTimeout"`
+
+	// Object requests in progress across all types, not counting streams;
+	// more get 503
+	MaxInFlight int `yaml:"maxInFlight"`
+
+	// By API type name; more get 429
+	TypeMaxInFlight map[string]int `yaml:"typeMaxInFlight"`
+
+	// Concurrent streams per principal (the authenticated user, token or
+	// API key, or else the remote address); more get 429. Each SSE stream
+	// counts, as does each subscription on /_subscribe or /_ws.
+	MaxStreamsPerPrincipal int `yaml:"maxStreamsPerPrincipal"`
+
+	// Token bucket per principal, type and operation for object requests,
+	// including opening streams or subscriptions, logins (operation login
+	// on the session type) and API key rotation (rotate); requests over get
+	// 429
+	RateLimit *RateLimit `yaml:"rateLimit"`
+
+	// By "type/operation", "type" or "*/operation", in that order of
+	// precedence, overriding RateLimit; a nil entry turns limiting off
+	RouteRateLimit map[string]*RateLimit `yaml:"routeRateLimit"`
+}
+
+// timeoutWriter buffers a response until the handler returns
+type timeoutWriter struct {
+	header   http.Header
+	code     int
+	buf      bytes.Buffer
+	timedOut bool
+	mu       sync.Mutex
+}
+
+type requestLimiter struct {
+	limits *Limits
+
+	mu           sync.Mutex
+	inFlight     int
+	typeInFlight map[string]int
+	streams      map[string]int
+}
+
+var (
+	ErrTooManyInFlight = errors.New("too many requests in progress")
+	ErrTooManyStreams  = errors.New("too many streams")
+	ErrBodyTooLarge    = errors.New("request body too large")
+	ErrHandlerTimeout  = errors.New("handler timed out")
+	ErrMultipleLimits  = errors.New("more than one Limits")
+)
+
+const defaultReadHeaderTimeout = 30 * time.Second
+
+// DefaultLimits are used when NewAPI isn't passed any
+func DefaultLimits() *Limits {
+	return &Limits{
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+}
+
+// getLimits returns the only entry in limits, or nil if there are none
+func getLimits(limits []*Limits) (*Limits, error) {
+	switch len(limits) {
+	case 0:
+		return nil, nil
+	case 1:
+		return limits[0], nil
+	default:
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "%d (%w)", len(limits), ErrMultipleLimits)
+	}
+}
+
+// withDefaults returns a copy of limits (which may be nil) with defaults
+// filled in
+func (limits *Limits) withDefaults() *Limits {
+	ret := DefaultLimits()
+
+	if limits != nil {
+		*ret = *limits
+	}
+
+	if ret.ReadHeaderTimeout == 0 {
+		ret.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+
+	return ret
+}
+
+func newRequestLimiter(limits *Limits) *requestLimiter {
+	return &requestLimiter{
+		limits:       limits,
+		typeInFlight: map[string]int{},
+		streams:      map[string]int{},
+	}
+}
+
+// acquire counts a request against the in-flight limits; call the returned
+// function when it finishes
+func (rl *requestLimiter) acquire(cfg *config) (func(), error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.limits.MaxInFlight > 0 && rl.inFlight >= rl.limits.MaxInFlight {
+		return nil, jsrest.Errorf(jsrest.ErrServiceUnavailable, "%d (%w)", rl.limits.MaxInFlight, ErrTooManyInFlight)
+	}
+
+	limit := rl.limits.TypeMaxInFlight[cfg.apiName]
+	if limit > 0 && rl.typeInFlight[cfg.apiName] >= limit {
+		return nil, jsrest.Errorf(jsrest.ErrTooManyRequests, "%s: %d (%w)", cfg.apiName, limit, ErrTooManyInFlight)
+	}
+
+	rl.inFlight++
+	rl.typeInFlight[cfg.apiName]++
+
+	return func() {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+
+		rl.inFlight--
+		rl.typeInFlight[cfg.apiName]--
+
+		if rl.typeInFlight[cfg.apiName] == 0 {
+			delete(rl.typeInFlight, cfg.apiName)
+		}
+	}, nil
+}
+
+// acquireStream counts a stream against the principal's limit; call the
+// returned function when it ends
+func (rl *requestLimiter) acquireStream(principal string) (func(), error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limit := rl.limits.MaxStreamsPerPrincipal
+
+	if limit > 0 && rl.streams[principal] >= limit {
+		return nil, jsrest.Errorf(jsrest.ErrTooManyRequests, "%d (%w)", limit, ErrTooManyStreams)
+	}
+
+	rl.streams[principal]++
+
+	return func() {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+
+		rl.streams[principal]--
+
+		if rl.streams[principal] == 0 {
+			delete(rl.streams, principal)
+		}
+	}, nil
+}
+
+func (rl *requestLimiter) maxBodySize(cfg *config) int64 {
+	if limit, found := rl.limits.TypeMaxBodySize[cfg.apiName]; found {
+		return limit
+	}
+
+	return rl.limits.MaxBodySize
+}
+
+func (rl *requestLimiter) timeout(op string) time.Duration {
+	if timeout, found := rl.limits.OperationTimeout[op]; found {
+		return timeout
+	}
+
+	return rl.limits.Timeout
+}
+
+// limited applies rate, body size, timeout and in-flight limits to a
+// non-stream object operation
+func (api *API) limited(op string, cb func(*config, http.ResponseWriter, *http.Request) error) func(*config, http.ResponseWriter, *http.Request) error {
+	return func(cfg *config, w http.ResponseWriter, r *http.Request) error {
+		release, err := api.admit(cfg, op, w, r)
+		if err != nil {
+			return err
+		}
+
+		limit := api.limiter.maxBodySize(cfg)
+		if limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+
+		timeout := api.limiter.timeout(op)
+		if timeout == 0 {
+			defer release()
+			return api.limitedErr(op, timeout, r, cb(cfg, w, r))
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		// Event data is copied back only if the handler finishes in time
+		ev, _ := ctx.Value(ContextEvent).(*event.Event)
+		hev := &event.Event{Data: map[string]any{}}
+
+		r = r.WithContext(context.WithValue(ctx, ContextEvent, hev))
+
+		// Stores may ignore ctx, so the handler runs on its own and its
+		// response is dropped if it's late, like http.TimeoutHandler. It
+		// counts as in flight until it returns.
+		tw := &timeoutWriter{
+			header: http.Header{},
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			defer release()
+			done <- cb(cfg, tw, r)
+		}()
+
+		select {
+		case err = <-done:
+			if ev != nil {
+				for k, v := range hev.Data {
+					ev.Set(k, v)
+				}
+			}
+
+			tw.flush(w)
+
+			return api.limitedErr(op, timeout, r, err)
+
+		case <-ctx.Done():
+			tw.timeout()
+			return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s after %s (%w)", op, timeout, ErrHandlerTimeout)
+		}
+	}
+}
+
+// limitedErr replaces the callback's error code where a limit caused the
+// failure, since the code reflects how it surfaced (often 400 or 500)
+func (api *API) limitedErr(op string, timeout time.Duration, r *http.Request, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	maxBytesErr := &http.MaxBytesError{}
+	if errors.As(err, &maxBytesErr) {
+		return jsrest.Errorf(jsrest.ErrRequestEntityTooLarge, "%d bytes (%w)", maxBytesErr.Limit, ErrBodyTooLarge)
+	}
+
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		return jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s after %s (%w)", op, timeout, ErrHandlerTimeout)
+	}
+
+	return err
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.code != 0 {
+		return
+	}
+
+	tw.code = code
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, ErrHandlerTimeout
+	}
+
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+
+	return tw.buf.Write(b)
+}
+
+func (tw *timeoutWriter) timeout() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.timedOut = true
+}
+
+// flush copies the buffered response to w; the handler must have returned
+func (tw *timeoutWriter) flush(w http.ResponseWriter) {
+	for k, vs := range tw.header {
+		w.Header()[k] = vs
+	}
+
+	if tw.code == 0 {
+		return
+	}
+
+	w.WriteHeader(tw.code)
+	_, _ = w.Write(tw.buf.Bytes())
+}
+
+// limitedBulk applies rate and in-flight limits only; bulk bodies are
+// streamed, so the body size limit is applied per operation by bulk()
+func (api *API) limitedBulk(cb func(*config, http.ResponseWriter, *http.Request) error) func(*config, http.ResponseWriter, *http.Request) error {
+	return func(cfg *config, w http.ResponseWriter, r *http.Request) error {
+		release, err := api.admit(cfg, "bulk", w, r)
+		if err != nil {
+			return err
+		}
+
+		defer release()
+
+		return cb(cfg, w, r)
+	}
+}
+
+// admit applies the rate and in-flight limits; call the returned function
+// when the request finishes
+func (api *API) admit(cfg *config, op string, w http.ResponseWriter, r *http.Request) (func(), error) {
+	return api.admitPrincipal(r.Context(), api.requestPrincipal(r), cfg, op, w.Header())
+}
+
+func (api *API) admitPrincipal(ctx context.Context, principal string, cfg *config, op string, header http.Header) (func(), error) {
+	err := api.checkRateLimitPrincipal(ctx, principal, cfg.apiName, op, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.limiter.acquire(cfg)
+}
+
+func (api *API) limitedID(op string, cb func(*config, string, http.ResponseWriter, *http.Request) error) func(*config, string, http.ResponseWriter, *http.Request) error {
+	return func(cfg *config, id string, w http.ResponseWriter, r *http.Request) error {
+		return api.limited(op, func(cfg *config, w http.ResponseWriter, r *http.Request) error {
+			return cb(cfg, id, w, r)
+		})(cfg, w, r)
+	}
+}
+
+// acquireStream applies MaxStreamsPerPrincipal
+func (api *API) acquireStream(r *http.Request) (func(), error) {
+	return api.limiter.acquireStream(api.requestPrincipal(r))
+}
+
+// requestPrincipal identifies the caller for per-principal limits
+func (api *API) requestPrincipal(r *http.Request) string {
+	method, id := api.auditPrincipal(r.Context())
+	if method != "" {
+		return fmt.Sprintf("%s:%s", method, id)
+	}
+
+	return fmt.Sprintf("addr:%s", remoteHost(r))
+}
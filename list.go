@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gopatchy/jsrest"
 	"github.com/gopatchy/metadata"
@@ -26,6 +28,16 @@ type ListOpts struct {
 	Sorts   []string
 	Filters []Filter
 
+	// Streams only: wait for changes to stop for Debounce, and send at
+	// most MaxRate updates per second
+	Debounce time.Duration
+	MaxRate  float64
+
+	// Streams only: interval between heartbeat events, and lifetime after
+	// which the server sends reconnect and closes the stream
+	Heartbeat   time.Duration
+	MaxDuration time.Duration
+
 	IfNoneMatch []httpheader.EntityTag
 
 	// This is "any" because making ListOpts generic complicates too many things
@@ -41,8 +53,9 @@ type Filter struct {
 var (
 	opMatch     = regexp.MustCompile(`^([^\[]+)\[(.+)\]$`)
 	validStream = map[string]bool{
-		"full": true,
-		"diff": true,
+		"full":  true,
+		"diff":  true,
+		"patch": true,
 	}
 	validOps = map[string]bool{
 		"eq":  true,
@@ -56,6 +69,8 @@ var (
 	ErrInvalidFilterOp     = errors.New("invalid filter operator")
 	ErrInvalidSort         = errors.New("invalid _sort")
 	ErrInvalidStreamFormat = errors.New("invalid _stream")
+	ErrInvalidDebounce     = errors.New("invalid _debounce")
+	ErrInvalidMaxRate      = errors.New("invalid _maxRate")
 )
 
 func ApplySorts[T any](list []T, opts *ListOpts) ([]T, error) {
@@ -158,43 +173,82 @@ func hashList(list any) (string, error) {
 }
 
 func (api *API) parseListOpts(r *http.Request) (*ListOpts, error) {
-	var err error
-
-	ret := &ListOpts{
-		Stream: "full",
+	ret, err := api.parseListForm(r.Form)
+	if err != nil {
+		return nil, err
 	}
 
 	if r.Header.Get("If-None-Match") != "" {
 		ret.IfNoneMatch = httpheader.IfNoneMatch(r.Header)
 	}
 
-	if r.Form.Has("_stream") {
-		ret.Stream = r.Form.Get("_stream")
+	return ret, nil
+}
+
+// parseListForm parses query parameters, shared by HTTP and WebSocket
+func (api *API) parseListForm(form url.Values) (*ListOpts, error) {
+	var err error
+
+	ret := &ListOpts{
+		Stream:   "full",
+		Debounce: api.streamDebounce,
+		MaxRate:  api.streamMaxRate,
+	}
+
+	if form.Has("_stream") {
+		ret.Stream = form.Get("_stream")
 	}
 
 	if _, valid := validStream[ret.Stream]; !valid {
 		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", ret.Stream, ErrInvalidStreamFormat)
 	}
 
-	if r.Form.Has("_limit") {
-		ret.Limit, err = strconv.ParseInt(r.Form.Get("_limit"), 10, 64)
+	if form.Has("_limit") {
+		ret.Limit, err = strconv.ParseInt(form.Get("_limit"), 10, 64)
 		if err != nil {
-			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse _limit value failed: %s (%w)", r.Form.Get("_limit"), err)
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse _limit value failed: %s (%w)", form.Get("_limit"), err)
 		}
 	}
 
-	if r.Form.Has("_offset") {
-		ret.Offset, err = strconv.ParseInt(r.Form.Get("_offset"), 10, 64)
+	if form.Has("_offset") {
+		ret.Offset, err = strconv.ParseInt(form.Get("_offset"), 10, 64)
 		if err != nil {
-			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse _offset value failed: %s (%w)", r.Form.Get("_offset"), err)
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse _offset value failed: %s (%w)", form.Get("_offset"), err)
 		}
 	}
 
-	if r.Form.Has("_after") {
-		ret.After = r.Form.Get("_after")
+	if form.Has("_after") {
+		ret.After = form.Get("_after")
+	}
+
+	if form.Has("_debounce") {
+		ret.Debounce, err = time.ParseDuration(form.Get("_debounce"))
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse _debounce value failed: %s (%w)", form.Get("_debounce"), err)
+		}
+
+		if ret.Debounce < 0 {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", form.Get("_debounce"), ErrInvalidDebounce)
+		}
+	}
+
+	if form.Has("_maxRate") {
+		ret.MaxRate, err = strconv.ParseFloat(form.Get("_maxRate"), 64)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse _maxRate value failed: %s (%w)", form.Get("_maxRate"), err)
+		}
+
+		if ret.MaxRate < 0 || math.IsInf(ret.MaxRate, 0) || math.IsNaN(ret.MaxRate) {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", form.Get("_maxRate"), ErrInvalidMaxRate)
+		}
+	}
+
+	ret.Heartbeat, ret.MaxDuration, err = api.parseStreamTiming(form)
+	if err != nil {
+		return nil, err
 	}
 
-	sorts := r.Form["_sort"]
+	sorts := form["_sort"]
 	for i := len(sorts) - 1; i >= 0; i-- {
 		srt := sorts[i]
 		if len(srt) == 0 {
@@ -204,7 +258,7 @@ func (api *API) parseListOpts(r *http.Request) (*ListOpts, error) {
 		ret.Sorts = append(ret.Sorts, srt)
 	}
 
-	for path, vals := range r.Form {
+	for path, vals := range form {
 		if strings.HasPrefix(path, "_") {
 			continue
 		}
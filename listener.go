@@ -0,0 +1,309 @@
+package patchy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gopatchy/jsrest"
+)
+
+type listener struct {
+	name    string
+	cfg     *ListenConfig
+	l       net.Listener
+	srv     *http.Server
+	certs   certSource
+	serving atomic.Bool
+}
+
+var (
+	ErrNoListeners        = errors.New("Serve() called before Listen*()")
+	ErrDuplicateListener  = errors.New("duplicate listener name")
+	ErrUnknownNetwork     = errors.New("unknown listener network")
+	ErrUnknownTLSMode     = errors.New("unknown TLS mode")
+	ErrUnknownTLSVersion  = errors.New("unknown TLS version")
+	ErrUnknownAuthScheme  = errors.New("unknown auth scheme")
+	ErrRouteNotServed     = errors.New("route not served on this listener")
+	ErrAuthSchemeRejected = errors.New("auth scheme not accepted on this listener")
+)
+
+var listenerAuthSchemes = map[string]bool{
+	"basic":   true,
+	"bearer":  true,
+	"apiKey":  true,
+	"session": true,
+	"none":    true,
+}
+
+// Listen adds a listener; Serve serves all of them
+func (api *API) Listen(lc *ListenConfig) error {
+	for _, scheme := range lc.Auth {
+		if !listenerAuthSchemes[scheme] {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", scheme, ErrUnknownAuthScheme)
+		}
+	}
+
+	tlsConfig, certs, err := api.listenerTLS(lc)
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		switch lc.TLSMinVersion {
+		case "":
+
+		case "1.2":
+			tlsConfig.MinVersion = tls.VersionTLS12
+
+		case "1.3":
+			tlsConfig.MinVersion = tls.VersionTLS13
+
+		default:
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", lc.TLSMinVersion, ErrUnknownTLSVersion)
+		}
+	}
+
+	return api.addListener(lc, tlsConfig, certs)
+}
+
+// Addr returns the address of each listener by name
+func (api *API) Addr() map[string]net.Addr {
+	ret := map[string]net.Addr{}
+
+	for _, li := range api.getListeners() {
+		ret[li.name] = li.l.Addr()
+	}
+
+	return ret
+}
+
+// Serve serves all listeners until Shutdown. If one fails, the others stop
+// accepting connections and its error is returned.
+func (api *API) Serve() error {
+	listeners := api.getListeners()
+	if len(listeners) == 0 {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "%w", ErrNoListeners)
+	}
+
+	stopReload := api.reloadOnSIGHUP()
+	defer stopReload()
+
+	errs := make(chan error, len(listeners))
+
+	for _, li := range listeners {
+		go func(li *listener) {
+			errs <- li.serve()
+		}(li)
+	}
+
+	var first error
+
+	for range listeners {
+		err := <-errs
+		if err == nil || first != nil {
+			continue
+		}
+
+		first = err
+
+		// Requests in flight on the others are drained by Shutdown
+		for _, li := range listeners {
+			li.l.Close()
+		}
+	}
+
+	return first
+}
+
+func (api *API) addListener(lc *ListenConfig, tlsConfig *tls.Config, certs certSource) error {
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+
+	case "unix":
+		err := removeStaleSocket(lc.Bind)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", network, ErrUnknownNetwork)
+	}
+
+	l, err := net.Listen(network, lc.Bind)
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	li := &listener{
+		name:  lc.Name,
+		cfg:   lc,
+		l:     l,
+		certs: certs,
+	}
+
+	if li.name == "" {
+		li.name = l.Addr().String()
+	}
+
+	li.srv = &http.Server{
+		Handler:           api,
+		ReadHeaderTimeout: api.limiter.limits.ReadHeaderTimeout,
+		IdleTimeout:       api.limiter.limits.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), ContextListener, li.name)
+		},
+	}
+
+	api.listenersMu.Lock()
+	defer api.listenersMu.Unlock()
+
+	for _, existing := range api.listeners {
+		if existing.name == li.name {
+			l.Close()
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", li.name, ErrDuplicateListener)
+		}
+	}
+
+	api.listeners = append(api.listeners, li)
+
+	return nil
+}
+
+func (api *API) getListeners() []*listener {
+	api.listenersMu.Lock()
+	defer api.listenersMu.Unlock()
+
+	return append([]*listener{}, api.listeners...)
+}
+
+func (api *API) shutdownListeners(ctx context.Context) error {
+	for _, li := range api.getListeners() {
+		err := li.srv.Shutdown(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// http.Server only closes listeners passed to Serve
+	api.closeListeners()
+
+	return nil
+}
+
+func (api *API) closeListeners() {
+	for _, li := range api.getListeners() {
+		li.l.Close()
+	}
+}
+
+// listenerFor returns nil for requests from other http.Servers
+func (api *API) listenerFor(r *http.Request) *listener {
+	name, ok := r.Context().Value(ContextListener).(string)
+	if !ok {
+		return nil
+	}
+
+	for _, li := range api.getListeners() {
+		if li.name == name {
+			return li
+		}
+	}
+
+	return nil
+}
+
+// checkListenerRoute runs before request hooks, so StripPrefix hasn't
+func (api *API) checkListenerRoute(r *http.Request) error {
+	li := api.listenerFor(r)
+	if li == nil || len(li.cfg.Routes) == 0 {
+		return nil
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, api.prefix)
+
+	for _, route := range li.cfg.Routes {
+		if p == route || strings.HasPrefix(p, strings.TrimSuffix(route, "/")+"/") {
+			return nil
+		}
+	}
+
+	return jsrest.Errorf(jsrest.ErrNotFound, "%s on %s (%w)", r.URL.Path, li.name, ErrRouteNotServed)
+}
+
+// checkListenerAuth rejects credentials for schemes the listener doesn't accept
+func (api *API) checkListenerAuth(r *http.Request, scheme string) error {
+	if api.listenerAcceptsAuth(r, scheme) {
+		return nil
+	}
+
+	return jsrest.Errorf(jsrest.ErrUnauthorized, "%s (%w)", scheme, ErrAuthSchemeRejected)
+}
+
+func (api *API) listenerAcceptsAuth(r *http.Request, scheme string) bool {
+	li := api.listenerFor(r)
+	if li == nil || len(li.cfg.Auth) == 0 {
+		return true
+	}
+
+	for _, accepted := range li.cfg.Auth {
+		if accepted == scheme {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (li *listener) serve() error {
+	li.serving.Store(true)
+	defer li.serving.Store(false)
+
+	err := li.srv.Serve(li.l)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "listener %s (%w)", li.name, err)
+	}
+
+	return nil
+}
+
+// removeStaleSocket removes a socket file left by a process that exited
+// without closing its listener
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		// Still served; let Listen fail
+		conn.Close()
+		return nil
+	}
+
+	return os.Remove(path)
+}
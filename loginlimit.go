@@ -0,0 +1,429 @@
+package patchy
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+	"github.com/julienschmidt/httprouter"
+)
+
+// LoginLimits controls authBasic failure tracking. A zero failure count
+// disables that dimension. Lockout is off unless set with SetLoginLimits
+// or the auth.loginLimits config.
+type LoginLimits struct {
+	// Failures per username within Window before lockout
+	UserFailures int `yaml:"userFailures"`
+
+	// Failures per remote address within Window before lockout
+	AddrFailures int `yaml:"addrFailures"`
+
+	Window  time.Duration `yaml:"window"`
+	Lockout time.Duration `yaml:"lockout"`
+
+	// Usernames and addresses tracked, each; zero uses
+	// DefaultLoginMaxEntries. When full, the oldest entry that isn't
+	// locked out is dropped, or if all are, the new one isn't tracked.
+	MaxEntries int `yaml:"maxEntries"`
+}
+
+type LoginLockout struct {
+	User  string    `json:"user,omitempty"`
+	Addr  string    `json:"addr,omitempty"`
+	Until time.Time `json:"until"`
+}
+
+type loginLimiter struct {
+	mu        sync.Mutex
+	limits    *LoginLimits
+	users     *loginTable
+	addrs     *loginTable
+	lastSweep time.Time
+}
+
+// loginTable holds attempts by username or address. Entries that aren't
+// locked out are also in lru, roughly oldest first, so makeRoom needn't
+// scan.
+type loginTable struct {
+	entries map[string]*loginAttempts
+	lru     *list.List
+}
+
+type loginAttempts struct {
+	key         string
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+
+	// nil while locked out
+	elem *list.Element
+}
+
+var (
+	ErrLoginLocked       = errors.New("too many failed login attempts")
+	ErrLockoutKeyMissing = errors.New("user or addr required")
+)
+
+const DefaultLoginMaxEntries = 100000
+
+// DefaultLoginLimits are suggested values for SetLoginLimits
+func DefaultLoginLimits() *LoginLimits {
+	return &LoginLimits{
+		UserFailures: 10,
+		AddrFailures: 100,
+		Window:       15 * time.Minute,
+		Lockout:      15 * time.Minute,
+		MaxEntries:   DefaultLoginMaxEntries,
+	}
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		limits: &LoginLimits{},
+		users:  newLoginTable(),
+		addrs:  newLoginTable(),
+	}
+}
+
+func newLoginTable() *loginTable {
+	return &loginTable{
+		entries: map[string]*loginAttempts{},
+		lru:     list.New(),
+	}
+}
+
+func (lt *loginTable) remove(key string) {
+	la := lt.entries[key]
+	if la == nil {
+		return
+	}
+
+	if la.elem != nil {
+		lt.lru.Remove(la.elem)
+	}
+
+	delete(lt.entries, key)
+}
+
+// setLimits keeps tracked attempts; a nil limits turns lockout off
+func (ll *loginLimiter) setLimits(limits *LoginLimits) {
+	if limits == nil {
+		limits = &LoginLimits{}
+	}
+
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	ll.limits = limits
+}
+
+// check returns the remaining lockout duration for user or addr, or zero
+func (ll *loginLimiter) check(user, addr string) time.Duration {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	now := time.Now()
+
+	retry := time.Duration(0)
+
+	for _, la := range []*loginAttempts{ll.users.entries[user], ll.addrs.entries[addr]} {
+		if la != nil && la.lockedUntil.After(now) && la.lockedUntil.Sub(now) > retry {
+			retry = la.lockedUntil.Sub(now)
+		}
+	}
+
+	return retry
+}
+
+// fail records a failed attempt and returns the lockout duration if this
+// attempt triggered one
+func (ll *loginLimiter) fail(user, addr string) time.Duration {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	now := time.Now()
+
+	ll.sweep(now)
+
+	retry := time.Duration(0)
+
+	if ll.limits.UserFailures > 0 && ll.record(ll.users, user, ll.limits.UserFailures, now) {
+		retry = ll.limits.Lockout
+	}
+
+	if ll.limits.AddrFailures > 0 && ll.record(ll.addrs, addr, ll.limits.AddrFailures, now) {
+		retry = ll.limits.Lockout
+	}
+
+	return retry
+}
+
+func (ll *loginLimiter) succeed(user string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	// Address failures are kept, so one valid account can't reset the
+	// counter for guesses against others
+	ll.users.remove(user)
+}
+
+func (ll *loginLimiter) record(lt *loginTable, key string, max int, now time.Time) bool {
+	la := lt.entries[key]
+
+	if la != nil && now.Sub(la.first) > ll.limits.Window {
+		lt.remove(key)
+		la = nil
+	}
+
+	if la == nil {
+		if !ll.makeRoom(lt) {
+			// Everything tracked is locked out; the other dimension still counts
+			return false
+		}
+
+		la = &loginAttempts{
+			key:   key,
+			first: now,
+		}
+		lt.entries[key] = la
+	}
+
+	if la.elem == nil && !now.Before(la.lockedUntil) {
+		// New, or its lockout has ended
+		la.elem = lt.lru.PushBack(la)
+	}
+
+	la.failures++
+
+	if la.failures < max {
+		return false
+	}
+
+	la.failures = 0
+	la.first = now
+	la.lockedUntil = now.Add(ll.limits.Lockout)
+
+	// Locked entries are kept so that flooding can't lift a lockout
+	if la.elem != nil {
+		lt.lru.Remove(la.elem)
+		la.elem = nil
+	}
+
+	return true
+}
+
+// sweep drops expired entries at most once per Window; makeRoom bounds the
+// maps in between
+func (ll *loginLimiter) sweep(now time.Time) {
+	if now.Sub(ll.lastSweep) < ll.limits.Window {
+		return
+	}
+
+	ll.lastSweep = now
+
+	for _, lt := range []*loginTable{ll.users, ll.addrs} {
+		for key, la := range lt.entries {
+			if now.Sub(la.first) > ll.limits.Window && now.After(la.lockedUntil) {
+				lt.remove(key)
+			}
+		}
+	}
+}
+
+// makeRoom drops the oldest entry that isn't locked out if lt is full
+func (ll *loginLimiter) makeRoom(lt *loginTable) bool {
+	max := ll.limits.MaxEntries
+	if max == 0 {
+		max = DefaultLoginMaxEntries
+	}
+
+	if len(lt.entries) < max {
+		return true
+	}
+
+	front := lt.lru.Front()
+	if front == nil {
+		return false
+	}
+
+	lt.remove(front.Value.(*loginAttempts).key)
+
+	return true
+}
+
+func (ll *loginLimiter) lockouts() []*LoginLockout {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	now := time.Now()
+	ret := []*LoginLockout{}
+
+	for user, la := range ll.users.entries {
+		if la.lockedUntil.After(now) {
+			ret = append(ret, &LoginLockout{User: user, Until: la.lockedUntil})
+		}
+	}
+
+	for addr, la := range ll.addrs.entries {
+		if la.lockedUntil.After(now) {
+			ret = append(ret, &LoginLockout{Addr: addr, Until: la.lockedUntil})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Until.Before(ret[j].Until) })
+
+	return ret
+}
+
+func (api *API) checkLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, user string) error {
+	addr := remoteHost(r)
+
+	retry := api.loginLimiter.check(user, addr)
+	if retry == 0 {
+		return nil
+	}
+
+	api.eventClient.WriteEvent(ctx, event.NewEvent(
+		"authBasicLocked",
+		"authUser", user,
+		"remoteAddr", addr,
+		"retryAfterSeconds", retryAfterSeconds(retry),
+	))
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retry)))
+
+	return jsrest.Errorf(jsrest.ErrTooManyRequests, "%s (%w)", user, ErrLoginLocked)
+}
+
+func (api *API) failLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, user string) {
+	addr := remoteHost(r)
+
+	retry := api.loginLimiter.fail(user, addr)
+
+	api.eventClient.WriteEvent(ctx, event.NewEvent(
+		"authBasicFailure",
+		"authUser", user,
+		"remoteAddr", addr,
+		"lockedOut", retry > 0,
+	))
+
+	if retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retry)))
+	}
+}
+
+// SetLoginLimits turns on lockout after repeated authBasic failures, e.g.
+// with DefaultLoginLimits; nil turns it off
+func (api *API) SetLoginLimits(limits *LoginLimits) {
+	api.loginLimiter.setLimits(limits)
+}
+
+func (api *API) LoginLockouts() []*LoginLockout {
+	return api.loginLimiter.lockouts()
+}
+
+func (api *API) ClearLoginLockoutUser(user string) {
+	api.loginLimiter.mu.Lock()
+	defer api.loginLimiter.mu.Unlock()
+
+	api.loginLimiter.users.remove(user)
+}
+
+func (api *API) ClearLoginLockoutAddr(addr string) {
+	api.loginLimiter.mu.Lock()
+	defer api.loginLimiter.mu.Unlock()
+
+	api.loginLimiter.addrs.remove(addr)
+}
+
+func (api *API) handleLockouts(w http.ResponseWriter, r *http.Request) error {
+	api.SetEventData(r.Context(), "operation", "lockouts")
+
+	err := api.checkAdmin(r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(api.LoginLockouts())
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "encode failed (%w)", err)
+	}
+
+	return nil
+}
+
+// handleClearLockout takes user and/or addr query parameters, since
+// addresses don't fit well in paths
+func (api *API) handleClearLockout(w http.ResponseWriter, r *http.Request) error {
+	api.SetEventData(r.Context(), "operation", "clearLockout")
+
+	err := api.checkAdmin(r)
+	if err != nil {
+		return err
+	}
+
+	user := r.URL.Query().Get("user")
+	addr := r.URL.Query().Get("addr")
+
+	if user == "" && addr == "" {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "%w", ErrLockoutKeyMissing)
+	}
+
+	if user != "" {
+		api.ClearLoginLockoutUser(user)
+	}
+
+	if addr != "" {
+		api.ClearLoginLockoutAddr(addr)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (api *API) registerLockoutHandlers() {
+	api.router.GET(
+		"/_lockouts",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.handleLockouts(w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+
+	api.router.DELETE(
+		"/_lockouts",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.handleClearLockout(w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,136 @@
+package patchy
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gopatchy/metadata"
+)
+
+type memoryBackend struct {
+	mu     sync.RWMutex
+	tables map[string]*memoryTable
+}
+
+type memoryTable struct {
+	objs map[string][]byte
+
+	// Insertion order, matching SQLite rowid order
+	ids []string
+}
+
+func NewMemoryStore() Store {
+	return NewBusStore(newMemoryBackend())
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		tables: map[string]*memoryTable{},
+	}
+}
+
+func (mb *memoryBackend) Close() {}
+
+func (mb *memoryBackend) Write(_ context.Context, t string, obj any) error {
+	// Store encoded objects so callers can't mutate stored state
+	js, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	id := metadata.GetMetadata(obj).ID
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	table := mb.tables[t]
+	if table == nil {
+		table = &memoryTable{
+			objs: map[string][]byte{},
+		}
+		mb.tables[t] = table
+	}
+
+	if _, has := table.objs[id]; !has {
+		table.ids = append(table.ids, id)
+	}
+
+	table.objs[id] = js
+
+	return nil
+}
+
+func (mb *memoryBackend) Delete(_ context.Context, t, id string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	table := mb.tables[t]
+	if table == nil {
+		return nil
+	}
+
+	if _, has := table.objs[id]; !has {
+		return nil
+	}
+
+	delete(table.objs, id)
+
+	for i, iter := range table.ids {
+		if iter == id {
+			table.ids = append(table.ids[:i], table.ids[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (mb *memoryBackend) Read(_ context.Context, t, id string, factory func() any) (any, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	table := mb.tables[t]
+	if table == nil {
+		return nil, nil
+	}
+
+	js, has := table.objs[id]
+	if !has {
+		return nil, nil
+	}
+
+	obj := factory()
+
+	err := json.Unmarshal(js, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (mb *memoryBackend) List(_ context.Context, t string, factory func() any) ([]any, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	ret := []any{}
+
+	table := mb.tables[t]
+	if table == nil {
+		return ret, nil
+	}
+
+	for _, id := range table.ids {
+		obj := factory()
+
+		err := json.Unmarshal(table.objs[id], obj)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, obj)
+	}
+
+	return ret, nil
+}
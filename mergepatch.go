@@ -0,0 +1,95 @@
+package patchy
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/metadata"
+)
+
+// writePatch sends a patch event that turns prev into obj. base and target
+// are their ETags; a client whose copy doesn't match base must resync.
+func writePatch(write eventWriter, params map[string]string, prev, obj any, flush bool) error {
+	patch, err := mergePatch(prev, obj)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "generate patch failed (%w)", err)
+	}
+
+	if params == nil {
+		params = map[string]string{}
+	}
+
+	params["base"] = metadata.GetMetadata(prev).ETag
+	params["target"] = metadata.GetMetadata(obj).ETag
+
+	err = write("patch", params, patch, flush)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write patch failed (%w)", err)
+	}
+
+	return nil
+}
+
+// mergePatch returns an RFC 7396 merge patch that turns from into to. As
+// in the RFC, a field changed to null can't be told apart from a removed one.
+func mergePatch(from, to any) (map[string]any, error) {
+	fromMap, err := toJSONMap(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toMap, err := toJSONMap(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffMaps(fromMap, toMap), nil
+}
+
+func diffMaps(from, to map[string]any) map[string]any {
+	patch := map[string]any{}
+
+	for k := range from {
+		if _, found := to[k]; !found {
+			patch[k] = nil
+		}
+	}
+
+	for k, toVal := range to {
+		fromVal, found := from[k]
+
+		if found && reflect.DeepEqual(fromVal, toVal) {
+			continue
+		}
+
+		fromSub, fromIsMap := fromVal.(map[string]any)
+		toSub, toIsMap := toVal.(map[string]any)
+
+		if fromIsMap && toIsMap {
+			patch[k] = diffMaps(fromSub, toSub)
+			continue
+		}
+
+		// Arrays and scalars are replaced whole
+		patch[k] = toVal
+	}
+
+	return patch
+}
+
+func toJSONMap(obj any) (map[string]any, error) {
+	js, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]any{}
+
+	err = json.Unmarshal(js, &ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
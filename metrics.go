@@ -0,0 +1,276 @@
+package patchy
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopatchy/event"
+	"github.com/julienschmidt/httprouter"
+)
+
+// metrics are served by /_metrics in the Prometheus text format
+type metrics struct {
+	requests        *metricVec
+	requestDuration *metricVec
+	streamsActive   *metricVec
+	storeDuration   *metricVec
+	lockWait        *metricVec
+	idempotency     *metricVec
+	certExpiry      *metricVec
+
+	all []*metricVec
+}
+
+type metricKind string
+
+const (
+	metricCounter   metricKind = "counter"
+	metricGauge     metricKind = "gauge"
+	metricHistogram metricKind = "histogram"
+)
+
+// metricVec is one metric family; series are keyed by label values
+type metricVec struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+
+	series map[string]*metricSeries
+	mu     sync.Mutex
+}
+
+type metricSeries struct {
+	labels []string
+
+	// Counters and gauges
+	value float64
+
+	// Histograms; counts aren't cumulative until written
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// In seconds; lower than the Prometheus defaults since lock waits and store
+// operations are usually fast
+var metricBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newMetrics() *metrics {
+	m := &metrics{}
+
+	m.requests = m.add("patchy_http_requests_total", "HTTP requests", metricCounter, "operation", "typeName", "responseCode")
+	m.requestDuration = m.add("patchy_http_request_duration_seconds", "HTTP request latency, excluding streams", metricHistogram, "operation", "typeName", "responseCode")
+	m.streamsActive = m.add("patchy_streams_active", "Open object and list streams, including multiplexed subscriptions", metricGauge, "typeName")
+	m.storeDuration = m.add("patchy_store_duration_seconds", "Store operation latency", metricHistogram, "operation", "typeName")
+	m.lockWait = m.add("patchy_lock_wait_seconds", "Time spent waiting for per-ID object locks", metricHistogram, "typeName")
+	m.idempotency = m.add("patchy_idempotency_requests_total", "Requests with an Idempotency-Key; hit includes requests rejected for not matching the cached request", metricCounter, "result")
+	m.certExpiry = m.add("patchy_tls_certificate_expiry_timestamp_seconds", "Expiry of certificates served by each listener, as a Unix time", metricGauge, "listener", "certificate")
+
+	return m
+}
+
+func (m *metrics) add(name, help string, kind metricKind, labels ...string) *metricVec {
+	mv := &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*metricSeries{},
+	}
+
+	if kind == metricHistogram {
+		mv.buckets = metricBuckets
+	}
+
+	m.all = append(m.all, mv)
+
+	return mv
+}
+
+// observeRequest records the fields that handlers set with SetEventData
+func (m *metrics) observeRequest(r *http.Request, ev *event.Event, start time.Time) {
+	labels := []string{
+		eventString(ev, "operation"),
+		eventString(ev, "typeName"),
+		eventString(ev, "responseCode"),
+	}
+
+	m.requests.add(1, labels...)
+
+	if stream, _ := ev.Data["stream"].(bool); !stream {
+		m.requestDuration.observe(time.Since(start).Seconds(), labels...)
+	}
+
+	if r.Header.Get("Idempotency-Key") != "" {
+		// Set when the request reaches the router
+		result := eventString(ev, "idempotency")
+		if result == "" {
+			result = "hit"
+		}
+
+		m.idempotency.add(1, result)
+	}
+}
+
+func eventString(ev *event.Event, key string) string {
+	val, found := ev.Data[key]
+	if !found {
+		return ""
+	}
+
+	return fmt.Sprint(val)
+}
+
+// trackStream counts an open stream; call the returned function when it
+// closes
+func (api *API) trackStream(cfg *config) func() {
+	api.metrics.streamsActive.add(1, cfg.apiName)
+
+	return func() {
+		api.metrics.streamsActive.add(-1, cfg.apiName)
+	}
+}
+
+func (mv *metricVec) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+
+	s := mv.series[key]
+	if s == nil {
+		s = &metricSeries{
+			labels: labels,
+			counts: make([]uint64, len(mv.buckets)),
+		}
+		mv.series[key] = s
+	}
+
+	return s
+}
+
+func (mv *metricVec) add(delta float64, labels ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	mv.get(labels).value += delta
+}
+
+func (mv *metricVec) set(val float64, labels ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	mv.get(labels).value = val
+}
+
+func (mv *metricVec) observe(val float64, labels ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	s := mv.get(labels)
+
+	i := sort.SearchFloat64s(mv.buckets, val)
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+
+	s.sum += val
+	s.count++
+}
+
+func (mv *metricVec) write(w *bufio.Writer) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", mv.name, mv.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", mv.name, mv.kind)
+
+	keys := []string{}
+	for key := range mv.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := mv.series[key]
+
+		if mv.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", mv.name, mv.formatLabels(s.labels, ""), formatFloat(s.value))
+			continue
+		}
+
+		cumulative := uint64(0)
+
+		for i, bound := range mv.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", mv.name, mv.formatLabels(s.labels, formatFloat(bound)), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", mv.name, mv.formatLabels(s.labels, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", mv.name, mv.formatLabels(s.labels, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", mv.name, mv.formatLabels(s.labels, ""), s.count)
+	}
+}
+
+// formatLabels adds an le label for histogram buckets when le isn't empty
+func (mv *metricVec) formatLabels(vals []string, le string) string {
+	parts := []string{}
+
+	for i, name := range mv.labels {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabel(vals[i])))
+	}
+
+	if le != "" {
+		parts = append(parts, fmt.Sprintf(`le="%s"`, le))
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("{%s}", strings.Join(parts, ","))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(val string) string {
+	return labelEscaper.Replace(val)
+}
+
+func formatFloat(val float64) string {
+	if math.IsInf(val, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func (api *API) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	api.SetEventData(r.Context(), "operation", "metrics")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	api.updateCertMetrics()
+
+	bw := bufio.NewWriter(w)
+
+	for _, mv := range api.metrics.all {
+		mv.write(bw)
+	}
+
+	_ = bw.Flush()
+}
+
+func (api *API) registerMetricsHandlers() {
+	api.router.GET(
+		"/_metrics",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) { api.handleMetrics(w, r) },
+	)
+}
@@ -0,0 +1,268 @@
+package patchy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/metadata"
+)
+
+// Migration converts the JSON form of an object from one schema version to
+// the next
+type Migration func(map[string]any) (map[string]any, error)
+
+type MigrationFailure struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	FromVersion int64  `json:"fromVersion"`
+	Error       string `json:"error"`
+}
+
+// schemaVersion records the version that all stored objects of a type are at
+type schemaVersion struct {
+	Metadata
+	Version int64 `json:"version"`
+}
+
+var ErrMigrationOrder = errors.New("migrations must be registered in version order")
+
+const schemaType = "_schema"
+
+// RegisterMigrationName adds a migration from fromVersion to fromVersion+1.
+// Types start at version 0; migrations must be registered in order.
+// Migrations run on first access to the type, or for all types at once
+// with Migrate().
+func RegisterMigrationName[T any](api *API, name string, fromVersion int64, fn Migration) {
+	cfg := api.registry[name]
+	if cfg == nil {
+		panic(name)
+	}
+
+	if fromVersion != int64(len(cfg.migrations)) {
+		panic(fmt.Sprintf("%s: %d (%s)", name, fromVersion, ErrMigrationOrder))
+	}
+
+	cfg.migrations = append(cfg.migrations, fn)
+}
+
+func RegisterMigration[T any](api *API, fromVersion int64, fn Migration) {
+	RegisterMigrationName[T](api, apiName[T](), fromVersion, fn)
+}
+
+// Migrate eagerly applies pending migrations for all types. Migration isn't
+// coordinated between processes, so run it from one.
+func (api *API) Migrate(ctx context.Context) error {
+	for _, name := range api.names() {
+		err := api.migrate(ctx, api.registry[name])
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "%s: migrate failed (%w)", name, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateDryRun reports objects that would fail to migrate, without writing
+func (api *API) MigrateDryRun(ctx context.Context) ([]*MigrationFailure, error) {
+	ret := []*MigrationFailure{}
+
+	for _, name := range api.names() {
+		cfg := api.registry[name]
+
+		if len(cfg.migrations) == 0 {
+			continue
+		}
+
+		failures, err := api.migrateInt(ctx, cfg, true)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "%s: migrate dry run failed (%w)", name, err)
+		}
+
+		ret = append(ret, failures...)
+	}
+
+	return ret, nil
+}
+
+// migrate is called before every operation; only the first call per type
+// does any work
+func (api *API) migrate(ctx context.Context, cfg *config) error {
+	if len(cfg.migrations) == 0 {
+		return nil
+	}
+
+	cfg.migrateMu.Lock()
+	defer cfg.migrateMu.Unlock()
+
+	if cfg.migrated {
+		return nil
+	}
+
+	failures, err := api.migrateInt(ctx, cfg, false)
+	if err == nil && len(failures) > 0 {
+		err = jsrest.Errorf(jsrest.ErrInternalServerError, "%s/%s: %s", cfg.apiName, failures[0].ID, failures[0].Error)
+	}
+
+	// Reported by /_health/ready
+	cfg.migrateErr = err
+
+	if err != nil {
+		return err
+	}
+
+	cfg.migrated = true
+
+	return nil
+}
+
+func (api *API) migrateInt(ctx context.Context, cfg *config, dryRun bool) ([]*MigrationFailure, error) {
+	target := int64(len(cfg.migrations))
+
+	version, found, err := api.getSchemaVersion(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == target {
+		if found || dryRun {
+			return nil, nil
+		}
+
+		return nil, api.setSchemaVersion(ctx, cfg, target)
+	}
+
+	if version > target {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "%s: stored schema version %d is newer than %d", cfg.apiName, version, target)
+	}
+
+	raws, err := api.sb.List(ctx, cfg.apiName, rawFactory)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "list failed (%w)", err)
+	}
+
+	failures := []*MigrationFailure{}
+	objs := []any{}
+
+	for _, raw := range raws {
+		m := *raw.(*map[string]any)
+		id, _ := m["id"].(string)
+
+		obj, err := cfg.migrateObj(m, version)
+		if err != nil {
+			failures = append(failures, &MigrationFailure{
+				Type:        cfg.apiName,
+				ID:          id,
+				FromVersion: version,
+				Error:       err.Error(),
+			})
+
+			continue
+		}
+
+		objs = append(objs, obj)
+	}
+
+	if dryRun || len(failures) > 0 {
+		return failures, nil
+	}
+
+	for _, obj := range objs {
+		err = api.storeWrite(ctx, cfg, obj)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "write failed (%w)", err)
+		}
+	}
+
+	return failures, api.setSchemaVersion(ctx, cfg, target)
+}
+
+// getSchemaVersion treats types with no version record and no objects as
+// current, since every write is preceded by migrate()
+func (api *API) getSchemaVersion(ctx context.Context, cfg *config) (int64, bool, error) {
+	sv, err := api.sb.Read(ctx, schemaType, cfg.apiName, func() any { return &schemaVersion{} })
+	if err != nil {
+		return 0, false, jsrest.Errorf(jsrest.ErrInternalServerError, "read schema version failed (%w)", err)
+	}
+
+	if sv != nil {
+		return sv.(*schemaVersion).Version, true, nil
+	}
+
+	// Old objects may not decode as the current type
+	list, err := api.sb.List(ctx, cfg.apiName, rawFactory)
+	if err != nil {
+		return 0, false, jsrest.Errorf(jsrest.ErrInternalServerError, "list failed (%w)", err)
+	}
+
+	if len(list) == 0 {
+		return int64(len(cfg.migrations)), false, nil
+	}
+
+	return 0, false, nil
+}
+
+func (api *API) setSchemaVersion(ctx context.Context, cfg *config, version int64) error {
+	err := api.sb.Write(ctx, schemaType, &schemaVersion{
+		Metadata: Metadata{
+			ID: cfg.apiName,
+		},
+		Version: version,
+	})
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write schema version failed (%w)", err)
+	}
+
+	return nil
+}
+
+func (cfg *config) migrateObj(m map[string]any, version int64) (any, error) {
+	md := &Metadata{}
+
+	err := remarshal(m, md, false)
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata failed (%w)", err)
+	}
+
+	for v := version; v < int64(len(cfg.migrations)); v++ {
+		m, err = cfg.migrations[v](m)
+		if err != nil {
+			return nil, fmt.Errorf("migration from version %d failed (%w)", v, err)
+		}
+	}
+
+	obj := cfg.factory()
+
+	// Unknown fields would be silently dropped, so reject them
+	err = remarshal(m, obj, true)
+	if err != nil {
+		return nil, fmt.Errorf("decode as version %d failed (%w)", len(cfg.migrations), err)
+	}
+
+	md.Generation++
+	metadata.SetMetadata(obj, md)
+
+	return obj, nil
+}
+
+func rawFactory() any {
+	return &map[string]any{}
+}
+
+func remarshal(src, dst any, strict bool) error {
+	js, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
+	return dec.Decode(dst)
+}
@@ -49,7 +49,7 @@ func (api *API) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
 
 	err := api.handleOpenAPIInt(ctx, w, r)
 	if err != nil {
-		jsrest.WriteError(w, err)
+		api.writeError(w, r, err)
 	}
 }
 
@@ -187,12 +187,82 @@ func (api *API) buildOpenAPIGlobal(r *http.Request) (*openapi3.T, error) {
 								Enum: []any{
 									"full",
 									"diff",
+									"patch",
 								},
 							},
 						},
 					},
 				},
 
+				"_stream-object": &openapi3.ParameterRef{
+					Value: &openapi3.Parameter{
+						Name:        "_stream",
+						In:          "query",
+						Description: "EventStream (Object) format; `patch` sends updates as JSON merge patches",
+						Schema: &openapi3.SchemaRef{
+							Value: &openapi3.Schema{
+								Type: "enum",
+								Enum: []any{
+									"full",
+									"patch",
+								},
+							},
+						},
+					},
+				},
+
+				"_debounce": &openapi3.ParameterRef{
+					Value: &openapi3.Parameter{
+						Name:        "_debounce",
+						In:          "query",
+						Description: "EventStream (List): wait until changes stop for this duration (e.g. `250ms`) and send only the latest list",
+						Schema: &openapi3.SchemaRef{
+							Value: &openapi3.Schema{
+								Type: "string",
+							},
+						},
+					},
+				},
+
+				"_maxRate": &openapi3.ParameterRef{
+					Value: &openapi3.Parameter{
+						Name:        "_maxRate",
+						In:          "query",
+						Description: "EventStream (List): maximum updates per second; intermediate lists are skipped",
+						Schema: &openapi3.SchemaRef{
+							Value: &openapi3.Schema{
+								Type: "number",
+							},
+						},
+					},
+				},
+
+				"_heartbeat": &openapi3.ParameterRef{
+					Value: &openapi3.Parameter{
+						Name:        "_heartbeat",
+						In:          "query",
+						Description: "EventStream: interval between heartbeat events (e.g. `15s`)",
+						Schema: &openapi3.SchemaRef{
+							Value: &openapi3.Schema{
+								Type: "string",
+							},
+						},
+					},
+				},
+
+				"_maxDuration": &openapi3.ParameterRef{
+					Value: &openapi3.Parameter{
+						Name:        "_maxDuration",
+						In:          "query",
+						Description: "EventStream: send a reconnect event and close the stream after this duration (e.g. `5m`); can't exceed the server limit",
+						Schema: &openapi3.SchemaRef{
+							Value: &openapi3.Schema{
+								Type: "string",
+							},
+						},
+					},
+				},
+
 				"_limit": &openapi3.ParameterRef{
 					Value: &openapi3.Parameter{
 						Name:        "_limit",
@@ -380,8 +450,10 @@ func (api *API) buildOpenAPIGlobal(r *http.Request) (*openapi3.T, error) {
 								"notModified",
 								"initial",
 								"update",
+								"patch",
 								"delete",
 								"heartbeat",
+								"reconnect",
 								"error",
 							},
 						},
@@ -398,6 +470,9 @@ func (api *API) buildOpenAPIGlobal(r *http.Request) (*openapi3.T, error) {
 							&openapi3.SchemaRef{
 								Ref: "#/components/schemas/event-stream-list-diff",
 							},
+							&openapi3.SchemaRef{
+								Ref: "#/components/schemas/event-stream-list-patch",
+							},
 						},
 					},
 				},
@@ -410,6 +485,7 @@ func (api *API) buildOpenAPIGlobal(r *http.Request) (*openapi3.T, error) {
 								"notModified",
 								"list",
 								"heartbeat",
+								"reconnect",
 								"error",
 							},
 						},
@@ -427,6 +503,25 @@ func (api *API) buildOpenAPIGlobal(r *http.Request) (*openapi3.T, error) {
 								"update",
 								"sync",
 								"heartbeat",
+								"reconnect",
+								"error",
+							},
+						},
+					},
+				},
+
+				"event-stream-list-patch": &openapi3.SchemaRef{
+					Value: &openapi3.Schema{
+						Title: "EventStream (List; _stream=patch)",
+						Extensions: map[string]any{
+							"x-event-types": []string{
+								"notModified",
+								"add",
+								"remove",
+								"patch",
+								"sync",
+								"heartbeat",
+								"reconnect",
 								"error",
 							},
 						},
@@ -645,6 +740,18 @@ func (api *API) buildOpenAPIType(t *openapi3.T, cfg *config) error {
 				&openapi3.ParameterRef{
 					Ref: "#/components/parameters/_stream",
 				},
+				&openapi3.ParameterRef{
+					Ref: "#/components/parameters/_debounce",
+				},
+				&openapi3.ParameterRef{
+					Ref: "#/components/parameters/_maxRate",
+				},
+				&openapi3.ParameterRef{
+					Ref: "#/components/parameters/_heartbeat",
+				},
+				&openapi3.ParameterRef{
+					Ref: "#/components/parameters/_maxDuration",
+				},
 				&openapi3.ParameterRef{
 					Ref: "#/components/parameters/_limit",
 				},
@@ -741,6 +848,15 @@ func (api *API) buildOpenAPIType(t *openapi3.T, cfg *config) error {
 				&openapi3.ParameterRef{
 					Ref: "#/components/headers/if-none-match",
 				},
+				&openapi3.ParameterRef{
+					Ref: "#/components/parameters/_stream-object",
+				},
+				&openapi3.ParameterRef{
+					Ref: "#/components/parameters/_heartbeat",
+				},
+				&openapi3.ParameterRef{
+					Ref: "#/components/parameters/_maxDuration",
+				},
 			},
 			Responses: openapi3.Responses{
 				"200": &openapi3.ResponseRef{
@@ -885,6 +1001,8 @@ func (api *API) buildOpenAPIType(t *openapi3.T, cfg *config) error {
 		},
 	}
 
+	openAPIBulk(t, cfg)
+
 	return nil
 }
 
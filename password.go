@@ -0,0 +1,314 @@
+package patchy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/path"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes plaintext passwords written to authBasicPass fields.
+// Verification is by hash format, so changing the hasher still accepts
+// existing hashes and upgrades them on the next successful login.
+type PasswordHasher interface {
+	Hash(string) (string, error)
+	NeedsRehash(string) bool
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+var (
+	ErrPasswordMismatch    = errors.New("password mismatch")
+	ErrInvalidArgon2idHash = errors.New("invalid argon2id hash")
+	ErrPasswordHashCostly  = errors.New("password hash parameters exceed the configured hasher")
+)
+
+const argon2idPrefix = "$argon2id$"
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{
+		Cost: cost,
+	}
+}
+
+func (h *BcryptHasher) Hash(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+
+	return cost != h.Cost
+}
+
+// NewArgon2idHasher returns a hasher with the RFC 9106 second recommended
+// parameters (t=3, m=64MiB)
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+func (h *Argon2idHasher) Hash(pass string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(pass), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Time != h.Time ||
+		params.Memory != h.Memory ||
+		params.Threads != h.Threads ||
+		uint32(len(salt)) != h.SaltLen ||
+		uint32(len(key)) != h.KeyLen
+}
+
+func parseArgon2id(hash string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2idPrefix), "$")
+	if !strings.HasPrefix(hash, argon2idPrefix) || len(parts) != 4 {
+		return nil, nil, nil, ErrInvalidArgon2idHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[0], "v=%d", &version)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s (%w)", parts[0], ErrInvalidArgon2idHash)
+	}
+
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported version %d (%w)", version, ErrInvalidArgon2idHash)
+	}
+
+	params := &Argon2idHasher{}
+
+	_, err = fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s (%w)", parts[1], ErrInvalidArgon2idHash)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("salt (%w)", ErrInvalidArgon2idHash)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("key (%w)", ErrInvalidArgon2idHash)
+	}
+
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// maxHashParams returns the costliest bcrypt and argon2id parameters that
+// are verified: those of hasher, or the defaults where they're higher (so
+// lowering the cost doesn't lock out existing users)
+func maxHashParams(hasher PasswordHasher) (int, *Argon2idHasher) {
+	maxCost := bcrypt.DefaultCost
+	maxArgon2id := NewArgon2idHasher()
+
+	switch h := hasher.(type) {
+	case *BcryptHasher:
+		if h.Cost > maxCost {
+			maxCost = h.Cost
+		}
+
+	case *Argon2idHasher:
+		if h.Time > maxArgon2id.Time {
+			maxArgon2id.Time = h.Time
+		}
+
+		if h.Memory > maxArgon2id.Memory {
+			maxArgon2id.Memory = h.Memory
+		}
+
+		if h.Threads > maxArgon2id.Threads {
+			maxArgon2id.Threads = h.Threads
+		}
+	}
+
+	return maxCost, maxArgon2id
+}
+
+// comparePassword rejects hashes costlier than hasher's before running
+// them, since hashes may come from outside (e.g. replication)
+func comparePassword(hash, pass string, hasher PasswordHasher) error {
+	maxCost, maxArgon2id := maxHashParams(hasher)
+
+	if !strings.HasPrefix(hash, argon2idPrefix) {
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return err
+		}
+
+		if cost > maxCost {
+			return fmt.Errorf("bcrypt cost %d (%w)", cost, ErrPasswordHashCostly)
+		}
+
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	}
+
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+
+	if params.Time > maxArgon2id.Time || params.Memory > maxArgon2id.Memory || params.Threads > maxArgon2id.Threads {
+		return fmt.Errorf("argon2id m=%d,t=%d,p=%d (%w)", params.Memory, params.Time, params.Threads, ErrPasswordHashCostly)
+	}
+
+	reqKey := argon2.IDKey([]byte(pass), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	if subtle.ConstantTimeCompare(key, reqKey) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+// isPasswordHash allows direct and replicated writes of already-hashed
+// values to pass through unchanged
+func isPasswordHash(val string) bool {
+	if strings.HasPrefix(val, argon2idPrefix) {
+		_, _, _, err := parseArgon2id(val)
+		return err == nil
+	}
+
+	_, err := bcrypt.Cost([]byte(val))
+
+	return err == nil
+}
+
+// hashPasswords hashes values that changed from prev (which may be nil).
+// Values from HTTP requests are always hashed, so clients can't store
+// hashes of their choosing.
+func (cfg *config) hashPasswords(ctx context.Context, obj, prev any, hasher PasswordHasher) error {
+	for _, p := range cfg.passwordPaths {
+		val, err := getString(obj, p)
+		if err != nil {
+			return err
+		}
+
+		if val == "" {
+			continue
+		}
+
+		if prev != nil {
+			prevVal, err := getString(prev, p)
+			if err != nil {
+				return err
+			}
+
+			if val == prevVal {
+				continue
+			}
+		}
+
+		if auditSource(ctx) != "http" && isPasswordHash(val) {
+			continue
+		}
+
+		hash, err := hasher.Hash(val)
+		if err != nil {
+			return err
+		}
+
+		err = path.Set(obj, p, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rehashPassword writes straight to the store, like Restore, since it isn't
+// a change by the (not yet authenticated) user: no hooks, generation bump or
+// audit record
+func (api *API) rehashPassword(ctx context.Context, cfg *config, id, pathPass, pass string) error {
+	hash, err := api.passwordHasher.Hash(pass)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "hash password failed (%w)", err)
+	}
+
+	cfg.lock(id)
+	defer cfg.unlock(id)
+
+	obj, err := api.sb.Read(ctx, cfg.apiName, id, cfg.factory)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
+	}
+
+	if obj == nil {
+		// Deleted since lookup
+		return nil
+	}
+
+	err = path.Set(obj, pathPass, hash)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "set password hash failed (%w)", err)
+	}
+
+	err = api.storeWrite(ctx, cfg, obj)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write failed: %s (%w)", id, err)
+	}
+
+	return nil
+}
+
+func (api *API) SetPasswordHasher(hasher PasswordHasher) {
+	api.passwordHasher = hasher
+}
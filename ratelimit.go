@@ -0,0 +1,167 @@
+package patchy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+)
+
+// RateLimit allows Burst requests at once, refilled at Rate per second
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type rateLimiter struct {
+	limits *Limits
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	limit  *RateLimit
+	tokens float64
+	last   time.Time
+}
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// Buckets idle this long are full again for any sane limit
+const rateLimitSweep = time.Minute
+
+func newRateLimiter(limits *Limits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// limit returns the RateLimit for op on typeName, or nil
+func (rl *rateLimiter) limit(typeName, op string) *RateLimit {
+	for _, key := range []string{
+		fmt.Sprintf("%s/%s", typeName, op),
+		typeName,
+		fmt.Sprintf("*/%s", op),
+	} {
+		if limit, found := rl.limits.RouteRateLimit[key]; found {
+			return limit
+		}
+	}
+
+	return rl.limits.RateLimit
+}
+
+// take removes a token from the principal's bucket for the route. It
+// returns the limit (nil if none applies), the tokens remaining, the time
+// until the bucket is full and, when refused, the time until a token is
+// available.
+func (rl *rateLimiter) take(principal, typeName, op string) (*RateLimit, int, time.Duration, time.Duration) {
+	limit := rl.limit(typeName, op)
+	if limit == nil || limit.Rate <= 0 {
+		return nil, 0, 0, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+
+	rl.sweep(now)
+
+	key := fmt.Sprintf("%s\xff%s\xff%s", principal, typeName, op)
+
+	tb := rl.buckets[key]
+	if tb == nil || tb.limit != limit {
+		tb = &tokenBucket{
+			limit:  limit,
+			tokens: float64(limit.Burst),
+			last:   now,
+		}
+		rl.buckets[key] = tb
+	}
+
+	tb.refill(now)
+
+	retry := time.Duration(0)
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+	} else {
+		retry = tb.wait(1 - tb.tokens)
+	}
+
+	return limit, int(math.Floor(tb.tokens)), tb.wait(float64(limit.Burst) - tb.tokens), retry
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(float64(tb.limit.Burst), tb.tokens+now.Sub(tb.last).Seconds()*tb.limit.Rate)
+	tb.last = now
+}
+
+// wait returns how long until tokens more are available
+func (tb *tokenBucket) wait(tokens float64) time.Duration {
+	return time.Duration(tokens / tb.limit.Rate * float64(time.Second))
+}
+
+// sweep drops full buckets at most once per rateLimitSweep, so the map
+// doesn't grow with every address seen
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweep {
+		return
+	}
+
+	rl.lastSweep = now
+
+	for key, tb := range rl.buckets {
+		tb.refill(now)
+
+		if tb.tokens >= float64(tb.limit.Burst) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// checkRateLimit sets RateLimit-* headers and returns 429 (with
+// Retry-After) when the caller is over the limit for op on cfg
+func (api *API) checkRateLimit(cfg *config, op string, w http.ResponseWriter, r *http.Request) error {
+	return api.checkRateLimitPrincipal(r.Context(), api.requestPrincipal(r), cfg.apiName, op, w.Header())
+}
+
+// checkRateLimitPrincipal is checkRateLimit for requests that aren't their
+// own HTTP request (e.g. over /_ws); header may be discarded
+func (api *API) checkRateLimitPrincipal(ctx context.Context, principal, typeName, op string, header http.Header) error {
+	limit, remaining, reset, retry := api.rateLimiter.take(principal, typeName, op)
+	if limit == nil {
+		return nil
+	}
+
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(retryAfterSeconds(reset)))
+
+	if retry == 0 {
+		return nil
+	}
+
+	api.eventClient.WriteEvent(ctx, event.NewEvent(
+		"rateLimited",
+		"principal", principal,
+		"typeName", typeName,
+		"operation", op,
+		"retryAfterSeconds", retryAfterSeconds(retry),
+	))
+
+	header.Set("Retry-After", strconv.Itoa(retryAfterSeconds(retry)))
+
+	return jsrest.Errorf(jsrest.ErrTooManyRequests, "%s %s (%w)", op, typeName, ErrRateLimited)
+}
@@ -0,0 +1,395 @@
+package patchy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/metadata"
+	"github.com/gopatchy/path"
+	"github.com/julienschmidt/httprouter"
+)
+
+type SessionPaths struct {
+	Token   string
+	CSRF    string
+	User    string
+	Expires string
+}
+
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	CSRFToken string    `json:"csrfToken"`
+	Expires   time.Time `json:"expires"`
+}
+
+var (
+	ErrCSRFMismatch     = errors.New("CSRF token missing or mismatch")
+	ErrLoginRequired    = errors.New("login requires Basic credentials")
+	ErrMultipleSessions = errors.New("multiple session types registered")
+)
+
+const (
+	SessionCookie = "patchy-session"
+	CSRFCookie    = "patchy-csrf"
+	CSRFHeader    = "X-CSRF-Token"
+
+	sessionTokenLen   = 40
+	DefaultSessionTTL = 24 * time.Hour
+)
+
+func authSession(w http.ResponseWriter, r *http.Request, api *API, cfg *config) (*http.Request, error) {
+	ctx := r.Context()
+
+	// Explicit credentials take precedence, which also lets a browser with
+	// a stale cookie log in again
+	if r.Header.Get("Authorization") != "" {
+		return r, nil
+	}
+
+	// Browsers send cookies to every port on a host, so a cookie on a
+	// listener that doesn't accept sessions is ignored rather than rejected
+	if !api.listenerAcceptsAuth(r, "session") {
+		return r, nil
+	}
+
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return r, nil
+	}
+
+	session, err := api.findSession(ctx, cfg, cookie.Value)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "find session failed (%w)", err)
+	}
+
+	if session == nil {
+		clearSessionCookies(w, r)
+		return r, nil
+	}
+
+	if !isSafeMethod(r.Method) {
+		err = checkCSRF(r, cfg, session)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = path.Set(session, cfg.sessionPaths.Token, "")
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "clear session token failed (%w)", err)
+	}
+
+	return r.WithContext(context.WithValue(ctx, ContextAuthSession, session)), nil
+}
+
+// findSession returns nil for unknown or expired tokens
+func (api *API) findSession(ctx context.Context, cfg *config, token string) (any, error) {
+	sessions, err := api.listInt(context.WithValue(ctx, ContextAuthSessionLookup, true), cfg, &ListOpts{
+		Filters: []Filter{
+			{
+				Path:  cfg.sessionPaths.Token,
+				Op:    "eq",
+				Value: hashSecret(token),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sessions) != 1 {
+		return nil, nil
+	}
+
+	session := sessions[0]
+
+	if cfg.sessionPaths.Expires != "" {
+		expires, err := getTime(session, cfg.sessionPaths.Expires)
+		if err != nil {
+			return nil, err
+		}
+
+		if !expires.IsZero() && time.Now().After(expires) {
+			return nil, nil
+		}
+	}
+
+	return session, nil
+}
+
+// checkCSRF requires the header to match both the cookie (double-submit)
+// and the value stored with the session
+func checkCSRF(r *http.Request, cfg *config, session any) error {
+	reqToken := r.Header.Get(CSRFHeader)
+
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || reqToken == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(reqToken)) != 1 {
+		return jsrest.Errorf(jsrest.ErrForbidden, "%w", ErrCSRFMismatch)
+	}
+
+	sessionToken, err := getString(session, cfg.sessionPaths.CSRF)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "get session CSRF token failed (%w)", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(sessionToken), []byte(reqToken)) != 1 {
+		return jsrest.Errorf(jsrest.ErrForbidden, "%w", ErrCSRFMismatch)
+	}
+
+	return nil
+}
+
+func (api *API) login(cfg *config, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	err := api.checkListenerAuth(r, "session")
+	if err != nil {
+		return err
+	}
+
+	user := ctx.Value(ContextAuthBasic)
+	if user == nil {
+		return jsrest.Errorf(jsrest.ErrUnauthorized, "%w", ErrLoginRequired)
+	}
+
+	token := uniuri.NewLen(sessionTokenLen)
+	csrf := uniuri.NewLen(sessionTokenLen)
+	expires := time.Now().Add(api.sessionTTL)
+
+	session := cfg.factory()
+
+	err = path.Set(session, cfg.sessionPaths.Token, hashSecret(token))
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "set session token failed (%w)", err)
+	}
+
+	err = path.Set(session, cfg.sessionPaths.CSRF, csrf)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "set session CSRF token failed (%w)", err)
+	}
+
+	err = path.Set(session, cfg.sessionPaths.User, metadata.GetMetadata(user).ID)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "set session user failed (%w)", err)
+	}
+
+	if cfg.sessionPaths.Expires != "" {
+		err = path.MergeMap(session, pathMap(cfg.sessionPaths.Expires, expires))
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "set session expiry failed (%w)", err)
+		}
+	}
+
+	created, err := api.createInt(context.WithValue(ctx, ContextAuthSessionLookup, true), cfg, session)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "create session failed (%w)", err)
+	}
+
+	info := &SessionInfo{
+		ID:        metadata.GetMetadata(created).ID,
+		CSRFToken: csrf,
+		Expires:   expires,
+	}
+
+	api.SetEventData(ctx,
+		"operation", "login",
+		"sessionID", info.ID,
+	)
+
+	secure := r.TLS != nil
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Readable by first-party JS so it can echo it in CSRFHeader
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(info)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write response failed (%w)", err)
+	}
+
+	return nil
+}
+
+func (api *API) logout(cfg *config, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	session := ctx.Value(ContextAuthSession)
+
+	if session != nil {
+		id := metadata.GetMetadata(session).ID
+
+		api.SetEventData(ctx,
+			"operation", "logout",
+			"sessionID", id,
+		)
+
+		err := api.deleteInt(context.WithValue(ctx, ContextAuthSessionLookup, true), cfg, id, nil)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "delete session failed (%w)", err)
+		}
+	}
+
+	clearSessionCookies(w, r)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{SessionCookie, CSRFCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   r.TLS != nil,
+			HttpOnly: name == SessionCookie,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+func AddSessionName[T any](api *API, name string, paths *SessionPaths) {
+	cfg := api.registry[name]
+	if cfg == nil {
+		panic(name)
+	}
+
+	if api.sessionCfg != nil {
+		panic(ErrMultipleSessions)
+	}
+
+	cfg.sessionPaths = paths
+	cfg.hidePaths = append(cfg.hidePaths, paths.Token, paths.CSRF)
+	api.sessionCfg = cfg
+
+	api.AddRequestHook(func(w http.ResponseWriter, r *http.Request, a *API) (*http.Request, error) {
+		return authSession(w, r, a, cfg)
+	})
+
+	api.router.POST(
+		"/_login",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.limited("login", api.login)(cfg, w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+
+	api.router.POST(
+		"/_logout",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.logout(cfg, w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+
+	api.eventClient.AddHook(EventHookAuthSession)
+	api.AddOpenAPIHook(OpenAPIHookAuthSession)
+
+	api.authSession = true
+}
+
+func AddSession[T any](api *API, paths *SessionPaths) {
+	AddSessionName[T](api, apiName[T](), paths)
+}
+
+// RevokeSessions deletes all sessions of a user, e.g. after a password change
+func (api *API) RevokeSessions(ctx context.Context, userID string) error {
+	cfg := api.sessionCfg
+	if cfg == nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "no session type registered")
+	}
+
+	lookupCtx := context.WithValue(ctx, ContextAuthSessionLookup, true)
+
+	sessions, err := api.listInt(lookupCtx, cfg, &ListOpts{
+		Filters: []Filter{
+			{
+				Path:  cfg.sessionPaths.User,
+				Op:    "eq",
+				Value: userID,
+			},
+		},
+	})
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "list sessions failed (%w)", err)
+	}
+
+	for _, session := range sessions {
+		err = api.deleteInt(lookupCtx, cfg, metadata.GetMetadata(session).ID, nil)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "delete session failed (%w)", err)
+		}
+	}
+
+	return nil
+}
+
+func (api *API) SetSessionTTL(ttl time.Duration) {
+	api.sessionTTL = ttl
+}
+
+func EventHookAuthSession(ctx context.Context, ev *event.Event) {
+	ctxSession := ctx.Value(ContextAuthSession)
+
+	if ctxSession == nil {
+		return
+	}
+
+	ev.Set(
+		"authMethod", "session",
+		"sessionID", metadata.GetMetadata(ctxSession).ID,
+	)
+}
+
+func OpenAPIHookAuthSession(_ context.Context, t *OpenAPI) {
+	t.Components.SecuritySchemes["sessionAuth"] = &openapi3.SecuritySchemeRef{
+		Value: &openapi3.SecurityScheme{
+			Type:        "apiKey",
+			In:          "cookie",
+			Name:        SessionCookie,
+			Description: "Issued by `POST /_login`; unsafe methods also require the `" + CSRFHeader + "` header",
+		},
+	}
+
+	t.Security = append(t.Security, openapi3.SecurityRequirement{"sessionAuth": []string{}})
+}
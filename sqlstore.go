@@ -0,0 +1,157 @@
+package patchy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopatchy/metadata"
+)
+
+// sqlBackend uses only SQL accepted by both PostgreSQL and SQLite: $N
+// placeholders, quoted identifiers and ON CONFLICT upserts
+type sqlBackend struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	tables map[string]bool
+}
+
+// NewSQLStore takes ownership of db, closing it on API shutdown. db may use
+// any PostgreSQL-compatible driver.
+func NewSQLStore(db *sql.DB) Store {
+	return NewBusStore(NewSQLBackend(db))
+}
+
+func NewSQLBackend(db *sql.DB) Backend {
+	return &sqlBackend{
+		db:     db,
+		tables: map[string]bool{},
+	}
+}
+
+func (sb *sqlBackend) Close() {
+	sb.db.Close()
+}
+
+func (sb *sqlBackend) Write(ctx context.Context, t string, obj any) error {
+	js, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	table, err := sb.table(ctx, t)
+	if err != nil {
+		return err
+	}
+
+	// seq is only set on insert, so it preserves insertion order for List()
+	_, err = sb.db.ExecContext(
+		ctx,
+		fmt.Sprintf(`INSERT INTO %s (id, seq, obj) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET obj = EXCLUDED.obj;`, table),
+		metadata.GetMetadata(obj).ID,
+		time.Now().UnixNano(),
+		string(js),
+	)
+
+	return err
+}
+
+func (sb *sqlBackend) Delete(ctx context.Context, t, id string) error {
+	table, err := sb.table(ctx, t)
+	if err != nil {
+		return err
+	}
+
+	_, err = sb.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1;`, table), id)
+
+	return err
+}
+
+func (sb *sqlBackend) Read(ctx context.Context, t, id string, factory func() any) (any, error) {
+	table, err := sb.table(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var js string
+
+	err = sb.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT obj FROM %s WHERE id = $1;`, table), id).Scan(&js)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	obj := factory()
+
+	err = json.Unmarshal([]byte(js), obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (sb *sqlBackend) List(ctx context.Context, t string, factory func() any) ([]any, error) {
+	table, err := sb.table(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sb.db.QueryContext(ctx, fmt.Sprintf(`SELECT obj FROM %s ORDER BY seq, id;`, table))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := []any{}
+
+	for rows.Next() {
+		var js string
+
+		err = rows.Scan(&js)
+		if err != nil {
+			return nil, err
+		}
+
+		obj := factory()
+
+		err = json.Unmarshal([]byte(js), obj)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, obj)
+	}
+
+	return ret, rows.Err()
+}
+
+// table creates the table on first use and returns its quoted name
+func (sb *sqlBackend) table(ctx context.Context, t string) (string, error) {
+	quoted := fmt.Sprintf(`"%s"`, strings.ReplaceAll(t, `"`, `""`))
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.tables[t] {
+		return quoted, nil
+	}
+
+	_, err := sb.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id TEXT NOT NULL PRIMARY KEY, seq BIGINT NOT NULL, obj TEXT NOT NULL);`, quoted))
+	if err != nil {
+		return "", err
+	}
+
+	sb.tables[t] = true
+
+	return quoted, nil
+}
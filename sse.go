@@ -9,6 +9,16 @@ import (
 	"github.com/gopatchy/jsrest"
 )
 
+// eventWriter sends one stream event; each transport (SSE, WebSocket)
+// provides one
+type eventWriter func(event string, params map[string]string, obj any, flush bool) error
+
+func sseWriter(w http.ResponseWriter) eventWriter {
+	return func(event string, params map[string]string, obj any, flush bool) error {
+		return writeEvent(w, event, params, obj, flush)
+	}
+}
+
 func writeEvent(w http.ResponseWriter, event string, params map[string]string, obj any, flush bool) error {
 	buf := &bytes.Buffer{}
 
@@ -0,0 +1,220 @@
+package patchy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gopatchy/bus"
+	"github.com/gopatchy/jsrest"
+	"github.com/gopatchy/store"
+	"github.com/gopatchy/storebus"
+)
+
+// Store is the storage interface used by API. Streams deliver the current
+// value first, then each change; ReadStream channels close on delete.
+// *storebus.StoreBus implements Store.
+type Store interface {
+	Write(context.Context, string, any) error
+	Delete(context.Context, string, string) error
+	Read(context.Context, string, string, func() any) (any, error)
+	List(context.Context, string, func() any) ([]any, error)
+
+	ReadStream(context.Context, string, string, func() any) (<-chan any, error)
+	CloseReadStream(string, string, <-chan any)
+	ListStream(context.Context, string, func() any) (<-chan []any, error)
+	CloseListStream(string, <-chan []any)
+
+	Close()
+}
+
+// Backend is plain persistence without change notification. NewBusStore
+// adds streams on top. *store.Store implements Backend.
+type Backend interface {
+	Write(context.Context, string, any) error
+	Delete(context.Context, string, string) error
+	Read(context.Context, string, string, func() any) (any, error)
+	List(context.Context, string, func() any) ([]any, error)
+	Close()
+}
+
+// BatchStore is optionally implemented by Stores that can announce several
+// changes of one type to list streams as a single update
+type BatchStore interface {
+	WriteBatch(ctx context.Context, t string, writes []any, deletes []string) error
+}
+
+type busStore struct {
+	backend Backend
+	bus     *bus.Bus
+
+	// List subscriptions are kept separately so batches can announce once
+	typeBus *bus.Bus
+
+	// This lock ensures that no writes interleave with read/subscribe pairs
+	orderMu sync.RWMutex
+
+	chanMap   map[<-chan []any]<-chan any
+	chanMapMu sync.Mutex
+}
+
+var (
+	_ Store      = (*storebus.StoreBus)(nil)
+	_ Backend    = (*store.Store)(nil)
+	_ BatchStore = (*busStore)(nil)
+)
+
+func NewBusStore(backend Backend) Store {
+	return &busStore{
+		backend: backend,
+		bus:     bus.NewBus(),
+		typeBus: bus.NewBus(),
+		chanMap: map[<-chan []any]<-chan any{},
+	}
+}
+
+func (bs *busStore) Close() {
+	bs.backend.Close()
+}
+
+func (bs *busStore) Write(ctx context.Context, t string, obj any) error {
+	bs.orderMu.Lock()
+	defer bs.orderMu.Unlock()
+
+	err := storebus.UpdateHash(obj)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "hash update failed (%w)", err)
+	}
+
+	err = bs.backend.Write(ctx, t, obj)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write failed (%w)", err)
+	}
+
+	bs.bus.Announce(t, obj)
+	bs.typeBus.Announce(t, obj)
+
+	return nil
+}
+
+func (bs *busStore) WriteBatch(ctx context.Context, t string, writes []any, deletes []string) error {
+	bs.orderMu.Lock()
+	defer bs.orderMu.Unlock()
+
+	for _, obj := range writes {
+		err := storebus.UpdateHash(obj)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "hash update failed (%w)", err)
+		}
+
+		err = bs.backend.Write(ctx, t, obj)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "write failed (%w)", err)
+		}
+
+		bs.bus.Announce(t, obj)
+	}
+
+	for _, id := range deletes {
+		err := bs.backend.Delete(ctx, t, id)
+		if err != nil {
+			return jsrest.Errorf(jsrest.ErrInternalServerError, "delete failed (%w)", err)
+		}
+
+		bs.bus.Delete(t, id)
+	}
+
+	// List subscribers re-list on any notification, so one is enough
+	switch {
+	case len(writes) > 0:
+		bs.typeBus.Announce(t, writes[len(writes)-1])
+	case len(deletes) > 0:
+		bs.typeBus.Delete(t, deletes[len(deletes)-1])
+	}
+
+	return nil
+}
+
+func (bs *busStore) Delete(ctx context.Context, t, id string) error {
+	bs.orderMu.Lock()
+	defer bs.orderMu.Unlock()
+
+	err := bs.backend.Delete(ctx, t, id)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "delete failed (%w)", err)
+	}
+
+	bs.bus.Delete(t, id)
+	bs.typeBus.Delete(t, id)
+
+	return nil
+}
+
+func (bs *busStore) Read(ctx context.Context, t, id string, factory func() any) (any, error) {
+	return bs.backend.Read(ctx, t, id, factory)
+}
+
+func (bs *busStore) ReadStream(ctx context.Context, t, id string, factory func() any) (<-chan any, error) {
+	bs.orderMu.RLock()
+	defer bs.orderMu.RUnlock()
+
+	initial, err := bs.backend.Read(ctx, t, id, factory)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed (%w)", err)
+	}
+
+	return bs.bus.SubscribeKey(t, id, initial), nil
+}
+
+func (bs *busStore) CloseReadStream(t, id string, c <-chan any) {
+	bs.bus.UnsubscribeKey(t, id, c)
+}
+
+func (bs *busStore) List(ctx context.Context, t string, factory func() any) ([]any, error) {
+	return bs.backend.List(ctx, t, factory)
+}
+
+func (bs *busStore) ListStream(ctx context.Context, t string, factory func() any) (<-chan []any, error) {
+	bs.orderMu.RLock()
+	defer bs.orderMu.RUnlock()
+
+	initial, err := bs.backend.List(ctx, t, factory)
+	if err != nil {
+		return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "list failed (%w)", err)
+	}
+
+	c := bs.typeBus.SubscribeType(t, initial)
+
+	ret := make(chan []any, 100)
+
+	bs.chanMapMu.Lock()
+	bs.chanMap[ret] = c
+	bs.chanMapMu.Unlock()
+
+	go func() {
+		defer close(ret)
+
+		for range c {
+			// List() results are always at least (but not exactly) as new as the write that triggered it
+			l, err := bs.backend.List(ctx, t, factory)
+			if err != nil {
+				break
+			}
+
+			select {
+			case ret <- l:
+			default:
+			}
+		}
+	}()
+
+	return ret, nil
+}
+
+func (bs *busStore) CloseListStream(t string, c <-chan []any) {
+	bs.chanMapMu.Lock()
+	defer bs.chanMapMu.Unlock()
+
+	bs.typeBus.UnsubscribeType(t, bs.chanMap[c])
+
+	delete(bs.chanMap, c)
+}
@@ -0,0 +1,282 @@
+package patchy_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/gopatchy/patchy"
+	"github.com/gopatchy/storebus"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+var testStores = map[string]func(*testing.T) patchy.Store{
+	"storebus": func(t *testing.T) patchy.Store {
+		sb, err := storebus.NewStoreBus(fmt.Sprintf("file:%s?mode=memory&cache=shared", uniuri.New()))
+		require.NoError(t, err)
+
+		return sb
+	},
+
+	"memory": func(*testing.T) patchy.Store {
+		return patchy.NewMemoryStore()
+	},
+
+	// SQLite stands in for PostgreSQL; the backend only uses SQL both accept
+	"sql": func(t *testing.T) patchy.Store {
+		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared", uniuri.New()))
+		require.NoError(t, err)
+
+		return patchy.NewSQLStore(db)
+	},
+}
+
+func TestStoreConformance(t *testing.T) {
+	t.Parallel()
+
+	for name, newStore := range testStores {
+		newStore := newStore
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			for testName, test := range storeTests {
+				test := test
+
+				t.Run(testName, func(t *testing.T) {
+					t.Parallel()
+
+					st := newStore(t)
+					defer st.Close()
+
+					test(t, st)
+				})
+			}
+		})
+	}
+}
+
+var storeTests = map[string]func(*testing.T, patchy.Store){
+	"WriteRead":       testStoreWriteRead,
+	"Overwrite":       testStoreOverwrite,
+	"Delete":          testStoreDelete,
+	"ListOrder":       testStoreListOrder,
+	"Isolation":       testStoreIsolation,
+	"ReadStream":      testStoreReadStream,
+	"ListStream":      testStoreListStream,
+	"TypesSeparate":   testStoreTypesSeparate,
+	"ReadMissing":     testStoreReadMissing,
+	"ListEmptyType":   testStoreListEmptyType,
+	"DeleteNonexists": testStoreDeleteNonexistent,
+	"WriteBatch":      testStoreWriteBatch,
+}
+
+func newStoreObj(id, text string) *testType {
+	return &testType{
+		Metadata: patchy.Metadata{
+			ID: id,
+		},
+		Text: text,
+	}
+}
+
+func storeFactory() any {
+	return &testType{}
+}
+
+func testStoreWriteRead(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	obj := newStoreObj("id1", "foo")
+
+	err := st.Write(ctx, "testtype", obj)
+	require.NoError(t, err)
+	require.NotEmpty(t, obj.ETag)
+
+	get, err := st.Read(ctx, "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+	require.Equal(t, "foo", get.(*testType).Text)
+	require.Equal(t, obj.ETag, get.(*testType).ETag)
+}
+
+func testStoreOverwrite(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	obj1 := newStoreObj("id1", "foo")
+	require.NoError(t, st.Write(ctx, "testtype", obj1))
+
+	obj2 := newStoreObj("id1", "bar")
+	require.NoError(t, st.Write(ctx, "testtype", obj2))
+	require.NotEqual(t, obj1.ETag, obj2.ETag)
+
+	get, err := st.Read(ctx, "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+	require.Equal(t, "bar", get.(*testType).Text)
+
+	list, err := st.List(ctx, "testtype", storeFactory)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+}
+
+func testStoreDelete(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id1", "foo")))
+	require.NoError(t, st.Delete(ctx, "testtype", "id1"))
+
+	get, err := st.Read(ctx, "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+	require.Nil(t, get)
+}
+
+func testStoreListOrder(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	for _, id := range []string{"c", "a", "b"} {
+		require.NoError(t, st.Write(ctx, "testtype", newStoreObj(id, id)))
+	}
+
+	// Overwrite keeps position
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("c", "cc")))
+
+	list, err := st.List(ctx, "testtype", storeFactory)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	require.Equal(t, "c", list[0].(*testType).ID)
+	require.Equal(t, "cc", list[0].(*testType).Text)
+	require.Equal(t, "a", list[1].(*testType).ID)
+	require.Equal(t, "b", list[2].(*testType).ID)
+}
+
+func testStoreIsolation(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	obj := newStoreObj("id1", "foo")
+	require.NoError(t, st.Write(ctx, "testtype", obj))
+
+	obj.Text = "bar"
+
+	get, err := st.Read(ctx, "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+	require.Equal(t, "foo", get.(*testType).Text)
+
+	get.(*testType).Text = "baz"
+
+	get, err = st.Read(ctx, "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+	require.Equal(t, "foo", get.(*testType).Text)
+}
+
+func testStoreReadStream(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id1", "foo")))
+
+	c, err := st.ReadStream(ctx, "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+
+	defer st.CloseReadStream("testtype", "id1", c)
+
+	require.Equal(t, "foo", (<-c).(*testType).Text)
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id1", "bar")))
+	require.Equal(t, "bar", (<-c).(*testType).Text)
+
+	require.NoError(t, st.Delete(ctx, "testtype", "id1"))
+
+	_, ok := <-c
+	require.False(t, ok)
+}
+
+func testStoreListStream(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id1", "foo")))
+
+	c, err := st.ListStream(ctx, "testtype", storeFactory)
+	require.NoError(t, err)
+
+	defer st.CloseListStream("testtype", c)
+
+	require.Len(t, <-c, 1)
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id2", "bar")))
+	require.Len(t, <-c, 2)
+
+	require.NoError(t, st.Delete(ctx, "testtype", "id1"))
+
+	list := <-c
+	require.Len(t, list, 1)
+	require.Equal(t, "id2", list[0].(*testType).ID)
+}
+
+func testStoreTypesSeparate(t *testing.T, st patchy.Store) {
+	ctx := context.Background()
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id1", "foo")))
+	require.NoError(t, st.Write(ctx, "testtypeb", newStoreObj("id1", "bar")))
+
+	get, err := st.Read(ctx, "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+	require.Equal(t, "foo", get.(*testType).Text)
+
+	list, err := st.List(ctx, "testtypeb", storeFactory)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, "bar", list[0].(*testType).Text)
+}
+
+func testStoreReadMissing(t *testing.T, st patchy.Store) {
+	get, err := st.Read(context.Background(), "testtype", "id1", storeFactory)
+	require.NoError(t, err)
+	require.Nil(t, get)
+}
+
+func testStoreListEmptyType(t *testing.T, st patchy.Store) {
+	list, err := st.List(context.Background(), "testtype", storeFactory)
+	require.NoError(t, err)
+	require.NotNil(t, list)
+	require.Empty(t, list)
+}
+
+func testStoreDeleteNonexistent(t *testing.T, st patchy.Store) {
+	err := st.Delete(context.Background(), "testtype", "id1")
+	require.NoError(t, err)
+}
+
+func testStoreWriteBatch(t *testing.T, st patchy.Store) {
+	bs, ok := st.(patchy.BatchStore)
+	if !ok {
+		t.Skip("store does not implement BatchStore")
+	}
+
+	ctx := context.Background()
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id1", "foo")))
+
+	c, err := st.ListStream(ctx, "testtype", storeFactory)
+	require.NoError(t, err)
+
+	defer st.CloseListStream("testtype", c)
+
+	require.Len(t, <-c, 1)
+
+	writes := []any{}
+	for i := 0; i < 200; i++ {
+		writes = append(writes, newStoreObj(fmt.Sprintf("batch%d", i), "bar"))
+	}
+
+	require.NoError(t, bs.WriteBatch(ctx, "testtype", writes, []string{"id1"}))
+	require.NotEmpty(t, writes[0].(*testType).ETag)
+
+	// The whole batch arrives as one update
+	list := <-c
+	require.Len(t, list, 200)
+	require.Equal(t, "batch0", list[0].(*testType).ID)
+
+	require.NoError(t, st.Write(ctx, "testtype", newStoreObj("id2", "baz")))
+	require.Len(t, <-c, 201)
+}
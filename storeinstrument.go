@@ -0,0 +1,95 @@
+package patchy
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedStore times and traces Store operations. Streams are passed
+// through; their lifetimes are traced by streamGetInt and streamListInt.
+type instrumentedStore struct {
+	Store
+	api *API
+}
+
+// instrumentedBatchStore keeps BatchStore visible to type assertions
+type instrumentedBatchStore struct {
+	*instrumentedStore
+	bs BatchStore
+}
+
+func newInstrumentedStore(sb Store, api *API) Store {
+	is := &instrumentedStore{
+		Store: sb,
+		api:   api,
+	}
+
+	bs, ok := sb.(BatchStore)
+	if ok {
+		return &instrumentedBatchStore{
+			instrumentedStore: is,
+			bs:                bs,
+		}
+	}
+
+	return is
+}
+
+func (is *instrumentedStore) Write(ctx context.Context, t string, obj any) (err error) {
+	ctx, done := is.start(ctx, "write", t)
+	defer func() { done(err) }()
+
+	return is.Store.Write(ctx, t, obj)
+}
+
+func (is *instrumentedStore) Delete(ctx context.Context, t, id string) (err error) {
+	ctx, done := is.start(ctx, "delete", t, attribute.String("patchy.id", id))
+	defer func() { done(err) }()
+
+	return is.Store.Delete(ctx, t, id)
+}
+
+func (is *instrumentedStore) Read(ctx context.Context, t, id string, factory func() any) (obj any, err error) {
+	ctx, done := is.start(ctx, "read", t, attribute.String("patchy.id", id))
+	defer func() { done(err) }()
+
+	return is.Store.Read(ctx, t, id, factory)
+}
+
+func (is *instrumentedStore) List(ctx context.Context, t string, factory func() any) (list []any, err error) {
+	ctx, done := is.start(ctx, "list", t)
+	defer func() { done(err) }()
+
+	return is.Store.List(ctx, t, factory)
+}
+
+// start begins a store.<op> span; call the returned function with the
+// operation's result
+func (is *instrumentedStore) start(ctx context.Context, op, t string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+
+	attrs = append(attrs, attribute.String("patchy.typeName", t))
+
+	ctx, span := is.api.tracer.Start(ctx, "store."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+
+	return ctx, func(err error) {
+		is.api.metrics.storeDuration.observe(time.Since(start).Seconds(), op, t)
+		endSpan(span, err)
+	}
+}
+
+func (ibs *instrumentedBatchStore) WriteBatch(ctx context.Context, t string, writes []any, deletes []string) (err error) {
+	ctx, done := ibs.start(ctx, "writeBatch", t,
+		attribute.Int("patchy.writes", len(writes)),
+		attribute.Int("patchy.deletes", len(deletes)),
+	)
+	defer func() { done(err) }()
+
+	return ibs.bs.WriteBatch(ctx, t, writes, deletes)
+}
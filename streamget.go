@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/gopatchy/jsrest"
 	"github.com/gopatchy/metadata"
@@ -24,12 +23,27 @@ func (api *API) streamGet(cfg *config, id string, w http.ResponseWriter, r *http
 		"stream", true,
 	)
 
-	opts := parseGetOpts(r)
+	opts, err := api.parseGetOpts(r)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "parse get parameters failed (%w)", err)
+	}
 
 	if _, ok := w.(http.Flusher); !ok {
 		return jsrest.Errorf(jsrest.ErrBadRequest, "stream failed (%w)", ErrStreamingNotSupported)
 	}
 
+	err = api.checkRateLimit(cfg, "get", w, r)
+	if err != nil {
+		return err
+	}
+
+	release, err := api.acquireStream(r)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
 	gsi, err := api.streamGetInt(ctx, cfg, id)
 	if err != nil {
 		return jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", id, err)
@@ -37,9 +51,11 @@ func (api *API) streamGet(cfg *config, id string, w http.ResponseWriter, r *http
 
 	defer gsi.Close()
 
+	defer api.trackStream(cfg)()
+
 	w.Header().Set("Content-Type", "text/event-stream")
 
-	err = api.streamGetWrite(ctx, w, gsi.ch, opts)
+	err = api.streamGetWrite(ctx, sseWriter(w), gsi.ch, opts)
 	if err != nil {
 		_ = writeEvent(w, "error", nil, jsrest.ToJSONError(err), true)
 		return nil
@@ -48,11 +64,14 @@ func (api *API) streamGet(cfg *config, id string, w http.ResponseWriter, r *http
 	return nil
 }
 
-func (api *API) streamGetWrite(ctx context.Context, w http.ResponseWriter, ch <-chan any, opts *GetOpts) error {
+func (api *API) streamGetWrite(ctx context.Context, write eventWriter, ch <-chan any, opts *GetOpts) error {
 	first := true
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	// Last object the client has, for patches
+	var prev any
+
+	timers := newStreamTimers(opts.Heartbeat, opts.MaxDuration)
+	defer timers.Stop()
 
 	for {
 		select {
@@ -61,7 +80,7 @@ func (api *API) streamGetWrite(ctx context.Context, w http.ResponseWriter, ch <-
 
 		case obj, ok := <-ch:
 			if !ok {
-				err := writeEvent(w, "delete", nil, nil, true)
+				err := write("delete", nil, nil, true)
 				if err != nil {
 					return jsrest.Errorf(jsrest.ErrInternalServerError, "write delete failed (%w)", err)
 				}
@@ -80,27 +99,47 @@ func (api *API) streamGetWrite(ctx context.Context, w http.ResponseWriter, ch <-
 
 				if httpheader.MatchWeak(opts.IfNoneMatch, httpheader.EntityTag{Opaque: md.ETag}) ||
 					httpheader.MatchWeak(opts.IfNoneMatch, httpheader.EntityTag{Opaque: gen}) {
-					err := writeEvent(w, "notModified", map[string]string{"id": md.ETag}, nil, true)
+					err := write("notModified", map[string]string{"id": md.ETag}, nil, true)
 					if err != nil {
 						return jsrest.Errorf(jsrest.ErrInternalServerError, "write update failed (%w)", err)
 					}
 
 					first = false
+					prev = obj
 
 					continue
 				}
 			}
 
-			err := writeEvent(w, eventType, map[string]string{"id": md.ETag}, obj, true)
+			if opts.Stream == "patch" && prev != nil {
+				err := writePatch(write, map[string]string{"id": md.ETag}, prev, obj, true)
+				if err != nil {
+					return err
+				}
+
+				prev = obj
+
+				continue
+			}
+
+			err := write(eventType, map[string]string{"id": md.ETag}, obj, true)
 			if err != nil {
 				return jsrest.Errorf(jsrest.ErrInternalServerError, "write update failed (%w)", err)
 			}
 
-		case <-ticker.C:
-			err := writeEvent(w, "heartbeat", nil, nil, true)
+			prev = obj
+
+		case <-timers.heartbeat.C:
+			err := write("heartbeat", nil, nil, true)
 			if err != nil {
 				return jsrest.Errorf(jsrest.ErrInternalServerError, "write heartbeat failed (%w)", err)
 			}
+
+		case <-timers.expire:
+			return writeReconnect(write)
+
+		case <-api.draining:
+			return writeReconnect(write)
 		}
 	}
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gopatchy/jsrest"
 	"github.com/gopatchy/metadata"
@@ -29,20 +28,34 @@ func (api *API) streamList(cfg *config, w http.ResponseWriter, r *http.Request)
 		return jsrest.Errorf(jsrest.ErrBadRequest, "parse list parameters failed (%w)", err)
 	}
 
+	err = api.checkRateLimit(cfg, "list", w, r)
+	if err != nil {
+		return err
+	}
+
+	release, err := api.acquireStream(r)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	defer api.trackStream(cfg)()
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Stream-Format", opts.Stream)
 
 	switch opts.Stream {
 	case "full":
-		err = api.streamListFull(ctx, cfg, w, opts)
+		err = api.streamListFull(ctx, cfg, sseWriter(w), opts)
 		if err != nil {
 			_ = writeEvent(w, "error", nil, jsrest.ToJSONError(err), true)
 		}
 
 		return nil
 
-	case "diff":
-		err = api.streamListDiff(ctx, cfg, w, opts)
+	case "diff", "patch":
+		err = api.streamListDiff(ctx, cfg, sseWriter(w), opts)
 		if err != nil {
 			_ = writeEvent(w, "error", nil, jsrest.ToJSONError(err), true)
 		}
@@ -54,7 +67,7 @@ func (api *API) streamList(cfg *config, w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func (api *API) streamListFull(ctx context.Context, cfg *config, w http.ResponseWriter, opts *ListOpts) error {
+func (api *API) streamListFull(ctx context.Context, cfg *config, write eventWriter, opts *ListOpts) error {
 	// TODO: Add query condition pushdown
 	lsi, err := api.streamListInt(ctx, cfg, opts)
 	if err != nil {
@@ -62,8 +75,8 @@ func (api *API) streamListFull(ctx context.Context, cfg *config, w http.Response
 	}
 	defer lsi.Close()
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	timers := newStreamTimers(opts.Heartbeat, opts.MaxDuration)
+	defer timers.Stop()
 
 	ifNoneMatch := opts.IfNoneMatch
 	previousETag := ""
@@ -73,12 +86,18 @@ func (api *API) streamListFull(ctx context.Context, cfg *config, w http.Response
 		case <-ctx.Done():
 			return nil
 
-		case <-ticker.C:
-			err = writeEvent(w, "heartbeat", nil, nil, true)
+		case <-timers.heartbeat.C:
+			err = write("heartbeat", nil, nil, true)
 			if err != nil {
 				return jsrest.Errorf(jsrest.ErrInternalServerError, "write heartbeat failed (%w)", err)
 			}
 
+		case <-timers.expire:
+			return writeReconnect(write)
+
+		case <-api.draining:
+			return writeReconnect(write)
+
 		case list := <-lsi.Chan():
 			etag, err := hashList(list)
 			if err != nil {
@@ -88,7 +107,7 @@ func (api *API) streamListFull(ctx context.Context, cfg *config, w http.Response
 			if ifNoneMatch != nil && httpheader.MatchWeak(opts.IfNoneMatch, httpheader.EntityTag{Opaque: etag}) {
 				ifNoneMatch = nil
 
-				err = writeEvent(w, "notModified", map[string]string{"id": etag}, nil, true)
+				err = write("notModified", map[string]string{"id": etag}, nil, true)
 				if err != nil {
 					return jsrest.Errorf(jsrest.ErrInternalServerError, "write list failed (%w)", err)
 				}
@@ -104,7 +123,7 @@ func (api *API) streamListFull(ctx context.Context, cfg *config, w http.Response
 
 			previousETag = etag
 
-			err = writeEvent(w, "list", map[string]string{"id": etag}, list, true)
+			err = write("list", map[string]string{"id": etag}, list, true)
 			if err != nil {
 				return jsrest.Errorf(jsrest.ErrInternalServerError, "write list failed (%w)", err)
 			}
@@ -117,7 +136,7 @@ type listEntry struct {
 	obj any
 }
 
-func (api *API) streamListDiff(ctx context.Context, cfg *config, w http.ResponseWriter, opts *ListOpts) error {
+func (api *API) streamListDiff(ctx context.Context, cfg *config, write eventWriter, opts *ListOpts) error {
 	lsi, err := api.streamListInt(ctx, cfg, opts)
 	if err != nil {
 		return jsrest.Errorf(jsrest.ErrInternalServerError, "read list failed (%w)", err)
@@ -126,20 +145,28 @@ func (api *API) streamListDiff(ctx context.Context, cfg *config, w http.Response
 
 	last := map[string]*listEntry{}
 
-	ticker := time.NewTicker(5 * time.Second)
+	timers := newStreamTimers(opts.Heartbeat, opts.MaxDuration)
+	defer timers.Stop()
+
 	ifNoneMatch := opts.IfNoneMatch
 	previousETag := ""
 
 	for {
 		select {
-		case <-ticker.C:
-			err = writeEvent(w, "heartbeat", nil, nil, true)
+		case <-timers.heartbeat.C:
+			err = write("heartbeat", nil, nil, true)
 			if err != nil {
 				return jsrest.Errorf(jsrest.ErrInternalServerError, "write heartbeat failed (%w)", err)
 			}
 
 			continue
 
+		case <-timers.expire:
+			return writeReconnect(write)
+
+		case <-api.draining:
+			return writeReconnect(write)
+
 		case <-ctx.Done():
 			return nil
 
@@ -175,7 +202,7 @@ func (api *API) streamListDiff(ctx context.Context, cfg *config, w http.Response
 			if tmpIfNoneMatch != nil && httpheader.MatchWeak(tmpIfNoneMatch, httpheader.EntityTag{Opaque: etag}) {
 				last = cur
 
-				err = writeEvent(w, "notModified", map[string]string{"id": etag}, nil, true)
+				err = write("notModified", map[string]string{"id": etag}, nil, true)
 				if err != nil {
 					return jsrest.Errorf(jsrest.ErrInternalServerError, "write list failed (%w)", err)
 				}
@@ -191,7 +218,7 @@ func (api *API) streamListDiff(ctx context.Context, cfg *config, w http.Response
 					continue
 				}
 
-				err = writeEvent(w, "remove", map[string]string{"old-position": strconv.Itoa(lastEntry.pos)}, nil, false)
+				err = write("remove", map[string]string{"old-position": strconv.Itoa(lastEntry.pos)}, nil, false)
 				if err != nil {
 					return jsrest.Errorf(jsrest.ErrInternalServerError, "write remove failed (%w)", err)
 				}
@@ -203,7 +230,7 @@ func (api *API) streamListDiff(ctx context.Context, cfg *config, w http.Response
 
 				lastEntry := last[objMD.ID]
 				if lastEntry == nil {
-					err = writeEvent(w, "add", map[string]string{"new-position": strconv.Itoa(pos)}, obj, false)
+					err = write("add", map[string]string{"new-position": strconv.Itoa(pos)}, obj, false)
 					if err != nil {
 						return jsrest.Errorf(jsrest.ErrInternalServerError, "write add failed (%w)", err)
 					}
@@ -215,7 +242,16 @@ func (api *API) streamListDiff(ctx context.Context, cfg *config, w http.Response
 							"new-position": strconv.Itoa(pos),
 						}
 
-						err = writeEvent(w, "update", params, obj, false)
+						if opts.Stream == "patch" {
+							err = writePatch(write, params, lastEntry.obj, obj, false)
+							if err != nil {
+								return err
+							}
+
+							continue
+						}
+
+						err = write("update", params, obj, false)
 						if err != nil {
 							return jsrest.Errorf(jsrest.ErrInternalServerError, "write update failed (%w)", err)
 						}
@@ -225,7 +261,7 @@ func (api *API) streamListDiff(ctx context.Context, cfg *config, w http.Response
 
 			last = cur
 
-			err = writeEvent(w, "sync", map[string]string{"id": etag}, nil, true)
+			err = write("sync", map[string]string{"id": etag}, nil, true)
 			if err != nil {
 				return jsrest.Errorf(jsrest.ErrInternalServerError, "write sync failed (%w)", err)
 			}
@@ -0,0 +1,113 @@
+package patchy
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/gopatchy/jsrest"
+)
+
+// streamTimers drives heartbeat events and the optional maximum stream
+// lifetime. expire is nil (never fires) when there is no maximum.
+type streamTimers struct {
+	heartbeat *time.Ticker
+	expire    <-chan time.Time
+	timer     *time.Timer
+}
+
+const (
+	DefaultStreamHeartbeat = 5 * time.Second
+
+	// Lower bound for _heartbeat, so one client can't make the server spin
+	minStreamHeartbeat = 100 * time.Millisecond
+)
+
+var (
+	ErrInvalidHeartbeat   = errors.New("invalid _heartbeat")
+	ErrInvalidMaxDuration = errors.New("invalid _maxDuration")
+)
+
+// SetStreamHeartbeat sets the default _heartbeat for streams
+func (api *API) SetStreamHeartbeat(heartbeat time.Duration) {
+	if heartbeat < minStreamHeartbeat {
+		heartbeat = minStreamHeartbeat
+	}
+
+	api.streamHeartbeat = heartbeat
+}
+
+// SetStreamMaxDuration sets the maximum lifetime of streams, after which
+// the server sends a reconnect event and closes the stream. Clients may
+// request a shorter _maxDuration. Zero (the default) disables the limit.
+func (api *API) SetStreamMaxDuration(maxDuration time.Duration) {
+	api.streamMaxDuration = maxDuration
+}
+
+func (api *API) parseStreamTiming(form url.Values) (time.Duration, time.Duration, error) {
+	heartbeat := api.streamHeartbeat
+	maxDuration := api.streamMaxDuration
+
+	if form.Has("_heartbeat") {
+		var err error
+
+		heartbeat, err = time.ParseDuration(form.Get("_heartbeat"))
+		if err != nil {
+			return 0, 0, jsrest.Errorf(jsrest.ErrBadRequest, "parse _heartbeat value failed: %s (%w)", form.Get("_heartbeat"), err)
+		}
+
+		if heartbeat < minStreamHeartbeat {
+			return 0, 0, jsrest.Errorf(jsrest.ErrBadRequest, "%s is less than %s (%w)", form.Get("_heartbeat"), minStreamHeartbeat, ErrInvalidHeartbeat)
+		}
+	}
+
+	if form.Has("_maxDuration") {
+		reqMaxDuration, err := time.ParseDuration(form.Get("_maxDuration"))
+		if err != nil {
+			return 0, 0, jsrest.Errorf(jsrest.ErrBadRequest, "parse _maxDuration value failed: %s (%w)", form.Get("_maxDuration"), err)
+		}
+
+		if reqMaxDuration < 0 {
+			return 0, 0, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", form.Get("_maxDuration"), ErrInvalidMaxDuration)
+		}
+
+		// Clients can shorten but not extend the server limit
+		if reqMaxDuration > 0 && (maxDuration == 0 || reqMaxDuration < maxDuration) {
+			maxDuration = reqMaxDuration
+		}
+	}
+
+	return heartbeat, maxDuration, nil
+}
+
+func newStreamTimers(heartbeat, maxDuration time.Duration) *streamTimers {
+	st := &streamTimers{
+		heartbeat: time.NewTicker(heartbeat),
+	}
+
+	if maxDuration > 0 {
+		st.timer = time.NewTimer(maxDuration)
+		st.expire = st.timer.C
+	}
+
+	return st
+}
+
+func (st *streamTimers) Stop() {
+	st.heartbeat.Stop()
+
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+}
+
+// writeReconnect tells the client to open a new stream (with If-None-Match)
+// before the server closes this one
+func writeReconnect(write eventWriter) error {
+	err := write("reconnect", nil, nil, true)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write reconnect failed (%w)", err)
+	}
+
+	return nil
+}
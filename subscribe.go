@@ -0,0 +1,464 @@
+package patchy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gopatchy/jsrest"
+	"github.com/julienschmidt/httprouter"
+)
+
+// subscriber runs the streamGet and streamList subscriptions of one
+// multiplexed connection (/_ws or /_subscribe), tagging events with refs
+type subscriber struct {
+	api *API
+
+	// Each subscription counts against MaxStreamsPerPrincipal
+	principal string
+
+	// writer returns the eventWriter for one subscription; sendError reports
+	// a failed subscription before its end event
+	writer    func(ref string) eventWriter
+	sendError func(ref string, err error)
+
+	subs   map[string]context.CancelFunc
+	closed bool
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// sseSubscription is one GET /_subscribe stream. The ID is only sent on the
+// stream itself, so it acts as a capability for POST /_subscribe/:id.
+type sseSubscription struct {
+	id  string
+	ctx context.Context
+	w   http.ResponseWriter
+	sub *subscriber
+
+	// Subscriptions write concurrently; done drops writes once the handler
+	// is returning
+	done    bool
+	writeMu sync.Mutex
+}
+
+var (
+	ErrSubscriptionOp     = errors.New("invalid subscription operation")
+	ErrSubscriptionRef    = errors.New("missing or duplicate subscription ref")
+	ErrSubscriptionClosed = errors.New("subscription connection closed")
+	ErrSubscriptionSpec   = errors.New("invalid subscription")
+)
+
+func newSubscriber(api *API, principal string, writer func(string) eventWriter, sendError func(string, error)) *subscriber {
+	return &subscriber{
+		api:       api,
+		principal: principal,
+		writer:    writer,
+		sendError: sendError,
+		subs:      map[string]context.CancelFunc{},
+	}
+}
+
+// subscribe returns errors that prevent the subscription from starting.
+// Subscriptions that start always finish with an end event.
+func (s *subscriber) subscribe(ctx context.Context, req *WSRequest) error {
+	cfg := s.api.registry[req.Type]
+	if cfg == nil {
+		return jsrest.Errorf(jsrest.ErrNotFound, "%s", req.Type)
+	}
+
+	// Rate limited like the equivalent HTTP stream; there's no response to
+	// carry the headers
+	op := map[string]string{"streamGet": "get", "streamList": "list"}[req.Op]
+	if op != "" {
+		err := s.api.checkRateLimitPrincipal(ctx, s.principal, cfg.apiName, op, http.Header{})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return jsrest.Errorf(jsrest.ErrNotFound, "subscribe failed (%w)", ErrSubscriptionClosed)
+	}
+
+	if req.Ref == "" || s.subs[req.Ref] != nil {
+		s.mu.Unlock()
+		return jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", req.Ref, ErrSubscriptionRef)
+	}
+
+	release, err := s.api.limiter.acquireStream(s.principal)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(req.traceContext(ctx))
+	s.subs[req.Ref] = cancel
+	s.wg.Add(1)
+
+	s.mu.Unlock()
+
+	run, err := s.prepare(ctx, cfg, req)
+	if err != nil {
+		s.remove(req.Ref)
+		cancel()
+		release()
+		s.wg.Done()
+
+		return err
+	}
+
+	go func() {
+		defer s.wg.Done()
+		defer release()
+		defer s.api.trackStream(cfg)()
+
+		err := run()
+		if err != nil {
+			s.sendError(req.Ref, err)
+		}
+
+		// Free the ref before end, so the client can reuse it
+		s.remove(req.Ref)
+		cancel()
+
+		_ = s.writer(req.Ref)("end", nil, nil, true)
+	}()
+
+	return nil
+}
+
+// prepare parses options and opens the underlying stream, returning a
+// function that writes its events
+func (s *subscriber) prepare(ctx context.Context, cfg *config, req *WSRequest) (func() error, error) {
+	write := s.writer(req.Ref)
+
+	switch req.Op {
+	case "streamGet":
+		if req.ID == "" {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s: missing id (%w)", req.Op, ErrSubscriptionOp)
+		}
+
+		opts, err := s.api.parseGetForm(req.Params)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse get parameters failed (%w)", err)
+		}
+
+		opts.IfNoneMatch = req.ifNoneMatch()
+
+		gsi, err := s.api.streamGetInt(ctx, cfg, req.ID)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrInternalServerError, "read failed: %s (%w)", req.ID, err)
+		}
+
+		return func() error {
+			defer gsi.Close()
+			return s.api.streamGetWrite(ctx, write, gsi.ch, opts)
+		}, nil
+
+	case "streamList":
+		opts, err := s.api.parseListForm(req.Params)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "parse list parameters failed (%w)", err)
+		}
+
+		opts.IfNoneMatch = req.ifNoneMatch()
+
+		if opts.Stream == "diff" || opts.Stream == "patch" {
+			return func() error {
+				return s.api.streamListDiff(ctx, cfg, write, opts)
+			}, nil
+		}
+
+		return func() error {
+			return s.api.streamListFull(ctx, cfg, write, opts)
+		}, nil
+
+	default:
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", req.Op, ErrSubscriptionOp)
+	}
+}
+
+func (s *subscriber) unsubscribe(ref string) {
+	s.mu.Lock()
+	cancel := s.subs[ref]
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (s *subscriber) remove(ref string) {
+	s.mu.Lock()
+	delete(s.subs, ref)
+	s.mu.Unlock()
+}
+
+// close cancels all subscriptions and waits for them to finish
+func (s *subscriber) close() {
+	s.mu.Lock()
+
+	s.closed = true
+
+	for _, cancel := range s.subs {
+		cancel()
+	}
+
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+func (api *API) handleSubscribe(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	api.SetEventData(ctx,
+		"operation", "subscribe",
+		"stream", true,
+	)
+
+	if _, ok := w.(http.Flusher); !ok {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "stream failed (%w)", ErrStreamingNotSupported)
+	}
+
+	reqs, err := parseSubscribeForm(r)
+	if err != nil {
+		return err
+	}
+
+	ss := &sseSubscription{
+		id:  uniuri.NewLen(sessionTokenLen),
+		ctx: ctx,
+		w:   w,
+	}
+
+	// Subscriptions count as streams; the connection itself doesn't
+	ss.sub = newSubscriber(api, api.requestPrincipal(r), ss.writer, ss.sendError)
+
+	// Hold writes until the initial subscriptions have all started, so a
+	// failure can still be returned as an HTTP error
+	ss.writeMu.Lock()
+
+	for _, req := range reqs {
+		err = ss.sub.subscribe(ctx, req)
+		if err != nil {
+			ss.done = true
+			ss.writeMu.Unlock()
+			ss.sub.close()
+
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	err = writeEvent(w, "open", map[string]string{"subscription": ss.id}, nil, true)
+
+	ss.writeMu.Unlock()
+
+	if err != nil {
+		ss.close()
+		return nil
+	}
+
+	api.addSubscription(ss)
+	defer api.removeSubscription(ss)
+
+	ticker := time.NewTicker(api.streamHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ss.close()
+			return nil
+
+		case <-ticker.C:
+			err = ss.write("", "heartbeat", nil, nil)
+			if err != nil {
+				ss.close()
+				return nil
+			}
+
+		case <-api.draining:
+			// Subscriptions don't reconnect, so end them before saying why
+			ss.sub.close()
+			_ = ss.write("", "shutdown", nil, nil)
+			ss.close()
+
+			return nil
+		}
+	}
+}
+
+// parseSubscribeForm turns get=type/id and list=type?params query values
+// into subscriptions, using each value as its ref
+func parseSubscribeForm(r *http.Request) ([]*WSRequest, error) {
+	reqs := []*WSRequest{}
+
+	for _, spec := range r.Form["get"] {
+		typeName, id, found := strings.Cut(spec, "/")
+		if !found || id == "" {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "get=%s (%w)", spec, ErrSubscriptionSpec)
+		}
+
+		reqs = append(reqs, &WSRequest{
+			Ref:  spec,
+			Op:   "streamGet",
+			Type: typeName,
+			ID:   id,
+		})
+	}
+
+	for _, spec := range r.Form["list"] {
+		typeName, query, _ := strings.Cut(spec, "?")
+
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "list=%s (%w)", spec, err)
+		}
+
+		reqs = append(reqs, &WSRequest{
+			Ref:    spec,
+			Op:     "streamList",
+			Type:   typeName,
+			Params: params,
+		})
+	}
+
+	return reqs, nil
+}
+
+// handleSubscribeUpdate adds or removes a subscription on an open
+// /_subscribe stream. The body is a WSRequest with op streamGet, streamList
+// or unsubscribe.
+func (api *API) handleSubscribeUpdate(w http.ResponseWriter, r *http.Request, id string) error {
+	ctx := r.Context()
+
+	api.SetEventData(ctx, "operation", "subscribeUpdate")
+
+	ss := api.getSubscription(id)
+	if ss == nil {
+		return jsrest.Errorf(jsrest.ErrNotFound, "%s (%w)", id, ErrSubscriptionClosed)
+	}
+
+	req := &WSRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "decode request failed (%w)", err)
+	}
+
+	switch req.Op {
+	case "streamGet", "streamList":
+		// Subscriptions run with the stream's auth, and end with it
+		err = ss.sub.subscribe(ss.ctx, req)
+		if err != nil {
+			return err
+		}
+
+	case "unsubscribe":
+		ss.sub.unsubscribe(req.Ref)
+
+	default:
+		return jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", req.Op, ErrSubscriptionOp)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (ss *sseSubscription) writer(ref string) eventWriter {
+	return func(event string, params map[string]string, obj any, _ bool) error {
+		return ss.write(ref, event, params, obj)
+	}
+}
+
+// write tags events with their subscription ref and always flushes, since
+// events from other subscriptions may not follow
+func (ss *sseSubscription) write(ref, event string, params map[string]string, obj any) error {
+	ss.writeMu.Lock()
+	defer ss.writeMu.Unlock()
+
+	if ss.done {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "%s (%w)", ss.id, ErrSubscriptionClosed)
+	}
+
+	if ref != "" {
+		tagged := map[string]string{"ref": ref}
+
+		for k, v := range params {
+			tagged[k] = v
+		}
+
+		params = tagged
+	}
+
+	return writeEvent(ss.w, event, params, obj, true)
+}
+
+func (ss *sseSubscription) sendError(ref string, err error) {
+	_ = ss.write(ref, "error", nil, jsrest.ToJSONError(err))
+}
+
+func (ss *sseSubscription) close() {
+	ss.sub.close()
+
+	ss.writeMu.Lock()
+	ss.done = true
+	ss.writeMu.Unlock()
+}
+
+func (api *API) addSubscription(ss *sseSubscription) {
+	api.subscriptionsMu.Lock()
+	defer api.subscriptionsMu.Unlock()
+
+	api.subscriptions[ss.id] = ss
+}
+
+func (api *API) removeSubscription(ss *sseSubscription) {
+	api.subscriptionsMu.Lock()
+	defer api.subscriptionsMu.Unlock()
+
+	delete(api.subscriptions, ss.id)
+}
+
+func (api *API) getSubscription(id string) *sseSubscription {
+	api.subscriptionsMu.Lock()
+	defer api.subscriptionsMu.Unlock()
+
+	return api.subscriptions[id]
+}
+
+func (api *API) registerSubscribeHandlers() {
+	api.router.GET(
+		"/_subscribe",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.handleSubscribe(w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+
+	api.router.POST(
+		"/_subscribe/:id",
+		func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			err := api.handleSubscribeUpdate(w, r, ps.ByName("id"))
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+}
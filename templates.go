@@ -29,21 +29,24 @@ var templates = template.Must(
 		ParseFS(templateFS, "templates/*"))
 
 type templateInput struct {
-	Info       *OpenAPIInfo
-	Form       url.Values
-	Types      []*templateType
-	APIs       []*apiType
-	UsesTime   bool
-	UsesCivil  bool
-	URLPrefix  string
-	AuthBasic  bool
-	AuthBearer bool
+	Info        *OpenAPIInfo
+	Form        url.Values
+	Types       []*templateType
+	APIs        []*apiType
+	UsesTime    bool
+	UsesCivil   bool
+	URLPrefix   string
+	AuthBasic   bool
+	AuthBearer  bool
+	AuthAPIKey  bool
+	AuthSession bool
 }
 
 type apiType struct {
 	NameLower      string // "homeaddress"
 	NameUpperCamel string // "HomeAddress"
 	TypeUpperCamel string // "AddressType"
+	APIKey         bool
 
 	typeOf reflect.Type
 }
@@ -84,11 +87,13 @@ func (api *API) writeTemplate(name string) func(http.ResponseWriter, *http.Reque
 		)
 
 		input := &templateInput{
-			Info:       api.openAPI.info,
-			Form:       r.Form,
-			URLPrefix:  api.prefix,
-			AuthBasic:  api.authBasic,
-			AuthBearer: api.authBearer,
+			Info:        api.openAPI.info,
+			Form:        r.Form,
+			URLPrefix:   api.prefix,
+			AuthBasic:   api.authBasic,
+			AuthBearer:  api.authBearer,
+			AuthAPIKey:  api.authAPIKey,
+			AuthSession: api.authSession,
 		}
 
 		typeQueue := []*templateType{}
@@ -106,6 +111,7 @@ func (api *API) writeTemplate(name string) func(http.ResponseWriter, *http.Reque
 				NameLower:      cfg.apiName,
 				NameUpperCamel: cfg.camelName,
 				TypeUpperCamel: upperFirst(cfg.typeOf.Name()),
+				APIKey:         cfg.apiKeyPaths != nil,
 				typeOf:         cfg.typeOf,
 			})
 		}
@@ -188,7 +194,7 @@ func (api *API) writeTemplate(name string) func(http.ResponseWriter, *http.Reque
 		err := templates.ExecuteTemplate(buf, name, input)
 		if err != nil {
 			err = jsrest.Errorf(jsrest.ErrInternalServerError, "execute template failed (%w)", err)
-			jsrest.WriteError(w, err)
+			api.writeError(w, r, err)
 
 			return
 		}
@@ -218,6 +224,10 @@ func upperFirst(in string) string {
 func goType(t reflect.Type) string {
 	elemType := path.MaybeIndirectType(t)
 
+	if elemType.Kind() == reflect.Slice {
+		return fmt.Sprintf("[]%s", goType(elemType.Elem()))
+	}
+
 	if elemType.Kind() != reflect.Struct || elemType == path.TimeTimeType || elemType == path.CivilDateType {
 		return elemType.String()
 	}
@@ -10,13 +10,12 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
-	{{- if .URLPrefix }}
 	"net/url"
-	{{- end }}
 	"reflect"
 	"strconv"
 	"strings"
@@ -30,6 +29,7 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/gopatchy/jsrest"
 	"github.com/gopatchy/metadata"
+	"go.opentelemetry.io/otel/propagation"
 	"golang.org/x/exp/slices"
 )
 
@@ -51,6 +51,11 @@ type {{ $type.TypeUpperCamel }} struct {
 {{- end }}
 
 type GetOpts[T any] struct {
+	// Streams only: "full" (default) or "patch"
+	Stream      string
+	Heartbeat   time.Duration
+	MaxDuration time.Duration
+
 	Prev *T
 	// TODO: Add FailFast bool
 }
@@ -63,6 +68,12 @@ type ListOpts[T any] struct {
 	Sorts   []string
 	Filters []Filter
 
+	// Streams only
+	Debounce    time.Duration
+	MaxRate     float64
+	Heartbeat   time.Duration
+	MaxDuration time.Duration
+
 	Prev []*T
 	// TODO: Add FailFast bool
 }
@@ -87,6 +98,12 @@ var (
 	ErrMultipleFound       = fmt.Errorf("multiple found")
 	ErrInvalidStreamEvent  = fmt.Errorf("invalid stream event")
 	ErrInvalidStreamFormat = fmt.Errorf("invalid stream format")
+
+	// Returned by stream processing when the server asks us to reconnect
+	errReconnect = fmt.Errorf("server requested reconnect")
+
+	// A patch event doesn't apply to the object we have
+	errPatchBase = fmt.Errorf("patch base mismatch")
 )
 
 {{- if .Form.Has "newClient" }}
@@ -100,7 +117,8 @@ func NewClient(baseURL string) *Client {
 
 	c.rst = resty.New().
 		SetHeader("Accept", "application/json").
-		SetJSONEscapeHTML(false)
+		SetJSONEscapeHTML(false).
+		OnBeforeRequest(injectTraceContext)
 
 	c.SetBaseURL(baseURL)
 
@@ -109,6 +127,13 @@ func NewClient(baseURL string) *Client {
 	return c
 }
 
+// injectTraceContext continues the trace of the span in each request's
+// context, if any, on the server
+func injectTraceContext(_ *resty.Client, r *resty.Request) error {
+	propagation.TraceContext{}.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	return nil
+}
+
 func (c *Client) SetBaseURL(baseURL string) *Client {
 	{{- if .URLPrefix }}
 	baseURL, err := url.JoinPath(baseURL, "{{ .URLPrefix }}")
@@ -145,6 +170,7 @@ func (c *Client) SetHeader(name, value string) *Client {
 func (c *Client) ResetAuth() *Client {
 	c.rst.Token = ""
 	c.rst.UserInfo = nil
+	c.rst.Header.Del("Authorization")
 
 	return c
 }
@@ -169,6 +195,61 @@ func (c *Client) SetAuthToken(token string) *Client {
 }
 {{- end }}
 
+{{- if .AuthAPIKey }}
+
+func (c *Client) SetAPIKey(key string) *Client {
+	c.ResetAuth()
+	c.rst.SetHeader("Authorization", fmt.Sprintf("ApiKey %s", key))
+
+	return c
+}
+{{- end }}
+
+{{- if .AuthSession }}
+
+// Login exchanges Basic credentials for a session cookie. Explicit auth
+// (SetBasicAuth etc.) takes precedence over the session, so don't combine them.
+func (c *Client) Login(ctx context.Context, user, pass string) error {
+	info := &struct {
+		CSRFToken string `json:"csrfToken"`
+	}{}
+
+	resp, err := c.rst.R().
+		SetContext(ctx).
+		SetBasicAuth(user, pass).
+		SetResult(info).
+		Post("_login")
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		return readError(resp)
+	}
+
+	c.rst.SetHeader("X-CSRF-Token", info.CSRFToken)
+
+	return nil
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+	resp, err := c.rst.R().
+		SetContext(ctx).
+		Post("_logout")
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		return readError(resp)
+	}
+
+	c.rst.Header.Del("X-CSRF-Token")
+
+	return nil
+}
+{{- end }}
+
 func (c *Client) DebugInfo(ctx context.Context) (map[string]any, error) {
 	return c.fetchMap(ctx, "_debug")
 }
@@ -227,6 +308,21 @@ func (c *Client) StreamGet{{ $api.NameUpperCamel }}(ctx context.Context, id stri
 func (c *Client) StreamList{{ $api.NameUpperCamel }}(ctx context.Context, opts *ListOpts[{{ $api.TypeUpperCamel }}]) (*ListStream[{{ $api.TypeUpperCamel }}], error) {
 	return StreamListName[{{ $api.TypeUpperCamel }}](ctx, c, "{{ $api.NameLower }}", opts)
 }
+
+func (sub *Subscription) StreamGet{{ $api.NameUpperCamel }}(ctx context.Context, id string, opts *GetOpts[{{ $api.TypeUpperCamel }}]) (*GetStream[{{ $api.TypeUpperCamel }}], error) {
+	return SubscribeGetName[{{ $api.TypeUpperCamel }}](ctx, sub, "{{ $api.NameLower }}", id, opts)
+}
+
+func (sub *Subscription) StreamList{{ $api.NameUpperCamel }}(ctx context.Context, opts *ListOpts[{{ $api.TypeUpperCamel }}]) (*ListStream[{{ $api.TypeUpperCamel }}], error) {
+	return SubscribeListName[{{ $api.TypeUpperCamel }}](ctx, sub, "{{ $api.NameLower }}", opts)
+}
+
+{{- if $api.APIKey }}
+
+func (c *Client) Rotate{{ $api.NameUpperCamel }}(ctx context.Context, id string, opts *UpdateOpts[{{ $api.TypeUpperCamel }}]) (string, error) {
+	return RotateName[{{ $api.TypeUpperCamel }}](ctx, c, "{{ $api.NameLower }}", id, opts)
+}
+{{- end }}
 {{- end }}
 
 //// Generic
@@ -248,7 +344,7 @@ func CreateName[T any](ctx context.Context, c *Client, name string, obj *T) (*T,
 	}
 
 	if resp.IsError() {
-		return nil, jsrest.ReadError(resp)
+		return nil, readError(resp)
 	}
 
 	return created, nil
@@ -271,7 +367,7 @@ func DeleteName[T any](ctx context.Context, c *Client, name, id string, opts *Up
 	}
 
 	if resp.IsError() {
-		return jsrest.ReadError(resp)
+		return readError(resp)
 	}
 
 	return nil
@@ -331,7 +427,7 @@ func GetName[T any](ctx context.Context, c *Client, name, id string, opts *GetOp
 	}
 
 	if resp.IsError() {
-		return nil, jsrest.ReadError(resp)
+		return nil, readError(resp)
 	}
 
 	return obj, nil
@@ -362,7 +458,7 @@ func ListName[T any](ctx context.Context, c *Client, name string, opts *ListOpts
 	}
 
 	if resp.IsError() {
-		return nil, jsrest.ReadError(resp)
+		return nil, readError(resp)
 	}
 
 	setListETag(objs, resp.Header().Get("ETag"))
@@ -391,7 +487,7 @@ func ReplaceName[T any](ctx context.Context, c *Client, name, id string, obj *T,
 	}
 
 	if resp.IsError() {
-		return nil, jsrest.ReadError(resp)
+		return nil, readError(resp)
 	}
 
 	return replaced, nil
@@ -418,47 +514,96 @@ func UpdateName[T any](ctx context.Context, c *Client, name, id string, obj *T,
 	}
 
 	if resp.IsError() {
-		return nil, jsrest.ReadError(resp)
+		return nil, readError(resp)
 	}
 
 	return updated, nil
 }
 
-func StreamGetName[T any](ctx context.Context, c *Client, name, id string, opts *GetOpts[T]) (*GetStream[T], error) {
+func RotateName[T any](ctx context.Context, c *Client, name, id string, opts *UpdateOpts[T]) (string, error) {
+	tok := &struct {
+		Token string `json:"token"`
+	}{}
+
 	r := c.rst.R().
 		SetContext(ctx).
-		SetDoNotParseResponse(true).
-		SetHeader("Accept", "text/event-stream").
 		SetPathParam("name", name).
-		SetPathParam("id", id)
-
-	// TODO: Split out StreamGetNameOnce, add retry loop
+		SetPathParam("id", id).
+		SetResult(tok)
 
 	opts.apply(r)
 
-	resp, err := r.Get("{name}/{id}")
+	resp, err := r.Post("{name}/{id}/_rotate")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	if resp.IsError() {
-		return nil, jsrest.ReadError(resp)
+		return "", readError(resp)
 	}
 
+	return tok.Token, nil
+}
+
+func StreamGetName[T any](ctx context.Context, c *Client, name, id string, opts *GetOpts[T]) (*GetStream[T], error) {
+	ctx, cancel := context.WithCancel(ctx)
+
 	stream := &GetStream[T]{
-		ch:   make(chan *T, 100),
-		body: resp.RawBody(),
+		ch:     make(chan *T, 100),
+		cancel: cancel,
 	}
 
-	if opts != nil && opts.Prev != nil {
+	if opts != nil {
 		stream.prev = opts.Prev
 	}
 
-	go stream.process()
+	err := streamGetNameOnce[T](ctx, c, name, id, opts, stream)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// TODO: Add retry loop for failures other than reconnect
+
+	go stream.run(func() error {
+		return streamGetNameOnce[T](ctx, c, name, id, opts, stream)
+	})
 
 	return stream, nil
 }
 
+func streamGetNameOnce[T any](ctx context.Context, c *Client, name, id string, opts *GetOpts[T], stream *GetStream[T]) error {
+	r := c.rst.R().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
+		SetHeader("Accept", "text/event-stream").
+		SetPathParam("name", name).
+		SetPathParam("id", id)
+
+	tmp := GetOpts[T]{}
+
+	if opts != nil {
+		tmp = *opts
+	}
+
+	// Resume from the last object we delivered
+	tmp.Prev = stream.prev
+	tmp.apply(r)
+
+	resp, err := r.Get("{name}/{id}")
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		return readError(resp)
+	}
+
+	stream.reset(resp.RawBody())
+
+	return nil
+}
+
 func StreamListName[T any](ctx context.Context, c *Client, name string, opts *ListOpts[T]) (*ListStream[T], error) {
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -478,14 +623,20 @@ func StreamListName[T any](ctx context.Context, c *Client, name string, opts *Li
 
 		for ctx.Err() == nil {
 			err := streamListNameOnce[T](ctx, c, name, opts, stream)
+			if errors.Is(err, errReconnect) {
+				// Requested by the server, so no backoff
+				continue
+			}
+
 			stream.writeError(err)
 
+			// Retrying won't fix other client errors
 			hErr := jsrest.GetHTTPError(err)
-			if hErr != nil && hErr.Code/100 == 4 {
+			if hErr != nil && hErr.Code/100 == 4 && hErr.Code != http.StatusTooManyRequests {
 				break
 			}
 
-			b.failure(ctx)
+			b.failure(ctx, err)
 		}
 	}()
 
@@ -510,28 +661,207 @@ func streamListNameOnce[T any](ctx context.Context, c *Client, name string, opts
 		return err
 	}
 
+	if stream.lastETag != "" {
+		// Resume from the last list we delivered, which may be empty
+		r.SetHeader("If-None-Match", stream.lastETag)
+	}
+
 	resp, err := r.Get("{name}")
 	if err != nil {
 		return err
 	}
 
 	if resp.IsError() {
-		return jsrest.ReadError(resp)
+		return readError(resp)
 	}
 
 	stream.reset(resp.RawBody())
 
-	switch resp.Header().Get("Stream-Format") {
-	case "full":
-		return stream.processFull()
+	return stream.process(resp.Header().Get("Stream-Format"))
+}
 
-	case "diff":
-		return stream.processDiff()
+// Subscribe opens one connection that carries many streams (see
+// SubscribeGetName and SubscribeListName), for callers limited in how many
+// connections they can open
+func (c *Client) Subscribe(ctx context.Context) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
 
-	default:
-		stream.Close()
-		return jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", resp.Header().Get("Stream-Format"), ErrInvalidStreamFormat)
+	resp, err := c.rst.R().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
+		SetHeader("Accept", "text/event-stream").
+		Get("_subscribe")
+	if err != nil {
+		cancel()
+		return nil, err
 	}
+
+	if resp.IsError() {
+		cancel()
+		return nil, readError(resp)
+	}
+
+	sub := &Subscription{
+		c:       c,
+		ctx:     ctx,
+		cancel:  cancel,
+		body:    resp.RawBody(),
+		events:  newEventStream[any](resp.RawBody()),
+		streams: map[string]*subStream{},
+	}
+
+	event, err := sub.events.readEvent()
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	if event.eventType != "open" || event.params["subscription"] == "" {
+		sub.Close()
+		return nil, fmt.Errorf("%s (%w)", event.eventType, ErrInvalidStreamEvent)
+	}
+
+	sub.id = event.params["subscription"]
+
+	go sub.dispatch()
+
+	return sub, nil
+}
+
+func SubscribeGetName[T any](ctx context.Context, sub *Subscription, name, id string, opts *GetOpts[T]) (*GetStream[T], error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream := &GetStream[T]{
+		ch:     make(chan *T, 100),
+		cancel: cancel,
+	}
+
+	if opts != nil {
+		stream.prev = opts.Prev
+	}
+
+	err := subscribeGetNameOnce[T](ctx, sub, name, id, opts, stream)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go stream.run(func() error {
+		return subscribeGetNameOnce[T](ctx, sub, name, id, opts, stream)
+	})
+
+	return stream, nil
+}
+
+func subscribeGetNameOnce[T any](ctx context.Context, sub *Subscription, name, id string, opts *GetOpts[T], stream *GetStream[T]) error {
+	r := sub.c.rst.R()
+
+	tmp := GetOpts[T]{}
+
+	if opts != nil {
+		tmp = *opts
+	}
+
+	// Resume from the last object we delivered
+	tmp.Prev = stream.prev
+	tmp.apply(r)
+
+	events, err := subscribeEvents[T](ctx, sub, newSubscribeRequest("streamGet", name, id, r))
+	if err != nil {
+		return err
+	}
+
+	stream.resetEvents(events)
+
+	return nil
+}
+
+func SubscribeListName[T any](ctx context.Context, sub *Subscription, name string, opts *ListOpts[T]) (*ListStream[T], error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream := &ListStream[T]{
+		ch:     make(chan []*T, 100),
+		cancel: cancel,
+	}
+
+	if opts != nil {
+		stream.prev = opts.Prev
+	}
+
+	go func() {
+		defer close(stream.ch)
+
+		for ctx.Err() == nil {
+			err := subscribeListNameOnce[T](ctx, sub, name, opts, stream)
+			if errors.Is(err, errReconnect) {
+				// Requested by the server, so no backoff
+				continue
+			}
+
+			// Retrying can't help once the Subscription has failed
+			stream.writeError(err)
+
+			return
+		}
+	}()
+
+	return stream, nil
+}
+
+func subscribeListNameOnce[T any](ctx context.Context, sub *Subscription, name string, opts *ListOpts[T], stream *ListStream[T]) error {
+	r := sub.c.rst.R()
+
+	tmp := ListOpts[T]{}
+
+	if opts != nil {
+		tmp = *opts
+	}
+
+	tmp.Prev = stream.prev
+
+	err := tmp.apply(r)
+	if err != nil {
+		return err
+	}
+
+	if stream.lastETag != "" {
+		// Resume from the last list we delivered, which may be empty
+		r.SetHeader("If-None-Match", stream.lastETag)
+	}
+
+	events, err := subscribeEvents[T](ctx, sub, newSubscribeRequest("streamList", name, "", r))
+	if err != nil {
+		return err
+	}
+
+	stream.resetEvents(events)
+
+	if tmp.Stream == "" {
+		tmp.Stream = "full"
+	}
+
+	return stream.process(tmp.Stream)
+}
+
+func subscribeEvents[T any](ctx context.Context, sub *Subscription, req *subscribeRequest) (*subEventReader[T], error) {
+	ch, err := sub.subscribe(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &subEventReader[T]{
+		ctx: ctx,
+		sub: sub,
+		ref: req.Ref,
+		ch:  ch,
+	}, nil
+}
+
+type eventReader[T any] interface {
+	readEvent() (*streamEvent[T], error)
+
+	// close abandons the events, e.g. to resync
+	close()
 }
 
 type streamEvent[T any] struct {
@@ -569,15 +899,21 @@ func (ev *streamEvent[T]) decodeList() ([]*T, error) {
 }
 
 type eventStream[T any] struct {
+	body io.ReadCloser
 	scan *bufio.Scanner
 }
 
-func newEventStream[T any](scan *bufio.Scanner) *eventStream[T] {
+func newEventStream[T any](body io.ReadCloser) *eventStream[T] {
 	return &eventStream[T]{
-		scan: scan,
+		body: body,
+		scan: bufio.NewScanner(body),
 	}
 }
 
+func (es *eventStream[T]) close() {
+	es.body.Close()
+}
+
 func (es *eventStream[T]) readEvent() (*streamEvent[T], error) {
 	event := newStreamEvent[T]()
 	data := [][]byte{}
@@ -611,16 +947,24 @@ func (es *eventStream[T]) readEvent() (*streamEvent[T], error) {
 }
 
 type GetStream[T any] struct {
-	ch   chan *T
-	body io.ReadCloser
-	prev *T
+	ch     chan *T
+	cancel context.CancelFunc
+	body   io.ReadCloser
+	events eventReader[T]
+	prev   *T
 
 	lastEventReceived time.Time
+	lastETag          string
 	err               error
 	mu                sync.RWMutex
 }
 
 func (gs *GetStream[T]) Close() {
+	gs.cancel()
+
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
 	if gs.body != nil {
 		gs.body.Close()
 	}
@@ -648,15 +992,49 @@ func (gs *GetStream[T]) Error() error {
 	return gs.err
 }
 
-func (gs *GetStream[T]) process() {
-	scan := bufio.NewScanner(gs.body)
-	es := newEventStream[T](scan)
+func (gs *GetStream[T]) reset(body io.ReadCloser) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	gs.body = body
+	gs.events = newEventStream[T](body)
+}
+
+func (gs *GetStream[T]) resetEvents(events eventReader[T]) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	gs.body = nil
+	gs.events = events
+}
+
+// run processes events until the stream fails, calling open to resume when
+// the server requests a reconnect
+func (gs *GetStream[T]) run(open func() error) {
+	defer close(gs.ch)
 
 	for {
-		event, err := es.readEvent()
+		err := gs.process()
+
+		if errors.Is(err, errReconnect) {
+			// Requested by the server, so no backoff
+			err = open()
+			if err == nil {
+				continue
+			}
+		}
+
+		gs.writeError(err)
+
+		return
+	}
+}
+
+func (gs *GetStream[T]) process() error {
+	for {
+		event, err := gs.events.readEvent()
 		if err != nil {
-			gs.writeError(err)
-			return
+			return err
 		}
 
 		switch event.eventType {
@@ -665,22 +1043,37 @@ func (gs *GetStream[T]) process() {
 		case "update":
 			obj, err := event.decodeObj()
 			if err != nil {
-				gs.writeError(err)
-				return
+				return err
 			}
 
 			gs.writeEvent(obj)
 
 		case "notModified":
-			if gs.prev != nil {
-				gs.writeEvent(gs.prev)
-			} else {
-				gs.writeError(fmt.Errorf("notModified without If-None-Match (%w)", ErrInvalidStreamEvent))
-				return
+			if gs.prev == nil {
+				return fmt.Errorf("notModified without If-None-Match (%w)", ErrInvalidStreamEvent)
+			}
+
+			gs.writeEvent(gs.prev)
+
+		case "patch":
+			obj, err := applyPatch(gs.prev, event)
+			if errors.Is(err, errPatchBase) {
+				// We missed an update; resume from the last object we have
+				gs.events.close()
+				return errReconnect
 			}
 
+			if err != nil {
+				return err
+			}
+
+			gs.writeEvent(obj)
+
 		case "heartbeat":
 			gs.writeHeartbeat()
+
+		case "reconnect":
+			return errReconnect
 		}
 	}
 }
@@ -696,6 +1089,15 @@ func (gs *GetStream[T]) writeEvent(obj *T) {
 	gs.lastEventReceived = time.Now()
 	gs.mu.Unlock()
 
+	etag := metadata.GetMetadata(obj).ETag
+	if etag != "" && etag == gs.lastETag {
+		// Skip duplicates (notModified after reconnect)
+		return
+	}
+
+	gs.lastETag = etag
+	gs.prev = obj
+
 	gs.ch <- obj
 }
 
@@ -703,14 +1105,13 @@ func (gs *GetStream[T]) writeError(err error) {
 	gs.mu.Lock()
 	gs.err = err
 	gs.mu.Unlock()
-
-	close(gs.ch)
 }
 
 type ListStream[T any] struct {
 	ch     chan []*T
 	cancel context.CancelFunc
 	body   io.ReadCloser
+	events eventReader[T]
 	prev   []*T
 
 	lastEventReceived time.Time
@@ -753,15 +1154,33 @@ func (ls *ListStream[T]) Error() error {
 
 func (ls *ListStream[T]) reset(body io.ReadCloser) {
 	ls.body = body
+	ls.events = newEventStream[T](body)
 	ls.err = nil
 }
 
-func (ls *ListStream[T]) processFull() error {
-	scan := bufio.NewScanner(ls.body)
-	es := newEventStream[T](scan)
+func (ls *ListStream[T]) resetEvents(events eventReader[T]) {
+	ls.body = nil
+	ls.events = events
+	ls.err = nil
+}
+
+func (ls *ListStream[T]) process(format string) error {
+	switch format {
+	case "full":
+		return ls.processFull()
+
+	case "diff", "patch":
+		return ls.processDiff()
+
+	default:
+		ls.Close()
+		return jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", format, ErrInvalidStreamFormat)
+	}
+}
 
+func (ls *ListStream[T]) processFull() error {
 	for {
-		event, err := es.readEvent()
+		event, err := ls.events.readEvent()
 		if err != nil {
 			return err
 		}
@@ -773,21 +1192,23 @@ func (ls *ListStream[T]) processFull() error {
 				return err
 			}
 
-			setListETag(list, fmt.Sprintf(`"%s"`, event.params["id"]))
-			ls.writeEvent(list)
+			etag := fmt.Sprintf(`"%s"`, event.params["id"])
+			setListETag(list, etag)
+			ls.writeEvent(list, etag)
 
 		case "notModified":
-			ls.writeEvent(ls.prev)
+			ls.writeEvent(ls.prev, fmt.Sprintf(`"%s"`, event.params["id"]))
 
 		case "heartbeat":
 			ls.writeHeartbeat()
+
+		case "reconnect":
+			return errReconnect
 		}
 	}
 }
 
 func (ls *ListStream[T]) processDiff() error {
-	scan := bufio.NewScanner(ls.body)
-	es := newEventStream[T](scan)
 	list := []*T{}
 
 	add := func(event *streamEvent[T]) error {
@@ -818,7 +1239,7 @@ func (ls *ListStream[T]) processDiff() error {
 	}
 
 	for {
-		event, err := es.readEvent()
+		event, err := ls.events.readEvent()
 		if err != nil {
 			return err
 		}
@@ -841,6 +1262,35 @@ func (ls *ListStream[T]) processDiff() error {
 				return err
 			}
 
+		case "patch":
+			pos, err := strconv.Atoi(event.params["old-position"])
+			if err != nil || pos < 0 || pos >= len(list) {
+				return fmt.Errorf("old-position=%s (%w)", event.params["old-position"], ErrInvalidStreamEvent)
+			}
+
+			obj, err := applyPatch(list[pos], event)
+			if errors.Is(err, errPatchBase) {
+				// We missed an update; resume from the last list we have
+				ls.events.close()
+				return errReconnect
+			}
+
+			if err != nil {
+				return err
+			}
+
+			err = remove(event)
+			if err != nil {
+				return err
+			}
+
+			newPos, err := strconv.Atoi(event.params["new-position"])
+			if err != nil {
+				return err
+			}
+
+			list = slices.Insert(list, newPos, obj)
+
 		case "remove":
 			err = remove(event)
 			if err != nil {
@@ -848,7 +1298,8 @@ func (ls *ListStream[T]) processDiff() error {
 			}
 
 		case "sync":
-			setListETag(list, fmt.Sprintf(`"%s"`, event.params["id"]))
+			etag := fmt.Sprintf(`"%s"`, event.params["id"])
+			setListETag(list, etag)
 
 			// Write a copy since we mutate list
 			tmp, err := ls.clone(list)
@@ -856,10 +1307,14 @@ func (ls *ListStream[T]) processDiff() error {
 				return err
 			}
 
-			ls.writeEvent(tmp)
+			ls.writeEvent(tmp, etag)
 
 		case "notModified":
-			list = ls.prev
+			// prev belongs to the caller, so don't mutate it
+			list, err = ls.clone(ls.prev)
+			if err != nil {
+				return err
+			}
 
 			// Write a copy since we mutate list
 			tmp, err := ls.clone(list)
@@ -867,10 +1322,13 @@ func (ls *ListStream[T]) processDiff() error {
 				return err
 			}
 
-			ls.writeEvent(tmp)
+			ls.writeEvent(tmp, fmt.Sprintf(`"%s"`, event.params["id"]))
 
 		case "heartbeat":
 			ls.writeHeartbeat()
+
+		case "reconnect":
+			return errReconnect
 		}
 	}
 }
@@ -881,19 +1339,19 @@ func (ls *ListStream[T]) writeHeartbeat() {
 	ls.mu.Unlock()
 }
 
-func (ls *ListStream[T]) writeEvent(list []*T) {
+func (ls *ListStream[T]) writeEvent(list []*T, etag string) {
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
 
 	ls.lastEventReceived = time.Now()
 
-	etag := getListETag(list)
 	if etag != "" && etag == ls.lastETag {
 		// Skip duplicates
 		return
 	}
 
 	ls.lastETag = etag
+	ls.prev = list
 
 	ls.ch <- list
 }
@@ -922,6 +1380,271 @@ func (ls *ListStream[T]) clone(list []*T) ([]*T, error) {
 	return ret, nil
 }
 
+// Subscription carries the events of many GetStreams and ListStreams. It
+// doesn't reconnect; its streams fail when it does.
+type Subscription struct {
+	c      *Client
+	id     string
+	ctx    context.Context
+	cancel context.CancelFunc
+	body   io.ReadCloser
+	events *eventStream[any]
+
+	streams map[string]*subStream
+	lastRef int
+	err     error
+	mu      sync.Mutex
+}
+
+type subStream struct {
+	ch   chan *streamEvent[any]
+	done <-chan struct{}
+}
+
+type subEventReader[T any] struct {
+	ctx context.Context
+	sub *Subscription
+	ref string
+	ch  <-chan *streamEvent[any]
+}
+
+type subscribeRequest struct {
+	Ref         string     `json:"ref"`
+	Op          string     `json:"op"`
+	Type        string     `json:"type,omitempty"`
+	ID          string     `json:"id,omitempty"`
+	IfNoneMatch string     `json:"ifNoneMatch,omitempty"`
+	Params      url.Values `json:"params,omitempty"`
+
+	// The subscription outlives the POST that creates it, so it carries its
+	// own trace context
+	Traceparent string `json:"traceparent,omitempty"`
+	Tracestate  string `json:"tracestate,omitempty"`
+}
+
+func (sub *Subscription) Close() {
+	sub.cancel()
+	sub.body.Close()
+}
+
+func (sub *Subscription) Error() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.err
+}
+
+// dispatch routes events to streams by ref
+func (sub *Subscription) dispatch() {
+	for {
+		event, err := sub.events.readEvent()
+		if err != nil {
+			sub.mu.Lock()
+
+			sub.err = err
+
+			for ref, ss := range sub.streams {
+				close(ss.ch)
+				delete(sub.streams, ref)
+			}
+
+			sub.mu.Unlock()
+
+			return
+		}
+
+		ref := event.params["ref"]
+
+		sub.mu.Lock()
+
+		ss := sub.streams[ref]
+
+		if event.eventType == "end" {
+			delete(sub.streams, ref)
+		}
+
+		sub.mu.Unlock()
+
+		if ss == nil {
+			// Connection heartbeats and ended streams
+			continue
+		}
+
+		if event.eventType == "end" {
+			close(ss.ch)
+			continue
+		}
+
+		select {
+		case ss.ch <- event:
+		case <-ss.done:
+		}
+	}
+}
+
+// subscribe registers a new ref before sending req, since events can arrive
+// before the response
+func (sub *Subscription) subscribe(ctx context.Context, req *subscribeRequest) (<-chan *streamEvent[any], error) {
+	ss := &subStream{
+		ch:   make(chan *streamEvent[any], 100),
+		done: ctx.Done(),
+	}
+
+	sub.mu.Lock()
+
+	if sub.err != nil {
+		sub.mu.Unlock()
+		return nil, sub.err
+	}
+
+	sub.lastRef++
+	req.Ref = strconv.Itoa(sub.lastRef)
+	sub.streams[req.Ref] = ss
+
+	sub.mu.Unlock()
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	req.Traceparent = carrier.Get("traceparent")
+	req.Tracestate = carrier.Get("tracestate")
+
+	err := sub.post(ctx, req)
+	if err != nil {
+		sub.mu.Lock()
+		delete(sub.streams, req.Ref)
+		sub.mu.Unlock()
+
+		return nil, err
+	}
+
+	return ss.ch, nil
+}
+
+func (sub *Subscription) unsubscribe(ref string) {
+	_ = sub.post(sub.ctx, &subscribeRequest{
+		Ref: ref,
+		Op:  "unsubscribe",
+	})
+}
+
+func (sub *Subscription) post(ctx context.Context, req *subscribeRequest) error {
+	resp, err := sub.c.rst.R().
+		SetContext(ctx).
+		SetBody(req).
+		SetPathParam("id", sub.id).
+		Post("_subscribe/{id}")
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		return readError(resp)
+	}
+
+	return nil
+}
+
+// newSubscribeRequest carries the options applied to r
+func newSubscribeRequest(op, name, id string, r *resty.Request) *subscribeRequest {
+	return &subscribeRequest{
+		Op:          op,
+		Type:        name,
+		ID:          id,
+		IfNoneMatch: strings.Trim(r.Header.Get("If-None-Match"), `"`),
+		Params:      r.QueryParam,
+	}
+}
+
+func (sr *subEventReader[T]) readEvent() (*streamEvent[T], error) {
+	select {
+	case event, ok := <-sr.ch:
+		if !ok {
+			return nil, io.EOF
+		}
+
+		return &streamEvent[T]{
+			eventType: event.eventType,
+			params:    event.params,
+			data:      event.data,
+		}, nil
+
+	case <-sr.ctx.Done():
+		sr.sub.unsubscribe(sr.ref)
+		return nil, sr.ctx.Err()
+	}
+}
+
+func (sr *subEventReader[T]) close() {
+	sr.sub.unsubscribe(sr.ref)
+}
+
+// applyPatch applies the merge patch in a patch event to prev, which must
+// be the patch's base
+func applyPatch[T any](prev *T, event *streamEvent[T]) (*T, error) {
+	if prev == nil || metadata.GetMetadata(prev).ETag != event.params["base"] {
+		return nil, fmt.Errorf("%s (%w)", event.params["base"], errPatchBase)
+	}
+
+	js, err := json.Marshal(prev)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]any{}
+
+	err = json.Unmarshal(js, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	patch := map[string]any{}
+
+	err = json.Unmarshal(event.data, &patch)
+	if err != nil {
+		return nil, err
+	}
+
+	mergePatch(doc, patch)
+
+	js, err = json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := new(T)
+
+	err = json.Unmarshal(js, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch to doc in place
+func mergePatch(doc, patch map[string]any) {
+	for k, v := range patch {
+		if v == nil {
+			delete(doc, k)
+			continue
+		}
+
+		vMap, ok := v.(map[string]any)
+		if !ok {
+			doc[k] = v
+			continue
+		}
+
+		docMap, ok := doc[k].(map[string]any)
+		if !ok {
+			docMap = map[string]any{}
+			doc[k] = docMap
+		}
+
+		mergePatch(docMap, vMap)
+	}
+}
+
 //// Internal
 
 func (opts *GetOpts[T]) apply(req *resty.Request) {
@@ -929,6 +1652,18 @@ func (opts *GetOpts[T]) apply(req *resty.Request) {
 		return
 	}
 
+	if opts.Stream != "" {
+		req.SetQueryParam("_stream", opts.Stream)
+	}
+
+	if opts.Heartbeat != 0 {
+		req.SetQueryParam("_heartbeat", opts.Heartbeat.String())
+	}
+
+	if opts.MaxDuration != 0 {
+		req.SetQueryParam("_maxDuration", opts.MaxDuration.String())
+	}
+
 	if opts.Prev != nil {
 		md := metadata.GetMetadata(opts.Prev)
 		req.SetHeader("If-None-Match", fmt.Sprintf(`"%s"`, md.ETag))
@@ -949,6 +1684,22 @@ func (opts *ListOpts[T]) apply(req *resty.Request) error {
 		req.SetQueryParam("_stream", opts.Stream)
 	}
 
+	if opts.Debounce != 0 {
+		req.SetQueryParam("_debounce", opts.Debounce.String())
+	}
+
+	if opts.MaxRate != 0 {
+		req.SetQueryParam("_maxRate", strconv.FormatFloat(opts.MaxRate, 'f', -1, 64))
+	}
+
+	if opts.Heartbeat != 0 {
+		req.SetQueryParam("_heartbeat", opts.Heartbeat.String())
+	}
+
+	if opts.MaxDuration != 0 {
+		req.SetQueryParam("_maxDuration", opts.MaxDuration.String())
+	}
+
 	if opts.Limit != 0 {
 		req.SetQueryParam("_limit", fmt.Sprintf("%d", opts.Limit))
 	}
@@ -999,7 +1750,7 @@ func (c *Client) fetchMap(ctx context.Context, path string) (map[string]any, err
 	}
 
 	if resp.IsError() {
-		return nil, jsrest.ReadError(resp)
+		return nil, readError(resp)
 	}
 
 	return ret, nil
@@ -1014,7 +1765,7 @@ func (c *Client) fetchString(ctx context.Context, path string) (string, error) {
 	}
 
 	if resp.IsError() {
-		return "", jsrest.ReadError(resp)
+		return "", readError(resp)
 	}
 
 	return resp.String(), nil
@@ -1040,6 +1791,43 @@ func getListETagField[T any](list []*T) reflect.Value {
 	return reflect.Indirect(reflect.ValueOf(list[0])).FieldByName("ListETag")
 }
 
+// retryAfterError carries the server's Retry-After with the error it came with
+type retryAfterError struct {
+	error
+	retryAfter time.Duration
+}
+
+func (rae *retryAfterError) Unwrap() error {
+	return rae.error
+}
+
+// RetryAfter returns how long the server asked us to wait before retrying
+// the request that returned err, or zero
+func RetryAfter(err error) time.Duration {
+	rae := &retryAfterError{}
+
+	if errors.As(err, &rae) {
+		return rae.retryAfter
+	}
+
+	return 0
+}
+
+func readError(resp *resty.Response) error {
+	err := jsrest.ReadError(resp)
+
+	// Only the delay-seconds form; patchy doesn't send HTTP dates
+	secs, parseErr := strconv.Atoi(resp.Header().Get("Retry-After"))
+	if parseErr != nil || secs <= 0 {
+		return err
+	}
+
+	return &retryAfterError{
+		error:      err,
+		retryAfter: time.Duration(secs) * time.Second,
+	}
+}
+
 type backoff struct {
 	delay time.Duration
 	lastFailure time.Time
@@ -1050,7 +1838,9 @@ const (
 	maxDelay = 60 * time.Second
 )
 
-func (b *backoff) failure(ctx context.Context) {
+// failure waits before the next attempt, for at least as long as err's
+// Retry-After
+func (b *backoff) failure(ctx context.Context, err error) {
 	if !b.lastFailure.IsZero() {
 		// Credit for time since last delay
 		b.delay -= time.Since(b.lastFailure)
@@ -1074,6 +1864,11 @@ func (b *backoff) failure(ctx context.Context) {
 	// Full jitter
 	actualDelay := time.Duration(rand.Int63n(int64(b.delay))) //nolint:gosec
 
+	retryAfter := RetryAfter(err)
+	if retryAfter > actualDelay {
+		actualDelay = retryAfter
+	}
+
 	t := time.NewTimer(actualDelay)
 
 	select {
@@ -19,6 +19,11 @@ export interface Metadata {
 }
 
 export interface GetOpts<T> {
+	// Streams only; durations are in milliseconds
+	stream?:      string;
+	heartbeat?:   number;
+	maxDuration?: number;
+
 	prev?: T & Metadata;
 	// TODO: Add failFast
 }
@@ -31,6 +36,12 @@ export interface ListOpts<T> {
 	sorts?:   string[];
 	filters?: Filter[];
 
+	// Streams only; durations are in milliseconds
+	debounce?:    number;
+	maxRate?:     number;
+	heartbeat?:   number;
+	maxDuration?: number;
+
 	prev?:    (T & Metadata)[];
 	// TODO: Add failFast
 }
@@ -51,20 +62,93 @@ export interface JSONError {
 	messages:  string[];
 }
 
+// Sets trace context headers for the current span
+export type TracePropagator = (headers: Headers) => void;
+
 const ETagKey = Symbol('etag');
 
 export class Client {
 	private baseURL: URL;
 	private headers: Headers = new Headers();
+	private credentials: RequestCredentials = '{{ if .AuthSession }}same-origin{{ else }}omit{{ end }}';
+	private ws: WSConn | null = null;
+	private mux: SSEMux | null = null;
+	private tracePropagator: TracePropagator | null = null;
 
 	constructor(baseURL: string) {
 		this.baseURL = new URL(baseURL, globalThis?.location?.href);
+
+		{{- if .AuthSession }}
+
+		// Same-origin pages can recover the CSRF token after a reload
+		const csrf = readCookie('patchy-csrf');
+		if (csrf) {
+			this.headers.set('X-CSRF-Token', csrf);
+		}
+		{{- end }}
 	}
 
 	setBaseURL(baseURL: string)  {
 		this.baseURL = new URL(baseURL, globalThis?.location?.href);
 	}
 
+	// Sends streams, creates, replaces, updates and deletes over one
+	// WebSocket (/_ws). WebSocket requests can't carry headers, so this
+	// only authenticates with cookies, not setHeader() and friends.
+	async useWebSocket(): Promise<void> {
+		const url = new URL('_ws', this.baseURL);
+		url.protocol = url.protocol == 'https:' ? 'wss:' : 'ws:';
+
+		const ws = new WSConn(url);
+		await ws.opened;
+
+		this.closeWebSocket();
+		this.ws = ws;
+	}
+
+	closeWebSocket() {
+		this.ws?.close();
+		this.ws = null;
+	}
+
+	// Sends all streams over one EventStream (/_subscribe), to stay within
+	// browsers' per-host connection limit
+	async useSubscription(): Promise<void> {
+		const controller = new AbortController();
+
+		const req = this.newReq('GET', '_subscribe');
+		req.setSignal(controller.signal);
+		const resp = await req.fetchStream();
+
+		const events = new EventStream<any>(resp.body!);
+		const open = await events.readEvent();
+		const id = open?.params.get('subscription');
+
+		if (open?.eventType != 'open' || !id) {
+			controller.abort();
+
+			throw new Error({
+				messages: [
+					`invalid subscription event: ${open?.eventType}`,
+				],
+			});
+		}
+
+		const post = (wsReq: WSRequest) => {
+			const postReq = this.newReq<WSRequest>('POST', `_subscribe/${encodeURIComponent(id)}`);
+			postReq.setBody(wsReq);
+			return postReq.fetchVoid();
+		};
+
+		this.closeSubscription();
+		this.mux = new SSEMux(events, controller, post);
+	}
+
+	closeSubscription() {
+		this.mux?.close();
+		this.mux = null;
+	}
+
 	// Skipped: setDebug()
 	// Skipped: setTLSClientConfig()
 	// Skipped: setCloseConnection()
@@ -73,6 +157,16 @@ export class Client {
 		this.headers.set(name, value)
 	}
 
+	// Adds W3C trace context headers (traceparent, tracestate) to each
+	// request, e.g. with @opentelemetry/api:
+	//
+	//   client.setTracePropagator((headers) => propagation.inject(context.active(), headers, {
+	//     set: (h, k, v) => h.set(k, v),
+	//   }));
+	setTracePropagator(inject: TracePropagator | null) {
+		this.tracePropagator = inject;
+	}
+
 	resetAuth() {
 		this.headers.delete('Authorization');
 	}
@@ -92,6 +186,36 @@ export class Client {
 	}
 	{{- end }}
 
+	{{- if .AuthAPIKey }}
+
+	setAPIKey(key: string) {
+		this.headers.set('Authorization', `ApiKey ${key}`);
+	}
+	{{- end }}
+
+	{{- if .AuthSession }}
+
+	// Cross-origin sessions need 'include' and a server CORSPolicy with
+	// explicit origins and credentials
+	setCredentials(credentials: RequestCredentials) {
+		this.credentials = credentials;
+	}
+
+	// Explicit auth (setBasicAuth etc.) takes precedence over the session
+	async login(user: string, pass: string): Promise<void> {
+		const req = this.newReq('POST', '_login');
+		req.setHeader('Authorization', `Basic ${btoa(`${user}:${pass}`)}`);
+		const info = await req.fetchJSON() as {csrfToken: string};
+		this.headers.set('X-CSRF-Token', info.csrfToken);
+	}
+
+	async logout(): Promise<void> {
+		const req = this.newReq('POST', '_logout');
+		await req.fetchVoid();
+		this.headers.delete('X-CSRF-Token');
+	}
+	{{- end }}
+
 	async debugInfo(): Promise<Object> {
 		const req = this.newReq('GET', '_debug');
 		return req.fetchJSON();
@@ -154,6 +278,13 @@ export class Client {
 		return this.streamListName<{{ $api.TypeUpperCamel }}>('{{ $api.NameLower }}', opts);
 	}
 
+	{{- if $api.APIKey }}
+
+	async rotate{{ $api.NameUpperCamel }}(id: string, opts?: UpdateOpts<{{ $api.TypeUpperCamel }}> | null): Promise<string> {
+		return this.rotateName<{{ $api.TypeUpperCamel }}>('{{ $api.NameLower }}', id, opts);
+	}
+	{{- end }}
+
 	{{- end }}
 
 	//// Generic
@@ -163,6 +294,11 @@ export class Client {
 		// TODO: Split out createNameOnce, add retry loop
 		const req = this.newReq<T>('POST', encodeURIComponent(name));
 		req.setBody(obj);
+
+		if (this.ws) {
+			return this.ws.fetchObj<T>(req.toWSRequest('create', name));
+		}
+
 		return req.fetchObj();
 	}
 
@@ -171,6 +307,12 @@ export class Client {
 		// TODO: Split out deleteNameOnce, add retry loop
 		const req = this.newReq<T>('DELETE', `${encodeURIComponent(name)}/${encodeURIComponent(id)}`);
 		req.applyUpdateOpts(opts);
+
+		if (this.ws) {
+			await this.ws.call(req.toWSRequest('delete', name, id));
+			return;
+		}
+
 		return req.fetchVoid();
 	}
 
@@ -218,6 +360,11 @@ export class Client {
 		const req = this.newReq<T>('PUT', `${encodeURIComponent(name)}/${encodeURIComponent(id)}`);
 		req.applyUpdateOpts(opts);
 		req.setBody(obj);
+
+		if (this.ws) {
+			return this.ws.fetchObj<T>(req.toWSRequest('replace', name, id));
+		}
+
 		return req.fetchObj();
 	}
 
@@ -227,44 +374,87 @@ export class Client {
 		const req = this.newReq<T>('PATCH', `${encodeURIComponent(name)}/${encodeURIComponent(id)}`);
 		req.applyUpdateOpts(opts);
 		req.setBody(obj);
+
+		if (this.ws) {
+			return this.ws.fetchObj<T>(req.toWSRequest('update', name, id));
+		}
+
 		return req.fetchObj();
 	}
 
-	async streamGetName<T>(name: string, id: string, opts?: GetOpts<T> | null): Promise<GetStream<T>> {
-		// TODO: Split out streamGetNameOnce, add retry loop
-		const req = this.newReq<T>('GET', `${encodeURIComponent(name)}/${encodeURIComponent(id)}`);
-		req.applyGetOpts(opts);
+	async rotateName<T>(name: string, id: string, opts?: UpdateOpts<T> | null): Promise<string> {
+		const req = this.newReq<T>('POST', `${encodeURIComponent(name)}/${encodeURIComponent(id)}/_rotate`);
+		req.applyUpdateOpts(opts);
+		const tok = await req.fetchJSON() as {token: string};
+		return tok.token;
+	}
 
+	async streamGetName<T>(name: string, id: string, opts?: GetOpts<T> | null): Promise<GetStream<T>> {
+		// TODO: Add retry loop for failures other than reconnect
 		const controller = new AbortController();
-		req.setSignal(controller.signal);
 
-		const resp = await req.fetchStream();
+		// Also used to resume after a reconnect event
+		const open = async (prev: (T & Metadata) | null): Promise<EventReader<T>> => {
+			const req = this.newReq<T>('GET', `${encodeURIComponent(name)}/${encodeURIComponent(id)}`);
+			req.applyGetOpts(opts);
+			req.setPrevObj('If-None-Match', prev);
+
+			const mux: Mux | null = this.ws ?? this.mux;
+
+			if (mux) {
+				return mux.subscribe<T>(req.toWSRequest('streamGet', name, id), controller.signal);
+			}
+
+			req.setSignal(controller.signal);
+			const resp = await req.fetchStream();
+			return new EventStream<T>(resp.body!);
+		};
+
+		const events = await open(opts?.prev ?? null);
 
-		return new GetStream<T>(resp, controller, opts?.prev);
+		return new GetStream<T>(events, controller, opts?.prev, open);
 	}
 
 	async streamListName<T>(name: string, opts?: ListOpts<T> | null): Promise<ListStream<T>> {
-		// TODO: Split out streamListNameOnce, add retry loop
-		const req = this.newReq<T>('GET', `${encodeURIComponent(name)}`);
-		req.applyListOpts(opts);
-
+		// TODO: Add retry loop for failures other than reconnect
 		const controller = new AbortController();
-		req.setSignal(controller.signal);
 
-		const resp = await req.fetchStream();
+		// Also used to resume after a reconnect event
+		// Multiplexed subscriptions don't have a Stream-Format header
+		let format: string | null = opts?.stream ?? 'full';
+
+		const open = async (prev: (T & Metadata)[] | null): Promise<EventReader<T>> => {
+			const req = this.newReq<T>('GET', `${encodeURIComponent(name)}`);
+			req.applyListOpts(opts);
+			req.setPrevList('If-None-Match', prev);
+
+			const mux: Mux | null = this.ws ?? this.mux;
+
+			if (mux) {
+				return mux.subscribe<T>(req.toWSRequest('streamList', name), controller.signal);
+			}
+
+			req.setSignal(controller.signal);
+			const resp = await req.fetchStream();
+			format = resp.headers.get('Stream-Format');
+			return new EventStream<T>(resp.body!);
+		};
+
+		const events = await open(opts?.prev ?? null);
 
 		try {
-			switch (resp.headers.get('Stream-Format')) {
+			switch (format) {
 			case 'full':
-				return new ListStreamFull<T>(resp, controller, opts?.prev);
+				return new ListStreamFull<T>(events, controller, opts?.prev, open);
 
 			case 'diff':
-				return new ListStreamDiff<T>(resp, controller, opts?.prev);
+			case 'patch':
+				return new ListStreamDiff<T>(events, controller, opts?.prev, open);
 
 			default:
 				throw new Error({
 					messages: [
-						`invalid Stream-Format: ${resp.headers.get('Stream-Format')}`,
+						`invalid Stream-Format: ${format}`,
 					],
 				});
 			}
@@ -276,7 +466,13 @@ export class Client {
 
 	private newReq<T = void>(method: string, path: string): Req<T> {
 		const url = new URL(path, this.baseURL);
-		return new Req<T>(method, url, this.headers);
+		const req = new Req<T>(method, url, this.headers, this.credentials);
+
+		if (this.tracePropagator) {
+			req.injectTraceContext(this.tracePropagator);
+		}
+
+		return req;
 	}
 }
 
@@ -311,6 +507,10 @@ class Scanner {
 		this.buf = this.buf.substring(lineEnd + 1);
 		return line;
 	}
+
+	cancel() {
+		this.reader.cancel().catch(() => {});
+	}
 }
 
 class StreamEvent<T> {
@@ -318,22 +518,67 @@ class StreamEvent<T> {
 	params:    Map<string, string> = new Map();
 	data:      string = '';
 
+	// Already decoded (WebSocket events)
+	value:     any = null;
+
 	decodeObj(): T & Metadata {
-		return JSON.parse(this.data);
+		const obj = this.decode();
+		this.setETag(obj);
+		return obj;
 	}
 
 	decodeList(): (T & Metadata)[] {
-		return JSON.parse(this.data);
+		const list = this.decode();
+		this.setETag(list);
+		return list;
+	}
+
+	// Applies a patch event to prev; null if prev isn't the patch's base
+	applyPatch(prev: (T & Metadata) | null | undefined): (T & Metadata) | null {
+		if (!prev || prev.etag != this.params.get('base')) {
+			return null;
+		}
+
+		const obj = mergePatch(JSON.parse(JSON.stringify(prev)), this.decode());
+		this.setETag(obj);
+		return obj;
+	}
+
+	private decode(): any {
+		return this.value ?? JSON.parse(this.data);
+	}
+
+	// Objects and lists carry their ETag so they can be passed back as prev
+	setETag(obj: Object) {
+		const id = this.params.get('id');
+
+		if (id) {
+			Object.defineProperty(obj, ETagKey, {
+				value: `"${id}"`,
+			});
+		}
 	}
 }
 
-class EventStream<T> {
+interface EventReader<T> {
+	// null when the stream ends
+	readEvent(): Promise<StreamEvent<T> | null>;
+
+	// Abandons the events, e.g. to resync
+	close(): void;
+}
+
+class EventStream<T> implements EventReader<T> {
 	private scan: Scanner;
 
 	constructor(stream: ReadableStream) {
 		this.scan = new Scanner(stream);
 	}
 
+	close() {
+		this.scan.cancel();
+	}
+
 	async readEvent(): Promise<StreamEvent<T> | null> {
 		const data: string[] = [];
 		const ev = new StreamEvent<T>();
@@ -365,16 +610,346 @@ class EventStream<T> {
 	}
 }
 
+interface WSRequest {
+	ref?:         string;
+	op:           string;
+	type?:        string;
+	id?:          string;
+	ifMatch?:     string;
+	ifNoneMatch?: string;
+	params?:      Record<string, string[]>;
+	obj?:         any;
+	traceparent?: string;
+	tracestate?:  string;
+}
+
+interface WSMessage {
+	ref:     string;
+	event:   string;
+	status?: number;
+	params?: Record<string, string>;
+	data?:   any;
+}
+
+// Carries many subscriptions over one connection
+interface Mux {
+	subscribe<T>(req: WSRequest, signal: AbortSignal): Promise<SubscriptionEvents<T>>;
+}
+
+// TODO: Reconnect the socket and resubscribe after it closes
+class WSConn implements Mux {
+	opened: Promise<void>;
+
+	private ws: WebSocket;
+	private lastRef: number = 0;
+	private results: Map<string, (msg: WSMessage) => void> = new Map();
+	private subs: Map<string, SubscriptionEvents<any>> = new Map();
+	private closed: boolean = false;
+
+	constructor(url: URL) {
+		this.ws = new WebSocket(url);
+
+		this.opened = new Promise((resolve, reject) => {
+			this.ws.addEventListener('open', () => resolve());
+			this.ws.addEventListener('error', () => reject(new Error({
+				messages: [
+					`websocket connect failed: ${url}`,
+				],
+			})));
+		});
+
+		this.ws.addEventListener('message', (e: MessageEvent) => this.onMessage(JSON.parse(e.data)));
+		this.ws.addEventListener('close', () => this.onClose());
+	}
+
+	close() {
+		this.ws.close();
+	}
+
+	// Sends a create, replace, update or delete and waits for its result
+	async call(req: WSRequest): Promise<WSMessage> {
+		const ref = this.send(req);
+
+		const msg = await new Promise<WSMessage>(resolve => this.results.set(ref, resolve));
+
+		if (msg.event == 'error') {
+			throw new Error(msg.data);
+		}
+
+		return msg;
+	}
+
+	async fetchObj<T>(req: WSRequest): Promise<T & Metadata> {
+		const msg = await this.call(req);
+		const obj = msg.data;
+
+		Object.defineProperty(obj, ETagKey, {
+			value: `"${obj.etag}"`,
+		});
+
+		return obj;
+	}
+
+	async subscribe<T>(req: WSRequest, signal: AbortSignal): Promise<SubscriptionEvents<T>> {
+		const ref = this.nextRef();
+
+		const sub = new SubscriptionEvents<T>(() => {
+			if (!this.closed) {
+				this.ws.send(JSON.stringify({ref, op: 'unsubscribe'}));
+			}
+		});
+
+		this.subs.set(ref, sub);
+		this.send(req, ref);
+
+		signal.addEventListener('abort', () => sub.close());
+
+		// Errors starting the subscription (e.g. bad options) come first
+		const first = await sub.next();
+
+		if (first.eventType == 'error' || first.eventType == 'end') {
+			throw new Error(first.value ?? {messages: ['websocket closed']});
+		}
+
+		sub.unshift(first);
+
+		return sub;
+	}
+
+	private send(req: WSRequest, ref?: string): string {
+		req.ref = ref ?? this.nextRef();
+
+		if (this.closed) {
+			throw new Error({
+				messages: [
+					'websocket closed',
+				],
+			});
+		}
+
+		this.ws.send(JSON.stringify(req));
+
+		return req.ref;
+	}
+
+	private nextRef(): string {
+		return `${++this.lastRef}`;
+	}
+
+	private onMessage(msg: WSMessage) {
+		const result = this.results.get(msg.ref);
+
+		if (result) {
+			this.results.delete(msg.ref);
+			result(msg);
+			return;
+		}
+
+		const sub = this.subs.get(msg.ref);
+
+		if (sub) {
+			if (msg.event == 'end') {
+				this.subs.delete(msg.ref);
+			}
+
+			const ev = new StreamEvent<any>();
+			ev.eventType = msg.event;
+			ev.params = new Map(Object.entries(msg.params ?? {}));
+			ev.value = msg.data ?? null;
+			sub.push(ev);
+		}
+	}
+
+	private onClose() {
+		this.closed = true;
+
+		for (const [ref, result] of this.results) {
+			result({
+				ref,
+				event: 'error',
+				data: {
+					messages: [
+						'websocket closed',
+					],
+				},
+			});
+		}
+
+		for (const sub of this.subs.values()) {
+			sub.end();
+		}
+
+		this.results.clear();
+		this.subs.clear();
+	}
+}
+
+// One /_subscribe stream carrying many subscriptions, which are added and
+// removed by POSTing to /_subscribe/:id
+class SSEMux implements Mux {
+	private events: EventStream<any>;
+	private controller: AbortController;
+	private post: (req: WSRequest) => Promise<void>;
+	private lastRef: number = 0;
+	private subs: Map<string, SubscriptionEvents<any>> = new Map();
+	private closed: boolean = false;
+
+	constructor(events: EventStream<any>, controller: AbortController, post: (req: WSRequest) => Promise<void>) {
+		this.events = events;
+		this.controller = controller;
+		this.post = post;
+
+		this.dispatch();
+	}
+
+	close() {
+		this.controller.abort();
+	}
+
+	async subscribe<T>(req: WSRequest, signal: AbortSignal): Promise<SubscriptionEvents<T>> {
+		if (this.closed) {
+			throw new Error({
+				messages: [
+					'subscription stream closed',
+				],
+			});
+		}
+
+		const ref = `${++this.lastRef}`;
+
+		const sub = new SubscriptionEvents<T>(() => {
+			if (!this.closed) {
+				this.post({ref, op: 'unsubscribe'}).catch(() => {});
+			}
+		});
+
+		// Events can arrive before the POST returns
+		this.subs.set(ref, sub);
+
+		try {
+			await this.post({...req, ref});
+		} catch (e) {
+			this.subs.delete(ref);
+			throw e;
+		}
+
+		signal.addEventListener('abort', () => sub.close());
+
+		return sub;
+	}
+
+	private async dispatch() {
+		while (true) {
+			const ev = await this.events.readEvent();
+
+			if (ev == null) {
+				break;
+			}
+
+			const ref = ev.params.get('ref') ?? '';
+			const sub = this.subs.get(ref);
+
+			if (!sub) {
+				// Stream heartbeats and ended subscriptions
+				continue;
+			}
+
+			if (ev.eventType == 'end') {
+				this.subs.delete(ref);
+			}
+
+			sub.push(ev);
+		}
+
+		this.closed = true;
+
+		for (const sub of this.subs.values()) {
+			sub.end();
+		}
+
+		this.subs.clear();
+	}
+}
+
+// Events for one subscription of a WSConn or SSEMux
+class SubscriptionEvents<T> implements EventReader<T> {
+	private queue: StreamEvent<T>[] = [];
+	private waiting: ((ev: StreamEvent<T>) => void) | null = null;
+	private unsubscribe: () => void;
+
+	constructor(unsubscribe: () => void) {
+		this.unsubscribe = unsubscribe;
+	}
+
+	close() {
+		this.unsubscribe();
+	}
+
+	push(ev: StreamEvent<T>) {
+		const waiting = this.waiting;
+
+		if (waiting) {
+			this.waiting = null;
+			waiting(ev);
+			return;
+		}
+
+		this.queue.push(ev);
+	}
+
+	end() {
+		const ev = new StreamEvent<T>();
+		ev.eventType = 'end';
+		this.push(ev);
+	}
+
+	unshift(ev: StreamEvent<T>) {
+		this.queue.unshift(ev);
+	}
+
+	async next(): Promise<StreamEvent<T>> {
+		const ev = this.queue.shift();
+
+		if (ev) {
+			return ev;
+		}
+
+		return new Promise(resolve => this.waiting = resolve);
+	}
+
+	async readEvent(): Promise<StreamEvent<T> | null> {
+		while (true) {
+			const ev = await this.next();
+
+			switch (ev.eventType) {
+			case 'end':
+				// Keep returning null
+				this.unshift(ev);
+				return null;
+
+			case 'error':
+				// end follows
+				continue;
+			}
+
+			return ev;
+		}
+	}
+}
+
 export class GetStream<T> {
-	private eventStream: EventStream<T>;
+	private eventStream: EventReader<T>;
 	private controller: AbortController;
+	private open: (prev: (T & Metadata) | null) => Promise<EventReader<T>>;
 	private prev: (T & Metadata) | null;
+	private resumed: boolean = false;
 	private lastEvent: Date = new Date();
 
-	constructor(resp: Response, controller: AbortController, prev: (T & Metadata) | null | undefined) {
-		this.eventStream = new EventStream<T>(resp.body!);
+	constructor(events: EventReader<T>, controller: AbortController, prev: (T & Metadata) | null | undefined, open: (prev: (T & Metadata) | null) => Promise<EventReader<T>>) {
+		this.eventStream = events;
 		this.controller = controller;
 		this.prev = prev ?? null;
+		this.open = open;
 	}
 
 	lastEventReceived(): Date {
@@ -398,17 +973,61 @@ export class GetStream<T> {
 			switch (ev.eventType) {
 			case 'initial':
 			case 'update':
-				return ev.decodeObj();
+				this.prev = ev.decodeObj();
+				return this.prev;
+
+			case 'patch': {
+				const obj = ev.applyPatch(this.prev);
+
+				if (obj == null) {
+					// We missed an update; resume from prev
+					if (!await this.resync()) {
+						return null;
+					}
+
+					continue;
+				}
+
+				this.prev = obj;
+				return this.prev;
+			}
 
 			case 'notModified':
+				if (this.resumed) {
+					// Already returned prev before the reconnect
+					continue;
+				}
+
 				return this.prev;
 
 			case 'heartbeat':
 				continue;
+
+			case 'reconnect':
+				if (!await this.reconnect()) {
+					return null;
+				}
+
+				continue;
 			}
 		}
 	}
 
+	private async reconnect(): Promise<boolean> {
+		try {
+			this.eventStream = await this.open(this.prev);
+			this.resumed = true;
+			return true;
+		} catch {
+			return false;
+		}
+	}
+
+	private async resync(): Promise<boolean> {
+		this.eventStream.close();
+		return this.reconnect();
+	}
+
 	async close() {
 		this.abort();
 
@@ -429,13 +1048,35 @@ export class GetStream<T> {
 }
 
 export abstract class ListStream<T> {
-	protected eventStream: EventStream<T>;
+	protected eventStream: EventReader<T>;
 	private controller: AbortController;
+	private open: (prev: (T & Metadata)[] | null) => Promise<EventReader<T>>;
+	protected prev: (T & Metadata)[] | null;
+	protected resumed: boolean = false;
 	protected lastEvent: Date = new Date();
 
-	constructor(resp: Response, controller: AbortController) {
-		this.eventStream = new EventStream<T>(resp.body!);
+	constructor(events: EventReader<T>, controller: AbortController, prev: (T & Metadata)[] | null | undefined, open: (prev: (T & Metadata)[] | null) => Promise<EventReader<T>>) {
+		this.eventStream = events;
 		this.controller = controller;
+		this.prev = prev ?? null;
+		this.open = open;
+	}
+
+	// Resumes from prev after a reconnect event; false if that fails
+	protected async reconnect(): Promise<boolean> {
+		try {
+			this.eventStream = await this.open(this.prev);
+			this.resumed = true;
+			return true;
+		} catch {
+			return false;
+		}
+	}
+
+	// Abandons the current events and resumes from prev
+	protected async resync(): Promise<boolean> {
+		this.eventStream.close();
+		return this.reconnect();
 	}
 
 	lastEventReceived(): Date {
@@ -468,13 +1109,6 @@ export abstract class ListStream<T> {
 }
 
 export class ListStreamFull<T> extends ListStream<T> {
-	private prev: (T & Metadata)[] | null;
-
-	constructor(resp: Response, controller: AbortController, prev: (T & Metadata)[] | null | undefined) {
-		super(resp, controller);
-		this.prev = prev ?? null;
-	}
-
 	async read(): Promise<(T & Metadata)[] | null> {
 		while (true) {
 			const ev = await this.eventStream.readEvent();
@@ -487,27 +1121,34 @@ export class ListStreamFull<T> extends ListStream<T> {
 
 			switch (ev.eventType) {
 			case 'list':
-				return ev.decodeList();
+				this.prev = ev.decodeList();
+				return this.prev;
 
 			case 'notModified':
+				if (this.resumed) {
+					// Already returned prev before the reconnect
+					continue;
+				}
+
 				return this.prev;
 
 			case 'heartbeat':
 				continue;
+
+			case 'reconnect':
+				if (!await this.reconnect()) {
+					return null;
+				}
+
+				continue;
 			}
 		}
 	}
 }
 
 export class ListStreamDiff<T> extends ListStream<T> {
-	private prev: (T & Metadata)[] | null;
 	private objs: (T & Metadata)[] = [];
 
-	constructor(resp: Response, controller: AbortController, prev: (T & Metadata)[] | null | undefined) {
-		super(resp, controller);
-		this.prev = prev ?? null;
-	}
-
 	async read(): Promise<(T & Metadata)[] | null> {
 		while (true) {
 			const ev = await this.eventStream.readEvent();
@@ -528,19 +1169,56 @@ export class ListStreamDiff<T> extends ListStream<T> {
 				this.objs.splice(parseInt(ev.params.get('new-position')!, 10), 0, ev.decodeObj());
 				continue;
 
+			case 'patch': {
+				const oldPos = parseInt(ev.params.get('old-position')!, 10);
+				const obj = ev.applyPatch(this.objs[oldPos]);
+
+				if (obj == null) {
+					// We missed an update; resume from prev
+					if (!await this.resync()) {
+						return null;
+					}
+
+					this.objs = [];
+					continue;
+				}
+
+				this.objs.splice(oldPos, 1);
+				this.objs.splice(parseInt(ev.params.get('new-position')!, 10), 0, obj);
+				continue;
+			}
+
 			case 'remove':
 				this.objs.splice(parseInt(ev.params.get('old-position')!, 10), 1);
 				continue;
 
 			case 'sync':
+				// Snapshot, since objs is modified in place
+				this.prev = [...this.objs];
+				ev.setETag(this.prev);
 				return this.objs;
 
 			case 'notModified':
+				if (this.resumed) {
+					// Already returned prev before the reconnect
+					this.objs = [...this.prev!];
+					continue;
+				}
+
 				this.objs = this.prev!;
 				return this.objs;
 
 			case 'heartbeat':
 				continue;
+
+			case 'reconnect':
+				if (!await this.reconnect()) {
+					return null;
+				}
+
+				// The new stream starts from empty unless notModified
+				this.objs = [];
+				continue;
 			}
 		}
 	}
@@ -567,10 +1245,12 @@ class Req<T> {
 	private prevList?: (T & Metadata)[];
 	private body?:     T;
 	private signal?:   AbortSignal;
+	private credentials: RequestCredentials;
 
-	constructor(method: string, url: URL, headers: Headers) {
+	constructor(method: string, url: URL, headers: Headers, credentials: RequestCredentials) {
 		this.method = method;
 		this.url = url;
+		this.credentials = credentials;
 
 		this.params = new URLSearchParams();
 		this.headers = new Headers(headers);
@@ -582,6 +1262,22 @@ class Req<T> {
 		}
 
 		this.setPrevObj('If-None-Match', opts?.prev);
+
+		if (opts?.stream) {
+			this.setQueryParam('_stream', opts.stream);
+		}
+
+		this.applyStreamOpts(opts);
+	}
+
+	applyStreamOpts(opts: {heartbeat?: number, maxDuration?: number}) {
+		if (opts?.heartbeat) {
+			this.setQueryParam('_heartbeat', `${opts.heartbeat}ms`);
+		}
+
+		if (opts?.maxDuration) {
+			this.setQueryParam('_maxDuration', `${opts.maxDuration}ms`);
+		}
 	}
 
 	applyListOpts(opts: ListOpts<T> | null | undefined) {
@@ -595,6 +1291,16 @@ class Req<T> {
 			this.setQueryParam('_stream', opts.stream);
 		}
 
+		if (opts?.debounce) {
+			this.setQueryParam('_debounce', `${opts.debounce}ms`);
+		}
+
+		if (opts?.maxRate) {
+			this.setQueryParam('_maxRate', `${opts.maxRate}`);
+		}
+
+		this.applyStreamOpts(opts);
+
 		if (opts?.limit) {
 			this.setQueryParam('_limit', `${opts.limit}`);
 		}
@@ -659,10 +1365,55 @@ class Req<T> {
 		this.params.set(name, value);
 	}
 
+	injectTraceContext(inject: TracePropagator) {
+		inject(this.headers);
+	}
+
 	addQueryParam(name: string, value: string) {
 		this.params.append(name, value);
 	}
 
+	// The same request for /_ws; ETags there are unquoted
+	toWSRequest(op: string, type: string, id?: string): WSRequest {
+		const req: WSRequest = {
+			op,
+			type,
+			params: {},
+		};
+
+		if (id) {
+			req.id = id;
+		}
+
+		for (const [k, v] of this.params) {
+			req.params![k] = [...req.params![k] ?? [], v];
+		}
+
+		const ifMatch = this.headers.get('If-Match');
+		if (ifMatch) {
+			req.ifMatch = trimQuotes(ifMatch);
+		}
+
+		const ifNoneMatch = this.headers.get('If-None-Match');
+		if (ifNoneMatch) {
+			req.ifNoneMatch = trimQuotes(ifNoneMatch);
+		}
+
+		// WebSocket messages can't carry headers
+		for (const name of ['traceparent', 'tracestate'] as const) {
+			const value = this.headers.get(name);
+			if (value) {
+				req[name] = value;
+			}
+		}
+
+		if (this.body) {
+			req.obj = this.body;
+		}
+
+		return req;
+	}
+
 	async fetchObj(): Promise<T & Metadata> {
 		this.headers.set('Accept', 'application/json');
 		const resp = await this.fetch();
@@ -734,7 +1485,7 @@ class Req<T> {
 			method: this.method,
 			headers: this.headers,
 			mode: 'cors',
-			credentials: 'omit',
+			credentials: this.credentials,
 			referrerPolicy: 'no-referrer',
 			keepalive: true,
 			signal: this?.signal ?? null,
@@ -768,6 +1519,45 @@ class Req<T> {
 	}
 }
 
+// Applies an RFC 7396 merge patch to doc, which may be modified in place
+function mergePatch(doc: any, patch: any): any {
+	if (patch === null || typeof patch != 'object' || Array.isArray(patch)) {
+		return patch;
+	}
+
+	if (doc === null || typeof doc != 'object' || Array.isArray(doc)) {
+		doc = {};
+	}
+
+	for (const [k, v] of Object.entries(patch)) {
+		if (v === null) {
+			delete doc[k];
+		} else {
+			doc[k] = mergePatch(doc[k], v);
+		}
+	}
+
+	return doc;
+}
+
 function trimPrefix(s: string, prefix: string): string {
 	return s.substring(prefix.length);
 }
+
+function trimQuotes(s: string): string {
+	return s.replace(/^"(.*)"$/, '$1');
+}
+
+{{- if .AuthSession }}
+
+function readCookie(name: string): string | null {
+	for (const cookie of (globalThis?.document?.cookie ?? '').split('; ')) {
+		const [k, v] = cookie.split('=', 2);
+		if (k == name) {
+			return decodeURIComponent(v ?? '');
+		}
+	}
+
+	return null;
+}
+{{- end }}
@@ -0,0 +1,118 @@
+package patchy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gopatchy/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/gopatchy/patchy"
+
+// Incoming requests carry W3C traceparent and tracestate headers
+var tracePropagator = propagation.TraceContext{}
+
+// SetTracerProvider sets the OpenTelemetry provider for spans. The default
+// is the global provider (otel.SetTracerProvider), which discards spans
+// until one is configured.
+func (api *API) SetTracerProvider(tp trace.TracerProvider) {
+	api.tracer = tp.Tracer(tracerName)
+}
+
+// The global provider is looked up when each span starts, so it may be set
+// after NewAPI
+func defaultTracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startSpan starts a span for an operation on an object type
+func (api *API) startSpan(ctx context.Context, name string, cfg *config, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if cfg != nil {
+		attrs = append(attrs, attribute.String("patchy.typeName", cfg.apiName))
+	}
+
+	return api.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err (if any) and ends span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// startRequestSpan continues the caller's trace, if any. The span ID doubles
+// as the event spanID when spans are being recorded.
+func (api *API) startRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return api.tracer.Start(ctx, fmt.Sprintf("HTTP %s", r.Method),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+			attribute.String("http.flavor", r.Proto),
+			attribute.String("net.peer.addr", r.RemoteAddr),
+		),
+	)
+}
+
+// endRequestSpan copies the fields handlers set with SetEventData
+func endRequestSpan(span trace.Span, ev *event.Event) {
+	operation := eventString(ev, "operation")
+	typeName := eventString(ev, "typeName")
+
+	if operation != "" {
+		span.SetName(fmt.Sprintf("%s %s", operation, typeName))
+	}
+
+	code, _ := ev.Data["responseCode"].(int)
+
+	span.SetAttributes(
+		attribute.String("patchy.operation", operation),
+		attribute.String("patchy.typeName", typeName),
+		attribute.Int("http.status_code", code),
+	)
+
+	// Client errors aren't server span errors
+	if code >= 500 {
+		span.SetStatus(codes.Error, eventString(ev, "responseError"))
+	}
+
+	span.End()
+}
+
+func spanID(span trace.Span) string {
+	if !span.IsRecording() {
+		return ""
+	}
+
+	return span.SpanContext().SpanID().String()
+}
+
+// runHook wraps a RequestHook in a span. The request it returns is put back
+// under the request span, keeping any context values the hook added.
+func (api *API) runHook(hook RequestHook, w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	parent := trace.SpanFromContext(r.Context())
+
+	ctx, span := api.tracer.Start(r.Context(), "requestHook")
+
+	newR, err := hook(w, r.WithContext(ctx), api)
+
+	endSpan(span, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newR.WithContext(trace.ContextWithSpan(newR.Context(), parent)), nil
+}
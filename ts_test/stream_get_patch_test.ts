@@ -0,0 +1,22 @@
+import * as test from './test.js';
+
+test.def('stream get patch success', async (t: test.T) => {
+	const create = await t.client.createTestType({text: 'foo', num: 1});
+
+	const stream = await t.client.streamGetTestType(create.id, {stream: 'patch'});
+
+	try {
+		const s1 = await stream.read();
+		t.equal(s1!.text, 'foo');
+		t.equal(s1!.num, 1);
+
+		const update = await t.client.updateTestType(create.id, {text: 'bar'});
+
+		const s2 = await stream.read();
+		t.equal(s2!.text, 'bar');
+		t.equal(s2!.num, 1);
+		t.equal(s2!.etag, update.etag);
+	} finally {
+		await stream.close();
+	}
+});
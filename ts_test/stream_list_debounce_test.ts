@@ -0,0 +1,21 @@
+import * as test from './test.js';
+
+test.def('stream list debounce', async (t: test.T) => {
+	const stream = await t.client.streamListTestType({debounce: 200});
+
+	try {
+		const s1 = await stream.read();
+		t.true(s1);
+		t.equal(s1.length, 0);
+
+		for (let i = 0; i < 5; i++) {
+			await t.client.createTestType({text: 'foo'});
+		}
+
+		const s2 = await stream.read();
+		t.true(s2);
+		t.equal(s2.length, 5);
+	} finally {
+		await stream.close();
+	}
+});
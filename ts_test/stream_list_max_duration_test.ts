@@ -0,0 +1,22 @@
+import * as test from './test.js';
+
+test.def('stream list max duration', async (t: test.T) => {
+	const stream = await t.client.streamListTestType({maxDuration: 300});
+
+	try {
+		const s1 = await stream.read();
+		t.true(s1);
+		t.equal(s1.length, 0);
+
+		// Outlive several reconnects
+		await new Promise(resolve => setTimeout(resolve, 700));
+
+		await t.client.createTestType({text: 'foo'});
+
+		const s2 = await stream.read();
+		t.true(s2);
+		t.equal(s2.length, 1);
+	} finally {
+		await stream.close();
+	}
+});
@@ -0,0 +1,23 @@
+import * as test from './test.js';
+
+test.def('stream list patch success', async (t: test.T) => {
+	const create1 = await t.client.createTestType({text: 'foo', num: 1});
+	await t.client.createTestType({text: 'zig', num: 2});
+
+	const stream = await t.client.streamListTestType({stream: 'patch', sorts: ['+text']});
+
+	try {
+		const s1 = await stream.read();
+		t.true(s1);
+		t.equal(s1.map(x => x.text), ['foo', 'zig']);
+
+		await t.client.updateTestType(create1.id, {text: 'zzz'});
+
+		const s2 = await stream.read();
+		t.true(s2);
+		t.equal(s2.map(x => x.text), ['zig', 'zzz']);
+		t.equal(s2.map(x => x.num), [2, 1]);
+	} finally {
+		await stream.close();
+	}
+});
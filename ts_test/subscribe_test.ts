@@ -0,0 +1,35 @@
+import * as test from './test.js';
+
+test.def('subscribe success', async (t: test.T) => {
+	const create = await t.client.createTestType({text: 'foo'});
+
+	await t.client.useSubscription();
+
+	try {
+		const gstream = await t.client.streamGetTestType(create.id);
+		const lstream = await t.client.streamListTestType();
+
+		try {
+			const g1 = await gstream.read();
+			t.equal(g1?.text, 'foo');
+
+			const l1 = await lstream.read();
+			t.true(l1);
+			t.equal(l1.map(x => x.text), ['foo']);
+
+			await t.client.updateTestType(create.id, {text: 'bar'});
+
+			const g2 = await gstream.read();
+			t.equal(g2?.text, 'bar');
+
+			const l2 = await lstream.read();
+			t.true(l2);
+			t.equal(l2.map(x => x.text), ['bar']);
+		} finally {
+			await gstream.close();
+			await lstream.close();
+		}
+	} finally {
+		t.client.closeSubscription();
+	}
+});
@@ -0,0 +1,47 @@
+import * as test from './test.js';
+
+test.def('websocket success', async (t: test.T) => {
+	if (typeof WebSocket == 'undefined') {
+		await t.log('no WebSocket support, skipping');
+		return;
+	}
+
+	await t.client.useWebSocket();
+
+	try {
+		const create = await t.client.createTestType({text: 'foo'});
+
+		const lstream = await t.client.streamListTestType({stream: 'diff'});
+		const gstream = await t.client.streamGetTestType(create.id);
+
+		try {
+			const l1 = await lstream.read();
+			t.true(l1);
+			t.equal(l1.map(x => x.text), ['foo']);
+
+			const g1 = await gstream.read();
+			t.equal(g1?.text, 'foo');
+
+			const update = await t.client.updateTestType(create.id, {text: 'bar'}, {prev: create});
+			t.equal(update.text, 'bar');
+
+			const l2 = await lstream.read();
+			t.true(l2);
+			t.equal(l2.map(x => x.text), ['bar']);
+
+			const g2 = await gstream.read();
+			t.equal(g2?.text, 'bar');
+
+			await t.client.deleteTestType(create.id, {prev: update});
+
+			const l3 = await lstream.read();
+			t.true(l3);
+			t.equal(l3.length, 0);
+		} finally {
+			await lstream.close();
+			await gstream.close();
+		}
+	} finally {
+		t.client.closeWebSocket();
+	}
+});
@@ -1,6 +1,16 @@
 package patchy
 
-import "github.com/gopatchy/path"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gopatchy/path"
+)
+
+var ErrInvalidFieldType = errors.New("invalid field type")
 
 func IsCreate[T any](obj *T, prev *T) bool {
 	return obj != nil && prev == nil
@@ -31,3 +41,76 @@ func FieldChanged[T any](obj *T, prev *T, p string) bool {
 func P[T any](v T) *T {
 	return &v
 }
+
+func isLookup(ctx context.Context) bool {
+	return ctx.Value(ContextAuthBasicLookup) != nil ||
+		ctx.Value(ContextAuthBearerLookup) != nil ||
+		ctx.Value(ContextAPIKeyLookup) != nil ||
+		ctx.Value(ContextAuthSessionLookup) != nil
+}
+
+// pathMap converts a dotted path and value into a nested map suitable for
+// path.MergeMap()
+func pathMap(p string, val any) map[string]any {
+	parts := strings.Split(p, ".")
+
+	ret := map[string]any{
+		parts[len(parts)-1]: val,
+	}
+
+	for i := len(parts) - 2; i >= 0; i-- {
+		ret = map[string]any{
+			parts[i]: ret,
+		}
+	}
+
+	return ret
+}
+
+func getString(obj any, p string) (string, error) {
+	val, err := path.Get(obj, p)
+	if err != nil {
+		return "", err
+	}
+
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case *string:
+		if v == nil {
+			return "", nil
+		}
+
+		return *v, nil
+	default:
+		return "", fmt.Errorf("%s has invalid type %T (%w)", p, v, ErrInvalidFieldType)
+	}
+}
+
+func getStrings(obj any, p string) ([]string, error) {
+	val, err := path.Get(obj, p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := val.(type) {
+	case []string:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("%s has invalid type %T (%w)", p, v, ErrInvalidFieldType)
+	}
+}
+
+func getTime(obj any, p string) (time.Time, error) {
+	val, err := path.Get(obj, p)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch v := val.(type) {
+	case time.Time:
+		return v, nil
+	default:
+		return time.Time{}, fmt.Errorf("%s has invalid type %T (%w)", p, v, ErrInvalidFieldType)
+	}
+}
@@ -0,0 +1,430 @@
+package patchy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopatchy/event"
+	"github.com/gopatchy/jsrest"
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/httpheader"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/net/websocket"
+)
+
+// WSRequest is sent by the client over /_ws. Ref is chosen by the client
+// and echoed in every WSMessage about the request.
+//
+// streamGet and streamList subscribe (Params are the HTTP query parameters,
+// e.g. _stream or filters); unsubscribe cancels the subscription with Ref.
+// create, replace, update and delete reply with one result or error message.
+// Traceparent and Tracestate continue a W3C trace, like the HTTP headers.
+type WSRequest struct {
+	Ref         string          `json:"ref"`
+	Op          string          `json:"op"`
+	Type        string          `json:"type,omitempty"`
+	ID          string          `json:"id,omitempty"`
+	IfMatch     string          `json:"ifMatch,omitempty"`
+	IfNoneMatch string          `json:"ifNoneMatch,omitempty"`
+	Params      url.Values      `json:"params,omitempty"`
+	Obj         json.RawMessage `json:"obj,omitempty"`
+	Traceparent string          `json:"traceparent,omitempty"`
+	Tracestate  string          `json:"tracestate,omitempty"`
+}
+
+// WSMessage is sent by the server over /_ws. Subscriptions use the same
+// events as EventStreams; those that start always finish with an end event.
+type WSMessage struct {
+	Ref    string            `json:"ref"`
+	Event  string            `json:"event"`
+	Status int               `json:"status,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	Data   any               `json:"data,omitempty"`
+}
+
+type wsConn struct {
+	api  *API
+	conn *websocket.Conn
+	sub  *subscriber
+
+	// For limits, like the requestPrincipal of an HTTP request
+	principal string
+
+	// Subscriptions write concurrently
+	writeMu sync.Mutex
+}
+
+var (
+	ErrWebSocketRequired     = errors.New("websocket upgrade required")
+	ErrWebSocketNotSupported = errors.New("websocket not supported")
+	ErrWebSocketOrigin       = errors.New("websocket origin not allowed")
+	ErrWebSocketOp           = errors.New("invalid websocket operation")
+)
+
+// A client that stops reading is disconnected rather than stalling its
+// other subscriptions
+const wsWriteTimeout = 30 * time.Second
+
+func (api *API) handleWS(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	api.SetEventData(ctx,
+		"operation", "websocket",
+		"stream", true,
+	)
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "Upgrade: %s (%w)", r.Header.Get("Upgrade"), ErrWebSocketRequired)
+	}
+
+	// HTTP/2 connections can't be hijacked
+	if _, ok := w.(http.Hijacker); !ok {
+		return jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", r.Proto, ErrWebSocketNotSupported)
+	}
+
+	err := api.checkWSOrigin(r)
+	if err != nil {
+		return err
+	}
+
+	srv := websocket.Server{
+		// Origin is checked above
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			api.serveWS(ctx, api.requestPrincipal(r), conn)
+		},
+	}
+
+	srv.ServeHTTP(w, r)
+
+	return nil
+}
+
+// checkWSOrigin applies the CORS policy to browsers. Browsers send cookies
+// with cross-site upgrades and CSRF checks don't cover GET, so session
+// sockets must be same-origin or from an origin allowed credentials.
+func (api *API) checkWSOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+
+	policy := api.corsPolicy()
+
+	if r.Context().Value(ContextAuthSession) != nil {
+		if policy.Credentials && policy.allowsOrigin(origin) {
+			return nil
+		}
+
+		return jsrest.Errorf(jsrest.ErrForbidden, "%s (%w)", origin, ErrWebSocketOrigin)
+	}
+
+	if len(policy.Origins) > 0 && !policy.allowsOrigin(origin) {
+		return jsrest.Errorf(jsrest.ErrForbidden, "%s (%w)", origin, ErrWebSocketOrigin)
+	}
+
+	return nil
+}
+
+func (api *API) serveWS(ctx context.Context, principal string, conn *websocket.Conn) {
+	if !api.addWS(conn) {
+		return
+	}
+
+	defer api.removeWS(conn)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wc := &wsConn{
+		api:       api,
+		conn:      conn,
+		principal: principal,
+	}
+
+	wc.sub = newSubscriber(api, principal, wc.writer, wc.sendError)
+
+	for {
+		req := &WSRequest{}
+
+		err := websocket.JSON.Receive(conn, req)
+		if err != nil {
+			var syntaxErr *json.SyntaxError
+
+			var typeErr *json.UnmarshalTypeError
+
+			// The bad message has been consumed, so carry on
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				wc.sendError("", jsrest.Errorf(jsrest.ErrBadRequest, "decode request failed (%w)", err))
+				continue
+			}
+
+			break
+		}
+
+		wc.handle(ctx, req)
+	}
+
+	wc.sub.close()
+}
+
+func (wc *wsConn) handle(ctx context.Context, req *WSRequest) {
+	switch req.Op {
+	case "streamGet", "streamList":
+		err := wc.sub.subscribe(ctx, req)
+		if err != nil {
+			wc.sendError(req.Ref, err)
+		}
+
+	case "unsubscribe":
+		wc.sub.unsubscribe(req.Ref)
+
+	case "create", "replace", "update", "delete":
+		// Mutations run in order, before reading the next request
+		obj, err := wc.api.wsMutate(ctx, wc.principal, req)
+		if err != nil {
+			wc.sendError(req.Ref, err)
+			return
+		}
+
+		if obj == nil {
+			_ = wc.send(&WSMessage{Ref: req.Ref, Event: "result", Status: http.StatusNoContent})
+			return
+		}
+
+		_ = wc.send(&WSMessage{Ref: req.Ref, Event: "result", Status: http.StatusOK, Data: obj})
+
+	default:
+		wc.sendError(req.Ref, jsrest.Errorf(jsrest.ErrBadRequest, "%s (%w)", req.Op, ErrWebSocketOp))
+	}
+}
+
+// wsMutate applies the limits that limited applies to HTTP mutations
+func (api *API) wsMutate(ctx context.Context, principal string, req *WSRequest) (any, error) {
+	ctx = req.traceContext(ctx)
+
+	cfg := api.registry[req.Type]
+	if cfg == nil {
+		return nil, jsrest.Errorf(jsrest.ErrNotFound, "%s", req.Type)
+	}
+
+	if req.Op != "create" && req.ID == "" {
+		return nil, jsrest.Errorf(jsrest.ErrBadRequest, "%s: missing id (%w)", req.Op, ErrWebSocketOp)
+	}
+
+	release, err := api.admitPrincipal(ctx, principal, cfg, req.Op, http.Header{})
+	if err != nil {
+		return nil, err
+	}
+
+	limit := api.limiter.maxBodySize(cfg)
+	if limit > 0 && int64(len(req.Obj)) > limit {
+		release()
+		return nil, jsrest.Errorf(jsrest.ErrRequestEntityTooLarge, "%d bytes (%w)", limit, ErrBodyTooLarge)
+	}
+
+	timeout := api.limiter.timeout(req.Op)
+	if timeout == 0 {
+		defer release()
+		return api.wsMutateInt(ctx, cfg, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		obj any
+		err error
+	}
+
+	done := make(chan *result, 1)
+
+	// Like limited, answer at the timeout even if the handler runs on; it
+	// gets its own event since the connection's may be in use by then
+	go func() {
+		defer release()
+
+		obj, err := api.wsMutateInt(context.WithValue(ctx, ContextEvent, &event.Event{Data: map[string]any{}}), cfg, req)
+		done <- &result{obj, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s after %s (%w)", req.Op, timeout, ErrHandlerTimeout)
+		}
+
+		return res.obj, res.err
+
+	case <-ctx.Done():
+		return nil, jsrest.Errorf(jsrest.ErrServiceUnavailable, "%s after %s (%w)", req.Op, timeout, ErrHandlerTimeout)
+	}
+}
+
+func (api *API) wsMutateInt(ctx context.Context, cfg *config, req *WSRequest) (any, error) {
+	opts := &UpdateOpts{}
+
+	if req.IfMatch != "" {
+		opts.IfMatch = []httpheader.EntityTag{{Opaque: req.IfMatch}}
+	}
+
+	switch req.Op {
+	case "create":
+		obj := cfg.factory()
+
+		err := decodeStrict(req.Obj, obj)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "decode failed (%w)", err)
+		}
+
+		return api.createInt(ctx, cfg, obj)
+
+	case "replace":
+		obj := cfg.factory()
+
+		err := decodeStrict(req.Obj, obj)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "decode failed (%w)", err)
+		}
+
+		return api.replaceInt(ctx, cfg, req.ID, obj, opts)
+
+	case "update":
+		patch := map[string]any{}
+
+		err := decodeStrict(req.Obj, &patch)
+		if err != nil {
+			return nil, jsrest.Errorf(jsrest.ErrBadRequest, "decode failed (%w)", err)
+		}
+
+		return api.updateInt(ctx, cfg, req.ID, patch, opts)
+
+	default:
+		return nil, api.deleteInt(ctx, cfg, req.ID, opts)
+	}
+}
+
+// traceContext continues the request's trace, if it has one
+func (req *WSRequest) traceContext(ctx context.Context) context.Context {
+	if req.Traceparent == "" {
+		return ctx
+	}
+
+	return tracePropagator.Extract(ctx, propagation.MapCarrier{
+		"traceparent": req.Traceparent,
+		"tracestate":  req.Tracestate,
+	})
+}
+
+func (req *WSRequest) ifNoneMatch() []httpheader.EntityTag {
+	if req.IfNoneMatch == "" {
+		return nil
+	}
+
+	return []httpheader.EntityTag{{Opaque: req.IfNoneMatch}}
+}
+
+func (wc *wsConn) writer(ref string) eventWriter {
+	return func(event string, params map[string]string, obj any, _ bool) error {
+		return wc.send(&WSMessage{
+			Ref:    ref,
+			Event:  event,
+			Params: params,
+			Data:   obj,
+		})
+	}
+}
+
+func (wc *wsConn) send(msg *WSMessage) error {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
+	err := wc.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "set write deadline failed (%w)", err)
+	}
+
+	err = websocket.JSON.Send(wc.conn, msg)
+	if err != nil {
+		return jsrest.Errorf(jsrest.ErrInternalServerError, "write message failed (%w)", err)
+	}
+
+	return nil
+}
+
+func (wc *wsConn) sendError(ref string, err error) {
+	status := http.StatusInternalServerError
+
+	hErr := jsrest.GetHTTPError(err)
+	if hErr != nil {
+		status = hErr.Code
+	}
+
+	_ = wc.send(&WSMessage{
+		Ref:    ref,
+		Event:  "error",
+		Status: status,
+		Data:   jsrest.ToJSONError(err),
+	})
+}
+
+// addWS tracks hijacked connections, which http.Server.Shutdown doesn't
+// close; it returns false once the API is shutting down
+func (api *API) addWS(conn *websocket.Conn) bool {
+	api.wsMu.Lock()
+	defer api.wsMu.Unlock()
+
+	if api.wsClosed {
+		return false
+	}
+
+	api.wsConns[conn] = true
+	api.wsWG.Add(1)
+
+	return true
+}
+
+func (api *API) removeWS(conn *websocket.Conn) {
+	api.wsMu.Lock()
+	delete(api.wsConns, conn)
+	api.wsMu.Unlock()
+
+	api.wsWG.Done()
+}
+
+func (api *API) closeWS() {
+	api.wsMu.Lock()
+
+	api.wsClosed = true
+
+	for conn := range api.wsConns {
+		conn.Close()
+	}
+
+	api.wsMu.Unlock()
+
+	api.wsWG.Wait()
+}
+
+func (api *API) registerWSHandlers() {
+	api.router.GET(
+		"/_ws",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			err := api.handleWS(w, r)
+			if err != nil {
+				api.writeError(w, r, err)
+			}
+		},
+	)
+}